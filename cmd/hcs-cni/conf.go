@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Microsoft/hcsshim/internal/hns"
+)
+
+// The error codes of the CNI specification. Codes from 100 are the plugin's
+// own.
+const (
+	errIncompatibleVersion = 1
+	errUnsupportedField    = 2
+	errUnknownContainer    = 3
+	errInvalidEnvironment  = 4
+	errIOFailure           = 5
+	errDecodingFailure     = 6
+	errInvalidNetConfig    = 7
+	errPluginFailure       = 100
+)
+
+// supportedVersions are the versions of the CNI specification the plugin
+// implements. CHECK is only defined from 0.4.0.
+var supportedVersions = []string{"0.3.0", "0.3.1", "0.4.0"}
+
+// cniError is the error a plugin reports on its standard output.
+type cniError struct {
+	CNIVersion string `json:"cniVersion,omitempty"`
+	Code       uint   `json:"code"`
+	Msg        string `json:"msg"`
+	Details    string `json:"details,omitempty"`
+}
+
+func (e *cniError) Error() string {
+	if e.Details != "" {
+		return e.Msg + ": " + e.Details
+	}
+	return e.Msg
+}
+
+func newError(code uint, format string, a ...interface{}) *cniError {
+	return &cniError{Code: code, Msg: fmt.Sprintf(format, a...)}
+}
+
+func hnsError(err error, format string, a ...interface{}) *cniError {
+	return &cniError{Code: errPluginFailure, Msg: fmt.Sprintf(format, a...), Details: err.Error()}
+}
+
+// The network modes, and the HNS network types implementing them.
+const (
+	modeNAT      = "nat"
+	modeL2Bridge = "l2bridge"
+	modeOverlay  = "overlay"
+)
+
+var networkTypes = map[string]string{
+	modeNAT:      "NAT",
+	modeL2Bridge: "L2Bridge",
+	modeOverlay:  "Overlay",
+}
+
+// defaultVSID is the virtual subnet of overlay networks created without one.
+const defaultVSID = 4096
+
+// netConf is the network configuration passed to the plugin on its standard
+// input.
+type netConf struct {
+	CNIVersion string `json:"cniVersion"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+
+	Mode    string `json:"mode,omitempty"`    // One of the modes above. Defaults to nat.
+	Network string `json:"network,omitempty"` // The name of the HNS network. Defaults to Name.
+	Adapter string `json:"adapter,omitempty"` // The host adapter of a network created by the plugin.
+	VSID    uint   `json:"vsid,omitempty"`    // The virtual subnet of an overlay network created by the plugin.
+
+	IPAM struct {
+		Subnet  string  `json:"subnet,omitempty"`  // Creates the network if it does not exist.
+		Gateway string  `json:"gateway,omitempty"` // Defaults to the first address of the subnet.
+		Routes  []route `json:"routes,omitempty"`  // Defaults to a default route through the gateway.
+	} `json:"ipam,omitempty"`
+	DNS dns `json:"dns,omitempty"`
+
+	// OutboundNATExceptions are the destinations that l2bridge and overlay
+	// endpoints reach without translating their address.
+	OutboundNATExceptions []string         `json:"outboundNATExceptions,omitempty"`
+	ACLs                  []*hns.ACLPolicy `json:"acls,omitempty"`
+	LoadBalancers         []loadBalancer   `json:"loadBalancers,omitempty"`
+
+	RuntimeConfig struct {
+		PortMappings []portMapping `json:"portMappings,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+
+	PrevResult *result `json:"prevResult,omitempty"`
+}
+
+// loadBalancer is a load balancer the endpoint of a container is added to.
+type loadBalancer struct {
+	VIP          string `json:"vip,omitempty"`
+	SourceVIP    string `json:"sourceVIP,omitempty"`
+	ILB          bool   `json:"ilb,omitempty"`
+	Protocol     uint16 `json:"protocol"`
+	InternalPort uint16 `json:"internalPort"`
+	ExternalPort uint16 `json:"externalPort"`
+}
+
+// portMapping is a port-mapping of the portmap capability.
+type portMapping struct {
+	HostPort      uint16 `json:"hostPort"`
+	ContainerPort uint16 `json:"containerPort"`
+	Protocol      string `json:"protocol,omitempty"`
+	HostIP        string `json:"hostIP,omitempty"`
+}
+
+// parseConf parses and validates a network configuration.
+func parseConf(b []byte) (*netConf, error) {
+	conf := &netConf{}
+	if err := json.Unmarshal(b, conf); err != nil {
+		return nil, &cniError{Code: errDecodingFailure, Msg: "failed to parse the network configuration", Details: err.Error()}
+	}
+	if !isSupported(conf.CNIVersion) {
+		return nil, newError(errIncompatibleVersion, "CNI version %q is not supported", conf.CNIVersion)
+	}
+	if conf.Name == "" {
+		return nil, newError(errInvalidNetConfig, "the network name is missing")
+	}
+	if conf.Mode == "" {
+		conf.Mode = modeNAT
+	}
+	conf.Mode = strings.ToLower(conf.Mode)
+	if _, ok := networkTypes[conf.Mode]; !ok {
+		return nil, newError(errInvalidNetConfig, "network mode %q is not supported", conf.Mode)
+	}
+	if conf.Network == "" {
+		conf.Network = conf.Name
+	}
+	if conf.IPAM.Subnet != "" {
+		_, subnet, err := net.ParseCIDR(conf.IPAM.Subnet)
+		if err != nil {
+			return nil, newError(errInvalidNetConfig, "invalid subnet %q", conf.IPAM.Subnet)
+		}
+		if conf.IPAM.Gateway == "" {
+			gateway := append(net.IP(nil), subnet.IP...)
+			gateway[len(gateway)-1]++
+			conf.IPAM.Gateway = gateway.String()
+		} else if gateway := net.ParseIP(conf.IPAM.Gateway); gateway == nil || !subnet.Contains(gateway) {
+			return nil, newError(errInvalidNetConfig, "invalid gateway %q for subnet %s", conf.IPAM.Gateway, subnet)
+		}
+	}
+	for _, r := range conf.IPAM.Routes {
+		if _, _, err := net.ParseCIDR(r.Dst); err != nil {
+			return nil, newError(errInvalidNetConfig, "invalid route destination %q", r.Dst)
+		}
+	}
+	if len(conf.RuntimeConfig.PortMappings) > 0 && conf.Mode != modeNAT {
+		return nil, newError(errUnsupportedField, "port-mappings are only supported in nat mode")
+	}
+	for _, m := range conf.RuntimeConfig.PortMappings {
+		if m.HostIP != "" {
+			return nil, newError(errUnsupportedField, "port-mappings to a host IP are not supported")
+		}
+		switch strings.ToLower(m.Protocol) {
+		case "", "tcp", "udp":
+		default:
+			return nil, newError(errInvalidNetConfig, "port-mapping protocol %q is not supported", m.Protocol)
+		}
+	}
+	return conf, nil
+}
+
+func isSupported(version string) bool {
+	for _, v := range supportedVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// cniArgs are the arguments of CNI_ARGS the plugin supports.
+type cniArgs struct {
+	IP net.IP // The address of the endpoint, in place of allocating one.
+}
+
+// parseArgs parses CNI_ARGS, a list of KEY=VALUE pairs separated by
+// semicolons. Unknown keys are an error unless IgnoreUnknown is set.
+func parseArgs(s string) (*cniArgs, error) {
+	args := &cniArgs{}
+	if s == "" {
+		return args, nil
+	}
+	ignoreUnknown := false
+	var unknown []string
+	for _, pair := range strings.Split(s, ";") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, newError(errInvalidEnvironment, "invalid CNI_ARGS pair %q", pair)
+		}
+		switch kv[0] {
+		case "IgnoreUnknown":
+			ignoreUnknown = strings.ToLower(kv[1]) == "true" || kv[1] == "1"
+		case "IP":
+			if args.IP = net.ParseIP(kv[1]); args.IP == nil {
+				return nil, newError(errInvalidEnvironment, "invalid IP %q in CNI_ARGS", kv[1])
+			}
+		default:
+			unknown = append(unknown, kv[0])
+		}
+	}
+	if len(unknown) > 0 && !ignoreUnknown {
+		return nil, newError(errInvalidEnvironment, "unknown CNI_ARGS %s", strings.Join(unknown, ", "))
+	}
+	return args, nil
+}
+
+// result is the result of ADD, in the format of CNI 0.3.0 and later.
+type result struct {
+	CNIVersion string      `json:"cniVersion"`
+	Interfaces []*iface    `json:"interfaces,omitempty"`
+	IPs        []*ipConfig `json:"ips,omitempty"`
+	Routes     []route     `json:"routes,omitempty"`
+	DNS        dns         `json:"dns,omitempty"`
+}
+
+type iface struct {
+	Name    string `json:"name"`
+	Mac     string `json:"mac,omitempty"`
+	Sandbox string `json:"sandbox,omitempty"`
+}
+
+type ipConfig struct {
+	Version   string `json:"version"`
+	Interface *int   `json:"interface,omitempty"`
+	Address   string `json:"address"`
+	Gateway   string `json:"gateway,omitempty"`
+}
+
+type route struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw,omitempty"`
+}
+
+type dns struct {
+	Nameservers []string `json:"nameservers,omitempty"`
+	Domain      string   `json:"domain,omitempty"`
+	Search      []string `json:"search,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
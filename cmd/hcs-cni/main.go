@@ -0,0 +1,119 @@
+// hcs-cni is a CNI plugin connecting containers to NAT, l2bridge and overlay
+// networks of the host network service. CNI_NETNS is the ID of the HNS
+// namespace of the container.
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// cmdArgs are the parameters of a plugin invocation, from its environment.
+type cmdArgs struct {
+	Command     string // CNI_COMMAND
+	ContainerID string // CNI_CONTAINERID
+	Netns       string // CNI_NETNS
+	IfName      string // CNI_IFNAME
+	Args        string // CNI_ARGS
+	Path        string // CNI_PATH
+}
+
+func argsFromEnv(getenv func(string) string) *cmdArgs {
+	return &cmdArgs{
+		Command:     getenv("CNI_COMMAND"),
+		ContainerID: getenv("CNI_CONTAINERID"),
+		Netns:       getenv("CNI_NETNS"),
+		IfName:      getenv("CNI_IFNAME"),
+		Args:        getenv("CNI_ARGS"),
+		Path:        getenv("CNI_PATH"),
+	}
+}
+
+func main() {
+	args := argsFromEnv(os.Getenv)
+	stdin, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		err = &cniError{Code: errIOFailure, Msg: "failed to read the network configuration", Details: err.Error()}
+	} else {
+		err = run(args, stdin, os.Stdout)
+	}
+	if err != nil {
+		e, ok := err.(*cniError)
+		if !ok {
+			e = &cniError{Code: errPluginFailure, Msg: err.Error()}
+		}
+		if e.CNIVersion == "" {
+			e.CNIVersion = versionOf(stdin)
+		}
+		json.NewEncoder(os.Stdout).Encode(e)
+		os.Exit(1)
+	}
+}
+
+// run runs the command of args with the network configuration stdin, writing
+// its result to stdout.
+func run(args *cmdArgs, stdin []byte, stdout io.Writer) error {
+	if args.Command == "VERSION" {
+		return writeJSON(stdout, struct {
+			CNIVersion        string   `json:"cniVersion"`
+			SupportedVersions []string `json:"supportedVersions"`
+		}{versionOf(stdin), supportedVersions})
+	}
+
+	var mustHave []string
+	switch args.Command {
+	case "ADD", "CHECK":
+		mustHave = []string{args.ContainerID, args.Netns, args.IfName}
+	case "DEL":
+		mustHave = []string{args.ContainerID, args.IfName}
+	default:
+		return newError(errInvalidEnvironment, "unknown CNI_COMMAND %q", args.Command)
+	}
+	for _, v := range mustHave {
+		if v == "" {
+			return newError(errInvalidEnvironment, "CNI_CONTAINERID, CNI_IFNAME and, except for DEL, CNI_NETNS must be set")
+		}
+	}
+	conf, err := parseConf(stdin)
+	if err != nil {
+		return err
+	}
+	cargs, err := parseArgs(args.Args)
+	if err != nil {
+		return err
+	}
+
+	switch args.Command {
+	case "ADD":
+		r, err := add(args, cargs, conf)
+		if err != nil {
+			return err
+		}
+		return writeJSON(stdout, r)
+	case "DEL":
+		return del(args, conf)
+	default:
+		return check(args, conf)
+	}
+}
+
+// versionOf returns the CNI version of a network configuration, defaulting to
+// the latest supported version if it is missing or cannot be parsed.
+func versionOf(stdin []byte) string {
+	var conf struct {
+		CNIVersion string `json:"cniVersion"`
+	}
+	if json.Unmarshal(stdin, &conf) != nil || conf.CNIVersion == "" {
+		return supportedVersions[len(supportedVersions)-1]
+	}
+	return conf.CNIVersion
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return &cniError{Code: errIOFailure, Msg: "failed to write the result", Details: err.Error()}
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/internal/hns"
+	"github.com/Microsoft/hcsshim/internal/hns/hnstest"
+)
+
+// setup installs an HNS stand-in with a NAT network and returns a new HNS
+// namespace for the container.
+func setup(t *testing.T) (*hnstest.Server, string, func()) {
+	t.Helper()
+	s := hnstest.New()
+	restore := s.Install()
+	network := &hns.HNSNetwork{
+		Name:    "nat",
+		Type:    "NAT",
+		Subnets: []hns.Subnet{{AddressPrefix: "172.20.0.0/24", GatewayAddress: "172.20.0.1"}},
+	}
+	if _, err := network.Create(); err != nil {
+		restore()
+		t.Fatal(err)
+	}
+	netns, err := hns.CreateNamespace()
+	if err != nil {
+		restore()
+		t.Fatal(err)
+	}
+	return s, netns, restore
+}
+
+// invoke runs a command of the plugin as a runtime would, returning its
+// output.
+func invoke(command, containerID, netns, cniArgs, conf string) ([]byte, error) {
+	env := map[string]string{
+		"CNI_COMMAND":     command,
+		"CNI_CONTAINERID": containerID,
+		"CNI_NETNS":       netns,
+		"CNI_IFNAME":      "eth0",
+		"CNI_ARGS":        cniArgs,
+		"CNI_PATH":        `c:\cni\bin`,
+	}
+	var stdout bytes.Buffer
+	err := run(argsFromEnv(func(k string) string { return env[k] }), []byte(conf), &stdout)
+	return stdout.Bytes(), err
+}
+
+func expectCode(t *testing.T, err error, code uint) {
+	t.Helper()
+	e, ok := err.(*cniError)
+	if !ok || e.Code != code {
+		t.Fatalf("got error %v, expected code %d", err, code)
+	}
+}
+
+// The network configurations of the CNI conformance tests, one for each
+// supported version, and the result expected for the first container.
+var conformance = []struct {
+	conf   string
+	result string
+}{
+	{
+		conf: `{"cniVersion": "0.3.0", "name": "nat", "type": "hcs-cni"}`,
+		result: `{"cniVersion":"0.3.0","interfaces":[{"name":"eth0","mac":"00:15:5d:14:00:02","sandbox":"NS"}],` +
+			`"ips":[{"version":"4","interface":0,"address":"172.20.0.2/24","gateway":"172.20.0.1"}],` +
+			`"routes":[{"dst":"0.0.0.0/0","gw":"172.20.0.1"}],"dns":{}}`,
+	},
+	{
+		conf: `{"cniVersion": "0.3.1", "name": "nat", "type": "hcs-cni", "dns": {"nameservers": ["172.20.0.1"], "search": ["svc.local"]}}`,
+		result: `{"cniVersion":"0.3.1","interfaces":[{"name":"eth0","mac":"00:15:5d:14:00:02","sandbox":"NS"}],` +
+			`"ips":[{"version":"4","interface":0,"address":"172.20.0.2/24","gateway":"172.20.0.1"}],` +
+			`"routes":[{"dst":"0.0.0.0/0","gw":"172.20.0.1"}],"dns":{"nameservers":["172.20.0.1"],"search":["svc.local"]}}`,
+	},
+	{
+		conf: `{"cniVersion": "0.4.0", "name": "nat", "type": "hcs-cni", "ipam": {"routes": [{"dst": "10.0.0.0/8"}]}}`,
+		result: `{"cniVersion":"0.4.0","interfaces":[{"name":"eth0","mac":"00:15:5d:14:00:02","sandbox":"NS"}],` +
+			`"ips":[{"version":"4","interface":0,"address":"172.20.0.2/24","gateway":"172.20.0.1"}],` +
+			`"routes":[{"dst":"10.0.0.0/8"}],"dns":{}}`,
+	},
+}
+
+func TestConformance(t *testing.T) {
+	for _, c := range conformance {
+		t.Run(versionOf([]byte(c.conf)), func(t *testing.T) {
+			s, netns, restore := setup(t)
+			defer restore()
+
+			out, err := invoke("ADD", "ctr1", netns, "", c.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := strings.Replace(c.result, "NS", netns, 1)
+			if got := strings.TrimSpace(string(out)); got != expected {
+				t.Fatalf("got result\n%s\nexpected\n%s", got, expected)
+			}
+
+			// Repeating ADD returns the same result.
+			again, err := invoke("ADD", "ctr1", netns, "", c.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(again, out) {
+				t.Fatalf("repeated ADD returned %s", again)
+			}
+			if n := len(s.Endpoints()); n != 1 {
+				t.Fatalf("%d endpoints after repeating ADD", n)
+			}
+
+			if versionOf([]byte(c.conf)) == "0.4.0" {
+				conf := strings.TrimSuffix(c.conf, "}") + `, "prevResult": ` + string(out) + "}"
+				if _, err := invoke("CHECK", "ctr1", netns, "", conf); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				_, err := invoke("CHECK", "ctr1", netns, "", c.conf)
+				expectCode(t, err, errIncompatibleVersion)
+			}
+
+			for i := 0; i < 2; i++ {
+				if _, err := invoke("DEL", "ctr1", netns, "", c.conf); err != nil {
+					t.Fatalf("DEL %d: %s", i, err)
+				}
+			}
+			if n := len(s.Endpoints()); n != 0 {
+				t.Fatalf("%d endpoints after DEL", n)
+			}
+			ids, err := hns.GetNamespaceEndpoints(netns)
+			if err != nil || len(ids) != 0 {
+				t.Fatalf("namespace endpoints %v, %v after DEL", ids, err)
+			}
+		})
+	}
+}
+
+func TestVersion(t *testing.T) {
+	out, err := invoke("VERSION", "", "", "", `{"cniVersion": "0.3.1"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"cniVersion":"0.3.1","supportedVersions":["0.3.0","0.3.1","0.4.0"]}`
+	if got := strings.TrimSpace(string(out)); got != expected {
+		t.Fatalf("got %s", got)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	_, netns, restore := setup(t)
+	defer restore()
+	conf := `{"cniVersion": "0.4.0", "name": "nat", "type": "hcs-cni"}`
+	out, err := invoke("ADD", "ctr1", netns, "", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withPrev := func(prev string) string {
+		return strings.TrimSuffix(conf, "}") + `, "prevResult": ` + prev + "}"
+	}
+
+	// The address in the previous result must be the endpoint's.
+	wrong := strings.Replace(string(out), "172.20.0.2/24", "172.20.0.9/24", 1)
+	_, err = invoke("CHECK", "ctr1", netns, "", withPrev(wrong))
+	expectCode(t, err, errPluginFailure)
+
+	_, err = invoke("CHECK", "ctr1", netns, "", conf)
+	expectCode(t, err, errInvalidNetConfig)
+
+	_, err = invoke("CHECK", "ctr2", netns, "", withPrev(string(out)))
+	expectCode(t, err, errUnknownContainer)
+
+	// The endpoint must still be in the container's namespace.
+	endpoint, err := hns.GetHNSEndpointByName("ctr1_eth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hns.RemoveNamespaceEndpoint(netns, endpoint.Id); err != nil {
+		t.Fatal(err)
+	}
+	_, err = invoke("CHECK", "ctr1", netns, "", withPrev(string(out)))
+	expectCode(t, err, errPluginFailure)
+}
+
+func TestAddNetworkModes(t *testing.T) {
+	for _, mode := range []string{modeNAT, modeL2Bridge, modeOverlay} {
+		t.Run(mode, func(t *testing.T) {
+			s, netns, restore := setup(t)
+			defer restore()
+			conf := fmt.Sprintf(`{
+				"cniVersion": "0.3.1", "name": "cbr0", "type": "hcs-cni", "mode": %q, "network": "net-%[1]s",
+				"ipam": {"subnet": "10.10.0.0/16", "gateway": "10.10.0.1"},
+				"outboundNATExceptions": ["10.0.0.0/8"],
+				"acls": [{"Action": "Allow", "Direction": "In", "Protocol": 6, "LocalPorts": "80", "Priority": 200}],
+				"loadBalancers": [{"vip": "10.96.0.10", "protocol": 6, "internalPort": 8080, "externalPort": 80}]
+			}`, mode)
+			if mode == modeNAT {
+				conf = strings.Replace(conf, `"outboundNATExceptions"`,
+					`"runtimeConfig": {"portMappings": [{"hostPort": 8080, "containerPort": 80, "protocol": "tcp"}]}, "outboundNATExceptions"`, 1)
+			}
+			out, err := invoke("ADD", "ctr1", netns, "IgnoreUnknown=1;K8S_POD_NAME=web;IP=10.10.0.20", conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var r result
+			if err := json.Unmarshal(out, &r); err != nil {
+				t.Fatal(err)
+			}
+			if len(r.IPs) != 1 || r.IPs[0].Address != "10.10.0.20/16" || r.IPs[0].Gateway != "10.10.0.1" {
+				t.Fatalf("got addresses %s", out)
+			}
+
+			network, err := hns.GetHNSNetworkByName("net-" + mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if network.Type != networkTypes[mode] {
+				t.Fatalf("created a %s network", network.Type)
+			}
+			if vsid := len(network.Subnets[0].Policies) == 1; vsid != (mode == modeOverlay) {
+				t.Fatalf("got subnet policies %s", network.Subnets[0].Policies)
+			}
+
+			endpoints := s.Endpoints()
+			if len(endpoints) != 1 {
+				t.Fatalf("got %d endpoints", len(endpoints))
+			}
+			var types []string
+			for _, p := range endpoints[0].Policies {
+				var policy hns.Policy
+				if err := json.Unmarshal(p, &policy); err != nil {
+					t.Fatal(err)
+				}
+				types = append(types, string(policy.Type))
+			}
+			expected := "OutBoundNAT,ACL"
+			if mode == modeNAT {
+				expected = "NAT,ACL"
+			}
+			if got := strings.Join(types, ","); got != expected {
+				t.Fatalf("got endpoint policies %s, expected %s", got, expected)
+			}
+			if lists := s.PolicyLists(); len(lists) != 1 || lists[0].EndpointReferences[0] != "/endpoints/"+endpoints[0].Id {
+				t.Fatalf("got policy lists %+v", lists)
+			}
+
+			if _, err := invoke("DEL", "ctr1", netns, "", conf); err != nil {
+				t.Fatal(err)
+			}
+			if n := len(s.PolicyLists()); n != 0 {
+				t.Fatalf("%d policy lists after DEL", n)
+			}
+		})
+	}
+}
+
+func TestAddFailureRemovesEndpoint(t *testing.T) {
+	s, _, restore := setup(t)
+	defer restore()
+	conf := `{"cniVersion": "0.3.1", "name": "nat", "type": "hcs-cni"}`
+	_, err := invoke("ADD", "ctr1", "00000000-0000-0000-0000-000000000000", "", conf)
+	expectCode(t, err, errUnknownContainer)
+	if n := len(s.Endpoints()); n != 0 {
+		t.Fatalf("%d endpoints left after a failed ADD", n)
+	}
+}
+
+func TestInvalidInvocations(t *testing.T) {
+	_, netns, restore := setup(t)
+	defer restore()
+	for _, c := range []struct {
+		command, containerID, netns, args, conf string
+		code                                    uint
+	}{
+		{"ADD", "ctr1", netns, "", `{"cniVersion": "0.2.0", "name": "nat", "type": "hcs-cni"}`, errIncompatibleVersion},
+		{"ADD", "ctr1", netns, "", `{"cniVersion": "1.0.0", "name": "nat", "type": "hcs-cni"}`, errIncompatibleVersion},
+		{"ADD", "ctr1", netns, "", `{"cniVersion": "0.3.1", "name": "nat"`, errDecodingFailure},
+		{"ADD", "ctr1", "", "", `{"cniVersion": "0.3.1", "name": "nat", "type": "hcs-cni"}`, errInvalidEnvironment},
+		{"ADD", "", netns, "", `{"cniVersion": "0.3.1", "name": "nat", "type": "hcs-cni"}`, errInvalidEnvironment},
+		{"ADD", "ctr1", netns, "K8S_POD_NAME=web", `{"cniVersion": "0.3.1", "name": "nat", "type": "hcs-cni"}`, errInvalidEnvironment},
+		{"GET", "ctr1", netns, "", `{"cniVersion": "0.3.1", "name": "nat", "type": "hcs-cni"}`, errInvalidEnvironment},
+		{"ADD", "ctr1", netns, "", `{"cniVersion": "0.3.1", "name": "nat", "type": "hcs-cni", "mode": "transparent"}`, errInvalidNetConfig},
+		{"ADD", "ctr1", netns, "", `{"cniVersion": "0.3.1", "name": "nat", "type": "hcs-cni", "mode": "l2bridge"}`, errInvalidNetConfig},
+		{"ADD", "ctr1", netns, "", `{"cniVersion": "0.3.1", "name": "other", "type": "hcs-cni"}`, errInvalidNetConfig},
+		{"ADD", "ctr1", netns, "", `{"cniVersion": "0.3.1", "name": "nat", "type": "hcs-cni", "mode": "l2bridge", "runtimeConfig": {"portMappings": [{"hostPort": 80, "containerPort": 80}]}}`, errUnsupportedField},
+	} {
+		_, err := invoke(c.command, c.containerID, c.netns, c.args, c.conf)
+		e, ok := err.(*cniError)
+		if !ok || e.Code != c.code {
+			t.Errorf("%s %s: got error %v, expected code %d", c.command, c.conf, err, c.code)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/Microsoft/hcsshim/internal/hns"
+	"github.com/sirupsen/logrus"
+)
+
+// endpointName returns the name of the HNS endpoint of a container's
+// interface.
+func endpointName(args *cmdArgs) string {
+	return args.ContainerID + "_" + args.IfName
+}
+
+// add connects the container to the network. Repeating it returns the same
+// result rather than creating a second endpoint.
+func add(args *cmdArgs, cargs *cniArgs, conf *netConf) (*result, error) {
+	network, err := findNetwork(conf, true)
+	if err != nil {
+		return nil, err
+	}
+
+	name := endpointName(args)
+	created := false
+	endpoint, err := hns.GetHNSEndpointByName(name)
+	switch err.(type) {
+	case nil:
+		if endpoint.VirtualNetwork != network.Id {
+			return nil, newError(errInvalidNetConfig, "endpoint %s is on network %s, not %s", name, endpoint.VirtualNetworkName, network.Name)
+		}
+	case hns.EndpointNotFoundError:
+		endpoint, err = createEndpoint(network, name, cargs, conf)
+		if err != nil {
+			return nil, err
+		}
+		created = true
+	default:
+		return nil, hnsError(err, "failed to look up endpoint %s", name)
+	}
+
+	attached, err := inNamespace(args.Netns, endpoint.Id)
+	if err == nil && !attached {
+		err = hns.AddNamespaceEndpoint(args.Netns, endpoint.Id)
+		if err != nil {
+			err = hnsError(err, "failed to add endpoint %s to namespace %s", name, args.Netns)
+		}
+	}
+	if err != nil {
+		if created {
+			if rerr := removeEndpoint(endpoint); rerr != nil {
+				logrus.Warnf("hcs-cni: failed to remove endpoint %s: %s", name, rerr)
+			}
+		}
+		return nil, err
+	}
+	return resultOf(args, conf, network, endpoint), nil
+}
+
+// del disconnects the container from the network. It succeeds if the
+// container is not connected.
+func del(args *cmdArgs, conf *netConf) error {
+	name := endpointName(args)
+	endpoint, err := hns.GetHNSEndpointByName(name)
+	switch err.(type) {
+	case nil:
+	case hns.EndpointNotFoundError:
+		return nil
+	default:
+		return hnsError(err, "failed to look up endpoint %s", name)
+	}
+	if args.Netns != "" {
+		err := hns.RemoveNamespaceEndpoint(args.Netns, endpoint.Id)
+		if err != nil && err != os.ErrNotExist {
+			return hnsError(err, "failed to remove endpoint %s from namespace %s", name, args.Netns)
+		}
+	}
+	if err := removeEndpoint(endpoint); err != nil {
+		return hnsError(err, "failed to remove endpoint %s", name)
+	}
+	return nil
+}
+
+// check verifies that the container is connected as ADD reported in the
+// previous result.
+func check(args *cmdArgs, conf *netConf) error {
+	if conf.CNIVersion < "0.4.0" {
+		return newError(errIncompatibleVersion, "CHECK is not supported in CNI version %s", conf.CNIVersion)
+	}
+	if conf.PrevResult == nil {
+		return newError(errInvalidNetConfig, "CHECK requires the previous result")
+	}
+	network, err := findNetwork(conf, false)
+	if err != nil {
+		return err
+	}
+	name := endpointName(args)
+	endpoint, err := hns.GetHNSEndpointByName(name)
+	switch err.(type) {
+	case nil:
+	case hns.EndpointNotFoundError:
+		return newError(errUnknownContainer, "endpoint %s does not exist", name)
+	default:
+		return hnsError(err, "failed to look up endpoint %s", name)
+	}
+	if endpoint.VirtualNetwork != network.Id {
+		return newError(errPluginFailure, "endpoint %s is on network %s, not %s", name, endpoint.VirtualNetworkName, network.Name)
+	}
+	attached, err := inNamespace(args.Netns, endpoint.Id)
+	if err != nil {
+		return err
+	}
+	if !attached {
+		return newError(errPluginFailure, "endpoint %s is not in namespace %s", name, args.Netns)
+	}
+
+	prev := conf.PrevResult
+	found := false
+	for _, i := range prev.Interfaces {
+		if i.Name == args.IfName && i.Sandbox == args.Netns {
+			found = true
+		}
+	}
+	if !found {
+		return newError(errPluginFailure, "interface %s of namespace %s is not in the previous result", args.IfName, args.Netns)
+	}
+	for _, ip := range prev.IPs {
+		if addr, _, err := net.ParseCIDR(ip.Address); err == nil && addr.Equal(endpoint.IPAddress) {
+			return nil
+		}
+	}
+	return newError(errPluginFailure, "address %s of endpoint %s is not in the previous result", endpoint.IPAddress, name)
+}
+
+// findNetwork returns the HNS network of the configuration. If create is set,
+// a network that does not exist is created if the configuration has a
+// subnet.
+func findNetwork(conf *netConf, create bool) (*hns.HNSNetwork, error) {
+	hnsType := networkTypes[conf.Mode]
+	network, err := hns.GetHNSNetworkByName(conf.Network)
+	switch err.(type) {
+	case nil:
+	case hns.NetworkNotFoundError:
+		if !create || conf.IPAM.Subnet == "" {
+			return nil, newError(errInvalidNetConfig, "network %s does not exist", conf.Network)
+		}
+		network, err = createNetwork(conf)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, hnsError(err, "failed to look up network %s", conf.Network)
+	}
+	if !strings.EqualFold(network.Type, hnsType) {
+		return nil, newError(errInvalidNetConfig, "network %s is of type %s, not %s", conf.Network, network.Type, hnsType)
+	}
+	return network, nil
+}
+
+func createNetwork(conf *netConf) (*hns.HNSNetwork, error) {
+	subnet := hns.Subnet{
+		AddressPrefix:  conf.IPAM.Subnet,
+		GatewayAddress: conf.IPAM.Gateway,
+	}
+	if conf.Mode == modeOverlay {
+		vsid := conf.VSID
+		if vsid == 0 {
+			vsid = defaultVSID
+		}
+		policy, err := json.Marshal(hns.VsidPolicy{Type: hns.VSID, VSID: vsid})
+		if err != nil {
+			return nil, err
+		}
+		subnet.Policies = append(subnet.Policies, policy)
+	}
+	network := &hns.HNSNetwork{
+		Name:               conf.Network,
+		Type:               networkTypes[conf.Mode],
+		NetworkAdapterName: conf.Adapter,
+		Subnets:            []hns.Subnet{subnet},
+	}
+	logrus.Debugf("hcs-cni: creating %s network %s", network.Type, network.Name)
+	network, err := network.Create()
+	if err != nil {
+		return nil, hnsError(err, "failed to create network %s", conf.Network)
+	}
+	return network, nil
+}
+
+// createEndpoint creates the endpoint of a container on network, with the
+// policies, ACLs and load balancers of the configuration. The endpoint is
+// removed if any of them fails.
+func createEndpoint(network *hns.HNSNetwork, name string, cargs *cniArgs, conf *netConf) (*hns.HNSEndpoint, error) {
+	endpoint := &hns.HNSEndpoint{
+		Name:          name,
+		IPAddress:     cargs.IP,
+		DNSServerList: strings.Join(conf.DNS.Nameservers, ","),
+		DNSSuffix:     strings.Join(conf.DNS.Search, ","),
+	}
+	if endpoint.DNSSuffix == "" {
+		endpoint.DNSSuffix = conf.DNS.Domain
+	}
+	if conf.Mode == modeNAT {
+		for _, m := range conf.RuntimeConfig.PortMappings {
+			protocol := strings.ToUpper(m.Protocol)
+			if protocol == "" {
+				protocol = "TCP"
+			}
+			if err := addPolicy(endpoint, hns.NatPolicy{
+				Type:         hns.Nat,
+				Protocol:     protocol,
+				InternalPort: m.ContainerPort,
+				ExternalPort: m.HostPort,
+			}); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		policy := hns.OutboundNatPolicy{
+			Policy:     hns.Policy{Type: hns.OutboundNat},
+			Exceptions: conf.OutboundNATExceptions,
+		}
+		if err := addPolicy(endpoint, policy); err != nil {
+			return nil, err
+		}
+	}
+
+	logrus.Debugf("hcs-cni: creating endpoint %s on network %s", name, network.Name)
+	endpoint, err := network.CreateEndpoint(endpoint)
+	if err != nil {
+		return nil, hnsError(err, "failed to create endpoint %s", name)
+	}
+	if err := configureEndpoint(endpoint, conf); err != nil {
+		if rerr := removeEndpoint(endpoint); rerr != nil {
+			logrus.Warnf("hcs-cni: failed to remove endpoint %s: %s", name, rerr)
+		}
+		return nil, err
+	}
+	return endpoint, nil
+}
+
+func addPolicy(endpoint *hns.HNSEndpoint, policy interface{}) error {
+	b, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	endpoint.Policies = append(endpoint.Policies, b)
+	return nil
+}
+
+// configureEndpoint applies the ACLs of the configuration to endpoint and adds
+// it to the load balancers.
+func configureEndpoint(endpoint *hns.HNSEndpoint, conf *netConf) error {
+	if len(conf.ACLs) > 0 {
+		for _, acl := range conf.ACLs {
+			if acl.Type == "" {
+				acl.Type = hns.ACL
+			}
+		}
+		if err := endpoint.ApplyACLPolicy(conf.ACLs...); err != nil {
+			return hnsError(err, "failed to apply ACLs to endpoint %s", endpoint.Name)
+		}
+	}
+	for _, lb := range conf.LoadBalancers {
+		_, err := hns.AddLoadBalancer([]hns.HNSEndpoint{*endpoint}, lb.ILB, lb.SourceVIP, lb.VIP, lb.Protocol, lb.InternalPort, lb.ExternalPort)
+		if err != nil {
+			return hnsError(err, "failed to add endpoint %s to load balancer %s:%d", endpoint.Name, lb.VIP, lb.ExternalPort)
+		}
+	}
+	return nil
+}
+
+// removeEndpoint removes endpoint from the policy lists referring to it, and
+// deletes it. Policy lists left without endpoints are deleted.
+func removeEndpoint(endpoint *hns.HNSEndpoint) error {
+	lists, err := hns.HNSListPolicyListRequest()
+	if err != nil {
+		return err
+	}
+	ref := "/endpoints/" + endpoint.Id
+	for i := range lists {
+		list := &lists[i]
+		for _, r := range list.EndpointReferences {
+			if r != ref {
+				continue
+			}
+			if len(list.EndpointReferences) == 1 {
+				_, err = list.Delete()
+			} else {
+				_, err = list.RemoveEndpoint(endpoint)
+			}
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+	_, err = endpoint.Delete()
+	return err
+}
+
+// inNamespace returns whether endpoint is in the HNS namespace netns.
+func inNamespace(netns, endpoint string) (bool, error) {
+	ids, err := hns.GetNamespaceEndpoints(netns)
+	if err == os.ErrNotExist {
+		return false, newError(errUnknownContainer, "namespace %s does not exist", netns)
+	}
+	if err != nil {
+		return false, hnsError(err, "failed to query namespace %s", netns)
+	}
+	for _, id := range ids {
+		if id == endpoint {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// resultOf returns the result of ADD for endpoint.
+func resultOf(args *cmdArgs, conf *netConf, network *hns.HNSNetwork, endpoint *hns.HNSEndpoint) *result {
+	ip := endpoint.IPAddress
+	version, bits, defaultDst := "4", 32, "0.0.0.0/0"
+	if ip.To4() == nil {
+		version, bits, defaultDst = "6", 128, "::/0"
+	}
+	prefix, gateway := int(endpoint.PrefixLength), endpoint.GatewayAddress
+	for _, s := range network.Subnets {
+		if _, subnet, err := net.ParseCIDR(s.AddressPrefix); err == nil && subnet.Contains(ip) {
+			if prefix == 0 {
+				prefix, _ = subnet.Mask.Size()
+			}
+			if gateway == "" {
+				gateway = s.GatewayAddress
+			}
+		}
+	}
+
+	index := 0
+	r := &result{
+		CNIVersion: conf.CNIVersion,
+		Interfaces: []*iface{{
+			Name:    args.IfName,
+			Mac:     strings.ToLower(strings.Replace(endpoint.MacAddress, "-", ":", -1)),
+			Sandbox: args.Netns,
+		}},
+		IPs: []*ipConfig{{
+			Version:   version,
+			Interface: &index,
+			Address:   (&net.IPNet{IP: ip, Mask: net.CIDRMask(prefix, bits)}).String(),
+			Gateway:   gateway,
+		}},
+		Routes: conf.IPAM.Routes,
+		DNS:    conf.DNS,
+	}
+	if len(r.Routes) == 0 && gateway != "" {
+		r.Routes = []route{{Dst: defaultDst, GW: gateway}}
+	}
+	if len(r.DNS.Nameservers) == 0 && endpoint.DNSServerList != "" {
+		r.DNS.Nameservers = strings.Split(endpoint.DNSServerList, ",")
+	}
+	return r
+}
@@ -19,6 +19,7 @@ import (
 	"github.com/Microsoft/hcsshim/internal/hcs"
 	"github.com/Microsoft/hcsshim/internal/hcsoci"
 	"github.com/Microsoft/hcsshim/internal/regstate"
+	"github.com/Microsoft/hcsshim/internal/shimrpc"
 	"github.com/Microsoft/hcsshim/internal/uvm"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/sirupsen/logrus"
@@ -39,8 +40,34 @@ type persistedState struct {
 	IsHost         bool
 	UniqueID       guid.GUID
 	HostUniqueID   guid.GUID
+	// ShimProtocol and VMShimProtocol are the shimrpc protocol versions
+	// spoken by the container's shim and its VM shim, or 0 for shims that
+	// predate shimrpc.
+	ShimProtocol   int
+	VMShimProtocol int
 }
 
+// exitStatus records how a container's init process exited.
+type exitStatus struct {
+	Code   int        `json:"code"`
+	Time   time.Time  `json:"time"`
+	Reason exitReason `json:"reason"`
+}
+
+type exitReason string
+
+const (
+	// exitNormal means the init process exited on its own.
+	exitNormal exitReason = "exited"
+	// exitKilled means the init process was killed by the kill command.
+	exitKilled exitReason = "killed"
+	// exitTerminated means the container was stopped before the init process
+	// exited.
+	exitTerminated exitReason = "terminated"
+	// exitVMCrashed means the VM hosting the container stopped unexpectedly.
+	exitVMCrashed exitReason = "vm-crashed"
+)
+
 type containerStatus string
 
 const (
@@ -55,15 +82,45 @@ const (
 	keyShimPid   = "shim"
 	keyInitPid   = "pid"
 	keyNetNS     = "netns"
+	keyKilled    = "killed"
+	keyExit      = "exit"
+	keyJournal   = "journal"
+	keyVMState   = "vmstate"
+	keyVMBase    = "vmbase"
+
+	// containerLockTimeout is how long a command waits for another command
+	// operating on the same container to finish. It covers starting a VM.
+	containerLockTimeout = 2 * time.Minute
 )
 
 type container struct {
 	persistedState
 	ShimPid   int
+	Exit      *exitStatus
 	hc        *hcs.System
 	resources *hcsoci.Resources
 }
 
+// lockContainer takes the state lock for id, serialising runhcs commands that
+// modify the container. The returned function releases the lock.
+//
+// The shims do not take the lock while handling a request from a command,
+// since the command already holds it on their behalf.
+func lockContainer(id string) (func(), error) {
+	l, err := stateKey.Lock(id, containerLockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		if err := l.Unlock(); err != nil {
+			logrus.Warnf("failed to release the lock for %s: %s", id, err)
+		}
+	}, nil
+}
+
+// getErrorFromPipe reads the result of a request to a shim that was started
+// before runhcs used the shimrpc protocol. Such shims reply with shimSuccess
+// or an error string.
 func getErrorFromPipe(pipe io.Reader, p *os.Process) error {
 	serr, err := ioutil.ReadAll(pipe)
 	if err != nil {
@@ -90,21 +147,55 @@ func getErrorFromPipe(pipe io.Reader, p *os.Process) error {
 	return errors.New(string(serr))
 }
 
-func startProcessShim(id, pidFile, logFile string, spec *specs.Process) (_ *os.Process, err error) {
-	// Ensure the stdio handles inherit to the child process. This isn't undone
-	// after the StartProcess call because the caller never launches another
-	// process before exiting.
-	for _, f := range []*os.File{os.Stdin, os.Stdout, os.Stderr} {
-		err = windows.SetHandleInformation(windows.Handle(f.Fd()), windows.HANDLE_FLAG_INHERIT, windows.HANDLE_FLAG_INHERIT)
-		if err != nil {
-			return nil, err
+// getShimResult reads the result that a shim reports on its stdout once it
+// has started. If the shim exits without reporting anything, it is killed and
+// its exit code included in the error, or the error from waiting for it if
+// that fails.
+func getShimResult(pipe io.Reader, p *os.Process) error {
+	err := shimrpc.ReadResult(pipe, nil)
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*shimrpc.Error); ok {
+		return err
+	}
+
+	extra := ""
+	if p != nil {
+		p.Kill()
+		state, werr := p.Wait()
+		if werr != nil {
+			return fmt.Errorf("reading shim result: %s; waiting for shim: %s", err, werr)
 		}
+		extra = fmt.Sprintf(", exit code %d", state.Sys().(syscall.WaitStatus).ExitCode)
+	}
+	if err == io.EOF {
+		return fmt.Errorf("unknown shim failure%s", extra)
 	}
+	return fmt.Errorf("reading shim result: %s%s", err, extra)
+}
 
-	args := []string{
-		"--stdin", strconv.Itoa(int(os.Stdin.Fd())),
-		"--stdout", strconv.Itoa(int(os.Stdout.Fd())),
-		"--stderr", strconv.Itoa(int(os.Stderr.Fd())),
+func startProcessShim(id, pidFile, logFile, consoleSocket string, spec *specs.Process) (_ *os.Process, err error) {
+	var args []string
+	if consoleSocket != "" {
+		// The process's stdio is relayed through the console instead.
+		args = append(args, "--console-socket", consoleSocket)
+	} else {
+		// Ensure the stdio handles inherit to the child process. This isn't
+		// undone after the StartProcess call because the caller never
+		// launches another process before exiting.
+		for _, f := range []*os.File{os.Stdin, os.Stdout, os.Stderr} {
+			err = windows.SetHandleInformation(windows.Handle(f.Fd()), windows.HANDLE_FLAG_INHERIT, windows.HANDLE_FLAG_INHERIT)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		args = append(args,
+			"--stdin", strconv.Itoa(int(os.Stdin.Fd())),
+			"--stdout", strconv.Itoa(int(os.Stdout.Fd())),
+			"--stderr", strconv.Itoa(int(os.Stderr.Fd())),
+		)
 	}
 	if spec != nil {
 		args = append(args, "--exec")
@@ -154,6 +245,10 @@ func launchShim(cmd, pidFile, logFile string, args []string, data interface{}) (
 			fullargs = append(fullargs, "--debug")
 		}
 	}
+	fullargs = append(fullargs, "--root", stateRoot, "--owner", ownerName)
+	if vmPoolPipe != "" {
+		fullargs = append(fullargs, "--vm-pool", vmPoolPipe)
+	}
 	fullargs = append(fullargs, cmd)
 	fullargs = append(fullargs, args...)
 	attr := &os.ProcAttr{
@@ -185,7 +280,7 @@ func launchShim(cmd, pidFile, logFile string, args []string, data interface{}) (
 		wdatap.Close()
 	}
 
-	err = getErrorFromPipe(rp, p)
+	err = getShimResult(rp, p)
 	if err != nil {
 		return nil, err
 	}
@@ -224,6 +319,7 @@ func parseSandboxAnnotations(spec *specs.Spec) (string, bool) {
 func (c *container) startVMShim(logFile string, consolePipe string) (*os.Process, error) {
 	opts := &uvm.UVMOptions{
 		ID:          vmID(c.ID),
+		Owner:       ownerName,
 		ConsolePipe: consolePipe,
 	}
 	if c.Spec.Windows != nil {
@@ -247,6 +343,9 @@ func (c *container) startVMShim(logFile string, consolePipe string) (*os.Process
 		}
 		opts.LayerFolders = layers
 	}
+	if err := uvm.ParseAnnotations(opts, c.Spec.Annotations); err != nil {
+		return nil, err
+	}
 	return launchShim("vmshim", "", logFile, []string{c.VMPipePath()}, opts)
 }
 
@@ -257,6 +356,7 @@ type containerConfig struct {
 	ShimLogFile, VMLogFile string
 	Spec                   *specs.Spec
 	VMConsolePipe          string
+	ConsoleSocket          string
 }
 
 func createContainer(cfg *containerConfig) (_ *container, err error) {
@@ -284,6 +384,9 @@ func createContainer(cfg *containerConfig) (_ *container, err error) {
 		if sandbox.SandboxID != sandboxID {
 			return nil, fmt.Errorf("container %s is not a sandbox", sandboxID)
 		}
+		if sandbox.ShimPid == 0 {
+			return nil, &sandboxStoppedError{sandboxID}
+		}
 		if hostID == "" {
 			// Use the sandbox's host.
 			hostID = sandbox.HostID
@@ -301,6 +404,7 @@ func createContainer(cfg *containerConfig) (_ *container, err error) {
 
 	newvm := false
 	var hostUniqueID guid.GUID
+	vmShimProtocol := 0
 	if hostID != "" {
 		host, err := getContainer(hostID, false)
 		if err != nil {
@@ -311,10 +415,12 @@ func createContainer(cfg *containerConfig) (_ *container, err error) {
 			return nil, fmt.Errorf("host container %s is not a VM host", hostID)
 		}
 		hostUniqueID = host.UniqueID
+		vmShimProtocol = host.VMShimProtocol
 	} else if vmisolated && (isSandbox || cfg.Spec.Linux != nil) {
 		hostID = cfg.ID
 		newvm = true
 		hostUniqueID = uniqueID
+		vmShimProtocol = shimrpc.Version
 	}
 
 	// Make absolute the paths in Root.Path and Windows.LayerFolders.
@@ -346,6 +452,15 @@ func createContainer(cfg *containerConfig) (_ *container, err error) {
 		}
 	}
 
+	// Containers in a sandbox share its network namespace unless they ask for
+	// another one.
+	if netNS == "" && sandboxID != "" && !isSandbox {
+		netNS, err = sandboxNetNS(sandboxID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Store the initial container state in the registry so that the delete
 	// command can clean everything up if something goes wrong.
 	c := &container{
@@ -361,6 +476,8 @@ func createContainer(cfg *containerConfig) (_ *container, err error) {
 			RequestedNetNS: netNS,
 			UniqueID:       uniqueID,
 			HostUniqueID:   hostUniqueID,
+			ShimProtocol:   shimrpc.Version,
+			VMShimProtocol: vmShimProtocol,
 		},
 	}
 	err = stateKey.Create(cfg.ID, keyState, &c.persistedState)
@@ -373,6 +490,13 @@ func createContainer(cfg *containerConfig) (_ *container, err error) {
 		}
 	}()
 
+	if c.isSandboxMember() {
+		err = joinSandbox(stateKey, sandboxID, c.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Start a VM if necessary.
 	if newvm {
 		shim, err := c.startVMShim(cfg.VMLogFile, cfg.VMConsolePipe)
@@ -403,7 +527,7 @@ func createContainer(cfg *containerConfig) (_ *container, err error) {
 	}
 
 	// Create the shim process for the container.
-	err = startContainerShim(c, cfg.PidFile, cfg.ShimLogFile)
+	err = startContainerShim(c, cfg.PidFile, cfg.ShimLogFile, cfg.ConsoleSocket)
 	if err != nil {
 		if e := c.Kill(); e == nil {
 			c.Remove()
@@ -411,6 +535,13 @@ func createContainer(cfg *containerConfig) (_ *container, err error) {
 		return nil, err
 	}
 
+	// Run the create hooks. If one fails, the container is removed.
+	err = c.runCreateHooks()
+	if err != nil {
+		c.Kill()
+		return nil, err
+	}
+
 	return c, nil
 }
 
@@ -427,14 +558,22 @@ func (c *container) VMIsolated() bool {
 }
 
 func (c *container) unmountInHost(vm *uvm.UtilityVM, all bool) error {
-	resources := &hcsoci.Resources{}
-	err := stateKey.Get(c.ID, keyResources, resources)
-	if _, ok := err.(*regstate.NoStateError); ok {
-		return nil
-	}
+	// Replaying the journal releases allocations that a command interrupted
+	// before recording them. If the container's creation was interrupted,
+	// the resources it allocated are only recorded in the journal.
+	journal, err := openJournal(c.ID)
 	if err != nil {
 		return err
 	}
+	resources := hcsoci.ReplayJournal(journal, hcsoci.NewReleaser(vm))
+	recorded := &hcsoci.Resources{}
+	err = stateKey.Get(c.ID, keyResources, recorded)
+	if err == nil {
+		recorded.Journal = journal
+		resources = recorded
+	} else if _, ok := err.(*regstate.NoStateError); !ok {
+		return err
+	}
 	err = hcsoci.ReleaseResources(resources, vm, all)
 	if err != nil {
 		stateKey.Set(c.ID, keyResources, resources)
@@ -442,10 +581,10 @@ func (c *container) unmountInHost(vm *uvm.UtilityVM, all bool) error {
 	}
 
 	err = stateKey.Clear(c.ID, keyResources)
-	if err != nil {
+	if _, ok := err.(*regstate.NoStateError); !ok && err != nil {
 		return err
 	}
-	return nil
+	return clearJournal(c.ID, journal)
 }
 
 func (c *container) Unmount(all bool) error {
@@ -473,9 +612,16 @@ func createContainerInHost(c *container, vm *uvm.UtilityVM) (err error) {
 		return errors.New("container already created")
 	}
 
+	journal, err := openJournal(c.ID)
+	if err != nil {
+		return err
+	}
+
 	// Create the container without starting it.
 	opts := &hcsoci.CreateOptions{
+		Journal:          journal,
 		ID:               c.ID,
+		Owner:            ownerName,
 		Spec:             c.Spec,
 		HostingSystem:    vm,
 		NetworkNamespace: c.RequestedNetNS,
@@ -513,9 +659,9 @@ func createContainerInHost(c *container, vm *uvm.UtilityVM) (err error) {
 	return nil
 }
 
-func startContainerShim(c *container, pidFile, logFile string) error {
+func startContainerShim(c *container, pidFile, logFile, consoleSocket string) error {
 	// Launch a shim process to later execute a process in the container.
-	shim, err := startProcessShim(c.ID, pidFile, logFile, nil)
+	shim, err := startProcessShim(c.ID, pidFile, logFile, consoleSocket, nil)
 	if err != nil {
 		return err
 	}
@@ -554,44 +700,82 @@ func (c *container) Exec() error {
 		return err
 	}
 
-	if c.Spec.Process == nil {
-		return nil
+	if c.Spec.Hooks != nil {
+		err = runHooks(c.Spec.Hooks.StartContainer, c.ociState("created"))
+		if err != nil {
+			c.Kill()
+			return err
+		}
 	}
 
-	// Alert the shim that the container is ready.
+	if c.Spec.Process != nil {
+		err = c.startInit()
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Spec.Hooks != nil {
+		c.runHookList("poststart", c.Spec.Hooks.Poststart, "running")
+	}
+	return nil
+}
+
+// startInit alerts the shim that the container is ready for it to start the
+// init process.
+func (c *container) startInit() error {
 	pipe, err := winio.DialPipe(c.ShimPipePath(), nil)
 	if err != nil {
 		return err
 	}
 	defer pipe.Close()
 
-	shim, err := os.FindProcess(c.ShimPid)
-	if err != nil {
-		return err
+	if c.ShimProtocol == 0 {
+		shim, err := os.FindProcess(c.ShimPid)
+		if err != nil {
+			return err
+		}
+		defer shim.Release()
+		return getErrorFromPipe(pipe, shim)
 	}
-	defer shim.Release()
 
-	err = getErrorFromPipe(pipe, shim)
+	client, err := shimrpc.NewClient(pipe)
 	if err != nil {
 		return err
 	}
-
-	return nil
+	return client.Call(shimMethodStart, nil, nil)
 }
 
-func getContainer(id string, notStopped bool) (*container, error) {
+// readContainer reads the state of container id from s, without opening its
+// compute system.
+func readContainer(s regstate.Store, id string) (*container, error) {
 	var c container
-	err := stateKey.Get(id, keyState, &c.persistedState)
+	err := s.Get(id, keyState, &c.persistedState)
 	if err != nil {
 		return nil, err
 	}
-	err = stateKey.Get(id, keyShimPid, &c.ShimPid)
+	err = s.Get(id, keyShimPid, &c.ShimPid)
 	if err != nil {
 		if _, ok := err.(*regstate.NoStateError); !ok {
 			return nil, err
 		}
 		c.ShimPid = -1
 	}
+	var exit exitStatus
+	err = s.Get(id, keyExit, &exit)
+	if err == nil {
+		c.Exit = &exit
+	} else if _, ok := err.(*regstate.NoStateError); !ok {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func getContainer(id string, notStopped bool) (*container, error) {
+	c, err := readContainer(stateKey, id)
+	if err != nil {
+		return nil, err
+	}
 	if notStopped && c.ShimPid == 0 {
 		return nil, errContainerStopped
 	}
@@ -605,7 +789,7 @@ func getContainer(id string, notStopped bool) (*container, error) {
 		return nil, errContainerStopped
 	}
 
-	return &c, nil
+	return c, nil
 }
 
 func (c *container) Remove() error {
@@ -616,16 +800,35 @@ func (c *container) Remove() error {
 	}
 
 	// Follow kata's example and delay tearing down the VM until the owning
-	// container is removed.
+	// container is removed. The VM shim shuts the VM down gracefully; if it
+	// cannot be asked to, the VM is terminated.
 	if c.IsHost {
-		vm, err := hcs.OpenComputeSystem(vmID(c.ID))
-		if err == nil {
-			if err := vm.Terminate(); hcs.IsPending(err) {
-				vm.Wait()
+		err := c.issueVMRequest(opShutdownVM)
+		if err != nil {
+			_, novm := err.(*noVMError)
+			if !novm && !shimrpc.IsCode(err, shimrpc.ErrorMethodNotFound) {
+				logrus.Warnf("failed to shut down VM %s: %s", c.ID, err)
 			}
+			vm, err := hcs.OpenComputeSystem(hostVMID(c.ID))
+			if err == nil {
+				if err := vm.Terminate(); hcs.IsPending(err) {
+					vm.Wait()
+				}
+				vm.Close()
+			}
+		}
+		removePooledScratch(c.ID)
+	}
+	err = stateKey.Remove(c.ID)
+	if c.isSandboxMember() {
+		if e := leaveSandbox(stateKey, c.SandboxID, c.ID); e != nil {
+			logrus.Warnf("failed to remove container %s from sandbox %s: %s", c.ID, c.SandboxID, e)
 		}
 	}
-	return stateKey.Remove(c.ID)
+	if c.Spec.Hooks != nil {
+		c.runHookList("poststop", c.Spec.Hooks.Poststop, "stopped")
+	}
+	return err
 }
 
 func (c *container) Kill() error {
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+
 	"github.com/Microsoft/hcsshim/internal/appargs"
 	"github.com/urfave/cli"
 )
@@ -36,6 +38,11 @@ var createRunFlags = []cli.Flag{
 		Value: "",
 		Usage: "host container whose VM this container should run in",
 	},
+	cli.StringFlag{
+		Name:  "console-socket",
+		Value: "",
+		Usage: "path to an AF_UNIX socket which will receive the path of a named pipe for the container's console",
+	},
 }
 
 var createCommand = cli.Command{
@@ -61,6 +68,11 @@ command(s) that get executed on start, edit the args parameter of the spec. See
 		if err != nil {
 			return err
 		}
+		unlock, err := lockContainer(cfg.ID)
+		if err != nil {
+			return err
+		}
+		defer unlock()
 		_, err = createContainer(cfg)
 		if err != nil {
 			return err
@@ -87,12 +99,20 @@ func containerConfigFromContext(context *cli.Context) (*containerConfig, error)
 	if err != nil {
 		return nil, err
 	}
+	consoleSocket, err := absPathOrEmpty(context.String("console-socket"))
+	if err != nil {
+		return nil, err
+	}
+	if consoleSocket != "" && (spec.Process == nil || !spec.Process.Terminal) {
+		return nil, errors.New("--console-socket requires a process with a terminal")
+	}
 	return &containerConfig{
 		ID:            id,
 		PidFile:       pidFile,
 		ShimLogFile:   shimLog,
 		VMLogFile:     vmLog,
 		VMConsolePipe: context.String("vm-console"),
+		ConsoleSocket: consoleSocket,
 		Spec:          spec,
 		HostID:        context.String("host"),
 	}, nil
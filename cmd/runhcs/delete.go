@@ -32,6 +32,11 @@ status of "ubuntu01" as "stopped" the following will delete resources held for
 	Action: func(context *cli.Context) error {
 		id := context.Args().First()
 		force := context.Bool("force")
+		unlock, err := lockContainer(id)
+		if err != nil {
+			return err
+		}
+		defer unlock()
 		container, err := getContainer(id, false)
 		if err != nil {
 			if _, ok := err.(*regstate.NoStateError); ok {
@@ -61,6 +66,14 @@ status of "ubuntu01" as "stopped" the following will delete resources held for
 			kill = true
 		}
 
+		// Deleting a sandbox deletes the containers in it first.
+		if container.isSandbox() {
+			err = deleteSandboxMembers(id, force)
+			if err != nil {
+				return err
+			}
+		}
+
 		if kill {
 			err = container.Kill()
 			if err != nil {
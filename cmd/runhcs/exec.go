@@ -60,6 +60,11 @@ following will output a list of processes running in the container:
 			Value: "",
 			Usage: "path to the log file for the launched shim process",
 		},
+		cli.StringFlag{
+			Name:  "console-socket",
+			Value: "",
+			Usage: "path to an AF_UNIX socket which will receive the path of a named pipe for the process's console",
+		},
 	},
 	Before: appargs.Validate(argID, appargs.Rest(appargs.String)),
 	Action: func(context *cli.Context) error {
@@ -72,22 +77,11 @@ following will output a list of processes running in the container:
 		if err != nil {
 			return err
 		}
-		c, err := getContainer(id, false)
-		if err != nil {
-			return err
-		}
-		status, err := c.Status()
-		if err != nil {
-			return err
-		}
-		if status != containerRunning {
-			return fmt.Errorf("cannot exec a container that is not running")
-		}
-		spec, err := getProcessSpec(context, c)
+		consoleSocket, err := absPathOrEmpty(context.String("console-socket"))
 		if err != nil {
 			return err
 		}
-		p, err := startProcessShim(id, pidFile, shimLog, spec)
+		p, err := startExec(context, id, pidFile, shimLog, consoleSocket)
 		if err != nil {
 			return err
 		}
@@ -103,6 +97,37 @@ following will output a list of processes running in the container:
 	SkipArgReorder: true,
 }
 
+// startExec launches the shim for a new process in container id while holding
+// the container's lock, so that the container cannot be deleted between
+// checking its status and starting the process.
+func startExec(context *cli.Context, id, pidFile, shimLog, consoleSocket string) (*os.Process, error) {
+	unlock, err := lockContainer(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	c, err := getContainer(id, false)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	status, err := c.Status()
+	if err != nil {
+		return nil, err
+	}
+	if status != containerRunning {
+		return nil, fmt.Errorf("cannot exec a container that is not running")
+	}
+	spec, err := getProcessSpec(context, c)
+	if err != nil {
+		return nil, err
+	}
+	if consoleSocket != "" && !spec.Terminal {
+		return nil, fmt.Errorf("--console-socket requires a terminal")
+	}
+	return startProcessShim(id, pidFile, shimLog, consoleSocket, spec)
+}
+
 func getProcessSpec(context *cli.Context, c *container) (*specs.Process, error) {
 	if path := context.String("process"); path != "" {
 		f, err := os.Open(path)
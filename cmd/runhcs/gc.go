@@ -0,0 +1,450 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Microsoft/hcsshim/internal/appargs"
+	"github.com/Microsoft/hcsshim/internal/hcs"
+	"github.com/Microsoft/hcsshim/internal/hcsoci"
+	"github.com/Microsoft/hcsshim/internal/hns"
+	"github.com/Microsoft/hcsshim/internal/regstate"
+	"github.com/Microsoft/hcsshim/internal/schema1"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// gcLockTimeout is how long gc waits for a container's lock before assuming
+// another command is using the container.
+const gcLockTimeout = time.Second
+
+var gcCommand = cli.Command{
+	Name:  "gc",
+	Usage: "remove containers, VMs and network namespaces left behind by runhcs processes that exited unexpectedly",
+	Description: `The gc command finds containers under --root whose shim has exited without
+recording that the container stopped, compute systems owned by --owner that no
+remaining container under --root uses, and network namespaces that no
+remaining container uses, and removes them.
+
+With --root-only, only the compute systems and namespaces recorded in the state
+of --root are removed, so that gc leaves alone those of other roots sharing
+the owner. Stopped containers are left for the delete command.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "list what would be removed without removing it",
+		},
+		cli.BoolFlag{
+			Name:  "root-only",
+			Usage: "only remove compute systems and network namespaces of removed containers",
+		},
+		cli.BoolFlag{
+			Name:  "all-namespaces",
+			Usage: "with --root-only, also remove network namespaces that removed containers used but runhcs did not create",
+		},
+	},
+	Before: appargs.Validate(),
+	Action: func(context *cli.Context) error {
+		containers, cs, release, err := gatherGCContainers()
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		// Query the systems of the owner, and those the state records
+		// whatever their owner, such as VMs taken from a pool. An empty ID
+		// query would list every system on the host.
+		props, err := hcs.GetComputeSystems(schema1.ComputeSystemQuery{Owners: []string{ownerName}})
+		if err != nil {
+			return err
+		}
+		if ids := recordedSystems(containers); len(ids) > 0 {
+			recorded, err := hcs.GetComputeSystems(schema1.ComputeSystemQuery{IDs: ids})
+			if err != nil {
+				return err
+			}
+			props = append(props, recorded...)
+		}
+		var systems []string
+		seen := make(map[string]bool)
+		for _, p := range props {
+			if !seen[p.ID] {
+				seen[p.ID] = true
+				systems = append(systems, p.ID)
+			}
+		}
+
+		nss, err := hns.ListNamespaces()
+		if err != nil {
+			return err
+		}
+		var namespaces []string
+		for _, ns := range nss {
+			if !ns.IsDefault {
+				namespaces = append(namespaces, ns.ID)
+			}
+		}
+
+		plan := planGC(containers, systems, namespaces, context.Bool("root-only"), context.Bool("all-namespaces"))
+		return plan.run(cs, context.Bool("dry-run"))
+	},
+}
+
+// gcContainer describes a container in the state store for garbage
+// collection.
+type gcContainer struct {
+	ID     string
+	HostID string
+	// VMID is the ID of the utility VM of a VM host container, or of a
+	// container that was never fully created or is busy and may have
+	// started one.
+	VMID string
+	// VMScratch is the scratch folder of VMID if it was taken from a pool.
+	VMScratch string
+	// Busy is set if another command holds the container's lock.
+	Busy bool
+	// ShimPid is the recorded shim pid: 0 once the shim has recorded the
+	// container's exit, or -1 if no shim was ever recorded.
+	ShimPid     int
+	ShimRunning bool
+	// NetNS lists the network namespaces the container uses.
+	NetNS []string
+	// CreatedNetNS is the network namespace created for the container.
+	CreatedNetNS string
+}
+
+// orphaned returns whether the container's shim went away without recording
+// that the container stopped.
+func (c *gcContainer) orphaned() bool {
+	if c.Busy {
+		return false
+	}
+	return c.ShimPid < 0 || (c.ShimPid > 0 && !c.ShimRunning)
+}
+
+// gcPlan lists what gc will remove.
+type gcPlan struct {
+	// Containers are state entries to release and remove.
+	Containers []string
+	// Systems are container compute systems to terminate.
+	Systems []string
+	// VMs are utility VM compute systems to terminate.
+	VMs []string
+	// VMScratch are the scratch folders of pooled VMs in VMs, by VM ID, to
+	// remove once the VM is terminated.
+	VMScratch map[string]string
+	// Namespaces are HNS network namespaces to remove.
+	Namespaces []string
+}
+
+// recordedSystems returns the IDs of the compute systems the containers in the
+// state store may have created.
+func recordedSystems(containers []gcContainer) []string {
+	var ids []string
+	for _, c := range containers {
+		ids = append(ids, c.ID)
+		if c.VMID != "" {
+			ids = append(ids, c.VMID)
+		}
+	}
+	return ids
+}
+
+// planGC decides what to remove given the containers in the state store and
+// the compute systems and network namespaces that exist on the host.
+//
+// An orphaned container is kept if it hosts the VM of a container that is not
+// orphaned, since removing it would tear down that VM. A compute system is
+// removed unless a kept container refers to it, as its own system, its VM, or
+// the VM it runs in; and a namespace is removed unless a kept container uses
+// it. This collects systems and namespaces whose state entry is already gone.
+//
+// With rootOnly set, only the compute systems and VMs of removed containers are
+// removed, and a namespace only if it was created for a removed container, or,
+// if allNamespaces is also set, if a removed container used it.
+func planGC(containers []gcContainer, systems, namespaces []string, rootOnly, allNamespaces bool) *gcPlan {
+	liveHosts := make(map[string]bool)
+	for _, c := range containers {
+		if !c.orphaned() && c.HostID != "" {
+			liveHosts[c.HostID] = true
+		}
+	}
+
+	plan := &gcPlan{}
+	var removed []gcContainer
+	liveSystems := make(map[string]bool)
+	usedNS := make(map[string]bool)
+	orphanNS := make(map[string]bool)
+	for _, c := range containers {
+		if c.orphaned() && !liveHosts[c.ID] {
+			plan.Containers = append(plan.Containers, c.ID)
+			removed = append(removed, c)
+			if c.CreatedNetNS != "" {
+				orphanNS[c.CreatedNetNS] = true
+			}
+			if allNamespaces {
+				for _, ns := range c.NetNS {
+					orphanNS[ns] = true
+				}
+			}
+			continue
+		}
+		liveSystems[c.ID] = true
+		if c.VMID != "" {
+			liveSystems[c.VMID] = true
+		}
+		if c.HostID != "" {
+			liveSystems[vmID(c.HostID)] = true
+		}
+		for _, ns := range c.NetNS {
+			usedNS[ns] = true
+		}
+	}
+
+	scratch := make(map[string]string)
+	vms := make(map[string]bool)
+	for _, c := range removed {
+		if c.VMID != "" {
+			vms[c.VMID] = true
+			if c.VMScratch != "" {
+				scratch[c.VMID] = c.VMScratch
+			}
+		}
+	}
+	addVM := func(id string) {
+		plan.VMs = append(plan.VMs, id)
+		if s := scratch[id]; s != "" {
+			if plan.VMScratch == nil {
+				plan.VMScratch = make(map[string]string)
+			}
+			plan.VMScratch[id] = s
+		}
+	}
+
+	if rootOnly {
+		exists := make(map[string]bool)
+		for _, id := range systems {
+			exists[id] = true
+		}
+		for _, c := range removed {
+			if exists[c.ID] && !liveSystems[c.ID] {
+				plan.Systems = append(plan.Systems, c.ID)
+			}
+		}
+		for _, c := range removed {
+			if c.VMID != "" && exists[c.VMID] && !liveSystems[c.VMID] {
+				addVM(c.VMID)
+			}
+		}
+	} else {
+		for _, id := range systems {
+			if liveSystems[id] {
+				continue
+			}
+			if vms[id] || vmHostID(id) != id {
+				addVM(id)
+			} else {
+				plan.Systems = append(plan.Systems, id)
+			}
+		}
+	}
+
+	for _, ns := range namespaces {
+		if !usedNS[ns] && (!rootOnly || orphanNS[ns]) {
+			plan.Namespaces = append(plan.Namespaces, ns)
+		}
+	}
+	return plan
+}
+
+// gatherGCContainers reads the containers in the state store, taking the lock
+// of each container that is not in use. It returns the containers that could
+// be opened, keyed by ID, and a function that closes them and releases the
+// locks.
+func gatherGCContainers() ([]gcContainer, map[string]*container, func(), error) {
+	var (
+		containers []gcContainer
+		cs         = make(map[string]*container)
+		locks      []*regstate.Lock
+	)
+	release := func() {
+		for _, c := range cs {
+			if c != nil {
+				c.Close()
+			}
+		}
+		for _, l := range locks {
+			l.Unlock()
+		}
+	}
+
+	ids, err := stateKey.Enumerate()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, id := range ids {
+		l, err := stateKey.Lock(id, gcLockTimeout)
+		if err != nil {
+			if _, ok := err.(*regstate.LockTimeoutError); !ok {
+				release()
+				return nil, nil, nil, err
+			}
+			// Read what the container uses without its lock, so that
+			// nothing it may be creating is removed.
+			gc := gcContainer{ID: id, Busy: true}
+			gc.VMID, _ = hostVM(id)
+			var ps persistedState
+			if err := stateKey.Get(id, keyState, &ps); err == nil {
+				gc.HostID = ps.HostID
+				gc.readNetNS(ps.RequestedNetNS)
+			} else {
+				gc.readNetNS("")
+			}
+			containers = append(containers, gc)
+			continue
+		}
+		locks = append(locks, l)
+
+		c, err := getContainer(id, false)
+		if err != nil {
+			switch err.(type) {
+			case *regstate.NotFoundError:
+				// Removed since it was enumerated.
+			case *regstate.NoStateError:
+				// The container was never fully created.
+				cs[id] = nil
+				gc := gcContainer{ID: id, ShimPid: -1}
+				gc.VMID, gc.VMScratch = hostVM(id)
+				containers = append(containers, gc)
+			default:
+				release()
+				return nil, nil, nil, err
+			}
+			continue
+		}
+		cs[id] = c
+
+		gc := gcContainer{
+			ID:      id,
+			HostID:  c.HostID,
+			ShimPid: c.ShimPid,
+		}
+		if c.IsHost {
+			gc.VMID, gc.VMScratch = hostVM(id)
+		}
+		if c.ShimPid > 0 {
+			gc.ShimRunning = regstate.ProcessExists(c.ShimPid)
+		}
+		gc.readNetNS(c.RequestedNetNS)
+		containers = append(containers, gc)
+	}
+	return containers, cs, release, nil
+}
+
+// readNetNS fills in the network namespaces the container uses from its
+// state, given the namespace it was asked to join.
+func (gc *gcContainer) readNetNS(requested string) {
+	if requested != "" {
+		gc.NetNS = append(gc.NetNS, requested)
+	}
+	var netNS string
+	if err := stateKey.Get(gc.ID, keyNetNS, &netNS); err == nil && netNS != "" {
+		gc.NetNS = append(gc.NetNS, netNS)
+	}
+	var resources hcsoci.Resources
+	if err := stateKey.Get(gc.ID, keyResources, &resources); err == nil && resources.NetNS != "" {
+		if resources.CreatedNetNS {
+			gc.CreatedNetNS = resources.NetNS
+		}
+		gc.NetNS = append(gc.NetNS, resources.NetNS)
+	}
+}
+
+// hostVM returns the ID of the VM of the host container id, and its scratch
+// folder if it was taken from a pool.
+func hostVM(id string) (string, string) {
+	if pvm := hostPooledVM(id); pvm != nil {
+		return pvm.ID, pvm.Scratch
+	}
+	return vmID(id), ""
+}
+
+// run removes everything in the plan, printing each item as it goes. With
+// dryRun set it only prints.
+func (plan *gcPlan) run(cs map[string]*container, dryRun bool) error {
+	failed := 0
+	do := func(kind, id string, f func() error) {
+		fmt.Printf("%s\t%s\n", kind, id)
+		if dryRun {
+			return
+		}
+		if err := f(); err != nil {
+			logrus.Warnf("failed to remove %s %s: %s", kind, id, err)
+			fmt.Fprintf(os.Stderr, "remove %s %s: %v\n", kind, id, err)
+			failed++
+		}
+	}
+
+	for _, id := range plan.Systems {
+		do("system", id, func() error { return terminateComputeSystem(id) })
+	}
+	for _, id := range plan.Containers {
+		do("container", id, func() error {
+			c := cs[id]
+			if c == nil {
+				return stateKey.Remove(id)
+			}
+			if err := c.Kill(); err != nil {
+				return err
+			}
+			return c.Remove()
+		})
+	}
+	for _, id := range plan.VMs {
+		do("vm", id, func() error {
+			if err := terminateComputeSystem(id); err != nil {
+				return err
+			}
+			if scratch := plan.VMScratch[id]; scratch != "" {
+				return os.RemoveAll(scratch)
+			}
+			return nil
+		})
+	}
+	for _, id := range plan.Namespaces {
+		do("namespace", id, func() error {
+			err := hns.RemoveNamespace(id)
+			if err == os.ErrNotExist {
+				// HNS no longer has it; it was removed along with its
+				// container.
+				err = nil
+			}
+			return err
+		})
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("failed to remove %d items", failed)
+	}
+	return nil
+}
+
+func terminateComputeSystem(id string) error {
+	s, err := hcs.OpenComputeSystem(id)
+	if err != nil {
+		if hcs.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer s.Close()
+	err = s.Terminate()
+	if hcs.IsPending(err) {
+		err = s.Wait()
+	}
+	if hcs.IsAlreadyStopped(err) || hcs.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
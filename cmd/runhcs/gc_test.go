@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGCOrphaned(t *testing.T) {
+	tests := []struct {
+		c        gcContainer
+		orphaned bool
+	}{
+		{gcContainer{ShimPid: 10, ShimRunning: true}, false},
+		{gcContainer{ShimPid: 10}, true},
+		{gcContainer{ShimPid: 0}, false},
+		{gcContainer{ShimPid: -1}, true},
+		{gcContainer{ShimPid: -1, Busy: true}, false},
+		{gcContainer{ShimPid: 10, Busy: true}, false},
+	}
+	for i, test := range tests {
+		if o := test.c.orphaned(); o != test.orphaned {
+			t.Errorf("%d: %+v: got orphaned %v", i, test.c, o)
+		}
+	}
+}
+
+func TestPlanGC(t *testing.T) {
+	containers := []gcContainer{
+		// A running process-isolated container.
+		{ID: "live", ShimPid: 10, ShimRunning: true, NetNS: []string{"ns-live"}, CreatedNetNS: "ns-live"},
+		// A stopped container waiting to be deleted.
+		{ID: "stopped", ShimPid: 0, NetNS: []string{"ns-stopped"}, CreatedNetNS: "ns-stopped"},
+		// A container whose shim crashed.
+		{ID: "crashed", ShimPid: 11, NetNS: []string{"ns-crashed"}, CreatedNetNS: "ns-crashed"},
+		// A container sharing the crashed container's namespace.
+		{ID: "sharer", ShimPid: 12, ShimRunning: true, NetNS: []string{"ns-shared"}},
+		{ID: "shared-owner", ShimPid: 13, NetNS: []string{"ns-shared"}, CreatedNetNS: "ns-shared"},
+		// A container that is being created by another command.
+		{ID: "busy", VMID: "busy@vm", Busy: true, NetNS: []string{"ns-busy"}},
+		// A container that never got a shim, and may have started a VM.
+		{ID: "noshim", VMID: "noshim@vm", ShimPid: -1},
+		// A sandbox VM whose own shim crashed but which still hosts a
+		// running container.
+		{ID: "pod", HostID: "pod", VMID: "pod@vm", ShimPid: 14},
+		{ID: "pod-c", HostID: "pod", ShimPid: 15, ShimRunning: true},
+		// A sandbox VM whose containers have all crashed.
+		{ID: "deadpod", HostID: "deadpod", VMID: "deadpod@vm", ShimPid: 16},
+		{ID: "deadpod-c", HostID: "deadpod", ShimPid: 17},
+		// A crashed container in a network namespace runhcs did not create.
+		{ID: "joined", ShimPid: 18, NetNS: []string{"ns-joined"}},
+		// A crashed sandbox whose VM was taken from a pool.
+		{ID: "pooled", HostID: "pooled", VMID: "p1@pool", VMScratch: `c:\pool\p1@pool`, ShimPid: 19},
+	}
+	// "stateless" and "stateless@vm" are systems whose state entry is
+	// already gone, and "ns-unowned" a namespace no container uses.
+	systems := []string{
+		"live", "stopped", "crashed", "sharer", "busy", "busy@vm",
+		"pod", "pod-c", "pod@vm",
+		"deadpod", "deadpod-c", "deadpod@vm",
+		"pooled", "p1@pool",
+		"stateless", "stateless@vm",
+	}
+	namespaces := []string{
+		"ns-live", "ns-stopped", "ns-crashed", "ns-shared", "ns-joined", "ns-busy", "ns-unowned",
+	}
+	if ids := recordedSystems(containers); len(ids) != 18 {
+		t.Fatalf("got recorded systems %v", ids)
+	}
+
+	plan := planGC(containers, systems, namespaces, false, false)
+	expected := &gcPlan{
+		Containers: []string{"crashed", "shared-owner", "noshim", "deadpod", "deadpod-c", "joined", "pooled"},
+		Systems:    []string{"crashed", "deadpod", "deadpod-c", "pooled", "stateless"},
+		VMs:        []string{"deadpod@vm", "p1@pool", "stateless@vm"},
+		VMScratch:  map[string]string{"p1@pool": `c:\pool\p1@pool`},
+		Namespaces: []string{"ns-crashed", "ns-joined", "ns-unowned"},
+	}
+	if !reflect.DeepEqual(plan, expected) {
+		t.Fatalf("got %+v, expected %+v", plan, expected)
+	}
+
+	// With rootOnly, systems and namespaces the state does not record, such
+	// as those of another root, are never removed.
+	plan = planGC(containers, systems, namespaces, true, false)
+	expected = &gcPlan{
+		Containers: []string{"crashed", "shared-owner", "noshim", "deadpod", "deadpod-c", "joined", "pooled"},
+		Systems:    []string{"crashed", "deadpod", "deadpod-c", "pooled"},
+		VMs:        []string{"deadpod@vm", "p1@pool"},
+		VMScratch:  map[string]string{"p1@pool": `c:\pool\p1@pool`},
+		Namespaces: []string{"ns-crashed"},
+	}
+	if !reflect.DeepEqual(plan, expected) {
+		t.Fatalf("root only: got %+v, expected %+v", plan, expected)
+	}
+
+	plan = planGC(containers, systems, namespaces, true, true)
+	expected.Namespaces = []string{"ns-crashed", "ns-joined"}
+	if !reflect.DeepEqual(plan, expected) {
+		t.Fatalf("root only, all namespaces: got %+v, expected %+v", plan, expected)
+	}
+}
+
+func TestPlanGCEmpty(t *testing.T) {
+	plan := planGC(nil, []string{"a", "a@vm"}, []string{"ns"}, false, false)
+	expected := &gcPlan{Systems: []string{"a"}, VMs: []string{"a@vm"}, Namespaces: []string{"ns"}}
+	if !reflect.DeepEqual(plan, expected) {
+		t.Fatalf("got %+v, expected %+v", plan, expected)
+	}
+	plan = planGC(nil, []string{"a", "a@vm"}, []string{"ns"}, true, true)
+	if !reflect.DeepEqual(plan, &gcPlan{}) {
+		t.Fatalf("root only: got %+v for an empty state store", plan)
+	}
+}
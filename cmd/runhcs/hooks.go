@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"time"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+)
+
+// Hooks are run on the host for both Windows and Linux containers, with the
+// container's state on stdin. The createContainer and startContainer hooks,
+// which the OCI spec runs in the container namespace, are run on the host as
+// well.
+
+// ociState returns the state passed to the container's hooks.
+func (c *container) ociState(status string) *specs.State {
+	return &specs.State{
+		Version:     c.Spec.Version,
+		ID:          c.ID,
+		Status:      status,
+		Pid:         c.ShimPid,
+		Bundle:      c.Bundle,
+		Annotations: c.Spec.Annotations,
+	}
+}
+
+// runCreateHooks runs the prestart, createRuntime and createContainer hooks.
+// A failure aborts the create.
+func (c *container) runCreateHooks() error {
+	if c.Spec.Hooks == nil {
+		return nil
+	}
+	state := c.ociState("created")
+	for _, hooks := range [][]specs.Hook{
+		c.Spec.Hooks.Prestart,
+		c.Spec.Hooks.CreateRuntime,
+		c.Spec.Hooks.CreateContainer,
+	} {
+		if err := runHooks(hooks, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runHookList runs hooks with the container in the given status, logging
+// rather than returning failures. This is used for the poststart and
+// poststop hooks, which must not fail the lifecycle operation.
+func (c *container) runHookList(name string, hooks []specs.Hook, status string) {
+	if err := runHooks(hooks, c.ociState(status)); err != nil {
+		logrus.Warnf("%s hook for container %s failed: %s", name, c.ID, err)
+	}
+}
+
+// runHooks runs hooks in order, stopping at the first failure.
+func runHooks(hooks []specs.Hook, state *specs.State) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+	statej, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		if err := runHook(&hook, statej); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runHook runs a single hook, killing it if it runs longer than its timeout.
+func runHook(hook *specs.Hook, state []byte) error {
+	var stdout, stderr bytes.Buffer
+	cmd := &exec.Cmd{
+		Path:   hook.Path,
+		Args:   hook.Args,
+		Env:    hook.Env,
+		Stdin:  bytes.NewReader(state),
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	if len(cmd.Args) == 0 {
+		cmd.Args = []string{hook.Path}
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("hook %s: %s", hook.Path, err)
+	}
+
+	waitCh := make(chan error, 1)
+	go func() {
+		waitCh <- cmd.Wait()
+	}()
+	var timeoutCh <-chan time.Time
+	if hook.Timeout != nil && *hook.Timeout > 0 {
+		timer := time.NewTimer(time.Duration(*hook.Timeout) * time.Second)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	select {
+	case err := <-waitCh:
+		if err != nil {
+			return fmt.Errorf("hook %s: %s, stdout: %s, stderr: %s", hook.Path, err, stdout.String(), stderr.String())
+		}
+		return nil
+	case <-timeoutCh:
+		cmd.Process.Kill()
+		<-waitCh
+		return fmt.Errorf("hook %s: timed out after %d seconds", hook.Path, *hook.Timeout)
+	}
+}
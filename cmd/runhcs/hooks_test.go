@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// TestHookHelper is not a real test. It is run as a hook by the other tests.
+func TestHookHelper(t *testing.T) {
+	mode := os.Getenv("RUNHCS_TEST_HOOK")
+	if mode == "" {
+		return
+	}
+	defer os.Exit(0)
+	switch mode {
+	case "state":
+		var state specs.State
+		if err := json.NewDecoder(os.Stdin).Decode(&state); err != nil {
+			fmt.Fprint(os.Stderr, err)
+			os.Exit(1)
+		}
+		if state.ID != os.Args[len(os.Args)-1] {
+			fmt.Fprintf(os.Stderr, "bad state %+v", state)
+			os.Exit(1)
+		}
+	case "fail":
+		fmt.Fprint(os.Stderr, "hook failed")
+		os.Exit(1)
+	case "hang":
+		time.Sleep(time.Minute)
+	}
+}
+
+func testHook(mode string, args ...string) specs.Hook {
+	return specs.Hook{
+		Path: os.Args[0],
+		Args: append([]string{os.Args[0], "-test.run=TestHookHelper", "--"}, args...),
+		Env:  []string{"RUNHCS_TEST_HOOK=" + mode},
+	}
+}
+
+func TestRunHooks(t *testing.T) {
+	state := &specs.State{ID: "hooktest", Status: "created"}
+	err := runHooks([]specs.Hook{testHook("state", "hooktest"), testHook("state", "hooktest")}, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runHooks([]specs.Hook{testHook("fail"), testHook("state", "hooktest")}, state)
+	if err == nil || !strings.Contains(err.Error(), "hook failed") {
+		t.Fatal("expected hook failure", err)
+	}
+
+	if err := runHooks(nil, state); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunHookTimeout(t *testing.T) {
+	hook := testHook("hang")
+	timeout := 1
+	hook.Timeout = &timeout
+	start := time.Now()
+	err := runHook(&hook, []byte("{}"))
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatal("expected timeout", err)
+	}
+	if d := time.Since(start); d > 30*time.Second {
+		t.Fatal("hook was not killed", d)
+	}
+}
+
+func TestRunHookMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runhcs-hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hook := specs.Hook{Path: dir + string(os.PathSeparator) + "missing.exe"}
+	if err := runHook(&hook, nil); err == nil {
+		t.Fatal("expected error")
+	}
+}
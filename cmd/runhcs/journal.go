@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/Microsoft/hcsshim/internal/hcsoci"
+	"github.com/Microsoft/hcsshim/internal/regstate"
+)
+
+// stateJournalStore persists the resource journal of the container whose ID
+// it is in the state store.
+type stateJournalStore string
+
+func (id stateJournalStore) Save(entries []hcsoci.JournalEntry) error {
+	return stateKey.Set(string(id), keyJournal, entries)
+}
+
+// openJournal returns the resource journal of the container id, with the
+// entries left by earlier commands.
+func openJournal(id string) (*hcsoci.Journal, error) {
+	var entries []hcsoci.JournalEntry
+	err := stateKey.Get(id, keyJournal, &entries)
+	if _, ok := err.(*regstate.NoStateError); !ok && err != nil {
+		return nil, err
+	}
+	return hcsoci.NewJournal(stateJournalStore(id), entries), nil
+}
+
+// clearJournal removes the journal of the container id if it has no entries
+// left.
+func clearJournal(id string, j *hcsoci.Journal) error {
+	if len(j.Entries()) != 0 {
+		return nil
+	}
+	err := stateKey.Clear(id, keyJournal)
+	if _, ok := err.(*regstate.NoStateError); ok {
+		return nil
+	}
+	return err
+}
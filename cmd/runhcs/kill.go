@@ -24,6 +24,11 @@ signal to the init process of the "ubuntu01" container:
 	Before: appargs.Validate(argID, appargs.Optional(appargs.String)),
 	Action: func(context *cli.Context) error {
 		id := context.Args().First()
+		unlock, err := lockContainer(id)
+		if err != nil {
+			return err
+		}
+		defer unlock()
 		c, err := getContainer(id, true)
 		if err != nil {
 			return err
@@ -41,16 +46,31 @@ signal to the init process of the "ubuntu01" container:
 			sigstr = "SIGTERM"
 		}
 
-		var pid int
-		if err := stateKey.Get(id, keyInitPid, &pid); err != nil {
-			return err
+		// Killing a sandbox kills the containers in it first.
+		if c.isSandbox() {
+			if err := killSandboxMembers(id); err != nil {
+				return err
+			}
 		}
-
-		p, err := c.hc.OpenProcess(pid)
-		if err != nil {
-			return err
-		}
-		defer p.Close()
-		return p.Kill() // BUGBUG: should be Signal
+		return c.killInit()
 	},
 }
+
+// killInit kills the container's init process.
+func (c *container) killInit() error {
+	var pid int
+	if err := stateKey.Get(c.ID, keyInitPid, &pid); err != nil {
+		return err
+	}
+
+	p, err := c.hc.OpenProcess(pid)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	// Let the shim know why the process exited.
+	if err := stateKey.Set(c.ID, keyKilled, true); err != nil {
+		return err
+	}
+	return p.Kill() // BUGBUG: should be Signal
+}
@@ -35,6 +35,13 @@ type containerState struct {
 	Annotations map[string]string `json:"annotations,omitempty"`
 	// The owner of the state directory (the owner of the container).
 	Owner string `json:"owner"`
+	// Exit describes how the init process exited, once it has.
+	Exit *exitStatus `json:"exit,omitempty"`
+	// Sandbox is the ID of the sandbox the container is in, or its own ID if
+	// it is a sandbox.
+	Sandbox string `json:"sandbox,omitempty"`
+	// Members are the containers in the sandbox, if the container is one.
+	Members []string `json:"members,omitempty"`
 }
 
 var listCommand = cli.Command{
@@ -122,16 +129,25 @@ func getContainers(context *cli.Context) ([]containerState, error) {
 			fmt.Fprintf(os.Stderr, "reading status for %s: %v\n", id, err)
 		}
 
-		s = append(s, containerState{
-			ID:             id,
-			Version:        c.Spec.Version,
-			InitProcessPid: c.ShimPid,
-			Status:         string(status),
-			Bundle:         c.Bundle,
-			Rootfs:         c.Rootfs,
-			Created:        c.Created,
-			Annotations:    c.Spec.Annotations,
-		})
+		s = append(s, c.state(status))
 	}
 	return s, nil
 }
+
+// state returns the state of the container reported by the state and list
+// commands.
+func (c *container) state(status containerStatus) containerState {
+	return containerState{
+		ID:             c.ID,
+		Version:        c.Spec.Version,
+		InitProcessPid: c.ShimPid,
+		Status:         string(status),
+		Bundle:         c.Bundle,
+		Rootfs:         c.Rootfs,
+		Created:        c.Created,
+		Annotations:    c.Spec.Annotations,
+		Exit:           c.Exit,
+		Sandbox:        c.SandboxID,
+		Members:        c.sandboxMembers(),
+	}
+}
@@ -27,7 +27,11 @@ var version = ""
 // and will be populated by the Makefile
 var gitCommit = ""
 
-var stateKey *regstate.Key
+var stateKey regstate.Store
+
+// stateRoot, ownerName and vmPoolPipe are the values of the global --root,
+// --owner and --vm-pool options, which are passed on to the shims.
+var stateRoot, ownerName, vmPoolPipe string
 
 var logFormat string
 
@@ -93,10 +97,14 @@ func main() {
 			Value: "runhcs",
 			Usage: "compute system owner",
 		},
+		cli.StringFlag{
+			Name:  "vm-pool",
+			Usage: "named pipe of a pool daemon ('runhcs pool serve') to take new utility VMs from",
+		},
 		cli.StringFlag{
 			Name:  "root",
 			Value: "default",
-			Usage: "registry key for storage of container state",
+			Usage: "registry key for storage of container state, or a file:// URL of a directory (e.g. file:///C:/runhcs)",
 		},
 	}
 	app.Commands = []cli.Command{
@@ -104,9 +112,12 @@ func main() {
 		deleteCommand,
 		// eventsCommand,
 		execCommand,
+		gcCommand,
 		killCommand,
 		listCommand,
+		mountCommand,
 		pauseCommand,
+		poolCommand,
 		psCommand,
 		resizeTtyCommand,
 		resumeCommand,
@@ -114,7 +125,9 @@ func main() {
 		shimCommand,
 		startCommand,
 		stateCommand,
+		umountCommand,
 		// updateCommand,
+		vmCommand,
 		vmshimCommand,
 	}
 	app.Before = func(context *cli.Context) error {
@@ -137,8 +150,12 @@ func main() {
 			return fmt.Errorf("unknown log-format %q", logFormat)
 		}
 
+		stateRoot = context.GlobalString("root")
+		ownerName = context.GlobalString("owner")
+		vmPoolPipe = context.GlobalString("vm-pool")
+
 		var err error
-		stateKey, err = regstate.Open(context.GlobalString("root"), false)
+		stateKey, err = regstate.OpenStore(stateRoot, false)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/Microsoft/hcsshim/internal/appargs"
+	"github.com/Microsoft/hcsshim/internal/hcsoci"
+	"github.com/Microsoft/hcsshim/internal/regstate"
+	"github.com/Microsoft/hcsshim/internal/uvm"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/urfave/cli"
+)
+
+var mountCommand = cli.Command{
+	Name:  "mount",
+	Usage: "mount a host directory, file or named pipe in a running container",
+	ArgsUsage: `<container-id> <source> <destination>
+
+Where "<container-id>" is the name of a running container, "<source>" is the
+path on the host, and "<destination>" is the path in the container. A
+destination starting with \\.\pipe\ maps the host named pipe <source>.`,
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "option, o",
+			Value: &cli.StringSlice{},
+			Usage: "comma-separated mount options, such as ro",
+		},
+	},
+	Before: appargs.Validate(argID, appargs.NonEmptyString, appargs.NonEmptyString),
+	Action: func(context *cli.Context) error {
+		source := context.Args().Get(1)
+		destination := context.Args().Get(2)
+		if !strings.HasPrefix(destination, uvm.PipePrefix) {
+			var err error
+			source, err = filepath.Abs(source)
+			if err != nil {
+				return err
+			}
+		}
+		mount := &specs.Mount{Source: source, Destination: destination}
+		for _, o := range context.StringSlice("option") {
+			mount.Options = append(mount.Options, strings.Split(o, ",")...)
+		}
+		return modifyMount(context.Args().First(), opAddMount, mount)
+	},
+}
+
+var umountCommand = cli.Command{
+	Name:  "umount",
+	Usage: "unmount a mount added to a running container by mount",
+	ArgsUsage: `<container-id> <destination>
+
+Where "<container-id>" is the name of a running container.`,
+	Before: appargs.Validate(argID, appargs.NonEmptyString),
+	Action: func(context *cli.Context) error {
+		mount := &specs.Mount{Destination: context.Args().Get(1)}
+		return modifyMount(context.Args().First(), opRemoveMount, mount)
+	},
+}
+
+// modifyMount adds or removes a mount in the running container id. For a
+// container hosted in a utility VM, the VM shim does this since it owns the
+// VM's shares.
+func modifyMount(id string, op vmRequestOp, mount *specs.Mount) error {
+	unlock, err := lockContainer(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	c, err := getContainer(id, true)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if c.VMIsolated() {
+		return c.callVM(&vmRequest{ID: c.ID, Op: op, Mount: mount}, nil)
+	}
+	if op == opAddMount {
+		return c.addMountInHost(nil, mount)
+	}
+	return c.removeMountInHost(nil, mount.Destination)
+}
+
+// getResources returns the resources recorded for the container, with its
+// journal.
+func (c *container) getResources() (*hcsoci.Resources, error) {
+	journal, err := openJournal(c.ID)
+	if err != nil {
+		return nil, err
+	}
+	resources := &hcsoci.Resources{Journal: journal}
+	err = stateKey.Get(c.ID, keyResources, resources)
+	if _, ok := err.(*regstate.NoStateError); ok {
+		return resources, nil
+	}
+	return resources, err
+}
+
+// addMountInHost adds mount to the running container, sharing its source into
+// vm if the container is hosted. The mount is recorded in the container's
+// resources so that its share is released when the container is removed.
+func (c *container) addMountInHost(vm *uvm.UtilityVM, mount *specs.Mount) error {
+	resources, err := c.getResources()
+	if err != nil {
+		return err
+	}
+	err = hcsoci.AddMount(c.hc, vm, resources, *mount)
+	if err != nil {
+		return err
+	}
+	return stateKey.Set(c.ID, keyResources, resources)
+}
+
+// removeMountInHost removes a mount added by addMountInHost from the running
+// container.
+func (c *container) removeMountInHost(vm *uvm.UtilityVM, destination string) error {
+	resources, err := c.getResources()
+	if err != nil {
+		return err
+	}
+	err = hcsoci.RemoveMount(c.hc, vm, resources, destination)
+	if e := stateKey.Set(c.ID, keyResources, resources); err == nil {
+		err = e
+	}
+	return err
+}
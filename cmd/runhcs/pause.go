@@ -18,6 +18,11 @@ Use runc list to identiy instances of containers and their current status.`,
 	Before: appargs.Validate(argID),
 	Action: func(context *cli.Context) error {
 		id := context.Args().First()
+		unlock, err := lockContainer(id)
+		if err != nil {
+			return err
+		}
+		defer unlock()
 		container, err := getContainer(id, true)
 		if err != nil {
 			return err
@@ -43,6 +48,11 @@ Use runc list to identiy instances of containers and their current status.`,
 	Before: appargs.Validate(argID),
 	Action: func(context *cli.Context) error {
 		id := context.Args().First()
+		unlock, err := lockContainer(id)
+		if err != nil {
+			return err
+		}
+		defer unlock()
 		container, err := getContainer(id, true)
 		if err != nil {
 			return err
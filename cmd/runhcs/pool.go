@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	winio "github.com/Microsoft/go-winio"
+	"github.com/Microsoft/hcsshim/internal/appargs"
+	"github.com/Microsoft/hcsshim/internal/hcs"
+	"github.com/Microsoft/hcsshim/internal/regstate"
+	"github.com/Microsoft/hcsshim/internal/schema1"
+	"github.com/Microsoft/hcsshim/internal/shimrpc"
+	"github.com/Microsoft/hcsshim/internal/uvm"
+	"github.com/Microsoft/hcsshim/internal/uvmpool"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// A pool daemon keeps started utility VMs ready for VM shims. A VM shim run
+// with --vm-pool asks the daemon for a VM of the profile it needs before
+// creating one. The daemon hands over a VM by releasing its handle and
+// returning its state, with which the VM shim opens it. The VM shim records
+// the VM's ID under keyPooledVM, since it differs from vmID of its host.
+
+const (
+	defaultPoolPipe  = `\\.\pipe\runhcs-vm-pool`
+	poolMethodTake   = "take"
+	poolMethodStatus = "status"
+	keyPooledVM      = "pooledvm"
+)
+
+// poolConfigFile is the configuration file of the pool daemon.
+type poolConfigFile struct {
+	Size     int               `json:"size"`
+	MaxAge   string            `json:"maxAge,omitempty"` // A duration such as "2h". Defaults to no maximum.
+	Profiles []uvmpool.Profile `json:"profiles"`
+}
+
+// poolTakeRequest asks the pool daemon for a VM of Profile for the VM host
+// container Host.
+type poolTakeRequest struct {
+	Profile uvmpool.Profile
+	Host    string
+}
+
+// pooledVM is a VM handed out by the pool daemon, and the record of it kept
+// by its host container.
+type pooledVM struct {
+	ID      string
+	State   *uvm.State `json:",omitempty"`
+	Scratch string     `json:",omitempty"` // The scratch folder of a Windows VM, removed with the host.
+}
+
+var poolCommand = cli.Command{
+	Name:  "pool",
+	Usage: "keep utility VMs started for VM shims run with --vm-pool",
+	Subcommands: []cli.Command{
+		poolServeCommand,
+		poolStatusCommand,
+	},
+}
+
+var poolServeCommand = cli.Command{
+	Name:  "serve",
+	Usage: "run the pool daemon",
+	Description: `The serve command keeps started utility VMs of each profile in the
+configuration file ready until it is interrupted. The file is JSON, such as:
+
+    {
+        "size": 2,
+        "maxAge": "4h",
+        "profiles": [
+            {"OperatingSystem": "linux", "MemorySizeInMB": 1024, "ProcessorCount": 2}
+        ]
+    }
+
+It is read again whenever it changes. VMs whose profile is no longer
+configured, or that are older than maxAge, are replaced.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "config",
+			Usage: "path to the pool configuration file",
+		},
+		cli.StringFlag{
+			Name:  "pipe",
+			Value: defaultPoolPipe,
+			Usage: "named pipe to serve VM shims on",
+		},
+		cli.StringFlag{
+			Name:  "scratch-root",
+			Value: filepath.Join(os.TempDir(), "runhcs-vm-pool"),
+			Usage: "directory for the scratch folders of Windows utility VMs",
+		},
+		cli.DurationFlag{
+			Name:  "interval",
+			Value: time.Minute,
+			Usage: "how often to retire old VMs and check the configuration file",
+		},
+	},
+	Before: appargs.Validate(),
+	Action: func(context *cli.Context) error {
+		path := context.String("config")
+		if path == "" {
+			return fmt.Errorf("--config is required")
+		}
+		config, modTime, err := loadPoolConfig(path)
+		if err != nil {
+			return err
+		}
+		l, err := winio.ListenPipe(context.String("pipe"), &winio.PipeConfig{MessageMode: true})
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+
+		// The VMs have an owner of their own so that a restarted daemon can
+		// find the VMs it left. gc removes pooled VMs with the host
+		// containers they were handed out to.
+		backend := &uvmpool.UVMBackend{Owner: ownerName + "-pool", ScratchRoot: context.String("scratch-root")}
+		if err := reapPooledVMs(backend.Owner, backend.ScratchRoot); err != nil {
+			return err
+		}
+		pool := uvmpool.New(backend, config)
+		defer pool.Close()
+
+		pipeCh := make(chan net.Conn)
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					logrus.Error(err)
+					continue
+				}
+				pipeCh <- conn
+			}
+		}()
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		ticker := time.NewTicker(context.Duration("interval"))
+		defer ticker.Stop()
+		handlers := poolHandlers(pool)
+		for {
+			select {
+			case <-interrupt:
+				return nil
+			case <-ticker.C:
+				if fi, err := os.Stat(path); err == nil && !fi.ModTime().Equal(modTime) {
+					newConfig, newModTime, err := loadPoolConfig(path)
+					if err != nil {
+						logrus.Warnf("keeping the current pool configuration: %s", err)
+					} else {
+						logrus.Infof("reloading pool configuration from %s", path)
+						pool.Reconfigure(newConfig)
+					}
+					modTime = newModTime
+				}
+				pool.Tick()
+			case conn := <-pipeCh:
+				go func() {
+					if err := shimrpc.Serve(conn, handlers); err != nil {
+						logrus.Error(err)
+					}
+					conn.Close()
+				}()
+			}
+		}
+	},
+}
+
+var poolStatusCommand = cli.Command{
+	Name:  "status",
+	Usage: "show the VMs kept by the pool daemon",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "pipe",
+			Value: defaultPoolPipe,
+			Usage: "named pipe of the pool daemon",
+		},
+		cli.StringFlag{
+			Name:  "format, f",
+			Value: "table",
+			Usage: `select one of: ` + formatOptions,
+		},
+	},
+	Before: appargs.Validate(),
+	Action: func(context *cli.Context) error {
+		var status []uvmpool.ProfileStatus
+		if err := callPool(context.String("pipe"), poolMethodStatus, nil, &status); err != nil {
+			return err
+		}
+		switch context.String("format") {
+		case "table":
+			w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+			fmt.Fprint(w, "OS\tMEMORY\tPROCESSORS\tREADY\tSTARTING\n")
+			for _, s := range status {
+				starting := fmt.Sprint(s.Starting)
+				if s.Failed {
+					starting += " (failing)"
+				}
+				fmt.Fprintf(w, "%s\t%dMB\t%d\t%d\t%s\n", s.Profile.OperatingSystem, s.Profile.MemorySizeInMB, s.Profile.ProcessorCount, s.Ready, starting)
+			}
+			return w.Flush()
+		case "json":
+			return json.NewEncoder(os.Stdout).Encode(status)
+		default:
+			return fmt.Errorf("invalid format option")
+		}
+	},
+}
+
+// loadPoolConfig reads the pool configuration file at path, and returns it
+// with the file's modification time.
+func loadPoolConfig(path string) (uvmpool.Config, time.Time, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return uvmpool.Config{}, time.Time{}, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return uvmpool.Config{}, time.Time{}, err
+	}
+	config, err := parsePoolConfig(b)
+	if err != nil {
+		return uvmpool.Config{}, time.Time{}, fmt.Errorf("%s: %s", path, err)
+	}
+	return config, fi.ModTime(), nil
+}
+
+// parsePoolConfig parses and validates a pool configuration file.
+func parsePoolConfig(b []byte) (uvmpool.Config, error) {
+	var f poolConfigFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return uvmpool.Config{}, err
+	}
+	config := uvmpool.Config{Size: f.Size, Profiles: f.Profiles}
+	if f.Size < 0 {
+		return uvmpool.Config{}, fmt.Errorf("invalid size %d", f.Size)
+	}
+	if f.MaxAge != "" {
+		d, err := time.ParseDuration(f.MaxAge)
+		if err != nil || d < 0 {
+			return uvmpool.Config{}, fmt.Errorf("invalid maxAge %q", f.MaxAge)
+		}
+		config.MaxAge = d
+	}
+	for i, p := range f.Profiles {
+		switch {
+		case p.OperatingSystem != "windows" && p.OperatingSystem != "linux":
+			return uvmpool.Config{}, fmt.Errorf("profile %d: unsupported operating system %q", i, p.OperatingSystem)
+		case p.OperatingSystem == "windows" && len(p.LayerFolders) == 0:
+			return uvmpool.Config{}, fmt.Errorf("profile %d: a Windows profile needs the layer folders of the utility VM image", i)
+		case p.MemorySizeInMB <= 0 || p.ProcessorCount <= 0:
+			return uvmpool.Config{}, fmt.Errorf("profile %d: the memory size and processor count must be set", i)
+		}
+	}
+	return config, nil
+}
+
+// poolHandlers returns the shimrpc handlers of the pool daemon.
+func poolHandlers(pool *uvmpool.Pool) map[string]shimrpc.Handler {
+	return map[string]shimrpc.Handler{
+		poolMethodTake: func(params json.RawMessage) (interface{}, error) {
+			var req poolTakeRequest
+			if err := json.Unmarshal(params, &req); err != nil {
+				return nil, shimrpc.Errorf(shimrpc.ErrorInvalidParams, "%s", err)
+			}
+			vm, err := pool.Get(req.Profile)
+			if err == uvmpool.ErrEmpty {
+				return nil, shimrpc.Errorf(shimrpc.ErrorNotFound, "%s", err)
+			} else if err != nil {
+				return nil, err
+			}
+			v := vm.(*uvmpool.UVM)
+			result := &pooledVM{ID: v.ID(), State: v.State(), Scratch: v.ScratchPath()}
+			if err := v.Release(); err != nil {
+				logrus.Warnf("failed to release pooled VM %s: %s", result.ID, err)
+			}
+			logrus.Infof("bound pooled VM %s to %s", result.ID, req.Host)
+			return result, nil
+		},
+		poolMethodStatus: func(json.RawMessage) (interface{}, error) {
+			return pool.Status(), nil
+		},
+	}
+}
+
+// callPool calls method on the pool daemon listening on pipePath.
+func callPool(pipePath string, method string, params, result interface{}) error {
+	timeout := 5 * time.Second
+	pipe, err := winio.DialPipe(pipePath, &timeout)
+	if err != nil {
+		return err
+	}
+	defer pipe.Close()
+	client, err := shimrpc.NewClient(pipe)
+	if err != nil {
+		return err
+	}
+	return client.Call(method, params, result)
+}
+
+// takePooledVM takes a VM matching opts from the pool daemon for the VM host
+// container hostID, and records it as the host's VM. It returns nil if opts
+// cannot be pooled or the pool has no VM ready.
+func takePooledVM(pipePath string, hostID string, opts *uvm.UVMOptions) (*uvm.UtilityVM, error) {
+	profile, ok := uvmpool.ProfileOf(opts)
+	if !ok {
+		logrus.Debugf("the VM for %s does not match a pool profile", hostID)
+		return nil, nil
+	}
+	var pvm pooledVM
+	err := callPool(pipePath, poolMethodTake, &poolTakeRequest{Profile: profile, Host: hostID}, &pvm)
+	if shimrpc.IsCode(err, shimrpc.ErrorNotFound) {
+		logrus.Infof("no pooled VM is ready for %s", hostID)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if pvm.State == nil {
+		return nil, fmt.Errorf("pooled VM %s has no state", pvm.ID)
+	}
+	vm, err := uvm.Open(pvm.ID, pvm.State)
+	if err != nil {
+		return nil, err
+	}
+	pvm.State = nil
+	if err := stateKey.Set(hostID, keyPooledVM, &pvm); err != nil {
+		vm.Close()
+		return nil, err
+	}
+	logrus.Infof("took pooled VM %s for %s", pvm.ID, hostID)
+	return vm, nil
+}
+
+// hostPooledVM returns the record of the pooled VM of the host container
+// hostID, or nil if its VM was not taken from a pool.
+func hostPooledVM(hostID string) *pooledVM {
+	var pvm pooledVM
+	err := stateKey.Get(hostID, keyPooledVM, &pvm)
+	if err != nil {
+		if _, ok := err.(*regstate.NoStateError); !ok {
+			logrus.Warnf("failed to read pooled VM of %s: %s", hostID, err)
+		}
+		return nil
+	}
+	return &pvm
+}
+
+// hostVMID returns the ID of the compute system of the VM of the host
+// container hostID.
+func hostVMID(hostID string) string {
+	if pvm := hostPooledVM(hostID); pvm != nil {
+		return pvm.ID
+	}
+	return vmID(hostID)
+}
+
+// removePooledScratch removes the scratch folder of the pooled VM of the host
+// container hostID, once the VM is gone.
+func removePooledScratch(hostID string) {
+	pvm := hostPooledVM(hostID)
+	if pvm == nil || pvm.Scratch == "" {
+		return
+	}
+	if err := os.RemoveAll(pvm.Scratch); err != nil {
+		logrus.Warnf("failed to remove scratch folder of pooled VM %s: %s", pvm.ID, err)
+	}
+}
+
+// reapPooledVMs terminates the VMs of owner that a previous pool daemon left
+// running, and removes their scratch folders under scratchRoot. These are the
+// VMs that no host container records as its pooled VM: VMs that were idle
+// when the daemon exited, and VMs whose VM shim exited before recording them.
+// VMs handed out to host containers under another --root are not recorded
+// here, so a pool daemon serves a single root.
+func reapPooledVMs(owner, scratchRoot string) error {
+	systems, err := hcs.GetComputeSystems(schema1.ComputeSystemQuery{Owners: []string{owner}})
+	if err != nil {
+		return err
+	}
+	if len(systems) == 0 {
+		return nil
+	}
+	ids, err := stateKey.Enumerate()
+	if err != nil {
+		return err
+	}
+	inUse := make(map[string]bool)
+	for _, id := range ids {
+		if pvm := hostPooledVM(id); pvm != nil {
+			inUse[pvm.ID] = true
+		}
+	}
+	for _, s := range systems {
+		if inUse[s.ID] {
+			continue
+		}
+		logrus.Infof("terminating utility VM %s left by a previous pool daemon", s.ID)
+		if err := terminateComputeSystem(s.ID); err != nil {
+			logrus.Warnf("failed to terminate utility VM %s: %s", s.ID, err)
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(scratchRoot, s.ID)); err != nil {
+			logrus.Warnf("failed to remove scratch folder of utility VM %s: %s", s.ID, err)
+		}
+	}
+	return nil
+}
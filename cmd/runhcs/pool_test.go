@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/hcsshim/internal/uvmpool"
+)
+
+func TestParsePoolConfig(t *testing.T) {
+	config, err := parsePoolConfig([]byte(`{
+		"size": 2,
+		"maxAge": "90m",
+		"profiles": [
+			{"OperatingSystem": "linux", "MemorySizeInMB": 1024, "ProcessorCount": 2, "VPMemDeviceCount": 16},
+			{"OperatingSystem": "windows", "LayerFolders": ["c:\\layers\\base"], "MemorySizeInMB": 2048, "ProcessorCount": 1}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := uvmpool.Config{
+		Size:   2,
+		MaxAge: 90 * time.Minute,
+		Profiles: []uvmpool.Profile{
+			{OperatingSystem: "linux", MemorySizeInMB: 1024, ProcessorCount: 2, VPMemDeviceCount: 16},
+			{OperatingSystem: "windows", LayerFolders: []string{`c:\layers\base`}, MemorySizeInMB: 2048, ProcessorCount: 1},
+		},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Fatalf("got %+v, expected %+v", config, expected)
+	}
+
+	for _, bad := range []string{
+		`{"size": -1}`,
+		`{"size": 1, "maxAge": "soon"}`,
+		`{"size": 1, "profiles": [{"OperatingSystem": "plan9", "MemorySizeInMB": 1024, "ProcessorCount": 1}]}`,
+		`{"size": 1, "profiles": [{"OperatingSystem": "windows", "MemorySizeInMB": 1024, "ProcessorCount": 1}]}`,
+		`{"size": 1, "profiles": [{"OperatingSystem": "linux"}]}`,
+	} {
+		if _, err := parsePoolConfig([]byte(bad)); err == nil {
+			t.Errorf("expected error for %s", bad)
+		}
+	}
+}
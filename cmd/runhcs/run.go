@@ -37,18 +37,24 @@ command(s) that get executed on start, edit the args parameter of the spec. See
 		if err != nil {
 			return err
 		}
-		c, err := createContainer(cfg)
+		unlock, err := lockContainer(cfg.ID)
 		if err != nil {
 			return err
 		}
+		c, err := createContainer(cfg)
 		if err != nil {
+			unlock()
 			return err
 		}
 		p, err := os.FindProcess(c.ShimPid)
 		if err != nil {
+			unlock()
 			return err
 		}
 		err = c.Exec()
+		// Release the lock before waiting so that the shim can record its
+		// exit.
+		unlock()
 		if err != nil {
 			return err
 		}
@@ -57,7 +63,12 @@ command(s) that get executed on start, edit the args parameter of the spec. See
 			if err != nil {
 				return err
 			}
+			unlock, err = lockContainer(c.ID)
+			if err != nil {
+				return err
+			}
 			c.Remove()
+			unlock()
 			os.Exit(int(state.Sys().(syscall.WaitStatus).ExitCode))
 		}
 		return nil
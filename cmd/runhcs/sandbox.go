@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Microsoft/hcsshim/internal/regstate"
+	"github.com/sirupsen/logrus"
+)
+
+// A sandbox is a container that other containers, its members, are created
+// into. The members share the sandbox's VM and network namespace. The
+// sandbox records its members so that killing or deleting it applies to them
+// as well. Once the sandbox is stopped, no more members can join it.
+
+const keySandbox = "sandbox"
+
+// sandboxState is the membership of a sandbox.
+type sandboxState struct {
+	Members []string `json:"members,omitempty"`
+	// Stopped is set when the sandbox is being killed or deleted.
+	Stopped bool `json:"stopped,omitempty"`
+}
+
+type sandboxStoppedError struct {
+	ID string
+}
+
+func (err *sandboxStoppedError) Error() string {
+	return fmt.Sprintf("sandbox %s is stopped", err.ID)
+}
+
+// sandboxMembersLock is the ID of the lock guarding a sandbox's membership.
+// It is separate from the container's lock so that members can join and leave
+// while a command holds the sandbox's lock.
+func sandboxMembersLock(id string) string {
+	return id + "@members"
+}
+
+func getSandboxState(s regstate.Store, id string) (*sandboxState, error) {
+	state := &sandboxState{}
+	err := s.Get(id, keySandbox, state)
+	if _, ok := err.(*regstate.NoStateError); ok {
+		err = nil
+	}
+	return state, err
+}
+
+// updateSandbox applies f to the membership of sandbox id under the
+// membership lock.
+func updateSandbox(s regstate.Store, id string, f func(state *sandboxState) error) error {
+	l, err := s.Lock(sandboxMembersLock(id), containerLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+	state, err := getSandboxState(s, id)
+	if err != nil {
+		return err
+	}
+	if err := f(state); err != nil {
+		return err
+	}
+	return s.Set(id, keySandbox, state)
+}
+
+// joinSandbox adds the container id to the members of sandbox sandboxID. It
+// fails if the sandbox has stopped.
+func joinSandbox(s regstate.Store, sandboxID, id string) error {
+	return updateSandbox(s, sandboxID, func(state *sandboxState) error {
+		var shimPid int
+		err := s.Get(sandboxID, keyShimPid, &shimPid)
+		if err == nil && shimPid == 0 {
+			state.Stopped = true
+		} else if _, ok := err.(*regstate.NoStateError); err != nil && !ok {
+			return err
+		}
+		if state.Stopped {
+			return &sandboxStoppedError{sandboxID}
+		}
+		for _, m := range state.Members {
+			if m == id {
+				return nil
+			}
+		}
+		state.Members = append(state.Members, id)
+		return nil
+	})
+}
+
+// leaveSandbox removes the container id from the members of sandbox
+// sandboxID. It succeeds if the sandbox has already been removed.
+func leaveSandbox(s regstate.Store, sandboxID, id string) error {
+	err := updateSandbox(s, sandboxID, func(state *sandboxState) error {
+		for i, m := range state.Members {
+			if m == id {
+				state.Members = append(state.Members[:i], state.Members[i+1:]...)
+				break
+			}
+		}
+		return nil
+	})
+	if _, ok := err.(*regstate.NotFoundError); ok {
+		err = nil
+	}
+	return err
+}
+
+// stopSandbox marks sandbox id as stopped so that no more members can join
+// it, and returns its members.
+func stopSandbox(s regstate.Store, id string) ([]string, error) {
+	var members []string
+	err := updateSandbox(s, id, func(state *sandboxState) error {
+		state.Stopped = true
+		members = append(members, state.Members...)
+		return nil
+	})
+	return members, err
+}
+
+// isSandbox returns whether the container is a sandbox.
+func (c *container) isSandbox() bool {
+	return c.SandboxID == c.ID
+}
+
+// isSandboxMember returns whether the container was created in a sandbox.
+func (c *container) isSandboxMember() bool {
+	return c.SandboxID != "" && c.SandboxID != c.ID
+}
+
+// killSandboxMembers stops sandbox id and kills the init process of each of
+// its running members. Failures are logged rather than returned so that the
+// sandbox itself is still killed.
+func killSandboxMembers(id string) error {
+	members, err := stopSandbox(stateKey, id)
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		if err := killMember(m); err != nil {
+			logrus.Warnf("failed to kill container %s in sandbox %s: %s", m, id, err)
+		}
+	}
+	return nil
+}
+
+func killMember(id string) error {
+	unlock, err := lockContainer(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	c, err := getContainer(id, false)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	status, err := c.Status()
+	if err != nil {
+		return err
+	}
+	if status != containerRunning {
+		return nil
+	}
+	return c.killInit()
+}
+
+// deleteSandboxMembers stops sandbox id and deletes each of its members. If
+// force is not set, it fails at the first member that is still running.
+func deleteSandboxMembers(id string, force bool) error {
+	members, err := stopSandbox(stateKey, id)
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		if err := deleteMember(id, m, force); err != nil {
+			return fmt.Errorf("deleting container %s in sandbox %s: %s", m, id, err)
+		}
+	}
+	return nil
+}
+
+func deleteMember(sandboxID, id string, force bool) error {
+	unlock, err := lockContainer(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	c, err := getContainer(id, false)
+	if err != nil {
+		switch err.(type) {
+		case *regstate.NotFoundError, *regstate.NoStateError:
+			// The member was removed without leaving the sandbox.
+			stateKey.Remove(id)
+			return leaveSandbox(stateKey, sandboxID, id)
+		}
+		return err
+	}
+	defer c.Close()
+	status, err := c.Status()
+	if err != nil {
+		return err
+	}
+	switch status {
+	case containerStopped:
+	case containerCreated:
+		err = c.Kill()
+	default:
+		if !force {
+			return fmt.Errorf("container is not stopped: %s", status)
+		}
+		err = c.Kill()
+	}
+	if err != nil {
+		return err
+	}
+	return c.Remove()
+}
+
+// sandboxNetNS returns the network namespace of sandbox id: the one it is
+// using if it has been created, or else the one it requested.
+func sandboxNetNS(id string) (string, error) {
+	var netNS string
+	err := stateKey.Get(id, keyNetNS, &netNS)
+	if err == nil {
+		return netNS, nil
+	}
+	if _, ok := err.(*regstate.NoStateError); !ok {
+		return "", err
+	}
+	var state persistedState
+	err = stateKey.Get(id, keyState, &state)
+	if err != nil {
+		return "", err
+	}
+	return state.RequestedNetNS, nil
+}
+
+// sandboxMembers returns the members of the container if it is a sandbox.
+func (c *container) sandboxMembers() []string {
+	if !c.isSandbox() {
+		return nil
+	}
+	state, err := getSandboxState(stateKey, c.ID)
+	if err != nil {
+		logrus.Warnf("reading members of sandbox %s: %s", c.ID, err)
+		return nil
+	}
+	return state.Members
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/internal/regstate"
+)
+
+func newTestStore(t *testing.T) (regstate.Store, func()) {
+	dir, err := ioutil.TempDir("", "runhcs-sandbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := regstate.OpenFile(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func checkMembers(t *testing.T, s regstate.Store, id string, expected []string) {
+	state, err := getSandboxState(s, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(state.Members, expected) {
+		t.Fatalf("got members %v, expected %v", state.Members, expected)
+	}
+}
+
+func TestSandboxMembership(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+	if err := s.Create("pod", keyState, &persistedState{ID: "pod", SandboxID: "pod"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The sandbox's shim has not been started yet.
+	if err := joinSandbox(s, "pod", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("pod", keyShimPid, 10); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"b", "c", "b"} {
+		if err := joinSandbox(s, "pod", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkMembers(t, s, "pod", []string{"a", "b", "c"})
+
+	if err := leaveSandbox(s, "pod", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := leaveSandbox(s, "pod", "other"); err != nil {
+		t.Fatal(err)
+	}
+	checkMembers(t, s, "pod", []string{"a", "c"})
+
+	members, err := stopSandbox(s, "pod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(members, []string{"a", "c"}) {
+		t.Fatal("wrong members", members)
+	}
+	if _, ok := joinSandbox(s, "pod", "d").(*sandboxStoppedError); !ok {
+		t.Fatal("expected join of stopped sandbox to fail")
+	}
+
+	// Members can still leave once the sandbox is stopped.
+	if err := leaveSandbox(s, "pod", "a"); err != nil {
+		t.Fatal(err)
+	}
+	checkMembers(t, s, "pod", []string{"c"})
+}
+
+func TestJoinExitedSandbox(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+	if err := s.Create("pod", keyState, &persistedState{ID: "pod", SandboxID: "pod"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("pod", keyShimPid, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := joinSandbox(s, "pod", "a").(*sandboxStoppedError); !ok {
+		t.Fatal("expected join of exited sandbox to fail")
+	}
+	checkMembers(t, s, "pod", nil)
+}
+
+func TestLeaveRemovedSandbox(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+	if err := leaveSandbox(s, "gone", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := joinSandbox(s, "gone", "a"); err == nil {
+		t.Fatal("expected join of missing sandbox to fail")
+	}
+}
@@ -12,15 +12,26 @@ import (
 
 	winio "github.com/Microsoft/go-winio"
 	"github.com/Microsoft/hcsshim/internal/appargs"
+	"github.com/Microsoft/hcsshim/internal/consolesocket"
+	"github.com/Microsoft/hcsshim/internal/guid"
 	"github.com/Microsoft/hcsshim/internal/hcs"
 	"github.com/Microsoft/hcsshim/internal/schema2"
 	"github.com/Microsoft/hcsshim/internal/schemaversion"
+	"github.com/Microsoft/hcsshim/internal/shimrpc"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 	"golang.org/x/sys/windows"
 )
 
+// shimMethodStart is the request sent to a container's shim to start the init
+// process.
+const shimMethodStart = "start"
+
+// consoleAcceptTimeout is how long a shim waits for the receiver of a console
+// to connect to the console's pipe.
+const consoleAcceptTimeout = time.Minute
+
 func containerPipePath(id string) string {
 	return safePipePath("runhcs-shim-" + id)
 }
@@ -42,11 +53,12 @@ var shimCommand = cli.Command{
 		&cli.IntFlag{Name: "stdout", Hidden: true},
 		&cli.IntFlag{Name: "stderr", Hidden: true},
 		&cli.BoolFlag{Name: "exec", Hidden: true},
+		&cli.StringFlag{Name: "console-socket", Hidden: true},
 	},
 	Before: appargs.Validate(argID),
 	Action: func(context *cli.Context) error {
 		logrus.SetOutput(os.Stderr)
-		fatalWriter.Writer = os.Stdout
+		fatalWriter.Writer = shimrpc.ErrorWriter(os.Stdout, 0)
 
 		id := context.Args().First()
 		c, err := getContainer(id, true)
@@ -56,21 +68,52 @@ var shimCommand = cli.Command{
 
 		// Asynchronously wait for the container to exit.
 		containerExitCh := make(chan error)
+		containerExited := make(chan struct{})
 		go func() {
-			containerExitCh <- c.hc.Wait()
+			err := c.hc.Wait()
+			close(containerExited)
+			containerExitCh <- err
 		}()
 
-		// Get File objects for the open stdio files passed in as arguments.
-		stdin := newFile(context, "stdin")
-		stdout := newFile(context, "stdout")
-		stderr := newFile(context, "stderr")
+		// Get the process's stdio from the open stdio files passed in as
+		// arguments, or else from a console pipe sent to the console socket.
+		var (
+			stdin          io.Reader
+			stdout, stderr io.WriteCloser
+			console        net.Listener
+		)
+		if socket := context.String("console-socket"); socket != "" {
+			console, err = sendConsole(socket)
+			if err != nil {
+				return err
+			}
+			defer console.Close()
+		} else {
+			if f := newFile(context, "stdin"); f != nil {
+				stdin = f
+			}
+			if f := newFile(context, "stdout"); f != nil {
+				stdout = f
+			}
+			if f := newFile(context, "stderr"); f != nil {
+				stderr = f
+			}
+		}
 
 		exec := context.Bool("exec")
 		terminateOnFailure := false
 
-		errorOut := io.WriteCloser(os.Stdout)
+		// reportSuccess tells whoever is waiting for the process that it
+		// was launched.
+		reportSuccess := func() {
+			shimrpc.WriteResult(os.Stdout, nil)
+			os.Stdout.Close()
+		}
 
-		var spec *specs.Process
+		var (
+			spec *specs.Process
+			exit *exitStatus
+		)
 
 		if exec {
 			// Read the process spec from stdin.
@@ -98,12 +141,23 @@ var shimCommand = cli.Command{
 
 			// Alert the parent process that initialization has completed
 			// successfully.
-			errorOut.Write(shimSuccess)
-			errorOut.Close()
+			reportSuccess()
 			fatalWriter.Writer = ioutil.Discard
 
-			// When this process exits, clear this process's pid in the registry.
+			// When this process exits, record how the init process exited and
+			// clear this process's pid in the registry.
 			defer func() {
+				unlock, err := lockContainer(id)
+				if err != nil {
+					logrus.Error(err)
+				} else {
+					defer unlock()
+				}
+				if exit != nil {
+					if err := stateKey.Set(id, keyExit, exit); err != nil {
+						logrus.Error(err)
+					}
+				}
 				stateKey.Set(id, keyShimPid, 0)
 			}()
 
@@ -138,9 +192,23 @@ var shimCommand = cli.Command{
 				return cli.NewExitError("", 1)
 			}
 
-			// The next set of errors goes to the open pipe connection.
-			errorOut = pipe
-			fatalWriter.Writer = pipe
+			// Wait for the request to start the process. The next set of
+			// errors goes to the open pipe connection as the response to it.
+			sc := shimrpc.NewServerConn(pipe, []string{shimMethodStart})
+			req, err := sc.ReadRequest()
+			if err != nil {
+				return err
+			}
+			if req.Method != shimMethodStart {
+				err = shimrpc.Errorf(shimrpc.ErrorMethodNotFound, "unknown method %s", req.Method)
+				sc.Reply(req.ID, nil, err)
+				return err
+			}
+			reportSuccess = func() {
+				sc.Reply(req.ID, nil, nil)
+				pipe.Close()
+			}
+			fatalWriter.Writer = shimrpc.ErrorWriter(pipe, req.ID)
 
 			// The process spec comes from the original container spec.
 			spec = c.Spec.Process
@@ -179,6 +247,15 @@ var shimCommand = cli.Command{
 			}
 		}
 
+		if console != nil {
+			// Wait for the receiver of the console to connect to it.
+			conn, err := consolesocket.Accept(console, consoleAcceptTimeout)
+			if err != nil {
+				return err
+			}
+			stdin, stdout = conn, conn
+		}
+
 		pc.CreateStdInPipe = stdin != nil
 		pc.CreateStdOutPipe = stdout != nil
 		pc.CreateStdErrPipe = stderr != nil
@@ -204,8 +281,7 @@ var shimCommand = cli.Command{
 
 		// Alert the connected process that the process was launched
 		// successfully.
-		errorOut.Write(shimSuccess)
-		errorOut.Close()
+		reportSuccess()
 		fatalWriter.Writer = ioutil.Discard
 
 		// Relay stdio.
@@ -238,12 +314,12 @@ var shimCommand = cli.Command{
 			}()
 		}
 
-		err = p.Wait()
+		waitErr := p.Wait()
 		wg.Wait()
 
 		// Attempt to get the exit code from the process.
 		code := 1
-		if err == nil {
+		if waitErr == nil {
 			code, err = p.ExitCode()
 			if err != nil {
 				code = 1
@@ -251,6 +327,18 @@ var shimCommand = cli.Command{
 		}
 
 		if !exec {
+			stopped := false
+			select {
+			case <-containerExited:
+				stopped = true
+			default:
+			}
+			exit = &exitStatus{
+				Code:   code,
+				Time:   time.Now(),
+				Reason: c.exitReason(waitErr, stopped),
+			}
+
 			// Shutdown the container, waiting 5 minutes before terminating is
 			// forcefully.
 			const shutdownTimeout = time.Minute * 5
@@ -281,3 +369,68 @@ var shimCommand = cli.Command{
 		return cli.NewExitError("", code)
 	},
 }
+
+// sendConsole creates a named pipe for a process's console and sends its path
+// to the console socket.
+func sendConsole(socket string) (net.Listener, error) {
+	path := safePipePath("runhcs-console-" + guid.New().String())
+	l, err := winio.ListenPipe(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = consolesocket.Send(socket, &consolesocket.Message{
+		Version: consolesocket.Version,
+		Pipe:    path,
+	})
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// exitReason works out why the container's init process exited. waitErr is
+// the result of waiting for the process, and stopped is whether the container
+// stopped before the shim shut it down.
+func (c *container) exitReason(waitErr error, stopped bool) exitReason {
+	var killed bool
+	if err := stateKey.Get(c.ID, keyKilled, &killed); err != nil {
+		killed = false
+	}
+	vmUp := true
+	if (waitErr != nil || stopped) && c.HostID != "" {
+		vmUp = vmRunning(c.HostID)
+	}
+	return exitReasonFor(waitErr, stopped, killed, vmUp)
+}
+
+// exitReasonFor returns the reason an init process exited. killed is whether
+// the kill command was used on the container, and vmUp whether the VM hosting
+// it, if any, is still running.
+func exitReasonFor(waitErr error, stopped, killed, vmUp bool) exitReason {
+	if waitErr == nil && !stopped {
+		if killed {
+			return exitKilled
+		}
+		return exitNormal
+	}
+	if !vmUp {
+		return exitVMCrashed
+	}
+	return exitTerminated
+}
+
+// vmRunning returns whether the VM for hostID is still running. It errs
+// towards reporting the VM as running when its state cannot be determined.
+func vmRunning(hostID string) bool {
+	vm, err := hcs.OpenComputeSystem(hostVMID(hostID))
+	if err != nil {
+		return !hcs.IsNotExist(err)
+	}
+	defer vm.Close()
+	props, err := vm.Properties()
+	if err != nil {
+		return true
+	}
+	return props.State != "Stopped"
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestExitReasonFor(t *testing.T) {
+	waitErr := errors.New("wait failed")
+	tests := []struct {
+		waitErr error
+		stopped bool
+		killed  bool
+		vmUp    bool
+		reason  exitReason
+	}{
+		{nil, false, false, true, exitNormal},
+		{nil, false, true, true, exitKilled},
+		// A VM that is down only matters if the process did not exit on
+		// its own.
+		{nil, false, false, false, exitNormal},
+		{nil, true, false, true, exitTerminated},
+		{nil, true, true, true, exitTerminated},
+		{waitErr, false, false, true, exitTerminated},
+		{waitErr, false, false, false, exitVMCrashed},
+		{nil, true, true, false, exitVMCrashed},
+	}
+	for i, test := range tests {
+		reason := exitReasonFor(test.waitErr, test.stopped, test.killed, test.vmUp)
+		if reason != test.reason {
+			t.Errorf("%d: got %s, expected %s", i, reason, test.reason)
+		}
+	}
+}
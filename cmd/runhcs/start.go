@@ -20,6 +20,11 @@ your host.`,
 	Before:      appargs.Validate(argID),
 	Action: func(context *cli.Context) error {
 		id := context.Args().First()
+		unlock, err := lockContainer(id)
+		if err != nil {
+			return err
+		}
+		defer unlock()
 		container, err := getContainer(id, false)
 		if err != nil {
 			return err
@@ -27,17 +27,7 @@ instance of a container.`,
 		if err != nil {
 			return err
 		}
-		cs := containerState{
-			Version:        c.Spec.Version,
-			ID:             c.ID,
-			InitProcessPid: c.ShimPid,
-			Status:         string(status),
-			Bundle:         c.Bundle,
-			Rootfs:         c.Rootfs,
-			Created:        c.Created,
-			Annotations:    c.Spec.Annotations,
-		}
-		data, err := json.MarshalIndent(cs, "", "  ")
+		data, err := json.MarshalIndent(c.state(status), "", "  ")
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestContainerStateExit(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+	spec := &specs.Spec{Version: specs.Version}
+	for _, id := range []string{"exited", "running"} {
+		if err := s.Create(id, keyState, &persistedState{ID: id, Spec: spec}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exitTime := time.Date(2018, 7, 1, 12, 30, 0, 0, time.UTC)
+	if err := s.Set("exited", keyShimPid, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("exited", keyExit, &exitStatus{Code: 137, Time: exitTime, Reason: exitKilled}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("running", keyShimPid, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read the state back as a restarted runtime would, through the JSON
+	// output of the state and list commands.
+	read := func(id string, status containerStatus) *containerState {
+		c, err := readContainer(s, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := json.Marshal(c.state(status))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cs containerState
+		if err := json.Unmarshal(b, &cs); err != nil {
+			t.Fatal(err)
+		}
+		return &cs
+	}
+
+	cs := read("exited", containerStopped)
+	if cs.ID != "exited" || cs.Status != string(containerStopped) || cs.InitProcessPid != 0 {
+		t.Fatalf("wrong state %+v", cs)
+	}
+	if cs.Exit == nil {
+		t.Fatal("exit status was not reported")
+	}
+	if cs.Exit.Code != 137 || cs.Exit.Reason != exitKilled || !cs.Exit.Time.Equal(exitTime) {
+		t.Fatalf("got exit status %+v", cs.Exit)
+	}
+
+	cs = read("running", containerRunning)
+	if cs.Exit != nil {
+		t.Fatalf("got exit status %+v for a running container", cs.Exit)
+	}
+}
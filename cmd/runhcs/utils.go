@@ -10,6 +10,8 @@ import (
 	"github.com/Microsoft/hcsshim/internal/appargs"
 )
 
+// shimSuccess is the reply to a successful request in the protocol used by
+// shims that predate shimrpc.
 var shimSuccess = []byte{0, 'O', 'K', 0}
 
 var argID = appargs.NonEmptyString
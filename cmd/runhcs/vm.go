@@ -1,24 +1,44 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	winio "github.com/Microsoft/go-winio"
 	"github.com/Microsoft/hcsshim/internal/appargs"
+	"github.com/Microsoft/hcsshim/internal/hcs"
+	"github.com/Microsoft/hcsshim/internal/hcsoci"
+	"github.com/Microsoft/hcsshim/internal/regstate"
+	"github.com/Microsoft/hcsshim/internal/shimrpc"
 	"github.com/Microsoft/hcsshim/internal/uvm"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
 
+// vmShutdownTimeout is how long the VM shim waits for the VM to shut down
+// gracefully before terminating it.
+const vmShutdownTimeout = time.Minute * 2
+
 func vmID(id string) string {
 	return id + "@vm"
 }
 
+// vmHostID returns the ID of the container that hosts the VM vmid.
+func vmHostID(vmid string) string {
+	return strings.TrimSuffix(vmid, "@vm")
+}
+
 var vmshimCommand = cli.Command{
 	Name:   "vmshim",
 	Usage:  `launch a VM and containers inside it (do not call it outside of runhcs)`,
@@ -27,7 +47,7 @@ var vmshimCommand = cli.Command{
 	Before: appargs.Validate(argID),
 	Action: func(context *cli.Context) error {
 		logrus.SetOutput(os.Stderr)
-		fatalWriter.Writer = os.Stdout
+		fatalWriter.Writer = shimrpc.ErrorWriter(os.Stdout, 0)
 
 		pipePath := context.Args().First()
 
@@ -49,22 +69,44 @@ var vmshimCommand = cli.Command{
 			return err
 		}
 
-		vm, err := startVM(opts)
+		hostID := vmHostID(opts.ID)
+		vm, takenOver, err := openOrStartVM(hostID, opts)
 		if err != nil {
 			return err
 		}
 
+		// Save the VM's size before it is grown for workload containers,
+		// or restore the size the previous VM shim saved.
+		base := currentSize(vm)
+		if takenOver {
+			if err := stateKey.Get(hostID, keyVMBase, &base); err != nil {
+				logrus.Warnf("failed to read the base size of VM %s, using its current size: %s", vm.ID(), err)
+			}
+		} else if err := stateKey.Set(hostID, keyVMBase, &base); err != nil {
+			logrus.Warnf("failed to save the base size of VM %s: %s", vm.ID(), err)
+		}
+
 		// Asynchronously wait for the VM to exit.
-		exitCh := make(chan error)
+		s := &vmShim{
+			vm:         vm,
+			hostID:     hostID,
+			growth:     newVMGrowthPolicy(vm, base),
+			containers: make(map[string]*hostedContainer),
+			exited:     make(chan struct{}),
+		}
+		if takenOver {
+			s.adoptContainers()
+		}
 		go func() {
-			exitCh <- vm.Wait()
+			vm.Wait()
+			close(s.exited)
 		}()
 
 		defer vm.Terminate()
 
 		// Alert the parent process that initialization has completed
 		// successfully.
-		os.Stdout.Write(shimSuccess)
+		shimrpc.WriteResult(os.Stdout, nil)
 		os.Stdout.Close()
 		fatalWriter.Writer = ioutil.Discard
 
@@ -82,26 +124,18 @@ var vmshimCommand = cli.Command{
 
 		for {
 			select {
-			case <-exitCh:
+			case <-s.exited:
 				return nil
 			case pipe := <-pipeCh:
-				err = processRequest(vm, pipe)
-				if err == nil {
-					_, err = pipe.Write(shimSuccess)
-					// Wait until the pipe is closed before closing the
-					// container so that it is properly handed off to the other
-					// process.
-					if err == nil {
-						err = closeWritePipe(pipe)
-					}
-					if err == nil {
-						ioutil.ReadAll(pipe)
+				// Serve each connection separately so that a long running
+				// exec does not hold up other requests.
+				go func() {
+					err := s.serveConn(pipe)
+					if err != nil {
+						logrus.Error(err)
 					}
-				} else {
-					logrus.Error("failed creating container in VM: ", err)
-					fmt.Fprintf(pipe, "%v", err)
-				}
-				pipe.Close()
+					pipe.Close()
+				}()
 			}
 		}
 	},
@@ -113,11 +147,143 @@ const (
 	opCreateContainer          vmRequestOp = "create"
 	opUnmountContainer         vmRequestOp = "unmount"
 	opUnmountContainerDiskOnly vmRequestOp = "unmount-disk"
+	opListContainers           vmRequestOp = "list"
+	opGetResources             vmRequestOp = "resources"
+	opAddMount                 vmRequestOp = "add-mount"
+	opRemoveMount              vmRequestOp = "remove-mount"
+	opShutdownVM               vmRequestOp = "shutdown"
+	opExecInVM                 vmRequestOp = "exec"
 )
 
+// vmRequestOps are the operations supported by the VM shim.
+var vmRequestOps = []vmRequestOp{
+	opCreateContainer,
+	opUnmountContainer,
+	opUnmountContainerDiskOnly,
+	opListContainers,
+	opGetResources,
+	opAddMount,
+	opRemoveMount,
+	opShutdownVM,
+	opExecInVM,
+}
+
 type vmRequest struct {
-	ID string
-	Op vmRequestOp
+	ID    string
+	Op    vmRequestOp
+	Mount *specs.Mount `json:",omitempty"`
+	Exec  *vmExec      `json:",omitempty"`
+}
+
+// hostedContainer is the result of the list operation for each container
+// created in the VM that has not yet been removed.
+type hostedContainer struct {
+	ID      string `json:"id"`
+	Running bool   `json:"running"`
+}
+
+// vmShim is the state of the VM shim process.
+type vmShim struct {
+	vm     *uvm.UtilityVM
+	hostID string // The container whose state records the VM's state
+	exited chan struct{}
+	growth *vmGrowthPolicy // Guarded by requestM
+	// requestM serializes requests other than exec.
+	requestM   sync.Mutex
+	m          sync.Mutex
+	containers map[string]*hostedContainer
+}
+
+// openOrStartVM returns the VM described by opts for the container hostID,
+// and whether it was taken over. If a previous VM shim saved the state of the
+// VM and it is still running, the VM is taken over rather than a new one
+// started.
+func openOrStartVM(hostID string, opts *uvm.UVMOptions) (*uvm.UtilityVM, bool, error) {
+	var state uvm.State
+	err := stateKey.Get(hostID, keyVMState, &state)
+	if err == nil {
+		id := hostVMID(hostID)
+		vm, err := uvm.Open(id, &state)
+		if err == nil {
+			logrus.Infof("took over running VM %s", id)
+			return vm, true, nil
+		}
+		if !hcs.IsNotExist(err) {
+			return nil, false, err
+		}
+	} else if _, ok := err.(*regstate.NoStateError); !ok {
+		return nil, false, err
+	}
+	var vm *uvm.UtilityVM
+	if vmPoolPipe != "" {
+		vm, err = takePooledVM(vmPoolPipe, hostID, opts)
+		if err != nil {
+			logrus.Warnf("failed to take a VM from the pool for %s: %s", hostID, err)
+		}
+	}
+	if vm == nil {
+		vm, err = startVM(opts)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	err = stateKey.Set(hostID, keyVMState, vm.State())
+	if err != nil {
+		vm.Close()
+		return nil, false, err
+	}
+	return vm, false, nil
+}
+
+// adoptContainers records the containers that the previous VM shim of a
+// taken over VM created in it, from the state of the containers whose host
+// is the VM, and releases the allocations it left pending in their journals.
+// The VM's references to shares are those saved when its last request
+// finished, so this must be done before serving requests for the pending
+// shares to be reconciled against them.
+func (s *vmShim) adoptContainers() {
+	ids, err := stateKey.Enumerate()
+	if err != nil {
+		logrus.Warnf("failed to enumerate the containers of VM %s: %s", s.vm.ID(), err)
+		return
+	}
+	for _, id := range ids {
+		c, err := getContainer(id, false)
+		if err != nil {
+			continue
+		}
+		if c.HostID != s.hostID {
+			c.Close()
+			continue
+		}
+		journal, err := openJournal(id)
+		if err != nil {
+			logrus.Warnf("failed to open the journal of container %s: %s", id, err)
+		} else {
+			hcsoci.ReplayJournal(journal, hcsoci.NewReleaser(s.vm))
+		}
+		if c.ID != s.hostID {
+			if l := limitsOf(c.Spec); l != (containerLimits{}) {
+				s.growth.adopt(c.ID, l)
+			}
+		}
+		hc := &hostedContainer{ID: c.ID}
+		s.containers[c.ID] = hc
+		if c.hc == nil {
+			continue
+		}
+		hc.Running = true
+		go func() {
+			c.hc.Wait()
+			c.Close()
+			s.m.Lock()
+			hc.Running = false
+			s.m.Unlock()
+		}()
+	}
+	if err := stateKey.Set(s.hostID, keyVMState, s.vm.State()); err != nil {
+		logrus.Warnf("failed to save state of VM %s: %s", s.vm.ID(), err)
+	}
 }
 
 func startVM(opts *uvm.UVMOptions) (*uvm.UtilityVM, error) {
@@ -133,16 +299,107 @@ func startVM(opts *uvm.UVMOptions) (*uvm.UtilityVM, error) {
 	return vm, nil
 }
 
-func processRequest(vm *uvm.UtilityVM, pipe net.Conn) error {
+// serveConn serves requests on a connection to the VM shim. Connections from
+// runhcs versions that predate shimrpc send a single bare JSON request, which
+// is answered in the old protocol.
+func (s *vmShim) serveConn(pipe net.Conn) error {
+	br := bufio.NewReader(pipe)
+	first, err := br.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	if !shimrpc.IsLegacyRequest(first[0]) {
+		return shimrpc.Serve(struct {
+			io.Reader
+			io.Writer
+		}{br, pipe}, s.handlers())
+	}
+
 	var req vmRequest
-	err := json.NewDecoder(pipe).Decode(&req)
+	err = json.NewDecoder(br).Decode(&req)
 	if err != nil {
 		return err
 	}
+	_, err = s.processRequest(&req)
+	if err != nil {
+		logrus.Error("failed processing request in VM: ", err)
+		fmt.Fprintf(pipe, "%v", err)
+		return nil
+	}
+	_, err = pipe.Write(shimSuccess)
+	// Wait until the pipe is closed before closing the container so that it
+	// is properly handed off to the other process.
+	if err == nil {
+		err = closeWritePipe(pipe)
+	}
+	if err == nil {
+		ioutil.ReadAll(pipe)
+	}
+	return err
+}
+
+// handlers returns the shimrpc handlers for the VM shim's operations. Each
+// takes a vmRequest as its parameters.
+func (s *vmShim) handlers() map[string]shimrpc.Handler {
+	handlers := make(map[string]shimrpc.Handler)
+	for _, op := range vmRequestOps {
+		op := op
+		handlers[string(op)] = func(params json.RawMessage) (interface{}, error) {
+			var req vmRequest
+			if err := json.Unmarshal(params, &req); err != nil {
+				return nil, shimrpc.Errorf(shimrpc.ErrorInvalidParams, "%s", err)
+			}
+			req.Op = op
+			result, err := s.processRequest(&req)
+			if _, ok := err.(*regstate.NotFoundError); ok {
+				return nil, shimrpc.Errorf(shimrpc.ErrorNotFound, "%s", err)
+			}
+			return result, err
+		}
+	}
+	return handlers
+}
+
+// processRequest handles a request from a runhcs command. The command holds
+// the container's lock for the duration of requests that modify the
+// container.
+func (s *vmShim) processRequest(req *vmRequest) (interface{}, error) {
 	logrus.Debug("received operation ", req.Op, " for ", req.ID)
+	if req.Op == opExecInVM {
+		if req.Exec == nil || req.Exec.Process == nil {
+			return nil, shimrpc.Errorf(shimrpc.ErrorInvalidParams, "no process specified")
+		}
+		return s.exec(req.Exec)
+	}
+
+	s.requestM.Lock()
+	defer s.requestM.Unlock()
+
+	// These operations act on the VM rather than on a container.
+	switch req.Op {
+	case opListContainers:
+		return s.list(), nil
+	case opGetResources:
+		return s.vm.Allocation(), nil
+	case opShutdownVM:
+		return nil, s.shutdown(req.ID)
+	}
+
+	// The remaining operations change what is attached to the VM. Save the
+	// VM's state afterwards, even on failure, so that a restarted VM shim can
+	// take over the VM.
+	defer func() {
+		if err := stateKey.Set(s.hostID, keyVMState, s.vm.State()); err != nil {
+			logrus.Warnf("failed to save state of VM %s: %s", s.vm.ID(), err)
+		}
+	}()
+
 	c, err := getContainer(req.ID, false)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer func() {
 		if c != nil {
@@ -151,28 +408,102 @@ func processRequest(vm *uvm.UtilityVM, pipe net.Conn) error {
 	}()
 	switch req.Op {
 	case opCreateContainer:
-		err = createContainerInHost(c, vm)
+		s.growForContainer(c)
+		err = createContainerInHost(c, s.vm)
 		if err != nil {
-			return err
+			s.growth.remove(c.ID)
+			return nil, err
 		}
+		hc := &hostedContainer{ID: c.ID, Running: true}
+		s.m.Lock()
+		s.containers[c.ID] = hc
+		s.m.Unlock()
 		c2 := c
 		c = nil
 		go func() {
 			c2.hc.Wait()
 			c2.Close()
+			s.m.Lock()
+			hc.Running = false
+			s.m.Unlock()
 		}()
-		c = nil
 
 	case opUnmountContainer, opUnmountContainerDiskOnly:
-		err = c.unmountInHost(vm, req.Op == opUnmountContainer)
+		err = c.unmountInHost(s.vm, req.Op == opUnmountContainer)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if req.Op == opUnmountContainer {
+			s.growth.remove(c.ID)
+			s.m.Lock()
+			delete(s.containers, c.ID)
+			s.m.Unlock()
+		}
+
+	case opAddMount, opRemoveMount:
+		if req.Mount == nil {
+			return nil, shimrpc.Errorf(shimrpc.ErrorInvalidParams, "no mount specified")
+		}
+		if c.hc == nil {
+			return nil, errContainerStopped
+		}
+		if req.Op == opAddMount {
+			err = c.addMountInHost(s.vm, req.Mount)
+		} else {
+			err = c.removeMountInHost(s.vm, req.Mount.Destination)
+		}
+		if err != nil {
+			return nil, err
 		}
 
 	default:
-		panic("unknown operation")
+		return nil, fmt.Errorf("unknown operation %s", req.Op)
+	}
+	return nil, nil
+}
+
+// list returns the containers hosted in the VM, sorted by ID.
+func (s *vmShim) list() []hostedContainer {
+	s.m.Lock()
+	defer s.m.Unlock()
+	list := make([]hostedContainer, 0, len(s.containers))
+	for _, hc := range s.containers {
+		list = append(list, *hc)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// shutdown shuts down the VM on behalf of the container id, which is being
+// removed, terminating it if it does not shut down in time. Once the VM
+// stops, the VM shim exits.
+func (s *vmShim) shutdown(id string) error {
+	for _, hc := range s.list() {
+		if hc.ID != id {
+			logrus.Warnf("shutting down VM %s while it still hosts container %s", s.vm.ID(), hc.ID)
+		}
+	}
+	err := s.vm.Shutdown()
+	if hcs.IsPending(err) {
+		select {
+		case <-s.exited:
+			err = nil
+		case <-time.After(vmShutdownTimeout):
+			err = hcs.ErrTimeout
+		}
+	}
+	if hcs.IsAlreadyStopped(err) {
+		err = nil
 	}
-	return nil
+	if err != nil {
+		logrus.Warnf("terminating VM %s after failing to shut it down: %s", s.vm.ID(), err)
+		err = s.vm.Terminate()
+		if hcs.IsPending(err) || err == nil {
+			<-s.exited
+			err = nil
+		}
+	}
+	return err
 }
 
 type noVMError struct {
@@ -183,7 +514,15 @@ func (err *noVMError) Error() string {
 	return "VM " + err.ID + " cannot be contacted"
 }
 
+// issueVMRequest sends a request for the container to its VM shim.
 func (c *container) issueVMRequest(op vmRequestOp) error {
+	return c.callVM(&vmRequest{ID: c.ID, Op: op}, nil)
+}
+
+// callVM sends a request to the container's VM shim and decodes the result
+// into result, which may be nil. Operations other than those understood by
+// VM shims that predate shimrpc fail if the VM shim does not support them.
+func (c *container) callVM(req *vmRequest, result interface{}) error {
 	pipe, err := winio.DialPipe(c.VMPipePath(), nil)
 	if err != nil {
 		if perr, ok := err.(*os.PathError); ok && perr.Err == syscall.ERROR_FILE_NOT_FOUND {
@@ -192,17 +531,21 @@ func (c *container) issueVMRequest(op vmRequestOp) error {
 		return err
 	}
 	defer pipe.Close()
-	req := vmRequest{
-		ID: c.ID,
-		Op: op,
-	}
-	err = json.NewEncoder(pipe).Encode(&req)
-	if err != nil {
-		return err
+	if c.VMShimProtocol == 0 {
+		switch req.Op {
+		case opCreateContainer, opUnmountContainer, opUnmountContainerDiskOnly:
+		default:
+			return shimrpc.Errorf(shimrpc.ErrorMethodNotFound, "the VM shim for %s does not support %s", c.HostID, req.Op)
+		}
+		err = json.NewEncoder(pipe).Encode(req)
+		if err != nil {
+			return err
+		}
+		return getErrorFromPipe(pipe, nil)
 	}
-	err = getErrorFromPipe(pipe, nil)
+	client, err := shimrpc.NewClient(pipe)
 	if err != nil {
 		return err
 	}
-	return nil
+	return client.Call(string(req.Op), req, result)
 }
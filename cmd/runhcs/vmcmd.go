@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/Microsoft/hcsshim/internal/appargs"
+	"github.com/Microsoft/hcsshim/internal/uvm"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/urfave/cli"
+)
+
+var vmCommand = cli.Command{
+	Name:  "vm",
+	Usage: "inspect and manage the utility VM hosting a container",
+	Subcommands: []cli.Command{
+		vmListCommand,
+		vmResourcesCommand,
+		vmAddDirCommand,
+		vmRemoveDirCommand,
+		vmExecCommand,
+		vmDebugBundleCommand,
+	},
+}
+
+var vmListCommand = cli.Command{
+	Name:  "list",
+	Usage: "list the containers hosted in a container's utility VM",
+	ArgsUsage: `<container-id>
+
+Where "<container-id>" is the name of the sandbox or of any container in it.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format, f",
+			Value: "table",
+			Usage: `select one of: ` + formatOptions,
+		},
+	},
+	Before: appargs.Validate(argID),
+	Action: func(context *cli.Context) error {
+		c, err := getVMContainer(context.Args().First())
+		if err != nil {
+			return err
+		}
+		var list []hostedContainer
+		err = c.callVM(&vmRequest{ID: c.ID, Op: opListContainers}, &list)
+		if err != nil {
+			return err
+		}
+
+		switch context.String("format") {
+		case "table":
+			w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+			fmt.Fprint(w, "ID\tSTATUS\n")
+			for _, item := range list {
+				status := containerRunning
+				if !item.Running {
+					status = containerStopped
+				}
+				fmt.Fprintf(w, "%s\t%s\n", item.ID, status)
+			}
+			return w.Flush()
+		case "json":
+			return json.NewEncoder(os.Stdout).Encode(list)
+		default:
+			return fmt.Errorf("invalid format option")
+		}
+	},
+}
+
+var vmResourcesCommand = cli.Command{
+	Name:  "resources",
+	Usage: "show the devices and shares allocated in a container's utility VM",
+	ArgsUsage: `<container-id>
+
+Where "<container-id>" is the name of the sandbox or of any container in it.`,
+	Before: appargs.Validate(argID),
+	Action: func(context *cli.Context) error {
+		c, err := getVMContainer(context.Args().First())
+		if err != nil {
+			return err
+		}
+		var a uvm.Allocation
+		err = c.callVM(&vmRequest{ID: c.ID, Op: opGetResources}, &a)
+		if err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(&a, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	},
+}
+
+var vmAddDirCommand = cli.Command{
+	Name:  "add-dir",
+	Usage: "map a host directory into a running VM-isolated container",
+	ArgsUsage: `<container-id> <host-path> <container-path>
+
+Where "<container-id>" is the name of a running container hosted in a utility VM.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "readonly",
+			Usage: "map the directory read-only",
+		},
+	},
+	Before: appargs.Validate(argID, appargs.NonEmptyString, appargs.NonEmptyString),
+	Action: func(context *cli.Context) error {
+		id := context.Args().Get(0)
+		hostPath, err := filepath.Abs(context.Args().Get(1))
+		if err != nil {
+			return err
+		}
+		mount := &specs.Mount{Source: hostPath, Destination: context.Args().Get(2)}
+		if context.Bool("readonly") {
+			mount.Options = []string{"ro"}
+		}
+		return modifyVMMount(id, opAddMount, mount)
+	},
+}
+
+var vmRemoveDirCommand = cli.Command{
+	Name:  "remove-dir",
+	Usage: "unmap a directory mapped into a running container by add-dir",
+	ArgsUsage: `<container-id> <container-path>
+
+Where "<container-id>" is the name of a running container hosted in a utility VM.`,
+	Before: appargs.Validate(argID, appargs.NonEmptyString),
+	Action: func(context *cli.Context) error {
+		mount := &specs.Mount{Destination: context.Args().Get(1)}
+		return modifyVMMount(context.Args().First(), opRemoveMount, mount)
+	},
+}
+
+// getVMContainer returns the container id, which must be hosted in a utility
+// VM.
+func getVMContainer(id string) (*container, error) {
+	c, err := getContainer(id, false)
+	if err != nil {
+		return nil, err
+	}
+	c.Close()
+	if !c.VMIsolated() {
+		return nil, fmt.Errorf("container %s is not hosted in a utility VM", id)
+	}
+	return c, nil
+}
+
+// modifyVMMount adds or removes a mount in the container id, which must be
+// hosted in a utility VM.
+func modifyVMMount(id string, op vmRequestOp, mount *specs.Mount) error {
+	if _, err := getVMContainer(id); err != nil {
+		return err
+	}
+	return modifyMount(id, op, mount)
+}
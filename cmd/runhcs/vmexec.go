@@ -0,0 +1,297 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	winio "github.com/Microsoft/go-winio"
+	"github.com/Microsoft/hcsshim/internal/appargs"
+	"github.com/Microsoft/hcsshim/internal/guid"
+	"github.com/Microsoft/hcsshim/internal/uvm"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/urfave/cli"
+)
+
+// vmExec is a process to run in a utility VM. Stdin, Stdout and Stderr are
+// the paths of pipes created by the caller that the VM shim connects to the
+// process's stdio, or empty if the stream is not used.
+type vmExec struct {
+	Process *specs.Process
+	Stdin   string `json:",omitempty"`
+	Stdout  string `json:",omitempty"`
+	Stderr  string `json:",omitempty"`
+}
+
+// vmExecResult is the result of the exec operation.
+type vmExecResult struct {
+	ExitCode int
+}
+
+// exec runs a process in the VM, returning once it exits.
+func (s *vmShim) exec(e *vmExec) (*vmExecResult, error) {
+	opts := &uvm.ProcessOptions{Process: e.Process}
+	dial := func(path string) (net.Conn, error) {
+		if path == "" {
+			return nil, nil
+		}
+		return winio.DialPipe(path, nil)
+	}
+	stdin, err := dial(e.Stdin)
+	if err != nil {
+		return nil, err
+	}
+	if stdin != nil {
+		defer stdin.Close()
+		opts.Stdin = stdin
+	}
+	stdout, err := dial(e.Stdout)
+	if err != nil {
+		return nil, err
+	}
+	if stdout != nil {
+		defer stdout.Close()
+		opts.Stdout = stdout
+	}
+	stderr, err := dial(e.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if stderr != nil {
+		defer stderr.Close()
+		opts.Stderr = stderr
+	}
+
+	p, _, err := s.vm.CreateProcess(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer p.Close()
+	err = p.Wait()
+	if err != nil {
+		return nil, err
+	}
+	code, err := p.ExitCode()
+	if err != nil {
+		return nil, err
+	}
+	return &vmExecResult{ExitCode: code}, nil
+}
+
+// execInVM runs a command in the utility VM hosting the container, copying
+// its stdio from stdin and to stdout and stderr, any of which may be nil.
+// Stdin is sent in full before output is returned, so the command cannot be
+// interactive.
+func (c *container) execInVM(args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	e := &vmExec{
+		Process: &specs.Process{
+			Args: args,
+			Cwd:  "/",
+		},
+	}
+	base := "runhcs-vmexec-" + guid.New().String()
+	var (
+		listeners []net.Listener
+		wg        sync.WaitGroup
+	)
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+		wg.Wait()
+	}()
+	// serve listens on a pipe for one of the process's streams and copies it
+	// once the VM shim connects.
+	serve := func(name string, relay func(conn net.Conn)) (string, error) {
+		path := safePipePath(base + "-" + name)
+		l, err := winio.ListenPipe(path, nil)
+		if err != nil {
+			return "", err
+		}
+		listeners = append(listeners, l)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			relay(conn)
+		}()
+		return path, nil
+	}
+	var err error
+	if stdin != nil {
+		e.Stdin, err = serve("stdin", func(conn net.Conn) {
+			io.Copy(conn, stdin)
+			closeWritePipe(conn)
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	if stdout != nil {
+		e.Stdout, err = serve("stdout", func(conn net.Conn) { io.Copy(stdout, conn) })
+		if err != nil {
+			return 0, err
+		}
+	}
+	if stderr != nil {
+		e.Stderr, err = serve("stderr", func(conn net.Conn) { io.Copy(stderr, conn) })
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var result vmExecResult
+	err = c.callVM(&vmRequest{ID: c.ID, Op: opExecInVM, Exec: e}, &result)
+	if err != nil {
+		return 0, err
+	}
+	return result.ExitCode, nil
+}
+
+var vmExecCommand = cli.Command{
+	Name:  "exec",
+	Usage: "run a command in a container's utility VM",
+	ArgsUsage: `<container-id> -- <command> [command options]
+
+Where "<container-id>" is the name of the sandbox or of any container in it.
+This is only supported for Linux utility VMs.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "stdin, i",
+			Usage: "send stdin to the command; it is sent in full before the command's output is returned",
+		},
+	},
+	Before: appargs.Validate(argID, appargs.Rest(appargs.String)),
+	Action: func(context *cli.Context) error {
+		args := context.Args()[1:]
+		if len(args) != 0 && args[0] == "--" {
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			return appargs.ErrInvalidUsage
+		}
+		c, err := getVMContainer(context.Args().First())
+		if err != nil {
+			return err
+		}
+		var stdin io.Reader
+		if context.Bool("stdin") {
+			stdin = os.Stdin
+		}
+		code, err := c.execInVM(args, stdin, os.Stdout, os.Stderr)
+		if err != nil {
+			return err
+		}
+		return cli.NewExitError("", code)
+	},
+	SkipArgReorder: true,
+}
+
+// debugBundleEntry is a file in a debug bundle and the command run in the
+// utility VM to produce it.
+type debugBundleEntry struct {
+	Name string
+	Args []string
+}
+
+var debugBundleEntries = []debugBundleEntry{
+	{"gcs.log", []string{"cat", "/tmp/gcs.log"}},
+	{"global-runc.log", []string{"cat", "/tmp/gcs/global-runc.log"}},
+	{"gcs-files.txt", []string{"ls", "-lR", "/tmp/gcs"}},
+	{"ps.txt", []string{"ps", "-ef"}},
+	{"mounts.txt", []string{"cat", "/proc/mounts"}},
+	{"dmesg.txt", []string{"dmesg"}},
+}
+
+// vmCommandRunner runs a command in a utility VM, returning its stdout and
+// a description of its failure, if any.
+type vmCommandRunner func(args []string) ([]byte, error)
+
+// writeDebugBundle runs each of entries and writes their output to w as a tar
+// file. The failures of individual commands are recorded in errors.txt
+// rather than failing the bundle.
+func writeDebugBundle(w io.Writer, entries []debugBundleEntry, run vmCommandRunner) error {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	add := func(name string, b []byte) error {
+		err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(b)),
+			ModTime:  now,
+			Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(b)
+		return err
+	}
+	var failures bytes.Buffer
+	for _, e := range entries {
+		out, err := run(e.Args)
+		if err != nil {
+			fmt.Fprintf(&failures, "%s: %s\n", strings.Join(e.Args, " "), err)
+		}
+		if err := add(e.Name, out); err != nil {
+			return err
+		}
+	}
+	if failures.Len() != 0 {
+		if err := add("errors.txt", failures.Bytes()); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+var vmDebugBundleCommand = cli.Command{
+	Name:  "debug-bundle",
+	Usage: "collect logs and diagnostics from a container's utility VM into a tar file",
+	ArgsUsage: `<container-id>
+
+Where "<container-id>" is the name of the sandbox or of any container in it.
+The bundle contains the GCS logs, the process list, the mount table and the
+kernel log. This is only supported for Linux utility VMs.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "path of the tar file to write, or - for stdout",
+			Value: "-",
+		},
+	},
+	Before: appargs.Validate(argID),
+	Action: func(context *cli.Context) error {
+		c, err := getVMContainer(context.Args().First())
+		if err != nil {
+			return err
+		}
+		var w io.Writer = os.Stdout
+		if path := context.String("output"); path != "-" {
+			f, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		return writeDebugBundle(w, debugBundleEntries, func(args []string) ([]byte, error) {
+			var stdout, stderr bytes.Buffer
+			code, err := c.execInVM(args, nil, &stdout, &stderr)
+			if err == nil && code != 0 {
+				err = fmt.Errorf("exit code %d: %s", code, strings.TrimSpace(stderr.String()))
+			}
+			return stdout.Bytes(), err
+		})
+	},
+}
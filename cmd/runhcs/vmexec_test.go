@@ -0,0 +1,54 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWriteDebugBundle(t *testing.T) {
+	entries := []debugBundleEntry{
+		{"a.txt", []string{"echo", "a"}},
+		{"b.txt", []string{"false"}},
+	}
+	run := func(args []string) ([]byte, error) {
+		if args[0] == "false" {
+			return []byte("partial"), errors.New("exit code 1")
+		}
+		return []byte(strings.Join(args[1:], " ")), nil
+	}
+	var buf bytes.Buffer
+	if err := writeDebugBundle(&buf, entries, run); err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string]string)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = string(b)
+	}
+	expected := map[string]string{
+		"a.txt":      "a",
+		"b.txt":      "partial",
+		"errors.txt": "false: exit code 1\n",
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("got %v, expected %v", files, expected)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+)
+
+// vmResizer is a utility VM that can be resized while it runs.
+type vmResizer interface {
+	MemorySizeInMB() int32
+	MaxMemorySizeInMB() int32
+	ProcessorCount() int32
+	MaxProcessorCount() int32
+	UpdateMemory(sizeInMB int32) error
+	UpdateProcessors(count int32) error
+}
+
+// containerLimits are the resource limits of a container hosted in a VM.
+type containerLimits struct {
+	MemoryMB   int32
+	Processors int32
+}
+
+// limitsOf returns the resource limits in spec. A zero limit is unlimited.
+func limitsOf(spec *specs.Spec) containerLimits {
+	var l containerLimits
+	if spec == nil || spec.Windows == nil || spec.Windows.Resources == nil {
+		return l
+	}
+	r := spec.Windows.Resources
+	if r.Memory != nil && r.Memory.Limit != nil {
+		l.MemoryMB = int32((*r.Memory.Limit + 1024*1024 - 1) / 1024 / 1024)
+	}
+	if r.CPU != nil && r.CPU.Count != nil {
+		l.Processors = int32(*r.CPU.Count)
+	}
+	return l
+}
+
+// vmBaseSize is the size of a VM before it was grown for its workload
+// containers. It is saved with the VM so that a shim taking over the VM grows
+// it from the same base, which cannot be worked out from the VM's current
+// size once growth was capped at the VM's maximums.
+type vmBaseSize struct {
+	MemoryMB   int32
+	Processors int32
+}
+
+// currentSize returns the current size of vm.
+func currentSize(vm vmResizer) vmBaseSize {
+	return vmBaseSize{MemoryMB: vm.MemorySizeInMB(), Processors: vm.ProcessorCount()}
+}
+
+// vmGrowthPolicy grows a sandbox VM as workload containers with resource
+// limits are added to it. The VM needs its base size plus the memory limits
+// of its workload containers, and as many processors as the largest processor
+// limit of a container. The VM is never shrunk, as the memory and processors
+// of a running VM cannot reliably be removed, and it is not grown beyond the
+// maximums it was created with.
+//
+// A shim that takes over a running VM adopts the containers the previous shim
+// recorded, and the base size it saved.
+type vmGrowthPolicy struct {
+	vm             vmResizer
+	baseMemoryMB   int32
+	baseProcessors int32
+	containers     map[string]containerLimits
+}
+
+func newVMGrowthPolicy(vm vmResizer, base vmBaseSize) *vmGrowthPolicy {
+	return &vmGrowthPolicy{
+		vm:             vm,
+		baseMemoryMB:   base.MemoryMB,
+		baseProcessors: base.Processors,
+		containers:     make(map[string]containerLimits),
+	}
+}
+
+// add records the workload container id with limits l and grows the VM to
+// fit it. The container is recorded even if the VM cannot be grown, so that
+// the error is only a warning for the caller.
+func (p *vmGrowthPolicy) add(id string, l containerLimits) error {
+	p.containers[id] = l
+	memoryMB, processors := p.target()
+	var errs []string
+	if memoryMB > p.vm.MemorySizeInMB() {
+		if max := p.vm.MaxMemorySizeInMB(); memoryMB > max {
+			errs = append(errs, fmt.Sprintf("%dMB of memory needed, limited to %dMB", memoryMB, max))
+			memoryMB = max
+		}
+		if memoryMB > p.vm.MemorySizeInMB() {
+			if err := p.vm.UpdateMemory(memoryMB); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	if processors > p.vm.ProcessorCount() {
+		if max := p.vm.MaxProcessorCount(); processors > max {
+			errs = append(errs, fmt.Sprintf("%d processors needed, limited to %d", processors, max))
+			processors = max
+		}
+		if processors > p.vm.ProcessorCount() {
+			if err := p.vm.UpdateProcessors(processors); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("failed to grow VM for container %s: %v", id, errs)
+	}
+	return nil
+}
+
+// adopt records the workload container id with limits l, for which a
+// previous VM shim already grew the VM, without growing it.
+func (p *vmGrowthPolicy) adopt(id string, l containerLimits) {
+	p.containers[id] = l
+}
+
+// remove forgets the container id. The VM keeps its size.
+func (p *vmGrowthPolicy) remove(id string) {
+	delete(p.containers, id)
+}
+
+// target returns the size the VM needs for the recorded containers.
+func (p *vmGrowthPolicy) target() (int32, int32) {
+	memoryMB, processors := p.baseMemoryMB, p.baseProcessors
+	for _, l := range p.containers {
+		memoryMB += l.MemoryMB
+		if l.Processors > processors {
+			processors = l.Processors
+		}
+	}
+	return memoryMB, processors
+}
+
+// growForContainer grows the VM for the workload container c, logging rather
+// than failing if it cannot.
+func (s *vmShim) growForContainer(c *container) {
+	if c.ID == s.hostID {
+		// The VM was sized for the container that created it.
+		return
+	}
+	l := limitsOf(c.Spec)
+	if l == (containerLimits{}) {
+		return
+	}
+	if err := s.growth.add(c.ID, l); err != nil {
+		logrus.Warn(err)
+	}
+}
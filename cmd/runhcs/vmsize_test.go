@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// fakeResizer is a VM whose resizes are recorded.
+type fakeResizer struct {
+	memoryMB, maxMemoryMB     int32
+	processors, maxProcessors int32
+	updates                   int
+	fail                      bool
+}
+
+func (f *fakeResizer) MemorySizeInMB() int32 {
+	return f.memoryMB
+}
+
+func (f *fakeResizer) MaxMemorySizeInMB() int32 {
+	return f.maxMemoryMB
+}
+
+func (f *fakeResizer) ProcessorCount() int32 {
+	return f.processors
+}
+
+func (f *fakeResizer) MaxProcessorCount() int32 {
+	return f.maxProcessors
+}
+
+func (f *fakeResizer) UpdateMemory(sizeInMB int32) error {
+	if f.fail {
+		return errors.New("update failed")
+	}
+	f.updates++
+	f.memoryMB = sizeInMB
+	return nil
+}
+
+func (f *fakeResizer) UpdateProcessors(count int32) error {
+	if f.fail {
+		return errors.New("update failed")
+	}
+	f.updates++
+	f.processors = count
+	return nil
+}
+
+func TestLimitsOf(t *testing.T) {
+	limit := uint64(300*1024*1024 + 1)
+	count := uint64(3)
+	spec := &specs.Spec{Windows: &specs.Windows{Resources: &specs.WindowsResources{
+		Memory: &specs.WindowsMemoryResources{Limit: &limit},
+		CPU:    &specs.WindowsCPUResources{Count: &count},
+	}}}
+	if l := limitsOf(spec); l != (containerLimits{MemoryMB: 301, Processors: 3}) {
+		t.Fatalf("got %+v", l)
+	}
+	if l := limitsOf(&specs.Spec{}); l != (containerLimits{}) {
+		t.Fatalf("got %+v for no resources", l)
+	}
+}
+
+func TestVMGrowthPolicy(t *testing.T) {
+	vm := &fakeResizer{memoryMB: 1024, maxMemoryMB: 2048, processors: 2, maxProcessors: 4}
+	p := newVMGrowthPolicy(vm, currentSize(vm))
+	check := func(memoryMB, processors int32) {
+		t.Helper()
+		if vm.memoryMB != memoryMB || vm.processors != processors {
+			t.Fatalf("got %dMB %d processors, expected %dMB %d processors", vm.memoryMB, vm.processors, memoryMB, processors)
+		}
+	}
+
+	if err := p.add("a", containerLimits{MemoryMB: 512, Processors: 1}); err != nil {
+		t.Fatal(err)
+	}
+	check(1536, 2)
+	if err := p.add("b", containerLimits{MemoryMB: 256, Processors: 3}); err != nil {
+		t.Fatal(err)
+	}
+	check(1792, 3)
+
+	// The VM is not shrunk, and a replacement container only grows it past
+	// its previous peak.
+	p.remove("a")
+	updates := vm.updates
+	if err := p.add("c", containerLimits{MemoryMB: 512}); err != nil {
+		t.Fatal(err)
+	}
+	check(1792, 3)
+	if vm.updates != updates {
+		t.Fatalf("VM resized without growing")
+	}
+
+	// Growth is capped at the VM's maximums.
+	if err := p.add("d", containerLimits{MemoryMB: 1024, Processors: 8}); err == nil {
+		t.Fatal("expected an error for limits beyond the maximums")
+	}
+	check(2048, 4)
+
+	// The containers are recorded even if the VM cannot be grown.
+	vm = &fakeResizer{memoryMB: 1024, maxMemoryMB: 2048, processors: 2, maxProcessors: 4, fail: true}
+	p = newVMGrowthPolicy(vm, currentSize(vm))
+	if err := p.add("a", containerLimits{MemoryMB: 256}); err == nil {
+		t.Fatal("expected a failed update to be reported")
+	}
+	vm.fail = false
+	if err := p.add("b", containerLimits{MemoryMB: 256}); err != nil {
+		t.Fatal(err)
+	}
+	check(1536, 2)
+}
+
+func TestVMGrowthPolicyAdopt(t *testing.T) {
+	// A VM started with 1024MB and grown for a by a previous VM shim, which
+	// could only grow it by 256MB of the 512MB a needs.
+	vm := &fakeResizer{memoryMB: 1280, maxMemoryMB: 1280, processors: 2, maxProcessors: 4}
+	p := newVMGrowthPolicy(vm, vmBaseSize{MemoryMB: 1024, Processors: 2})
+	p.adopt("a", containerLimits{MemoryMB: 512, Processors: 1})
+	if vm.updates != 0 {
+		t.Fatal("VM resized when adopting a container")
+	}
+	if memoryMB, processors := p.target(); memoryMB != 1536 || processors != 2 {
+		t.Fatalf("got target %dMB, %d processors, expected 1536MB, 2 processors", memoryMB, processors)
+	}
+
+	// A removed adopted container leaves room for its replacement.
+	p.remove("a")
+	if err := p.add("b", containerLimits{MemoryMB: 256}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.add("c", containerLimits{MemoryMB: 256}); err == nil {
+		t.Fatal("expected the VM to be too small for b and c")
+	}
+	if vm.memoryMB != 1280 || vm.updates != 0 {
+		t.Fatalf("got %dMB after %d updates, expected 1280MB", vm.memoryMB, vm.updates)
+	}
+}
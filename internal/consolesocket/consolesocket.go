@@ -0,0 +1,86 @@
+// Package consolesocket implements the message that runhcs sends to the
+// socket passed with --console-socket.
+//
+// runc sends the pty master over the socket as SCM_RIGHTS ancillary data.
+// Unix domain sockets on Windows cannot carry handles, so runhcs instead
+// sends the path of a named pipe connected to the process's console. Data
+// written to the pipe is sent to the process's input, and the process's
+// output can be read from it.
+//
+// Messages are framed by the framing package.
+package consolesocket
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/Microsoft/hcsshim/internal/framing"
+)
+
+// Version is the version of the message format.
+const Version = 1
+
+// maxMessageSize bounds the size of a message so that a bad length prefix
+// does not cause a huge allocation.
+const maxMessageSize = 64 * 1024
+
+// Message describes the console of a process.
+type Message struct {
+	Version int `json:"version"`
+	// Pipe is the path of the named pipe for the console.
+	Pipe string `json:"pipe"`
+}
+
+// Write writes m to w.
+func Write(w io.Writer, m *Message) error {
+	return framing.Write(w, m, maxMessageSize)
+}
+
+// Read reads a message from r.
+func Read(r io.Reader) (*Message, error) {
+	var m Message
+	if err := framing.Read(r, &m, maxMessageSize); err != nil {
+		return nil, err
+	}
+	if m.Version != Version {
+		return nil, fmt.Errorf("unsupported console message version %d", m.Version)
+	}
+	return &m, nil
+}
+
+// Send connects to the Unix domain socket at path and sends m.
+func Send(path string, m *Message) error {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return Write(conn, m)
+}
+
+// Accept waits for the receiver of the console to connect to l, the listener
+// for the console's pipe. If nothing connects within timeout, l is closed so
+// that the caller does not wait forever on a receiver that went away.
+func Accept(l net.Listener, timeout time.Duration) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := l.Accept()
+		ch <- result{conn, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-time.After(timeout):
+		l.Close()
+		if r := <-ch; r.conn != nil {
+			r.conn.Close()
+		}
+		return nil, fmt.Errorf("timed out after %s waiting for the console receiver to connect", timeout)
+	}
+}
@@ -0,0 +1,146 @@
+package consolesocket
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	m := &Message{Version: Version, Pipe: `\\.\pipe\console`}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- Write(a, m)
+	}()
+	m2, err := Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if *m2 != *m {
+		t.Fatalf("got %+v, expected %+v", m2, m)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  error
+	}{
+		{"empty", "", io.EOF},
+		{"bad version", `{"version":2,"pipe":"p"}`, nil},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if test.data != "" {
+			buf.Write([]byte{0, 0, 0, byte(len(test.data))})
+			buf.WriteString(test.data)
+		}
+		_, err := Read(&buf)
+		if err == nil {
+			t.Errorf("%s: expected error", test.name)
+		} else if test.err != nil && err != test.err {
+			t.Errorf("%s: got %v, expected %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestReadSequence(t *testing.T) {
+	var buf bytes.Buffer
+	for _, p := range []string{"a", "b"} {
+		if err := Write(&buf, &Message{Version: Version, Pipe: p}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []string{"a", "b"} {
+		m, err := Read(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Pipe != p {
+			t.Fatalf("got %q, expected %q", m.Pipe, p)
+		}
+	}
+	if _, err := Read(&buf); err != io.EOF {
+		t.Fatal("expected EOF", err)
+	}
+}
+
+func TestSend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consolesocket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("unix sockets are not supported: ", err)
+	}
+	defer l.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- Send(path, &Message{Version: Version, Pipe: "console"})
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	m, err := Read(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if m.Pipe != "console" {
+		t.Fatal("wrong pipe", m.Pipe)
+	}
+}
+
+func TestAccept(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := net.Dial("tcp", l.Addr().String()); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := Accept(l, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestAcceptTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err := Accept(l, 10*time.Millisecond); err == nil {
+		t.Fatal("expected timeout")
+	}
+	// The listener is closed so that nothing can connect late.
+	if conn, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		conn.Close()
+		t.Fatal("listener still open")
+	}
+}
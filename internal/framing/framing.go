@@ -0,0 +1,49 @@
+// Package framing implements the message framing shared by the protocols
+// runhcs speaks over pipes and sockets. Each message is a 4-byte big-endian
+// length followed by that many bytes of JSON.
+package framing
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Write writes v as a single message of at most max bytes.
+func Write(w io.Writer, v interface{}, max uint32) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if uint64(len(b)) > uint64(max) {
+		return fmt.Errorf("message too large: %d bytes", len(b))
+	}
+	buf := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	copy(buf[4:], b)
+	_, err = w.Write(buf)
+	return err
+}
+
+// Read reads a single message of at most max bytes into v. The limit keeps a
+// bad length prefix from causing a huge allocation. It returns io.EOF if r is
+// at the end of the stream before the message starts.
+func Read(r io.Reader, v interface{}, max uint32) error {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > max {
+		return fmt.Errorf("message too large: %d bytes", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
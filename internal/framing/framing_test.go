@@ -0,0 +1,75 @@
+package framing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+type message struct {
+	ID   int    `json:"id"`
+	Text string `json:"text,omitempty"`
+}
+
+func frame(payload string) []byte {
+	b := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(len(payload)))
+	copy(b[4:], payload)
+	return b
+}
+
+func TestReadSequence(t *testing.T) {
+	var buf bytes.Buffer
+	for i, text := range []string{"a", "b"} {
+		if err := Write(&buf, &message{ID: i, Text: text}, 64); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, text := range []string{"a", "b"} {
+		var m message
+		if err := Read(&buf, &m, 64); err != nil {
+			t.Fatal(err)
+		}
+		if m.ID != i || m.Text != text {
+			t.Fatalf("got %+v, expected %d %q", m, i, text)
+		}
+	}
+	var m message
+	if err := Read(&buf, &m, 64); err != io.EOF {
+		t.Fatal("expected EOF", err)
+	}
+}
+
+func TestWriteTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, &message{Text: "too long for the limit"}, 16); err == nil {
+		t.Fatal("expected error")
+	}
+	if buf.Len() != 0 {
+		t.Fatal("message written", buf.Len())
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"empty", nil, io.EOF},
+		{"short header", []byte{0, 0}, io.ErrUnexpectedEOF},
+		{"short payload", frame(`{"id":1}`)[:6], io.ErrUnexpectedEOF},
+		{"too large", frame(`{"text":"too long for the limit"}`), nil},
+		{"bad json", frame(`{"id":`), nil},
+	}
+	for _, test := range tests {
+		var m message
+		err := Read(bytes.NewReader(test.data), &m, 16)
+		if err == nil {
+			t.Errorf("%s: expected error", test.name)
+		} else if test.err != nil && err != test.err {
+			t.Errorf("%s: got %v, expected %v", test.name, err, test.err)
+		}
+	}
+}
@@ -41,6 +41,7 @@ type CreateOptions struct {
 	SchemaVersion    *schemaversion.SchemaVersion // Requested Schema Version. Defaults to v2 for RS5, v1 for RS1..RS4
 	HostingSystem    *uvm.UtilityVM               // Utility or service VM in which the container is to be created.
 	NetworkNamespace string                       // Host network namespace to use (overrides anything in the spec)
+	Journal          *Journal                     // If not nil, records the resources as they are allocated
 
 	// This is an advanced debugging parameter. It allows for diagnosibility by leaving a containers
 	// resources allocated in case of a failure. Thus you would be able to use tools such as hcsdiag
@@ -96,7 +97,7 @@ func CreateContainer(createOptions *CreateOptions) (_ *hcs.System, _ *Resources,
 		logrus.Debugf("hcsshim::CreateContainer using schema %s", coi.actualSchemaVersion.String())
 	}
 
-	resources := &Resources{}
+	resources := &Resources{Journal: coi.Journal}
 	defer func() {
 		if err != nil {
 			if !coi.DoNotReleaseResourcesOnFailure {
@@ -133,7 +134,9 @@ func CreateContainer(createOptions *CreateOptions) (_ *hcs.System, _ *Resources,
 			if err != nil {
 				return nil, resources, err
 			}
-			err = coi.HostingSystem.AddNetNS(coi.actualNetworkNamespace, endpoints)
+			err = resources.track(JournalEntry{Kind: ResourceVMNetNS, Key: coi.actualNetworkNamespace}, func() (string, error) {
+				return "", coi.HostingSystem.AddNetNS(coi.actualNetworkNamespace, endpoints)
+			})
 			if err != nil {
 				return nil, resources, err
 			}
@@ -210,7 +213,7 @@ func createLCOWSpec(coi *createOptionsInternal) (*specs.Spec, error) {
 	// Linux containers don't care about Windows aspects of the spec
 	spec.Windows = nil
 
-	// Hooks are not supported (they should be run in the host)
+	// Hooks are run in the host by the caller, not in the guest.
 	spec.Hooks = nil
 
 	// Clear unsupported features
@@ -447,8 +450,8 @@ func createWindowsContainerDocument(coi *createOptionsInternal) (interface{}, er
 		}
 	}
 
-	// Add the mounts as mapped directories or mapped pipes
-	// TODO: Mapped pipes to add in v2 schema.
+	// Add the mounts as mapped directories or mapped pipes. For v2 Xenon,
+	// both refer to what was mapped into the utility VM.
 	var (
 		mdsv1 []schema1.MappedDir
 		mpsv1 []schema1.MappedPipe
@@ -457,17 +460,31 @@ func createWindowsContainerDocument(coi *createOptionsInternal) (interface{}, er
 	)
 	for _, mount := range coi.Spec.Mounts {
 		const pipePrefix = `\\.\pipe\`
-		if mount.Type != "" {
+		if mount.Type != "" && (mount.Type != MountTypeVirtualDisk || coi.HostingSystem == nil) {
 			return nil, fmt.Errorf("invalid container spec - Mount.Type '%s' must not be set", mount.Type)
 		}
 		if strings.HasPrefix(mount.Destination, pipePrefix) {
 			mpsv1 = append(mpsv1, schema1.MappedPipe{HostPath: mount.Source, ContainerPipeName: mount.Destination[len(pipePrefix):]})
-			mpsv2 = append(mpsv2, hcsschemav2.ContainersResourcesMappedPipeV2{HostPath: mount.Source, ContainerPipeName: mount.Destination[len(pipePrefix):]})
+			mpv2 := hcsschemav2.ContainersResourcesMappedPipeV2{HostPath: mount.Source, ContainerPipeName: mount.Destination[len(pipePrefix):]}
+			if coi.HostingSystem != nil {
+				guestPath, err := coi.HostingSystem.GetPipeGuestPath(mount.Source)
+				if err != nil {
+					return nil, err
+				}
+				mpv2.HostPath = guestPath
+			}
+			mpsv2 = append(mpsv2, mpv2)
 		} else {
 			mdv1 := schema1.MappedDir{HostPath: mount.Source, ContainerPath: mount.Destination, ReadOnly: false}
 			var mdv2 hcsschemav2.ContainersResourcesMappedDirectoryV2
 			if coi.HostingSystem == nil {
 				mdv2 = hcsschemav2.ContainersResourcesMappedDirectoryV2{HostPath: mount.Source, ContainerPath: mount.Destination, ReadOnly: false}
+			} else if mount.Type == MountTypeVirtualDisk {
+				mdv2 = hcsschemav2.ContainersResourcesMappedDirectoryV2{
+					HostPath:      diskUVMPath(coi.HostingSystem, mount.Source),
+					ContainerPath: mount.Destination,
+					ReadOnly:      false,
+				}
 			} else {
 				guestPath, err := coi.HostingSystem.GetVSMBGuestPath(mount.Source)
 				if err != nil {
@@ -0,0 +1,54 @@
+// +build windows
+
+package hcsoci
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/Microsoft/hcsshim/internal/uvm"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// MountTypeVirtualDisk is the type of a mount whose source is a VHD or VHDX
+// file, which is attached to the utility VM over SCSI and mounted at the
+// destination. The containers of a utility VM can share a disk mounted
+// read-only.
+const MountTypeVirtualDisk = "virtual-disk"
+
+// diskUVMPath returns the path in vm at which the virtual disk hostPath is
+// mounted. It depends only on the host path, so that containers mounting the
+// same disk share its attachment.
+func diskUVMPath(vm *uvm.UtilityVM, hostPath string) string {
+	h := sha256.Sum256([]byte(hostPath))
+	name := "d-" + hex.EncodeToString(h[:8])
+	if vm.OS() == "windows" {
+		return `C:\disks\` + name
+	}
+	return "/run/disks/" + name
+}
+
+// addVirtualDisk attaches the source of the virtual disk mount to vm, records
+// it in resources, and returns the path in the utility VM at which it is
+// mounted.
+func addVirtualDisk(vm *uvm.UtilityVM, resources *Resources, mount specs.Mount) (string, error) {
+	mo, err := parseMountOptions(mount.Options)
+	if err != nil {
+		return "", fmt.Errorf("invalid OCI spec - mount %+v: %s", mount, err)
+	}
+	opts, err := mo.scsiOptions()
+	if err != nil {
+		return "", fmt.Errorf("invalid OCI spec - mount %+v: %s", mount, err)
+	}
+	uvmPath := diskUVMPath(vm, mount.Source)
+	err = resources.track(shareEntry(vm, ResourceSCSI, mount.Source), func() (string, error) {
+		_, _, err := vm.AddSCSIWithOptions(mount.Source, uvmPath, opts)
+		return "", err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to attach virtual disk to utility VM for mount %+v: %s", mount, err)
+	}
+	resources.SCSIMounts = append(resources.SCSIMounts, mount.Source)
+	return uvmPath, nil
+}
@@ -0,0 +1,240 @@
+// +build windows
+
+package hcsoci
+
+// Contains functions to add and remove mounts in a running container
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/Microsoft/hcsshim/internal/guid"
+	"github.com/Microsoft/hcsshim/internal/hcs"
+	"github.com/Microsoft/hcsshim/internal/schema2"
+	"github.com/Microsoft/hcsshim/internal/uvm"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+)
+
+// AddMount maps mount into the running container hc. Its destination may be a
+// directory, a file, or for Windows a named pipe. If the container is hosted
+// in vm, the mount's source is first shared into the utility VM.
+//
+// The mount and any share are recorded in resources, so that the share is
+// released by RemoveMount or ReleaseResources.
+func AddMount(hc *hcs.System, vm *uvm.UtilityVM, resources *Resources, mount specs.Mount) (err error) {
+	if mount.Destination == "" || mount.Source == "" {
+		return fmt.Errorf("a mount must have both source and a destination: %+v", mount)
+	}
+	if mount.Type != "" && mount.Type != "bind" {
+		return fmt.Errorf("mount type '%s' is not supported", mount.Type)
+	}
+	for _, m := range resources.AddedMounts {
+		if m.Destination == mount.Destination {
+			return fmt.Errorf("%s is already mounted in %s", mount.Destination, hc.ID())
+		}
+	}
+	mo, err := parseMountOptions(mount.Options)
+	if err != nil {
+		return err
+	}
+
+	logrus.Debugf("hcsshim::AddMount %+v id:%s", mount, hc.ID())
+	hostPath := mount.Source
+	if vm != nil {
+		hostPath, err = addMountShare(vm, resources, mount)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				if err := removeMountShare(vm, resources, mount); err != nil {
+					logrus.Warnf("failed to release share of %s after failed mount: %s", mount.Source, err)
+				}
+			}
+		}()
+	}
+
+	err = hc.Modify(mountRequest(schema2.RequestTypeAdd, mount, hostPath, mo.readOnly))
+	if err != nil {
+		return fmt.Errorf("failed to mount %s in %s: %s", mount.Source, hc.ID(), err)
+	}
+	resources.AddedMounts = append(resources.AddedMounts, mount)
+	return nil
+}
+
+// RemoveMount removes the mount at destination, which must have been added by
+// AddMount, from the running container hc, and releases any share of its
+// source in vm.
+func RemoveMount(hc *hcs.System, vm *uvm.UtilityVM, resources *Resources, destination string) error {
+	i := 0
+	for i < len(resources.AddedMounts) && resources.AddedMounts[i].Destination != destination {
+		i++
+	}
+	if i == len(resources.AddedMounts) {
+		return fmt.Errorf("%s was not mounted in %s", destination, hc.ID())
+	}
+	mount := resources.AddedMounts[i]
+
+	logrus.Debugf("hcsshim::RemoveMount %+v id:%s", mount, hc.ID())
+	hostPath := mount.Source
+	if vm != nil {
+		var err error
+		if isPipeMount(mount) {
+			hostPath, err = vm.GetPipeGuestPath(mount.Source)
+		} else if vm.OS() == "windows" {
+			hostPath, err = vm.GetVSMBGuestPath(mount.Source)
+		} else {
+			hostPath, err = vm.GetPlan9GuestPath(mount.Source)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err := hc.Modify(mountRequest(schema2.RequestTypeRemove, mount, hostPath, false))
+	if err != nil {
+		return fmt.Errorf("failed to unmount %s from %s: %s", destination, hc.ID(), err)
+	}
+	resources.AddedMounts = append(resources.AddedMounts[:i], resources.AddedMounts[i+1:]...)
+	if vm != nil {
+		return removeMountShare(vm, resources, mount)
+	}
+	return nil
+}
+
+func isPipeMount(mount specs.Mount) bool {
+	return strings.HasPrefix(mount.Destination, uvm.PipePrefix)
+}
+
+// mountRequest returns the request to add or remove mount in a container,
+// where hostPath is the path of the mount's source as seen by the container's
+// host.
+func mountRequest(requestType schema2.RequestType, mount specs.Mount, hostPath string, readOnly bool) *schema2.ModifySettingsRequestV2 {
+	if isPipeMount(mount) {
+		return &schema2.ModifySettingsRequestV2{
+			ResourceType: schema2.ResourceTypeMappedPipe,
+			RequestType:  requestType,
+			Settings: schema2.ContainersResourcesMappedPipeV2{
+				HostPath:          hostPath,
+				ContainerPipeName: mount.Destination[len(uvm.PipePrefix):],
+			},
+		}
+	}
+	return &schema2.ModifySettingsRequestV2{
+		ResourceType: schema2.ResourceTypeMappedDirectory,
+		RequestType:  requestType,
+		Settings: schema2.ContainersResourcesMappedDirectoryV2{
+			HostPath:      hostPath,
+			ContainerPath: mount.Destination,
+			ReadOnly:      readOnly,
+		},
+	}
+}
+
+// addVSMBMount shares the source of mount, a file or a directory, into the
+// Windows utility VM vm and records the share in resources.
+func addVSMBMount(vm *uvm.UtilityVM, resources *Resources, mount specs.Mount, flags int32) error {
+	// A single file is shared by restricting a share of its directory to
+	// just that file.
+	fi, err := os.Stat(mount.Source)
+	if err != nil {
+		return fmt.Errorf("failed to stat source of mount %+v: %s", mount, err)
+	}
+	if !fi.IsDir() {
+		err := resources.track(shareEntry(vm, ResourceVSMBFile, mount.Source), func() (string, error) {
+			return "", vm.AddVSMBFile(mount.Source, flags)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add VSMB file share to utility VM for mount %+v: %s", mount, err)
+		}
+		resources.VSMBFileMounts = append(resources.VSMBFileMounts, mount.Source)
+		return nil
+	}
+	err = resources.track(shareEntry(vm, ResourceVSMB, mount.Source), func() (string, error) {
+		return "", vm.AddVSMB(mount.Source, "", flags)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add VSMB share to utility VM for mount %+v: %s", mount, err)
+	}
+	resources.VSMBMounts = append(resources.VSMBMounts, mount.Source)
+	return nil
+}
+
+// addMountShare shares the source of mount into vm, records the share in
+// resources, and returns the path of the source in the utility VM.
+func addMountShare(vm *uvm.UtilityVM, resources *Resources, mount specs.Mount) (string, error) {
+	if isPipeMount(mount) {
+		err := resources.track(shareEntry(vm, ResourcePipe, mount.Source), func() (string, error) {
+			return "", vm.AddPipe(mount.Source)
+		})
+		if err != nil {
+			return "", err
+		}
+		resources.PipeMounts = append(resources.PipeMounts, mount.Source)
+		return vm.GetPipeGuestPath(mount.Source)
+	}
+	if vm.OS() == "windows" {
+		flags, err := vsmbMountFlags(mount.Options)
+		if err != nil {
+			return "", err
+		}
+		if err := addVSMBMount(vm, resources, mount, flags); err != nil {
+			return "", err
+		}
+		return vm.GetVSMBGuestPath(mount.Source)
+	}
+	flags, err := plan9MountFlags(mount.Options)
+	if err != nil {
+		return "", err
+	}
+	guestPath := path.Join(resources.GuestRoot, mountPathPrefix+guid.New().String())
+	err = resources.track(shareEntry(vm, ResourcePlan9, mount.Source), func() (string, error) {
+		return "", vm.AddPlan9(mount.Source, guestPath, flags)
+	})
+	if err != nil {
+		return "", err
+	}
+	resources.Plan9Mounts = append(resources.Plan9Mounts, mount.Source)
+	return vm.GetPlan9GuestPath(mount.Source)
+}
+
+// removeMountShare releases the share of the source of mount added by
+// addMountShare and removes it from resources.
+func removeMountShare(vm *uvm.UtilityVM, resources *Resources, mount specs.Mount) error {
+	var (
+		kind   ResourceKind
+		list   *[]string
+		remove func(string) error
+	)
+	if isPipeMount(mount) {
+		kind, list, remove = ResourcePipe, &resources.PipeMounts, vm.RemovePipe
+	} else if vm.OS() != "windows" {
+		kind, list, remove = ResourcePlan9, &resources.Plan9Mounts, vm.RemovePlan9
+	} else if lastIndex(resources.VSMBFileMounts, mount.Source) >= 0 {
+		kind, list, remove = ResourceVSMBFile, &resources.VSMBFileMounts, vm.RemoveVSMBFile
+	} else {
+		kind, list, remove = ResourceVSMB, &resources.VSMBMounts, vm.RemoveVSMB
+	}
+	i := lastIndex(*list, mount.Source)
+	if i < 0 {
+		return fmt.Errorf("no share of %s is recorded", mount.Source)
+	}
+	if err := remove(mount.Source); err != nil {
+		return err
+	}
+	*list = append((*list)[:i], (*list)[i+1:]...)
+	resources.released(kind, mount.Source)
+	return nil
+}
+
+// lastIndex returns the index of the last occurrence of s in list, or -1.
+func lastIndex(list []string, s string) int {
+	for i := len(list) - 1; i >= 0; i-- {
+		if list[i] == s {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,43 @@
+// +build windows
+
+package hcsoci
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/internal/schema2"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestMountRequest(t *testing.T) {
+	pipe := mountRequest(schema2.RequestTypeAdd, specs.Mount{Source: `\\.\pipe\docker_engine`, Destination: `\\.\pipe\docker_engine`}, `\\.\pipe\docker_engine`, false)
+	expected := &schema2.ModifySettingsRequestV2{
+		ResourceType: schema2.ResourceTypeMappedPipe,
+		RequestType:  schema2.RequestTypeAdd,
+		Settings:     schema2.ContainersResourcesMappedPipeV2{HostPath: `\\.\pipe\docker_engine`, ContainerPipeName: "docker_engine"},
+	}
+	if !reflect.DeepEqual(pipe, expected) {
+		t.Errorf("got %+v, expected %+v", pipe, expected)
+	}
+
+	dir := mountRequest(schema2.RequestTypeRemove, specs.Mount{Source: `c:\data`, Destination: `c:\data`}, `\\?\VMSMB\s1`, true)
+	expected = &schema2.ModifySettingsRequestV2{
+		ResourceType: schema2.ResourceTypeMappedDirectory,
+		RequestType:  schema2.RequestTypeRemove,
+		Settings:     schema2.ContainersResourcesMappedDirectoryV2{HostPath: `\\?\VMSMB\s1`, ContainerPath: `c:\data`, ReadOnly: true},
+	}
+	if !reflect.DeepEqual(dir, expected) {
+		t.Errorf("got %+v, expected %+v", dir, expected)
+	}
+}
+
+func TestLastIndex(t *testing.T) {
+	list := []string{"a", "b", "a"}
+	if i := lastIndex(list, "a"); i != 2 {
+		t.Errorf("got %d, expected 2", i)
+	}
+	if i := lastIndex(list, "c"); i != -1 {
+		t.Errorf("got %d, expected -1", i)
+	}
+}
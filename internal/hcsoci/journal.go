@@ -0,0 +1,290 @@
+package hcsoci
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ResourceKind is the kind of a resource tracked in a Journal.
+type ResourceKind string
+
+const (
+	ResourceNetNS    ResourceKind = "netns"    // Key is the ID of a network namespace created for the container
+	ResourceEndpoint ResourceKind = "endpoint" // Key is an endpoint ID added to the namespace NetNS
+	ResourceVMNetNS  ResourceKind = "vmnetns"  // Key is a network namespace added to the utility VM
+	ResourceLayers   ResourceKind = "layers"   // Layers are mounted at GuestRoot
+	ResourceVSMB     ResourceKind = "vsmb"     // Key is the host path of a VSMB share
+	ResourceVSMBFile ResourceKind = "vsmbfile" // Key is the host path of a file shared over VSMB
+	ResourcePlan9    ResourceKind = "plan9"    // Key is the host path of a Plan9 share
+	ResourcePipe     ResourceKind = "pipe"     // Key is the host path of a named pipe mapped into the utility VM
+	ResourceSCSI     ResourceKind = "scsi"     // Key is the host path of a virtual disk attached to the utility VM
+)
+
+// JournalState is the state of an entry in a Journal.
+type JournalState string
+
+const (
+	// JournalPending is the state of a resource that is being allocated. If
+	// the process exits before the allocation completes, it is not known
+	// whether the resource exists.
+	JournalPending JournalState = "pending"
+	// JournalAllocated is the state of a resource that was allocated and is
+	// recorded in Resources.
+	JournalAllocated JournalState = "allocated"
+)
+
+// JournalEntry is a resource that is allocated or being allocated.
+type JournalEntry struct {
+	ID        uint64
+	State     JournalState
+	Kind      ResourceKind
+	Key       string   `json:",omitempty"`
+	NetNS     string   `json:",omitempty"`
+	Layers    []string `json:",omitempty"`
+	GuestRoot string   `json:",omitempty"`
+	// Refs is the number of references the utility VM held to the share of
+	// a VSMB, VSMBFile, Plan9, Pipe or SCSI entry when the entry was begun.
+	Refs uint32 `json:",omitempty"`
+}
+
+// JournalStore persists the entries of a Journal. Save must not return until
+// the entries are durable, and must replace the previous entries atomically.
+type JournalStore interface {
+	Save(entries []JournalEntry) error
+}
+
+// Journal is a write-ahead record of the resources of a container. Each
+// resource is recorded as pending before it is allocated and as allocated
+// once it has been, and is removed from the journal once it is released.
+// After a crash, ReplayJournal uses the entries to release or adopt the
+// resources.
+type Journal struct {
+	m       sync.Mutex
+	store   JournalStore
+	nextID  uint64
+	entries []JournalEntry
+}
+
+// NewJournal returns a journal persisted to store, starting with the entries
+// previously saved there, if any.
+func NewJournal(store JournalStore, entries []JournalEntry) *Journal {
+	j := &Journal{store: store, entries: append([]JournalEntry(nil), entries...)}
+	for _, e := range entries {
+		if e.ID >= j.nextID {
+			j.nextID = e.ID + 1
+		}
+	}
+	return j
+}
+
+// Entries returns the entries currently in the journal.
+func (j *Journal) Entries() []JournalEntry {
+	j.m.Lock()
+	defer j.m.Unlock()
+	return append([]JournalEntry(nil), j.entries...)
+}
+
+// begin records that the resource e is about to be allocated, and returns
+// the ID of its entry.
+func (j *Journal) begin(e JournalEntry) (uint64, error) {
+	j.m.Lock()
+	defer j.m.Unlock()
+	e.ID = j.nextID
+	e.State = JournalPending
+	if err := j.store.Save(append(j.entries, e)); err != nil {
+		return 0, fmt.Errorf("failed to record %s %s in journal: %s", e.Kind, e.Key, err)
+	}
+	j.nextID++
+	j.entries = append(j.entries, e)
+	return e.ID, nil
+}
+
+// complete records that the allocation of entry id succeeded. A non-empty
+// key replaces the entry's key, for resources whose name is only known once
+// allocated.
+func (j *Journal) complete(id uint64, key string) error {
+	j.m.Lock()
+	defer j.m.Unlock()
+	entries := append([]JournalEntry(nil), j.entries...)
+	for i := range entries {
+		if entries[i].ID == id {
+			entries[i].State = JournalAllocated
+			if key != "" {
+				entries[i].Key = key
+			}
+			return j.save(entries)
+		}
+	}
+	return fmt.Errorf("journal entry %d not found", id)
+}
+
+// abort records that the allocation of entry id failed without allocating
+// anything.
+func (j *Journal) abort(id uint64) error {
+	j.m.Lock()
+	defer j.m.Unlock()
+	for i, e := range j.entries {
+		if e.ID == id {
+			return j.save(append(append([]JournalEntry(nil), j.entries[:i]...), j.entries[i+1:]...))
+		}
+	}
+	return fmt.Errorf("journal entry %d not found", id)
+}
+
+// release records that the most recently allocated resource of kind with key
+// was released.
+func (j *Journal) release(kind ResourceKind, key string) error {
+	j.m.Lock()
+	defer j.m.Unlock()
+	for i := len(j.entries) - 1; i >= 0; i-- {
+		e := j.entries[i]
+		if e.State == JournalAllocated && e.Kind == kind && e.Key == key {
+			return j.save(append(append([]JournalEntry(nil), j.entries[:i]...), j.entries[i+1:]...))
+		}
+	}
+	return nil
+}
+
+// save persists entries and makes them the journal's entries. The lock MUST
+// be held when calling this function.
+func (j *Journal) save(entries []JournalEntry) error {
+	if err := j.store.Save(entries); err != nil {
+		return err
+	}
+	j.entries = entries
+	return nil
+}
+
+// track records in the journal of r, if any, that the resource e is about to
+// be allocated, calls allocate, and records the outcome. allocate returns the
+// resource's key if it was not known in advance.
+func (r *Resources) track(e JournalEntry, allocate func() (string, error)) error {
+	if r.Journal == nil {
+		_, err := allocate()
+		return err
+	}
+	id, err := r.Journal.begin(e)
+	if err != nil {
+		return err
+	}
+	key, err := allocate()
+	if err != nil {
+		if jerr := r.Journal.abort(id); jerr != nil {
+			logrus.Warnf("failed to record failed allocation of %s %s in journal: %s", e.Kind, e.Key, jerr)
+		}
+		return err
+	}
+	// The resource is allocated and recorded in r. If the journal cannot be
+	// updated, a replay would release it as a pending allocation, which is
+	// safe as the container does not outlive a crash of its owner.
+	if err := r.Journal.complete(id, key); err != nil {
+		logrus.Warnf("failed to record allocation of %s %s in journal: %s", e.Kind, e.Key, err)
+	}
+	return nil
+}
+
+// released records in the journal of r, if any, that a resource was released.
+func (r *Resources) released(kind ResourceKind, key string) {
+	if r.Journal == nil {
+		return
+	}
+	if err := r.Journal.release(kind, key); err != nil {
+		logrus.Warnf("failed to record release of %s %s in journal: %s", kind, key, err)
+	}
+}
+
+// ReplayJournal restores the state of resources recorded in j by a process
+// that exited before releasing them. Pending allocations may or may not have
+// happened, so they are released through rel, treating failures as the
+// resource not existing. A pending share of the utility VM is only released
+// if the VM holds more references to it than when the entry was begun, as
+// other containers may hold references to the same share; this requires that
+// no other container took or released a reference to it since. A pending
+// network namespace has no ID yet and is left for garbage collection.
+// Completed allocations are adopted: they are returned as Resources, recorded
+// in j, which the caller can go on using or release with ReleaseResources.
+func ReplayJournal(j *Journal, rel Releaser) *Resources {
+	r := &Resources{Journal: j}
+	for _, e := range j.Entries() {
+		if e.State == JournalAllocated {
+			adoptEntry(r, e)
+			continue
+		}
+		if isShare(e.Kind) && rel.ShareRefCount(e.Kind, e.Key) <= e.Refs {
+			logrus.Debugf("pending %s %s was not allocated", e.Kind, e.Key)
+		} else if err := releaseEntry(rel, e); err != nil {
+			logrus.Warnf("releasing pending %s %s: %s", e.Kind, e.Key, err)
+		}
+		if err := j.abort(e.ID); err != nil {
+			logrus.Warnf("failed to record release of pending %s %s in journal: %s", e.Kind, e.Key, err)
+		}
+	}
+	return r
+}
+
+// isShare returns whether resources of kind are shares of the utility VM,
+// which are reference counted by host path.
+func isShare(kind ResourceKind) bool {
+	switch kind {
+	case ResourceVSMB, ResourceVSMBFile, ResourcePlan9, ResourcePipe, ResourceSCSI:
+		return true
+	}
+	return false
+}
+
+// adoptEntry records the allocated resource e in r.
+func adoptEntry(r *Resources, e JournalEntry) {
+	switch e.Kind {
+	case ResourceNetNS:
+		r.NetNS = e.Key
+		r.CreatedNetNS = true
+	case ResourceEndpoint:
+		r.NetworkEndpoints = append(r.NetworkEndpoints, e.Key)
+	case ResourceVMNetNS:
+		r.NetNS = e.Key
+		r.AddedNetNSToVM = true
+	case ResourceLayers:
+		r.Layers = e.Layers
+		r.GuestRoot = e.GuestRoot
+	case ResourceVSMB:
+		r.VSMBMounts = append(r.VSMBMounts, e.Key)
+	case ResourceVSMBFile:
+		r.VSMBFileMounts = append(r.VSMBFileMounts, e.Key)
+	case ResourcePlan9:
+		r.Plan9Mounts = append(r.Plan9Mounts, e.Key)
+	case ResourcePipe:
+		r.PipeMounts = append(r.PipeMounts, e.Key)
+	case ResourceSCSI:
+		r.SCSIMounts = append(r.SCSIMounts, e.Key)
+	}
+}
+
+// releaseEntry releases the resource of a pending entry.
+func releaseEntry(rel Releaser, e JournalEntry) error {
+	switch e.Kind {
+	case ResourceNetNS:
+		if e.Key == "" {
+			return fmt.Errorf("namespace ID unknown")
+		}
+		return rel.RemoveNamespace(e.Key)
+	case ResourceEndpoint:
+		return rel.RemoveNamespaceEndpoint(e.NetNS, e.Key)
+	case ResourceVMNetNS:
+		return rel.RemoveNetNS(e.Key)
+	case ResourceLayers:
+		return rel.UnmountLayers(e.Layers, e.GuestRoot, true)
+	case ResourceVSMB:
+		return rel.RemoveVSMB(e.Key)
+	case ResourceVSMBFile:
+		return rel.RemoveVSMBFile(e.Key)
+	case ResourcePlan9:
+		return rel.RemovePlan9(e.Key)
+	case ResourcePipe:
+		return rel.RemovePipe(e.Key)
+	case ResourceSCSI:
+		return rel.RemoveSCSI(e.Key)
+	}
+	return fmt.Errorf("unknown resource kind %q", e.Kind)
+}
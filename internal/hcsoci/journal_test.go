@@ -0,0 +1,239 @@
+package hcsoci
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// memoryJournalStore keeps the last saved entries as JSON, as a real store
+// would persist them.
+type memoryJournalStore struct {
+	saved []byte
+	fail  bool
+}
+
+func (s *memoryJournalStore) Save(entries []JournalEntry) error {
+	if s.fail {
+		return errors.New("store failed")
+	}
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	s.saved = b
+	return nil
+}
+
+func (s *memoryJournalStore) load(t *testing.T) []JournalEntry {
+	var entries []JournalEntry
+	if err := json.Unmarshal(s.saved, &entries); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// fakeReleaser records the resources it releases, and reports the reference
+// counts of shares in refs.
+type fakeReleaser struct {
+	released []string
+	fail     map[string]bool
+	refs     map[string]uint32
+}
+
+func (f *fakeReleaser) release(s string) error {
+	if f.fail[s] {
+		return fmt.Errorf("failed to release %s", s)
+	}
+	f.released = append(f.released, s)
+	return nil
+}
+
+func (f *fakeReleaser) RemoveNetNS(id string) error {
+	return f.release("vmnetns " + id)
+}
+
+func (f *fakeReleaser) RemoveNamespace(id string) error {
+	return f.release("netns " + id)
+}
+
+func (f *fakeReleaser) RemoveNamespaceEndpoint(id string, endpointID string) error {
+	return f.release("endpoint " + id + " " + endpointID)
+}
+
+func (f *fakeReleaser) UnmountLayers(layers []string, guestRoot string, all bool) error {
+	return f.release(fmt.Sprintf("layers %v %s", layers, guestRoot))
+}
+
+func (f *fakeReleaser) RemoveVSMB(hostPath string) error {
+	return f.release("vsmb " + hostPath)
+}
+
+func (f *fakeReleaser) RemoveVSMBFile(hostPath string) error {
+	return f.release("vsmbfile " + hostPath)
+}
+
+func (f *fakeReleaser) RemovePlan9(hostPath string) error {
+	return f.release("plan9 " + hostPath)
+}
+
+func (f *fakeReleaser) RemovePipe(hostPath string) error {
+	return f.release("pipe " + hostPath)
+}
+
+func (f *fakeReleaser) RemoveSCSI(hostPath string) error {
+	return f.release("scsi " + hostPath)
+}
+
+func (f *fakeReleaser) ShareRefCount(kind ResourceKind, hostPath string) uint32 {
+	return f.refs[string(kind)+" "+hostPath]
+}
+
+func allocate(key string) func() (string, error) {
+	return func() (string, error) { return key, nil }
+}
+
+func TestJournalTrack(t *testing.T) {
+	store := &memoryJournalStore{}
+	r := &Resources{Journal: NewJournal(store, nil)}
+	if err := r.track(JournalEntry{Kind: ResourceNetNS}, allocate("ns")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.track(JournalEntry{Kind: ResourceVSMB, Key: `c:\a`}, allocate("")); err != nil {
+		t.Fatal(err)
+	}
+	failed := errors.New("allocation failed")
+	err := r.track(JournalEntry{Kind: ResourceVSMB, Key: `c:\b`}, func() (string, error) { return "", failed })
+	if err != failed {
+		t.Fatalf("got error %v, expected %v", err, failed)
+	}
+	expected := []JournalEntry{
+		{ID: 0, State: JournalAllocated, Kind: ResourceNetNS, Key: "ns"},
+		{ID: 1, State: JournalAllocated, Kind: ResourceVSMB, Key: `c:\a`},
+	}
+	if entries := store.load(t); !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("got %+v, expected %+v", entries, expected)
+	}
+
+	// Nothing is allocated if the intent cannot be recorded.
+	store.fail = true
+	called := false
+	err = r.track(JournalEntry{Kind: ResourcePlan9, Key: `c:\c`}, func() (string, error) {
+		called = true
+		return "", nil
+	})
+	if err == nil || called {
+		t.Fatalf("allocated without recording intent: %v", err)
+	}
+
+	// A reopened journal continues numbering after the saved entries.
+	store.fail = false
+	j := NewJournal(store, store.load(t))
+	if id, err := j.begin(JournalEntry{Kind: ResourcePipe, Key: "p"}); err != nil || id != 2 {
+		t.Fatalf("got id %d %v, expected 2", id, err)
+	}
+}
+
+func TestReplayJournal(t *testing.T) {
+	store := &memoryJournalStore{}
+	j := NewJournal(store, []JournalEntry{
+		{ID: 0, State: JournalAllocated, Kind: ResourceNetNS, Key: "ns"},
+		{ID: 1, State: JournalAllocated, Kind: ResourceEndpoint, Key: "ep1", NetNS: "ns"},
+		{ID: 2, State: JournalPending, Kind: ResourceEndpoint, Key: "ep2", NetNS: "ns"},
+		{ID: 3, State: JournalAllocated, Kind: ResourceLayers, Layers: []string{`c:\l1`, `c:\scratch`}, GuestRoot: `C:\c\1`},
+		{ID: 4, State: JournalAllocated, Kind: ResourceVSMB, Key: `c:\a`},
+		{ID: 5, State: JournalPending, Kind: ResourceVSMBFile, Key: `c:\a\f`},
+		{ID: 6, State: JournalPending, Kind: ResourceNetNS},
+		{ID: 7, State: JournalPending, Kind: ResourcePlan9, Key: `c:\p`},
+		{ID: 8, State: JournalPending, Kind: ResourceVSMB, Key: `c:\shared`, Refs: 1},
+		{ID: 9, State: JournalPending, Kind: ResourcePipe, Key: `\\.\pipe\p`},
+		{ID: 10, State: JournalAllocated, Kind: ResourceSCSI, Key: `c:\disk.vhdx`},
+	})
+	rel := &fakeReleaser{
+		fail: map[string]bool{`plan9 c:\p`: true},
+		refs: map[string]uint32{
+			`vsmbfile c:\a\f`: 1,
+			`plan9 c:\p`:      1,
+			`vsmb c:\shared`:  1,
+		},
+	}
+	r := ReplayJournal(j, rel)
+
+	// Pending allocations are released, even if that fails because they
+	// never happened. Pending shares are only released if the VM holds more
+	// references to them than when the entry was begun, so that the
+	// references of other containers to c:\shared are kept.
+	expectedReleased := []string{"endpoint ns ep2", `vsmbfile c:\a\f`}
+	if !reflect.DeepEqual(rel.released, expectedReleased) {
+		t.Fatalf("released %v, expected %v", rel.released, expectedReleased)
+	}
+	expected := &Resources{
+		GuestRoot:        `C:\c\1`,
+		NetNS:            "ns",
+		NetworkEndpoints: []string{"ep1"},
+		Layers:           []string{`c:\l1`, `c:\scratch`},
+		VSMBMounts:       []string{`c:\a`},
+		SCSIMounts:       []string{`c:\disk.vhdx`},
+		CreatedNetNS:     true,
+		Journal:          j,
+	}
+	if !reflect.DeepEqual(r, expected) {
+		t.Fatalf("got %+v, expected %+v", r, expected)
+	}
+	if entries := store.load(t); len(entries) != 5 {
+		t.Fatalf("expected only the adopted entries to remain, got %+v", entries)
+	}
+
+	// Releasing the adopted resources empties the journal.
+	rel.released = nil
+	if err := releaseResources(r, rel, true); err != nil {
+		t.Fatal(err)
+	}
+	expectedReleased = []string{"endpoint ns ep1", "netns ns", `layers [c:\l1 c:\scratch] C:\c\1`, `vsmb c:\a`, `scsi c:\disk.vhdx`}
+	if !reflect.DeepEqual(rel.released, expectedReleased) {
+		t.Fatalf("released %v, expected %v", rel.released, expectedReleased)
+	}
+	if entries := store.load(t); len(entries) != 0 {
+		t.Fatalf("expected an empty journal, got %+v", entries)
+	}
+}
+
+func TestReleaseResourcesIdempotent(t *testing.T) {
+	store := &memoryJournalStore{}
+	r := &Resources{Journal: NewJournal(store, nil)}
+	for _, key := range []string{`c:\a`, `c:\b`} {
+		if err := r.track(JournalEntry{Kind: ResourceVSMB, Key: key}, allocate("")); err != nil {
+			t.Fatal(err)
+		}
+		r.VSMBMounts = append(r.VSMBMounts, key)
+	}
+
+	// A failed release leaves the unreleased resources recorded.
+	rel := &fakeReleaser{fail: map[string]bool{`vsmb c:\a`: true}}
+	if err := releaseResources(r, rel, true); err == nil {
+		t.Fatal("expected release to fail")
+	}
+	if !reflect.DeepEqual(r.VSMBMounts, []string{`c:\a`}) {
+		t.Fatalf("wrong resources after failed release %v", r.VSMBMounts)
+	}
+	if entries := store.load(t); len(entries) != 1 || entries[0].Key != `c:\a` {
+		t.Fatalf("wrong journal after failed release %+v", entries)
+	}
+
+	// Retrying releases each resource only once.
+	delete(rel.fail, `vsmb c:\a`)
+	if err := releaseResources(r, rel, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := releaseResources(r, rel, true); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{`vsmb c:\b`, `vsmb c:\a`}; !reflect.DeepEqual(rel.released, expected) {
+		t.Fatalf("released %v, expected %v", rel.released, expected)
+	}
+	if entries := store.load(t); len(entries) != 0 {
+		t.Fatalf("expected an empty journal, got %+v", entries)
+	}
+}
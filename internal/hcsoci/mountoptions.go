@@ -0,0 +1,169 @@
+// +build windows
+
+package hcsoci
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Microsoft/hcsshim/internal/schema2"
+	"github.com/Microsoft/hcsshim/internal/uvm"
+)
+
+// mountOptions are the OCI options of a bind or virtual disk mount into a
+// hosted container that change how the mount's source is shared with the
+// utility VM.
+//
+// The options are:
+//
+//	ro             Share read-only.
+//	rw             Share read-write. This is the default.
+//	cache          Use cached I/O. The default for read-only VSMB shares. VSMB and virtual disks only.
+//	nocache        Use non-cached I/O. VSMB and virtual disks only.
+//	casesensitive  Create directories in case-sensitive mode. Plan9 only.
+//	linuxmetadata  Store Linux metadata such as owners and modes. Plan9 only.
+//	nooplocks      Disable oplocks. VSMB only.
+//	nodirnotify    Disable directory change notifications. VSMB only.
+//
+// Options that only affect how the guest binds the share into the container,
+// such as rbind or nosuid, are accepted and left to the guest. Any other
+// option is rejected.
+type mountOptions struct {
+	readOnly      bool
+	cache         bool
+	noCache       bool
+	caseSensitive bool
+	linuxMetadata bool
+	noOplocks     bool
+	noDirNotify   bool
+}
+
+// guestMountOptions are the options that are applied by the guest rather
+// than the share.
+var guestMountOptions = map[string]bool{
+	"bind": true, "rbind": true,
+	"private": true, "rprivate": true,
+	"shared": true, "rshared": true,
+	"slave": true, "rslave": true,
+	"nosuid": true, "nodev": true, "noexec": true,
+}
+
+// parseMountOptions parses the options of a bind mount, rejecting unknown and
+// conflicting ones.
+func parseMountOptions(options []string) (*mountOptions, error) {
+	mo := &mountOptions{}
+	readWrite := false
+	for _, o := range options {
+		switch strings.ToLower(o) {
+		case "ro":
+			mo.readOnly = true
+		case "rw":
+			readWrite = true
+		case "cache":
+			mo.cache = true
+		case "nocache":
+			mo.noCache = true
+		case "casesensitive":
+			mo.caseSensitive = true
+		case "linuxmetadata":
+			mo.linuxMetadata = true
+		case "nooplocks":
+			mo.noOplocks = true
+		case "nodirnotify":
+			mo.noDirNotify = true
+		default:
+			if !guestMountOptions[strings.ToLower(o)] {
+				return nil, fmt.Errorf("unsupported mount option %q", o)
+			}
+		}
+	}
+	if mo.readOnly && readWrite {
+		return nil, fmt.Errorf("mount options ro and rw conflict")
+	}
+	if mo.cache && mo.noCache {
+		return nil, fmt.Errorf("mount options cache and nocache conflict")
+	}
+	return mo, nil
+}
+
+// plan9Flags returns the VPlan9Flag* flags for a Plan9 share.
+func (mo *mountOptions) plan9Flags() (int32, error) {
+	switch {
+	case mo.cache, mo.noCache:
+		return 0, fmt.Errorf("cache mount options are not supported for Linux containers")
+	case mo.noOplocks, mo.noDirNotify:
+		return 0, fmt.Errorf("nooplocks and nodirnotify mount options are not supported for Linux containers")
+	}
+	var flags int32 = schema2.VPlan9FlagNone
+	if mo.readOnly {
+		flags |= schema2.VPlan9FlagReadOnly
+	}
+	if mo.caseSensitive {
+		flags |= schema2.VPlan9FlagCaseSensitive
+	}
+	if mo.linuxMetadata {
+		flags |= schema2.VPlan9FlagLinuxMetadata
+	}
+	return flags, nil
+}
+
+// vsmbFlags returns the VsmbFlag* flags for a VSMB share.
+func (mo *mountOptions) vsmbFlags() (int32, error) {
+	if mo.caseSensitive || mo.linuxMetadata {
+		return 0, fmt.Errorf("casesensitive and linuxmetadata mount options are not supported for Windows containers")
+	}
+	var flags int32 = schema2.VsmbFlagNone
+	cache := mo.cache
+	if mo.readOnly {
+		flags |= schema2.VsmbFlagReadOnly | schema2.VsmbFlagShareRead | schema2.VsmbFlagForceLevelIIOplocks
+		cache = !mo.noCache
+	}
+	if cache {
+		flags |= schema2.VsmbFlagCacheIO
+	}
+	if mo.noCache {
+		flags |= schema2.VsmbFlagNonCacheIO
+	}
+	if mo.noOplocks {
+		flags = flags&^schema2.VsmbFlagForceLevelIIOplocks | schema2.VsmbFlagNoOplocks
+	}
+	if mo.noDirNotify {
+		flags |= schema2.VsmbFlagNoDirnotify
+	}
+	return flags, nil
+}
+
+// scsiOptions returns the options for attaching a virtual disk.
+func (mo *mountOptions) scsiOptions() (*uvm.SCSIOptions, error) {
+	if mo.caseSensitive || mo.linuxMetadata || mo.noOplocks || mo.noDirNotify {
+		return nil, fmt.Errorf("casesensitive, linuxmetadata, nooplocks and nodirnotify mount options are not supported for virtual disks")
+	}
+	opts := &uvm.SCSIOptions{ReadOnly: mo.readOnly}
+	switch {
+	case mo.noCache:
+		opts.CachingMode = uvm.SCSICachingModeUncached
+	case mo.cache && mo.readOnly:
+		opts.CachingMode = uvm.SCSICachingModeReadOnlyCached
+	case mo.cache:
+		opts.CachingMode = uvm.SCSICachingModeCached
+	}
+	return opts, nil
+}
+
+// plan9MountFlags returns the Plan9 share flags for a bind mount's options.
+func plan9MountFlags(options []string) (int32, error) {
+	mo, err := parseMountOptions(options)
+	if err != nil {
+		return 0, err
+	}
+	return mo.plan9Flags()
+}
+
+// vsmbMountFlags returns the VSMB share flags for a bind mount's options.
+func vsmbMountFlags(options []string) (int32, error) {
+	mo, err := parseMountOptions(options)
+	if err != nil {
+		return 0, err
+	}
+	return mo.vsmbFlags()
+}
@@ -0,0 +1,110 @@
+// +build windows
+
+package hcsoci
+
+import (
+	"testing"
+
+	"github.com/Microsoft/hcsshim/internal/schema2"
+	"github.com/Microsoft/hcsshim/internal/uvm"
+)
+
+func TestPlan9MountFlags(t *testing.T) {
+	tests := []struct {
+		options []string
+		flags   int32
+		err     bool
+	}{
+		{options: nil, flags: schema2.VPlan9FlagNone},
+		{options: []string{"rbind", "rw", "nosuid"}, flags: schema2.VPlan9FlagNone},
+		{options: []string{"RO"}, flags: schema2.VPlan9FlagReadOnly},
+		{options: []string{"ro", "casesensitive", "linuxmetadata"}, flags: schema2.VPlan9FlagReadOnly | schema2.VPlan9FlagCaseSensitive | schema2.VPlan9FlagLinuxMetadata},
+		{options: []string{"ro", "rw"}, err: true},
+		{options: []string{"nocache"}, err: true},
+		{options: []string{"nooplocks"}, err: true},
+		{options: []string{"bogus"}, err: true},
+	}
+	for _, test := range tests {
+		flags, err := plan9MountFlags(test.options)
+		if test.err {
+			if err == nil {
+				t.Errorf("%v: expected error", test.options)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %s", test.options, err)
+		} else if flags != test.flags {
+			t.Errorf("%v: got flags %#x, expected %#x", test.options, flags, test.flags)
+		}
+	}
+}
+
+func TestVSMBMountFlags(t *testing.T) {
+	const readOnly = schema2.VsmbFlagReadOnly | schema2.VsmbFlagShareRead | schema2.VsmbFlagForceLevelIIOplocks
+	tests := []struct {
+		options []string
+		flags   int32
+		err     bool
+	}{
+		{options: nil, flags: schema2.VsmbFlagNone},
+		{options: []string{"rw", "rbind"}, flags: schema2.VsmbFlagNone},
+		{options: []string{"ro"}, flags: readOnly | schema2.VsmbFlagCacheIO},
+		{options: []string{"ro", "nocache"}, flags: readOnly | schema2.VsmbFlagNonCacheIO},
+		{options: []string{"cache"}, flags: schema2.VsmbFlagCacheIO},
+		{options: []string{"ro", "nooplocks", "nodirnotify"}, flags: schema2.VsmbFlagReadOnly | schema2.VsmbFlagShareRead | schema2.VsmbFlagCacheIO | schema2.VsmbFlagNoOplocks | schema2.VsmbFlagNoDirnotify},
+		{options: []string{"cache", "nocache"}, err: true},
+		{options: []string{"linuxmetadata"}, err: true},
+		{options: []string{"casesensitive"}, err: true},
+		{options: []string{"noatime"}, err: true},
+	}
+	for _, test := range tests {
+		flags, err := vsmbMountFlags(test.options)
+		if test.err {
+			if err == nil {
+				t.Errorf("%v: expected error", test.options)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %s", test.options, err)
+		} else if flags != test.flags {
+			t.Errorf("%v: got flags %#x, expected %#x", test.options, flags, test.flags)
+		}
+	}
+}
+
+func TestSCSIOptions(t *testing.T) {
+	tests := []struct {
+		options []string
+		opts    uvm.SCSIOptions
+		err     bool
+	}{
+		{options: nil, opts: uvm.SCSIOptions{}},
+		{options: []string{"ro", "rbind"}, opts: uvm.SCSIOptions{ReadOnly: true}},
+		{options: []string{"ro", "cache"}, opts: uvm.SCSIOptions{ReadOnly: true, CachingMode: uvm.SCSICachingModeReadOnlyCached}},
+		{options: []string{"cache"}, opts: uvm.SCSIOptions{CachingMode: uvm.SCSICachingModeCached}},
+		{options: []string{"ro", "nocache"}, opts: uvm.SCSIOptions{ReadOnly: true, CachingMode: uvm.SCSICachingModeUncached}},
+		{options: []string{"casesensitive"}, err: true},
+		{options: []string{"nooplocks"}, err: true},
+		{options: []string{"bogus"}, err: true},
+	}
+	for _, test := range tests {
+		mo, err := parseMountOptions(test.options)
+		var opts *uvm.SCSIOptions
+		if err == nil {
+			opts, err = mo.scsiOptions()
+		}
+		if test.err {
+			if err == nil {
+				t.Errorf("%v: expected error", test.options)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %s", test.options, err)
+		} else if *opts != test.opts {
+			t.Errorf("%v: got %+v, expected %+v", test.options, *opts, test.opts)
+		}
+	}
+}
@@ -6,7 +6,12 @@ import (
 )
 
 func createNetworkNamespace(coi *createOptionsInternal, resources *Resources) error {
-	netID, err := hns.CreateNamespace()
+	var netID string
+	err := resources.track(JournalEntry{Kind: ResourceNetNS}, func() (string, error) {
+		var err error
+		netID, err = hns.CreateNamespace()
+		return netID, err
+	})
 	if err != nil {
 		return err
 	}
@@ -14,7 +19,10 @@ func createNetworkNamespace(coi *createOptionsInternal, resources *Resources) er
 	resources.NetNS = netID
 	resources.CreatedNetNS = true
 	for _, endpointID := range coi.Spec.Windows.Network.EndpointList {
-		err = hns.AddNamespaceEndpoint(netID, endpointID)
+		endpointID := endpointID
+		err = resources.track(JournalEntry{Kind: ResourceEndpoint, Key: endpointID, NetNS: netID}, func() (string, error) {
+			return "", hns.AddNamespaceEndpoint(netID, endpointID)
+		})
 		if err != nil {
 			return err
 		}
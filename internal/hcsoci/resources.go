@@ -5,6 +5,7 @@ import (
 
 	"github.com/Microsoft/hcsshim/internal/hns"
 	"github.com/Microsoft/hcsshim/internal/uvm"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/sirupsen/logrus"
 )
 
@@ -14,24 +15,136 @@ type Resources struct {
 	NetworkEndpoints []string
 	Layers           []string
 	VSMBMounts       []string
+	VSMBFileMounts   []string
 	Plan9Mounts      []string
+	PipeMounts       []string
+	SCSIMounts       []string
+	AddedMounts      []specs.Mount // Mounts added to the running container by AddMount
 	CreatedNetNS     bool
 	AddedNetNSToVM   bool
+
+	// Journal, if not nil, records each resource before it is allocated and
+	// after it is released.
+	Journal *Journal `json:"-"`
+}
+
+// Releaser releases the resources recorded in Resources.
+type Releaser interface {
+	RemoveNetNS(id string) error
+	RemoveNamespace(id string) error
+	RemoveNamespaceEndpoint(id string, endpointID string) error
+	UnmountLayers(layers []string, guestRoot string, all bool) error
+	RemoveVSMB(hostPath string) error
+	RemoveVSMBFile(hostPath string) error
+	RemovePlan9(hostPath string) error
+	RemovePipe(hostPath string) error
+	RemoveSCSI(hostPath string) error
+	// ShareRefCount returns the number of references held to the share of
+	// kind with hostPath in the utility VM.
+	ShareRefCount(kind ResourceKind, hostPath string) uint32
+}
+
+// hostReleaser releases resources from HNS and the utility VM, if any.
+type hostReleaser struct {
+	*uvm.UtilityVM
+}
+
+// NewReleaser returns a Releaser for resources allocated by CreateContainer
+// or AddMount in vm, which is nil for a container that is not hosted.
+func NewReleaser(vm *uvm.UtilityVM) Releaser {
+	return hostReleaser{vm}
+}
+
+func (h hostReleaser) RemoveNetNS(id string) error {
+	if h.UtilityVM == nil {
+		return nil
+	}
+	return h.UtilityVM.RemoveNetNS(id)
+}
+
+func (hostReleaser) RemoveNamespace(id string) error {
+	return hns.RemoveNamespace(id)
+}
+
+func (hostReleaser) RemoveNamespaceEndpoint(id string, endpointID string) error {
+	return hns.RemoveNamespaceEndpoint(id, endpointID)
+}
+
+func (h hostReleaser) UnmountLayers(layers []string, guestRoot string, all bool) error {
+	op := unmountOperationSCSI
+	if h.UtilityVM == nil || all {
+		op = unmountOperationAll
+	}
+	return unmountContainerLayers(layers, guestRoot, h.UtilityVM, op)
+}
+
+func (h hostReleaser) ShareRefCount(kind ResourceKind, hostPath string) uint32 {
+	return shareRefCount(h.UtilityVM, kind, hostPath)
+}
+
+// shareRefCount returns the number of references vm holds to the share of
+// kind with hostPath.
+func shareRefCount(vm *uvm.UtilityVM, kind ResourceKind, hostPath string) uint32 {
+	if vm == nil {
+		return 0
+	}
+	a := vm.Allocation()
+	switch kind {
+	case ResourceVSMB, ResourceVSMBFile:
+		for _, share := range a.VSMB {
+			if share.HostPath == hostPath {
+				return share.RefCount
+			}
+		}
+	case ResourcePlan9:
+		for _, share := range a.Plan9 {
+			if share.HostPath == hostPath {
+				return share.RefCount
+			}
+		}
+	case ResourcePipe:
+		for _, pipe := range a.Pipes {
+			if pipe.HostPath == hostPath {
+				return pipe.RefCount
+			}
+		}
+	case ResourceSCSI:
+		for _, disk := range a.SCSI {
+			if disk.HostPath == hostPath {
+				return disk.RefCount
+			}
+		}
+	}
+	return 0
+}
+
+// shareEntry returns the journal entry for a reference to the share of kind
+// with hostPath in vm, recording the references already held to it.
+func shareEntry(vm *uvm.UtilityVM, kind ResourceKind, hostPath string) JournalEntry {
+	return JournalEntry{Kind: kind, Key: hostPath, Refs: shareRefCount(vm, kind, hostPath)}
 }
 
 func ReleaseResources(r *Resources, vm *uvm.UtilityVM, all bool) error {
-	if vm != nil && r.AddedNetNSToVM {
-		err := vm.RemoveNetNS(r.NetNS)
+	return releaseResources(r, NewReleaser(vm), all)
+}
+
+// releaseResources releases r through rel. Each resource is removed from r,
+// and from its journal, as soon as it is released, so that a failed release
+// can be retried without releasing anything twice.
+func releaseResources(r *Resources, rel Releaser, all bool) error {
+	if r.AddedNetNSToVM {
+		err := rel.RemoveNetNS(r.NetNS)
 		if err != nil {
 			logrus.Warn(err)
 		}
 		r.AddedNetNSToVM = false
+		r.released(ResourceVMNetNS, r.NetNS)
 	}
 
 	if r.CreatedNetNS {
 		for len(r.NetworkEndpoints) != 0 {
 			endpoint := r.NetworkEndpoints[len(r.NetworkEndpoints)-1]
-			err := hns.RemoveNamespaceEndpoint(r.NetNS, endpoint)
+			err := rel.RemoveNamespaceEndpoint(r.NetNS, endpoint)
 			if err != nil {
 				if !os.IsNotExist(err) {
 					return err
@@ -39,43 +152,48 @@ func ReleaseResources(r *Resources, vm *uvm.UtilityVM, all bool) error {
 				logrus.Warnf("removing endpoint %s from namespace %s: does not exist", endpoint, r.NetNS)
 			}
 			r.NetworkEndpoints = r.NetworkEndpoints[:len(r.NetworkEndpoints)-1]
+			r.released(ResourceEndpoint, endpoint)
 		}
 		r.NetworkEndpoints = nil
-		err := hns.RemoveNamespace(r.NetNS)
+		err := rel.RemoveNamespace(r.NetNS)
 		if err != nil && !os.IsNotExist(err) {
 			return err
 		}
 		r.CreatedNetNS = false
+		r.released(ResourceNetNS, r.NetNS)
 	}
 
 	if len(r.Layers) != 0 {
-		op := unmountOperationSCSI
-		if vm == nil || all {
-			op = unmountOperationAll
-		}
-		err := unmountContainerLayers(r.Layers, r.GuestRoot, vm, op)
+		err := rel.UnmountLayers(r.Layers, r.GuestRoot, all)
 		if err != nil {
 			return err
 		}
 		r.Layers = nil
+		r.released(ResourceLayers, "")
 	}
 
 	if all {
-		for len(r.VSMBMounts) != 0 {
-			mount := r.VSMBMounts[len(r.VSMBMounts)-1]
-			if err := vm.RemoveVSMB(mount); err != nil {
-				return err
-			}
-			r.VSMBMounts = r.VSMBMounts[:len(r.VSMBMounts)-1]
-		}
-
-		for len(r.Plan9Mounts) != 0 {
-			mount := r.Plan9Mounts[len(r.Plan9Mounts)-1]
-			if err := vm.RemovePlan9(mount); err != nil {
-				return err
+		for _, list := range []struct {
+			kind   ResourceKind
+			mounts *[]string
+			remove func(string) error
+		}{
+			{ResourceVSMB, &r.VSMBMounts, rel.RemoveVSMB},
+			{ResourceVSMBFile, &r.VSMBFileMounts, rel.RemoveVSMBFile},
+			{ResourcePlan9, &r.Plan9Mounts, rel.RemovePlan9},
+			{ResourcePipe, &r.PipeMounts, rel.RemovePipe},
+			{ResourceSCSI, &r.SCSIMounts, rel.RemoveSCSI},
+		} {
+			for len(*list.mounts) != 0 {
+				mount := (*list.mounts)[len(*list.mounts)-1]
+				if err := list.remove(mount); err != nil {
+					return err
+				}
+				*list.mounts = (*list.mounts)[:len(*list.mounts)-1]
+				r.released(list.kind, mount)
 			}
-			r.Plan9Mounts = r.Plan9Mounts[:len(r.Plan9Mounts)-1]
 		}
+		r.AddedMounts = nil
 	}
 
 	return nil
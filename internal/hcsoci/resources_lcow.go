@@ -23,7 +23,12 @@ func allocateLinuxResources(coi *createOptionsInternal, resources *Resources) er
 	}
 	if coi.Spec.Root.Path == "" {
 		logrus.Debugln("hcsshim::allocateLinuxResources mounting storage")
-		mcl, err := mountContainerLayers(coi.Spec.Windows.LayerFolders, resources.GuestRoot, coi.HostingSystem)
+		var mcl interface{}
+		err := resources.track(JournalEntry{Kind: ResourceLayers, Layers: coi.Spec.Windows.LayerFolders, GuestRoot: resources.GuestRoot}, func() (string, error) {
+			var err error
+			mcl, err = mountContainerLayers(coi.Spec.Windows.LayerFolders, resources.GuestRoot, coi.HostingSystem)
+			return "", err
+		})
 		if err != nil {
 			return fmt.Errorf("failed to mount container storage: %s", err)
 		}
@@ -40,7 +45,9 @@ func allocateLinuxResources(coi *createOptionsInternal, resources *Resources) er
 		if coi.Spec.Root.Readonly {
 			flags |= schema2.VPlan9FlagReadOnly
 		}
-		err := coi.HostingSystem.AddPlan9(hostPath, guestPath, flags)
+		err := resources.track(shareEntry(coi.HostingSystem, ResourcePlan9, hostPath), func() (string, error) {
+			return "", coi.HostingSystem.AddPlan9(hostPath, guestPath, flags)
+		})
 		if err != nil {
 			return fmt.Errorf("adding plan9 root: %s", err)
 		}
@@ -49,14 +56,26 @@ func allocateLinuxResources(coi *createOptionsInternal, resources *Resources) er
 	}
 
 	for i, mount := range coi.Spec.Mounts {
+		if mount.Type == MountTypeVirtualDisk && coi.HostingSystem != nil {
+			logrus.Debugf("hcsshim::allocateLinuxResources Hot-adding SCSI disk for OCI mount %+v", mount)
+			uvmPath, err := addVirtualDisk(coi.HostingSystem, resources, mount)
+			if err != nil {
+				return err
+			}
+			// The guest binds the disk's mount into the container.
+			coi.Spec.Mounts[i].Type = "bind"
+			coi.Spec.Mounts[i].Source = uvmPath
+			continue
+		}
 		if mount.Type != "bind" {
 			continue
 		}
 		if mount.Destination == "" || mount.Source == "" {
 			return fmt.Errorf("invalid OCI spec - a mount must have both source and a destination: %+v", mount)
 		}
-		if mount.Type != "" {
-			return fmt.Errorf("invalid OCI spec - Type '%s' must not be set", mount.Type)
+		flags, err := plan9MountFlags(mount.Options)
+		if err != nil {
+			return fmt.Errorf("invalid OCI spec - mount %+v: %s", mount, err)
 		}
 
 		if coi.HostingSystem != nil {
@@ -65,9 +84,9 @@ func allocateLinuxResources(coi *createOptionsInternal, resources *Resources) er
 			hostPath := mount.Source
 			guestPath := path.Join(resources.GuestRoot, mountPathPrefix+strconv.Itoa(i))
 
-			// TODO: Read-only
-			var flags int32
-			err := coi.HostingSystem.AddPlan9(hostPath, guestPath, flags)
+			err := resources.track(shareEntry(coi.HostingSystem, ResourcePlan9, hostPath), func() (string, error) {
+				return "", coi.HostingSystem.AddPlan9(hostPath, guestPath, flags)
+			})
 			if err != nil {
 				return fmt.Errorf("adding plan9 mount %+v: %s", mount, err)
 			}
@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/Microsoft/hcsshim/internal/schema2"
 	"github.com/Microsoft/hcsshim/internal/wclayer"
@@ -43,7 +42,12 @@ func allocateWindowsResources(coi *createOptionsInternal, resources *Resources)
 	}
 	if coi.Spec.Root.Path == "" && (coi.HostingSystem != nil || coi.Spec.Windows.HyperV == nil) {
 		logrus.Debugln("hcsshim::allocateWindowsResources mounting storage")
-		mcl, err := mountContainerLayers(coi.Spec.Windows.LayerFolders, resources.GuestRoot, coi.HostingSystem)
+		var mcl interface{}
+		err := resources.track(JournalEntry{Kind: ResourceLayers, Layers: coi.Spec.Windows.LayerFolders, GuestRoot: resources.GuestRoot}, func() (string, error) {
+			var err error
+			mcl, err = mountContainerLayers(coi.Spec.Windows.LayerFolders, resources.GuestRoot, coi.HostingSystem)
+			return "", err
+		})
 		if err != nil {
 			return fmt.Errorf("failed to mount container storage: %s", err)
 		}
@@ -63,25 +67,36 @@ func allocateWindowsResources(coi *createOptionsInternal, resources *Resources)
 		if mount.Destination == "" || mount.Source == "" {
 			return fmt.Errorf("invalid OCI spec - a mount must have both source and a destination: %+v", mount)
 		}
+		if mount.Type == MountTypeVirtualDisk && coi.HostingSystem != nil {
+			logrus.Debugf("hcsshim::allocateWindowsResources Hot-adding SCSI disk for OCI mount %+v", mount)
+			if _, err := addVirtualDisk(coi.HostingSystem, resources, mount); err != nil {
+				return err
+			}
+			continue
+		}
 		if mount.Type != "" {
 			return fmt.Errorf("invalid OCI spec - Type '%s' must not be set", mount.Type)
 		}
 
-		if coi.HostingSystem != nil {
+		if coi.HostingSystem != nil && isPipeMount(mount) {
+			logrus.Debugf("hcsshim::allocateWindowsResources Hot-adding mapped pipe for OCI mount %+v", mount)
+			err := resources.track(shareEntry(coi.HostingSystem, ResourcePipe, mount.Source), func() (string, error) {
+				return "", coi.HostingSystem.AddPipe(mount.Source)
+			})
+			if err != nil {
+				return fmt.Errorf("failed to add mapped pipe to utility VM for mount %+v: %s", mount, err)
+			}
+			resources.PipeMounts = append(resources.PipeMounts, mount.Source)
+		} else if coi.HostingSystem != nil {
 			logrus.Debugf("hcsshim::allocateWindowsResources Hot-adding VSMB share for OCI mount %+v", mount)
-			var flags int32 = schema2.VsmbFlagNone
-			for _, o := range mount.Options {
-				if strings.ToLower(o) == "ro" {
-					flags = schema2.VsmbFlagReadOnly | schema2.VsmbFlagCacheIO | schema2.VsmbFlagShareRead | schema2.VsmbFlagForceLevelIIOplocks
-					break
-				}
+			flags, err := vsmbMountFlags(mount.Options)
+			if err != nil {
+				return fmt.Errorf("invalid OCI spec - mount %+v: %s", mount, err)
 			}
 
-			err := coi.HostingSystem.AddVSMB(mount.Source, "", flags)
-			if err != nil {
-				return fmt.Errorf("failed to add VSMB share to utility VM for mount %+v: %s", mount, err)
+			if err := addVSMBMount(coi.HostingSystem, resources, mount, flags); err != nil {
+				return err
 			}
-			resources.VSMBMounts = append(resources.VSMBMounts, mount.Source)
 		}
 	}
 
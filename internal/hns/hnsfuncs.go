@@ -4,20 +4,25 @@ import (
 	"encoding/json"
 	"fmt"
 
-	"github.com/Microsoft/hcsshim/internal/hcserror"
-	"github.com/Microsoft/hcsshim/internal/interop"
 	"github.com/sirupsen/logrus"
 )
 
+// StandIn, if set, handles HNS calls in place of the host network service. It
+// returns the response HNS would, for testing the users of this package
+// without Windows. See package hnstest.
+var StandIn func(method, path, request string) (string, error)
+
 func hnsCall(method, path, request string, returnResponse interface{}) error {
-	var responseBuffer *uint16
 	logrus.Debugf("[%s]=>[%s] Request : %s", method, path, request)
 
-	err := _hnsCall(method, path, request, &responseBuffer)
+	call := callService
+	if StandIn != nil {
+		call = StandIn
+	}
+	response, err := call(method, path, request)
 	if err != nil {
-		return hcserror.New(err, "hnsCall ", "")
+		return err
 	}
-	response := interop.ConvertAndFreeCoTaskMemString(responseBuffer)
 
 	hnsresponse := &hnsResponse{}
 	if err = json.Unmarshal([]byte(response), &hnsresponse); err != nil {
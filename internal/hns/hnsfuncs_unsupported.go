@@ -0,0 +1,9 @@
+// +build !windows
+
+package hns
+
+import "errors"
+
+func callService(method, path, request string) (string, error) {
+	return "", errors.New("HNS is only available on Windows")
+}
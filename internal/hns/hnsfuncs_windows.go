@@ -0,0 +1,17 @@
+package hns
+
+import (
+	"github.com/Microsoft/hcsshim/internal/hcserror"
+	"github.com/Microsoft/hcsshim/internal/interop"
+)
+
+// callService makes a call to the host network service and returns its
+// response.
+func callService(method, path, request string) (string, error) {
+	var responseBuffer *uint16
+	err := _hnsCall(method, path, request, &responseBuffer)
+	if err != nil {
+		return "", hcserror.New(err, "hnsCall ", "")
+	}
+	return interop.ConvertAndFreeCoTaskMemString(responseBuffer), nil
+}
@@ -0,0 +1,402 @@
+// Package hnstest provides an in-memory stand-in for the host network service,
+// so that the users of package hns can be tested without Windows.
+package hnstest
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/Microsoft/hcsshim/internal/guid"
+	"github.com/Microsoft/hcsshim/internal/hns"
+)
+
+// errNotFound is the error HNS reports for objects that do not exist.
+const errNotFound = "Element not found."
+
+// Server is an in-memory HNS. It keeps networks, endpoints, namespaces and
+// policy lists, and allocates endpoint addresses from the first subnet of
+// their network. Attaching endpoints to containers and VMs is not supported.
+type Server struct {
+	m           sync.Mutex
+	networks    map[string]*hns.HNSNetwork
+	endpoints   map[string]*hns.HNSEndpoint
+	namespaces  map[string]*hns.Namespace
+	policyLists map[string]*hns.PolicyList
+}
+
+// New returns an empty server.
+func New() *Server {
+	return &Server{
+		networks:    make(map[string]*hns.HNSNetwork),
+		endpoints:   make(map[string]*hns.HNSEndpoint),
+		namespaces:  make(map[string]*hns.Namespace),
+		policyLists: make(map[string]*hns.PolicyList),
+	}
+}
+
+// Install makes the server handle the calls of package hns, and returns a
+// function restoring the previous handler.
+func (s *Server) Install() func() {
+	previous := hns.StandIn
+	hns.StandIn = s.Call
+	return func() {
+		hns.StandIn = previous
+	}
+}
+
+type response struct {
+	Success bool
+	Error   string          `json:",omitempty"`
+	Output  json.RawMessage `json:",omitempty"`
+}
+
+// Call handles an HNS call, returning the response envelope HNS would.
+func (s *Server) Call(method, path, request string) (string, error) {
+	s.m.Lock()
+	output, err := s.call(method, path, request)
+	s.m.Unlock()
+
+	r := response{Success: err == nil}
+	if err != nil {
+		r.Error = err.Error()
+	} else if output != nil {
+		b, err := json.Marshal(output)
+		if err != nil {
+			return "", err
+		}
+		r.Output = b
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Endpoints returns the endpoints of the server.
+func (s *Server) Endpoints() []hns.HNSEndpoint {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var endpoints []hns.HNSEndpoint
+	for _, e := range s.endpoints {
+		endpoints = append(endpoints, *e)
+	}
+	return endpoints
+}
+
+// PolicyLists returns the policy lists of the server.
+func (s *Server) PolicyLists() []hns.PolicyList {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var lists []hns.PolicyList
+	for _, l := range s.policyLists {
+		lists = append(lists, *l)
+	}
+	return lists
+}
+
+// call dispatches a call by the collection of its path. The lock MUST be held
+// when calling this function.
+func (s *Server) call(method, path, request string) (interface{}, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	id, action := "", ""
+	if len(parts) > 1 {
+		id = parts[1]
+	}
+	if len(parts) > 2 {
+		action = strings.Join(parts[2:], "/")
+	}
+	switch parts[0] {
+	case "networks":
+		if action == "" {
+			return s.network(method, id, request)
+		}
+	case "endpoints":
+		if action == "" {
+			return s.endpoint(method, id, request)
+		}
+	case "namespaces":
+		return s.namespace(method, id, action, request)
+	case "policylists":
+		if action == "" {
+			return s.policyList(method, id, request)
+		}
+	case "globals":
+		if method == "GET" && id == "version" && action == "" {
+			return hns.HNSVersion1803, nil
+		}
+	}
+	return nil, fmt.Errorf("%s %s is not supported", method, path)
+}
+
+func (s *Server) network(method, id, request string) (interface{}, error) {
+	switch {
+	case method == "GET" && id == "":
+		networks := []hns.HNSNetwork{}
+		for _, n := range s.networks {
+			networks = append(networks, *n)
+		}
+		return networks, nil
+	case method == "POST" && id == "":
+		n := &hns.HNSNetwork{}
+		if err := json.Unmarshal([]byte(request), n); err != nil {
+			return nil, err
+		}
+		if n.Type == "" {
+			return nil, errors.New("the network type is missing")
+		}
+		for _, subnet := range n.Subnets {
+			if _, _, err := net.ParseCIDR(subnet.AddressPrefix); err != nil {
+				return nil, err
+			}
+		}
+		n.Id = guid.New().String()
+		s.networks[n.Id] = n
+		return n, nil
+	}
+	n, ok := s.networks[id]
+	if !ok {
+		return nil, errors.New(errNotFound)
+	}
+	switch method {
+	case "GET":
+		return n, nil
+	case "DELETE":
+		for _, e := range s.endpoints {
+			if e.VirtualNetwork == id {
+				return nil, fmt.Errorf("network %s has endpoints", id)
+			}
+		}
+		delete(s.networks, id)
+		return n, nil
+	}
+	return nil, fmt.Errorf("%s is not supported on networks", method)
+}
+
+func (s *Server) endpoint(method, id, request string) (interface{}, error) {
+	switch {
+	case method == "GET" && id == "":
+		endpoints := []hns.HNSEndpoint{}
+		for _, e := range s.endpoints {
+			endpoints = append(endpoints, *e)
+		}
+		return endpoints, nil
+	case method == "POST" && id == "":
+		e := &hns.HNSEndpoint{}
+		if err := json.Unmarshal([]byte(request), e); err != nil {
+			return nil, err
+		}
+		if err := s.allocate(e); err != nil {
+			return nil, err
+		}
+		e.Id = guid.New().String()
+		s.endpoints[e.Id] = e
+		return e, nil
+	}
+	e, ok := s.endpoints[id]
+	if !ok {
+		return nil, errors.New(errNotFound)
+	}
+	switch method {
+	case "GET":
+		return e, nil
+	case "POST":
+		// An update replaces the policies of the endpoint.
+		update := &hns.HNSEndpoint{}
+		if err := json.Unmarshal([]byte(request), update); err != nil {
+			return nil, err
+		}
+		e.Policies = update.Policies
+		return e, nil
+	case "DELETE":
+		for _, ns := range s.namespaces {
+			if i := namespaceEndpoint(ns, id); i >= 0 {
+				return nil, fmt.Errorf("endpoint %s is in namespace %s", id, ns.ID)
+			}
+		}
+		delete(s.endpoints, id)
+		return e, nil
+	}
+	return nil, fmt.Errorf("%s is not supported on endpoints", method)
+}
+
+// allocate assigns the endpoint an address in the first subnet of its
+// network, unless it requests one, and fills in the gateway, prefix length
+// and MAC address.
+func (s *Server) allocate(e *hns.HNSEndpoint) error {
+	n, ok := s.networks[e.VirtualNetwork]
+	if !ok {
+		return fmt.Errorf("network %s: %s", e.VirtualNetwork, errNotFound)
+	}
+	if len(n.Subnets) == 0 {
+		return fmt.Errorf("network %s has no subnet", n.Name)
+	}
+	subnet := n.Subnets[0]
+	_, ipnet, err := net.ParseCIDR(subnet.AddressPrefix)
+	if err != nil {
+		return err
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits != 32 {
+		return fmt.Errorf("subnet %s is not IPv4", subnet.AddressPrefix)
+	}
+	used := map[string]bool{subnet.GatewayAddress: true}
+	for _, other := range s.endpoints {
+		if other.VirtualNetwork == n.Id {
+			used[other.IPAddress.String()] = true
+		}
+	}
+	if e.IPAddress != nil {
+		if !ipnet.Contains(e.IPAddress) {
+			return fmt.Errorf("address %s is not in subnet %s", e.IPAddress, subnet.AddressPrefix)
+		}
+		if used[e.IPAddress.String()] {
+			return fmt.Errorf("address %s is in use", e.IPAddress)
+		}
+	} else {
+		base := binary.BigEndian.Uint32(ipnet.IP.To4())
+		size := uint32(1) << uint(bits-ones)
+		for i := uint32(1); i+1 < size; i++ {
+			ip := make(net.IP, 4)
+			binary.BigEndian.PutUint32(ip, base+i)
+			if !used[ip.String()] {
+				e.IPAddress = ip
+				break
+			}
+		}
+		if e.IPAddress == nil {
+			return fmt.Errorf("subnet %s is full", subnet.AddressPrefix)
+		}
+	}
+	e.VirtualNetworkName = n.Name
+	e.GatewayAddress = subnet.GatewayAddress
+	e.PrefixLength = uint8(ones)
+	if e.MacAddress == "" {
+		ip := e.IPAddress.To4()
+		e.MacAddress = fmt.Sprintf("00-15-5D-%02X-%02X-%02X", ip[1], ip[2], ip[3])
+	}
+	return nil
+}
+
+type namespaceResource struct {
+	Type string
+	Data struct {
+		ID string `json:"Id"`
+	}
+}
+
+func (s *Server) namespace(method, id, action, request string) (interface{}, error) {
+	switch {
+	case method == "GET" && id == "":
+		namespaces := []hns.Namespace{}
+		for _, ns := range s.namespaces {
+			namespaces = append(namespaces, *ns)
+		}
+		return namespaces, nil
+	case method == "POST" && id == "":
+		ns := &hns.Namespace{}
+		if err := json.Unmarshal([]byte(request), ns); err != nil {
+			return nil, err
+		}
+		ns.ID = guid.New().String()
+		s.namespaces[ns.ID] = ns
+		return ns, nil
+	}
+	ns, ok := s.namespaces[id]
+	if !ok {
+		return nil, errors.New(errNotFound)
+	}
+	switch {
+	case method == "GET" && action == "":
+		return ns, nil
+	case method == "DELETE" && action == "":
+		delete(s.namespaces, id)
+		return ns, nil
+	case method == "POST" && (action == "addresource" || action == "removeresource"):
+		var r namespaceResource
+		if err := json.Unmarshal([]byte(request), &r); err != nil {
+			return nil, err
+		}
+		if r.Type != "Endpoint" {
+			return nil, fmt.Errorf("resource type %s is not supported", r.Type)
+		}
+		if _, ok := s.endpoints[r.Data.ID]; !ok {
+			return nil, fmt.Errorf("endpoint %s: %s", r.Data.ID, errNotFound)
+		}
+		i := namespaceEndpoint(ns, r.Data.ID)
+		if action == "addresource" {
+			if i >= 0 {
+				return nil, fmt.Errorf("endpoint %s is already in namespace %s", r.Data.ID, id)
+			}
+			data, err := json.Marshal(r.Data)
+			if err != nil {
+				return nil, err
+			}
+			ns.ResourceList = append(ns.ResourceList, hns.NamespaceResource{Type: r.Type, Data: data})
+		} else {
+			if i < 0 {
+				return nil, fmt.Errorf("endpoint %s: %s", r.Data.ID, errNotFound)
+			}
+			ns.ResourceList = append(ns.ResourceList[:i], ns.ResourceList[i+1:]...)
+		}
+		return ns, nil
+	}
+	return nil, fmt.Errorf("%s %s is not supported on namespaces", method, action)
+}
+
+// namespaceEndpoint returns the index of endpoint id in the resources of ns,
+// or -1.
+func namespaceEndpoint(ns *hns.Namespace, id string) int {
+	for i, r := range ns.ResourceList {
+		var data struct {
+			ID string `json:"Id"`
+		}
+		if r.Type == "Endpoint" && json.Unmarshal(r.Data, &data) == nil && data.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *Server) policyList(method, id, request string) (interface{}, error) {
+	switch {
+	case method == "GET" && id == "":
+		lists := []hns.PolicyList{}
+		for _, l := range s.policyLists {
+			lists = append(lists, *l)
+		}
+		return lists, nil
+	case method == "POST" && id == "":
+		l := &hns.PolicyList{}
+		if err := json.Unmarshal([]byte(request), l); err != nil {
+			return nil, err
+		}
+		for _, ref := range l.EndpointReferences {
+			if _, ok := s.endpoints[strings.TrimPrefix(ref, "/endpoints/")]; !ok {
+				return nil, fmt.Errorf("endpoint reference %s: %s", ref, errNotFound)
+			}
+		}
+		if l.ID == "" {
+			l.ID = guid.New().String()
+		}
+		s.policyLists[l.ID] = l
+		return l, nil
+	}
+	l, ok := s.policyLists[id]
+	if !ok {
+		return nil, errors.New(errNotFound)
+	}
+	switch method {
+	case "GET":
+		return l, nil
+	case "DELETE":
+		delete(s.policyLists, id)
+		return l, nil
+	}
+	return nil, fmt.Errorf("%s is not supported on policy lists", method)
+}
@@ -67,6 +67,15 @@ func CreateNamespace() (string, error) {
 	return ns.ID, nil
 }
 
+func ListNamespaces() ([]Namespace, error) {
+	var namespaces []Namespace
+	err := hnsCall("GET", "/namespaces/", "", &namespaces)
+	if err != nil {
+		return nil, fmt.Errorf("GET /namespaces/: %s", err)
+	}
+	return namespaces, nil
+}
+
 func RemoveNamespace(id string) error {
 	_, err := issueNamespaceRequest(&id, "DELETE", "", nil)
 	return err
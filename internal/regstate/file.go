@@ -0,0 +1,254 @@
+package regstate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	fileExt   = ".json"
+	updateExt = ".update"
+
+	// fileUpdateTimeout is how long to wait for another process to finish
+	// updating an ID before giving up.
+	fileUpdateTimeout = 10 * time.Second
+)
+
+// FileStore is a Store that keeps the state for each ID in a directory under
+// the root, with one JSON file per key. Unlike the registry, the state
+// survives reboots and can be inspected with ordinary tools.
+//
+// Values are written to a temporary file and renamed into place so that
+// readers never see a partial write. Updates to an ID are serialised across
+// processes by an update file next to the ID's directory, and the lock
+// returned by Lock is a lock file in the same place.
+type FileStore struct {
+	root string
+}
+
+var _ Store = &FileStore{}
+
+// OpenFile opens a file-backed store rooted at the directory root, creating
+// it if necessary.
+func OpenFile(root string) (*FileStore, error) {
+	if root == "" {
+		return nil, fmt.Errorf("no directory specified for the state store")
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	return &FileStore{root: root}, nil
+}
+
+// escapeName escapes an ID or key for use as a file name. In addition to the
+// escaping done for the registry, ':' is escaped since it is not valid in
+// Windows file names.
+func escapeName(name string) string {
+	return strings.Replace(url.PathEscape(name), ":", "%3A", -1)
+}
+
+func (s *FileStore) idPath(id string) string {
+	return filepath.Join(s.root, escapeName(id))
+}
+
+func (s *FileStore) keyPath(id, key string) string {
+	return filepath.Join(s.idPath(id), escapeName(key)+fileExt)
+}
+
+// Close is a no-op; it exists to satisfy Store.
+func (s *FileStore) Close() error {
+	return nil
+}
+
+// Enumerate returns the IDs in the store.
+func (s *FileStore) Enumerate() ([]string, error) {
+	fis, err := ioutil.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			continue
+		}
+		id, err := url.PathUnescape(fi.Name())
+		if err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (s *FileStore) createLockRecord(name string, pid int) (bool, error) {
+	f, err := os.OpenFile(filepath.Join(s.root, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	_, err = f.WriteString(strconv.Itoa(pid))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return true, err
+}
+
+func (s *FileStore) readLockRecord(name string) (int, time.Time, error) {
+	p := filepath.Join(s.root, name)
+	fi, err := os.Stat(p)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	// A record that is still being written has no owner yet.
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	return pid, fi.ModTime(), nil
+}
+
+func (s *FileStore) removeLockRecord(name string) error {
+	return os.Remove(filepath.Join(s.root, name))
+}
+
+// Lock takes the lock for id, waiting up to timeout for another process to
+// release it.
+func (s *FileStore) Lock(id string, timeout time.Duration) (*Lock, error) {
+	return acquireLock(s, id, escapeName(id)+lockExt, timeout)
+}
+
+// update takes the update lock for id, which is held only for the duration
+// of a single change. The returned function releases it.
+func (s *FileStore) update(id string) (func(), error) {
+	l, err := acquireLock(s, id, escapeName(id)+updateExt, fileUpdateTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return func() { l.Unlock() }, nil
+}
+
+// notFound returns the error for a missing key, distinguishing between a
+// missing ID and a missing value.
+func (s *FileStore) notFound(id, key string) error {
+	if _, err := os.Stat(s.idPath(id)); os.IsNotExist(err) {
+		return &NotFoundError{id}
+	}
+	return &NoStateError{id, key}
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory as
+// path and renames it over path.
+func writeFileAtomic(path string, data []byte) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (s *FileStore) set(id string, create bool, key string, state interface{}) error {
+	js, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	unlock, err := s.update(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if create {
+		err = os.Mkdir(s.idPath(id), 0700)
+		if os.IsExist(err) {
+			return fmt.Errorf("container %s already exists", id)
+		}
+	} else {
+		_, err = os.Stat(s.idPath(id))
+		if os.IsNotExist(err) {
+			return &NotFoundError{id}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.keyPath(id, key), js)
+}
+
+// Create creates id and sets its first value.
+func (s *FileStore) Create(id, key string, state interface{}) error {
+	return s.set(id, true, key, state)
+}
+
+// Set sets a value for an existing id.
+func (s *FileStore) Set(id, key string, state interface{}) error {
+	return s.set(id, false, key, state)
+}
+
+// Get reads a value into state.
+func (s *FileStore) Get(id, key string, state interface{}) error {
+	js, err := ioutil.ReadFile(s.keyPath(id, key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.notFound(id, key)
+		}
+		return err
+	}
+	return json.Unmarshal(js, state)
+}
+
+// Clear removes a value for id.
+func (s *FileStore) Clear(id, key string) error {
+	unlock, err := s.update(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = os.Remove(s.keyPath(id, key))
+	if os.IsNotExist(err) {
+		return s.notFound(id, key)
+	}
+	return err
+}
+
+// Remove removes id and all its values.
+func (s *FileStore) Remove(id string) error {
+	unlock, err := s.update(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if _, err := os.Stat(s.idPath(id)); err != nil {
+		if os.IsNotExist(err) {
+			return &NotFoundError{id}
+		}
+		return err
+	}
+	return os.RemoveAll(s.idPath(id))
+}
@@ -0,0 +1,77 @@
+package regstate
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileURLPath(t *testing.T) {
+	tests := []struct {
+		url, path string
+	}{
+		{"file:///C:/runhcs", `C:/runhcs`},
+		{"file:///var/run/runhcs", "/var/run/runhcs"},
+		{"file://localhost/var/run/runhcs", "/var/run/runhcs"},
+		{"file://server/share/runhcs", "//server/share/runhcs"},
+		{"file:runhcs/state", "runhcs/state"},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p := fileURLPath(u); p != filepath.FromSlash(test.path) {
+			t.Errorf("%s: got %q, expected %q", test.url, p, filepath.FromSlash(test.path))
+		}
+	}
+}
+
+func TestOpenStoreFileURL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runhcs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "state")
+	k, err := OpenStore("file:///"+strings.TrimPrefix(filepath.ToSlash(root), "/"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	if _, ok := k.(*FileStore); !ok {
+		t.Fatalf("expected a file store, got %T", k)
+	}
+	if err := k.Create("a:b", "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "a%3Ab", "key.json")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileClear(t *testing.T) {
+	k, cleanup := openTestFileStore(t)
+	defer cleanup()
+	err := k.Clear("x", "y")
+	if _, ok := err.(*NotFoundError); !ok {
+		t.Fatal("expected NotFoundError, got", err)
+	}
+	if err := k.Create("x", "y", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Clear("x", "y"); err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	err = k.Get("x", "y", &v)
+	if _, ok := err.(*NoStateError); !ok {
+		t.Fatal("expected NoStateError, got", err)
+	}
+	if err := k.Create("x", "y", 1); err == nil {
+		t.Fatal("expected error creating an existing ID")
+	}
+}
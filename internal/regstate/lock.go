@@ -0,0 +1,136 @@
+package regstate
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	lockExt   = ".lock"
+	breakExt  = ".break"
+	lockPoll  = 10 * time.Millisecond
+	lockGrace = 5 * time.Second
+)
+
+// lockRecords is implemented by each Store to keep the records that back
+// per-ID locks. A record holds the pid of the owning process.
+type lockRecords interface {
+	// createLockRecord atomically creates the record name owned by pid. It
+	// returns false if the record already exists.
+	createLockRecord(name string, pid int) (bool, error)
+	// readLockRecord returns the owner of the record name, or 0 if the owner
+	// has not been written yet, and the time the record was last written.
+	// It returns an error satisfying os.IsNotExist if there is no record.
+	readLockRecord(name string) (int, time.Time, error)
+	// removeLockRecord removes the record name.
+	removeLockRecord(name string) error
+}
+
+// LockTimeoutError is returned when a lock could not be taken because
+// another process held it for the whole timeout.
+type LockTimeoutError struct {
+	ID    string
+	Owner int
+}
+
+func (err *LockTimeoutError) Error() string {
+	return fmt.Sprintf("timed out waiting for the lock on ID '%s' held by process %d", err.ID, err.Owner)
+}
+
+// Lock is a held per-ID lock.
+type Lock struct {
+	records lockRecords
+	name    string
+}
+
+// Unlock releases the lock.
+func (l *Lock) Unlock() error {
+	return l.records.removeLockRecord(l.name)
+}
+
+// acquireLock takes the lock record name on behalf of id, waiting up to
+// timeout for another process to release it. Records left behind by
+// processes that have exited are broken.
+func acquireLock(r lockRecords, id, name string, timeout time.Duration) (*Lock, error) {
+	pid := os.Getpid()
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, err := r.createLockRecord(name, pid)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return &Lock{r, name}, nil
+		}
+		owner, broken, err := breakStaleLock(r, name)
+		if err != nil {
+			return nil, err
+		}
+		if broken {
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, &LockTimeoutError{ID: id, Owner: owner}
+		}
+		time.Sleep(lockPoll)
+	}
+}
+
+// isStale returns whether a lock record owned by owner and last written at
+// modTime should be broken. A record with no owner yet is only stale once it
+// is older than lockGrace, since its creator may still be writing it.
+func isStale(owner int, modTime time.Time) bool {
+	if owner == 0 {
+		return time.Since(modTime) > lockGrace
+	}
+	return !ProcessExists(owner)
+}
+
+// breakStaleLock removes the lock record name if its owner has exited. It
+// returns the current owner and whether the record is gone.
+func breakStaleLock(r lockRecords, name string) (int, bool, error) {
+	owner, modTime, err := r.readLockRecord(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, true, nil
+		}
+		return 0, false, err
+	}
+	if !isStale(owner, modTime) {
+		return owner, false, nil
+	}
+
+	// Serialise breaking the lock so that a process that has just taken the
+	// lock is not broken by another that saw the previous owner.
+	guard := name + breakExt
+	ok, err := r.createLockRecord(guard, os.Getpid())
+	if err != nil {
+		return owner, false, err
+	}
+	if !ok {
+		// Someone else is breaking the lock. Guards are held only briefly,
+		// so one that has been around for a while was left by a process
+		// that exited while breaking.
+		if _, guardTime, err := r.readLockRecord(guard); err == nil && time.Since(guardTime) > lockGrace {
+			r.removeLockRecord(guard)
+		}
+		return owner, false, nil
+	}
+	defer r.removeLockRecord(guard)
+
+	current, modTime, err := r.readLockRecord(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, true, nil
+		}
+		return owner, false, err
+	}
+	if current != owner || !isStale(current, modTime) {
+		return current, false, nil
+	}
+	if err := r.removeLockRecord(name); err != nil && !os.IsNotExist(err) {
+		return owner, false, err
+	}
+	return owner, true, nil
+}
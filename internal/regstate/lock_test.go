@@ -0,0 +1,151 @@
+package regstate
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	runStores(t, testLock)
+}
+
+func testLock(t *testing.T, k Store) {
+	l, err := k.Lock("a", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = k.Lock("a", 50*time.Millisecond)
+	if lerr, ok := err.(*LockTimeoutError); !ok || lerr.ID != "a" || lerr.Owner != os.Getpid() {
+		t.Fatal("expected lock timeout", err)
+	}
+	l2, err := k.Lock("b", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = l2.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	l, err = k.Lock("a", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := k.Enumerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Fatal("locks should not create IDs", ids)
+	}
+}
+
+// exitedPid returns the pid of a process that has exited.
+func exitedPid(t *testing.T) int {
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestLockStale(t *testing.T) {
+	runStores(t, testLockStale)
+}
+
+func testLockStale(t *testing.T, k Store) {
+	r := k.(lockRecords)
+	ok, err := r.createLockRecord(escapeName("a")+lockExt, exitedPid(t))
+	if err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	l, err := k.Lock("a", 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockUnowned(t *testing.T) {
+	runStores(t, testLockUnowned)
+}
+
+func testLockUnowned(t *testing.T, k Store) {
+	// A record without an owner may still be being written, so it must not
+	// be broken straight away.
+	r := k.(lockRecords)
+	name := escapeName("a") + lockExt
+	ok, err := r.createLockRecord(name, 0)
+	if err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	_, err = k.Lock("a", 50*time.Millisecond)
+	if _, ok := err.(*LockTimeoutError); !ok {
+		t.Fatal("expected lock timeout", err)
+	}
+	if err = r.removeLockRecord(name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockStress(t *testing.T) {
+	runStores(t, testLockStress)
+}
+
+func testLockStress(t *testing.T, k Store) {
+	const (
+		workers = 8
+		rounds  = 25
+	)
+	err := k.Create("a", "n", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				l, err := k.Lock("a", 30*time.Second)
+				if err != nil {
+					errs <- err
+					return
+				}
+				var n int
+				err = k.Get("a", "n", &n)
+				if err == nil {
+					err = k.Set("a", "n", n+1)
+				}
+				l.Unlock()
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	var n int
+	err = k.Get("a", "n", &n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != workers*rounds {
+		t.Fatal("lost updates", n)
+	}
+}
@@ -0,0 +1,12 @@
+// +build !windows
+
+package regstate
+
+import "syscall"
+
+// ProcessExists returns whether the process pid is still running. A pid that
+// has been reused by another process is reported as running.
+func ProcessExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
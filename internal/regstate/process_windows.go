@@ -0,0 +1,31 @@
+package regstate
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	_PROCESS_QUERY_LIMITED_INFORMATION = 0x1000
+	_STILL_ACTIVE                      = 259
+
+	_ERROR_INVALID_PARAMETER = syscall.Errno(87)
+)
+
+// ProcessExists returns whether the process pid is still running. A pid that
+// has been reused by another process is reported as running.
+func ProcessExists(pid int) bool {
+	h, err := windows.OpenProcess(_PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		// Access to a running process can be denied, but a process that does
+		// not exist is reported as an invalid parameter.
+		return err != _ERROR_INVALID_PARAMETER
+	}
+	defer windows.CloseHandle(h)
+	var code uint32
+	if err := windows.GetExitCodeProcess(h, &code); err != nil {
+		return true
+	}
+	return code == _STILL_ACTIVE
+}
@@ -1,3 +1,5 @@
+// +build windows
+
 package regstate
 
 import (
@@ -8,6 +10,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"syscall"
+	"time"
 
 	"golang.org/x/sys/windows/registry"
 )
@@ -21,6 +24,11 @@ const (
 
 	_REG_CREATED_NEW_KEY     = 1
 	_REG_OPENED_EXISTING_KEY = 2
+
+	// locksKey holds the lock records for the IDs under a root. It is not a
+	// valid escaped ID, so Enumerate does not return it.
+	locksKey = "locks%"
+	lockPid  = "pid"
 )
 
 type Key struct {
@@ -28,28 +36,13 @@ type Key struct {
 	Name string
 }
 
+var _ Store = &Key{}
+
 var localMachine = &Key{registry.LOCAL_MACHINE, "HKEY_LOCAL_MACHINE"}
 var localUser = &Key{registry.CURRENT_USER, "HKEY_CURRENT_USER"}
 
 var rootPath = `SOFTWARE\Microsoft\runhcs`
 
-type NotFoundError struct {
-	Id string
-}
-
-func (err *NotFoundError) Error() string {
-	return fmt.Sprintf("ID '%s' was not found", err.Id)
-}
-
-type NoStateError struct {
-	ID  string
-	Key string
-}
-
-func (err *NoStateError) Error() string {
-	return fmt.Sprintf("state '%s' is not present for ID '%s'", err.Key, err.ID)
-}
-
 func createVolatileKey(k *Key, path string, access uint32) (newk *Key, openedExisting bool, err error) {
 	var (
 		h syscall.Handle
@@ -85,6 +78,10 @@ func Open(root string, perUser bool) (*Key, error) {
 	return k2, nil
 }
 
+func openRegistry(root string, perUser bool) (Store, error) {
+	return Open(root, perUser)
+}
+
 func RemoveAll(root string, perUser bool) error {
 	k, err := hive(perUser).open(rootPath)
 	if err != nil {
@@ -106,6 +103,10 @@ func RemoveAll(root string, perUser bool) error {
 			return err
 		}
 	}
+	err = r.removeLockRecords()
+	if err != nil {
+		return err
+	}
 	r.Close()
 	return k.Remove(root)
 }
@@ -280,3 +281,83 @@ func (k *Key) Get(id, key string, state interface{}) error {
 	}
 	return err
 }
+
+func (k *Key) createLockRecord(name string, pid int) (bool, error) {
+	lk, _, err := createVolatileKey(k, locksKey, registry.ALL_ACCESS)
+	if err != nil {
+		return false, err
+	}
+	defer lk.Close()
+	rk, existing, err := createVolatileKey(lk, name, registry.ALL_ACCESS)
+	if err != nil {
+		return false, err
+	}
+	defer rk.Close()
+	if existing {
+		return false, nil
+	}
+	err = rk.SetQWordValue(lockPid, uint64(pid))
+	if err != nil {
+		return true, &os.PathError{Op: "RegSetValueEx", Path: rk.Name + ":" + lockPid, Err: err}
+	}
+	return true, nil
+}
+
+func (k *Key) readLockRecord(name string) (int, time.Time, error) {
+	rk, err := k.open(filepath.Join(locksKey, name))
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer rk.Close()
+	info, err := rk.Stat()
+	if err != nil {
+		return 0, time.Time{}, &os.PathError{Op: "RegQueryInfoKey", Path: rk.Name, Err: err}
+	}
+	// A record that is still being written has no owner yet.
+	pid, _, err := rk.GetIntegerValue(lockPid)
+	if err != nil && err != syscall.ERROR_FILE_NOT_FOUND {
+		return 0, time.Time{}, &os.PathError{Op: "RegQueryValueEx", Path: rk.Name + ":" + lockPid, Err: err}
+	}
+	return int(pid), info.ModTime(), nil
+}
+
+func (k *Key) removeLockRecord(name string) error {
+	path := filepath.Join(locksKey, name)
+	err := registry.DeleteKey(k.Key, path)
+	if err != nil {
+		return &os.PathError{Op: "RegDeleteKey", Path: filepath.Join(k.Name, path), Err: err}
+	}
+	return nil
+}
+
+func (k *Key) removeLockRecords() error {
+	lk, err := k.open(locksKey)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	names, err := lk.ReadSubKeyNames(0)
+	lk.Close()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err = k.removeLockRecord(name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	err = registry.DeleteKey(k.Key, locksKey)
+	if err != nil {
+		return &os.PathError{Op: "RegDeleteKey", Path: filepath.Join(k.Name, locksKey), Err: err}
+	}
+	return nil
+}
+
+// Lock takes the lock for id, waiting up to timeout for another process to
+// release it.
+func (k *Key) Lock(id string, timeout time.Duration) (*Lock, error) {
+	return acquireLock(k, id, url.PathEscape(id)+lockExt, timeout)
+}
@@ -1,25 +1,55 @@
 package regstate
 
 import (
+	"io/ioutil"
 	"os"
 	"testing"
 )
 
-var testKey = "runhcs-test-test-key"
+// testStore describes a Store implementation to run the tests against. open
+// returns an empty store and a function to clean it up.
+type testStore struct {
+	name string
+	open func(t *testing.T) (Store, func())
+}
 
-func prepTest(t *testing.T) {
-	err := RemoveAll(testKey, true)
-	if err != nil && !os.IsNotExist(err) {
-		t.Fatal(err)
-	}
+var testStores = []testStore{
+	{"file", openTestFileStore},
 }
 
-func TestLifetime(t *testing.T) {
-	prepTest(t)
-	k, err := Open(testKey, true)
+func openTestFileStore(t *testing.T) (Store, func()) {
+	dir, err := ioutil.TempDir("", "runhcs-test")
 	if err != nil {
 		t.Fatal(err)
 	}
+	k, err := OpenFile(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return k, func() {
+		k.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// runStores runs f against each of the test stores.
+func runStores(t *testing.T, f func(*testing.T, Store)) {
+	for _, ts := range testStores {
+		ts := ts
+		t.Run(ts.name, func(t *testing.T) {
+			k, cleanup := ts.open(t)
+			defer cleanup()
+			f(t, k)
+		})
+	}
+}
+
+func TestLifetime(t *testing.T) {
+	runStores(t, testLifetime)
+}
+
+func testLifetime(t *testing.T, k Store) {
 	ids, err := k.Enumerate()
 	if err != nil {
 		t.Fatal(err)
@@ -96,14 +126,13 @@ func TestLifetime(t *testing.T) {
 }
 
 func TestBool(t *testing.T) {
-	prepTest(t)
-	k, err := Open(testKey, true)
-	if err != nil {
-		t.Fatal(err)
-	}
+	runStores(t, testBool)
+}
+
+func testBool(t *testing.T, k Store) {
 	id := "x"
 	key := "y"
-	err = k.Create(id, key, true)
+	err := k.Create(id, key, true)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -118,14 +147,13 @@ func TestBool(t *testing.T) {
 }
 
 func TestInt(t *testing.T) {
-	prepTest(t)
-	k, err := Open(testKey, true)
-	if err != nil {
-		t.Fatal(err)
-	}
+	runStores(t, testInt)
+}
+
+func testInt(t *testing.T, k Store) {
 	id := "x"
 	key := "y"
-	err = k.Create(id, key, 10)
+	err := k.Create(id, key, 10)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -140,14 +168,13 @@ func TestInt(t *testing.T) {
 }
 
 func TestString(t *testing.T) {
-	prepTest(t)
-	k, err := Open(testKey, true)
-	if err != nil {
-		t.Fatal(err)
-	}
+	runStores(t, testString)
+}
+
+func testString(t *testing.T, k Store) {
 	id := "x"
 	key := "y"
-	err = k.Create(id, key, "blah")
+	err := k.Create(id, key, "blah")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -162,15 +189,14 @@ func TestString(t *testing.T) {
 }
 
 func TestJson(t *testing.T) {
-	prepTest(t)
-	k, err := Open(testKey, true)
-	if err != nil {
-		t.Fatal(err)
-	}
+	runStores(t, testJson)
+}
+
+func testJson(t *testing.T, k Store) {
 	id := "x"
 	key := "y"
 	v := struct{ X int }{5}
-	err = k.Create(id, key, &v)
+	err := k.Create(id, key, &v)
 	if err != nil {
 		t.Fatal(err)
 	}
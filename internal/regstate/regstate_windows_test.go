@@ -0,0 +1,24 @@
+package regstate
+
+import (
+	"os"
+	"testing"
+)
+
+var testKey = "runhcs-test-test-key"
+
+func init() {
+	testStores = append(testStores, testStore{"registry", openTestRegistry})
+}
+
+func openTestRegistry(t *testing.T) (Store, func()) {
+	err := RemoveAll(testKey, true)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	k, err := Open(testKey, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k, func() { k.Close() }
+}
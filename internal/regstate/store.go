@@ -0,0 +1,59 @@
+package regstate
+
+import (
+	"net/url"
+	"path/filepath"
+	"time"
+)
+
+// Store is the interface implemented by the backends that persist runhcs
+// state. Each ID holds a set of values, each named by a key. Values of type
+// bool, int and string are stored directly; anything else is stored as JSON.
+type Store interface {
+	// Create creates a new ID and sets its first value. It fails if the ID
+	// already exists.
+	Create(id, key string, state interface{}) error
+	// Set sets a value for an existing ID.
+	Set(id, key string, state interface{}) error
+	// Get reads a value into state, which must be a pointer.
+	Get(id, key string, state interface{}) error
+	// Clear removes a value from an existing ID.
+	Clear(id, key string) error
+	// Remove removes an ID and all of its values.
+	Remove(id string) error
+	// Enumerate returns all the IDs in the store.
+	Enumerate() ([]string, error)
+	// Lock takes the lock for an ID, waiting up to timeout for another
+	// process to release it. The lock is advisory; it does not prevent
+	// other calls from modifying the ID. A lock whose owning process has
+	// exited is broken. The ID does not need to exist.
+	Lock(id string, timeout time.Duration) (*Lock, error)
+	// Close releases the store.
+	Close() error
+}
+
+// OpenStore opens the store named by root. If root is a file URL (for
+// example file:///C:/runhcs), the state is kept in a directory of JSON files
+// at that path. Otherwise root names a volatile registry key as for Open.
+func OpenStore(root string, perUser bool) (Store, error) {
+	if u, err := url.Parse(root); err == nil && u.Scheme == "file" {
+		return OpenFile(fileURLPath(u))
+	}
+	return openRegistry(root, perUser)
+}
+
+// fileURLPath returns the local path for a file URL.
+func fileURLPath(u *url.URL) string {
+	p := u.Path
+	if u.Opaque != "" {
+		// file:relative/path
+		p = u.Opaque
+	} else if u.Host != "" && u.Host != "localhost" {
+		// file://server/share/path
+		p = "//" + u.Host + p
+	} else if len(p) >= 3 && p[0] == '/' && p[2] == ':' {
+		// file:///C:/path
+		p = p[1:]
+	}
+	return filepath.FromSlash(p)
+}
@@ -0,0 +1,9 @@
+// +build !windows
+
+package regstate
+
+import "errors"
+
+func openRegistry(root string, perUser bool) (Store, error) {
+	return nil, errors.New("registry state is only supported on Windows; use a file:// root")
+}
@@ -45,6 +45,7 @@ type ContainersResourcesMappedDirectoryV2 struct {
 	ContainerPath     string `json:"ContainerPath,omitempty"`
 	ReadOnly          bool   `json:"ReadOnly,omitempty"`
 	Lun               uint8  `json:"Lun,omitempty"`
+	Controller        uint8  `json:"Controller,omitempty"`       // SCSI controller of the disk in a utility VM. Defaults to 0.
 	AttachOnly        bool   `json:AttachOnly,omitempty"`        // If `true` then not mapped to the ContainerPath. This is used, for instance, if the disk doesn't yet have a filesystem on it
 	OverwriteIfExists bool   `json:OverwriteIfExists,omitempty"` // If `true` then delete `ContainerPath` if it exists. Only used if the container path will be a volume mount point and is not a drive letter. Otherwise this parameter is silently ignored.
 	CacheMode         string `json:CacheMode,omitempty"`         // Unspecified defaults to cache just the parent VHDs
@@ -196,6 +197,10 @@ type VirtualMachinesResourcesComputeProcessorV2 struct {
 	EnableSchedulerAssist          bool  `json:"EnableSchedulerAssist,omitempty"`
 }
 
+type VirtualMachinesResourcesComputeCpuGroupV2 struct {
+	Id string `json:"Id,omitempty"`
+}
+
 type VirtualMachinesResourcesComputeTopologyV2 struct {
 	Memory    *VirtualMachinesResourcesComputeMemoryV2    `json:"Memory,omitempty"`
 	Processor *VirtualMachinesResourcesComputeProcessorV2 `json:"Processor,omitempty"`
@@ -228,6 +233,12 @@ type VirtualMachinesResourcesStorageVpmemDeviceV2 struct {
 	HostPath    string `json:"HostPath,omitempty"`
 	ReadOnly    bool   `json:"ReadOnly,omitempty"`
 	ImageFormat string `json:"ImageFormat,omitempty"`
+	SizeBytes   uint64 `json:"SizeBytes,omitempty"` // For a device with no HostPath that holds mappings
+}
+
+type VirtualMachinesResourcesStorageVpmemMappingV2 struct {
+	HostPath    string `json:"HostPath,omitempty"`
+	ImageFormat string `json:"ImageFormat,omitempty"`
 }
 
 type VirtualMachinesResourcesStorageVpmemControllerV2 struct {
@@ -327,7 +338,7 @@ type VirtualMachinesResourcesStoragePlan9ShareV2 struct {
 	Name  string `json:"Name,omitempty"`
 	Path  string `json:"Path,omitempty"`
 	Port  int32  `json:"Port,omitempty"`
-	Flags string `json:"Flags,omitempty"`
+	Flags int32  `json:"Flags,omitempty"` // VPlan9Flag* values
 }
 
 type VirtualMachinesResourcesNetworkNic struct {
@@ -390,6 +401,7 @@ type ModifySettingsRequestV2 struct {
 const (
 	ResourceTypeMemory             ResourceType = "Memory"
 	ResourceTypeCpuGroup           ResourceType = "CpuGroup"
+	ResourceTypeProcessor          ResourceType = "Processor"
 	ResourceTypeMappedDirectory    ResourceType = "MappedDirectory"
 	ResourceTypeMappedPipe         ResourceType = "MappedPipe"
 	ResourceTypeMappedVirtualDisk  ResourceType = "MappedVirtualDisk"
@@ -410,7 +422,7 @@ const (
 	RequestTypeAdd     RequestType  = "Add"
 	RequestTypeRemove  RequestType  = "Remove"
 	RequestTypeNetwork ResourceType = "Network"
-	RequestTypeUpdate  ResourceType = "Update"
+	RequestTypeUpdate  RequestType  = "Update"
 )
 
 // This class is used by a modify request to add or remove a combined layers
@@ -0,0 +1,347 @@
+// Package shimrpc implements the protocol spoken between runhcs and its shim
+// processes.
+//
+// Messages are framed by the framing package. A client sends requests, each
+// with an ID, a method name and optional parameters, and the server answers
+// each with a response carrying the same ID and either a result or an error.
+// The first request on a connection is "hello", which negotiates the protocol
+// version and tells the client which methods the server supports.
+//
+// The protocol does not depend on the transport; runhcs uses it over named
+// pipes.
+package shimrpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/Microsoft/hcsshim/internal/framing"
+)
+
+const (
+	// Version is the newest version of the protocol implemented by this
+	// package.
+	Version = 1
+	// MinVersion is the oldest version of the protocol implemented by this
+	// package.
+	MinVersion = 1
+
+	// MethodHello is the method used to negotiate the protocol.
+	MethodHello = "hello"
+
+	// maxMessageSize bounds the size of a message so that a bad length
+	// prefix does not cause a huge allocation.
+	maxMessageSize = 16 * 1024 * 1024
+)
+
+// ErrorCode identifies the kind of an Error. The values follow JSON-RPC.
+type ErrorCode int
+
+const (
+	ErrorInvalidRequest     ErrorCode = -32600
+	ErrorMethodNotFound     ErrorCode = -32601
+	ErrorInvalidParams      ErrorCode = -32602
+	ErrorInternal           ErrorCode = -32603
+	ErrorNotFound           ErrorCode = -32001
+	ErrorUnsupportedVersion ErrorCode = -32002
+)
+
+// Error is an error returned by the server.
+type Error struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func (err *Error) Error() string {
+	return err.Message
+}
+
+// Errorf returns an Error with the given code.
+func Errorf(code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// IsCode returns whether err is an Error with the given code.
+func IsCode(err error, code ErrorCode) bool {
+	rerr, ok := err.(*Error)
+	return ok && rerr.Code == code
+}
+
+// Request is a call from the client.
+type Request struct {
+	ID     uint64          `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// Response is the server's answer to a Request.
+type Response struct {
+	ID     uint64          `json:"id"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *Error          `json:"error,omitempty"`
+}
+
+// Hello is the parameter and result of the hello method. The client sends
+// the newest version it supports, and the server replies with the version
+// to use and the methods it supports.
+type Hello struct {
+	Version int      `json:"version"`
+	Methods []string `json:"methods,omitempty"`
+}
+
+// WriteMessage writes v as a single message.
+func WriteMessage(w io.Writer, v interface{}) error {
+	return framing.Write(w, v, maxMessageSize)
+}
+
+// ReadMessage reads a single message into v. It returns io.EOF if r is at
+// the end of the stream before the message starts.
+func ReadMessage(r io.Reader, v interface{}) error {
+	return framing.Read(r, v, maxMessageSize)
+}
+
+// IsLegacyRequest returns whether first, the first byte sent by a client, is
+// the start of a request in the protocol used by runhcs before this package,
+// which sent a bare JSON object.
+func IsLegacyRequest(first byte) bool {
+	return first == '{'
+}
+
+// Client is the client end of a connection.
+type Client struct {
+	rw      io.ReadWriter
+	nextID  uint64
+	version int
+	methods map[string]bool
+}
+
+// NewClient negotiates the protocol over rw.
+func NewClient(rw io.ReadWriter) (*Client, error) {
+	c := &Client{rw: rw}
+	var hello Hello
+	err := c.call(MethodHello, &Hello{Version: Version}, &hello)
+	if err != nil {
+		return nil, err
+	}
+	if hello.Version < MinVersion || hello.Version > Version {
+		return nil, Errorf(ErrorUnsupportedVersion, "server chose unsupported protocol version %d", hello.Version)
+	}
+	c.version = hello.Version
+	c.methods = make(map[string]bool)
+	for _, m := range hello.Methods {
+		c.methods[m] = true
+	}
+	return c, nil
+}
+
+// Version returns the negotiated protocol version.
+func (c *Client) Version() int {
+	return c.version
+}
+
+// Supports returns whether the server supports method.
+func (c *Client) Supports(method string) bool {
+	return c.methods[method]
+}
+
+// Call calls method with params, which may be nil, and decodes the result
+// into result, which may be nil to discard it. An error returned by the
+// server is an *Error.
+func (c *Client) Call(method string, params, result interface{}) error {
+	if !c.Supports(method) {
+		return Errorf(ErrorMethodNotFound, "the shim does not support %s", method)
+	}
+	return c.call(method, params, result)
+}
+
+func (c *Client) call(method string, params, result interface{}) error {
+	c.nextID++
+	req := Request{ID: c.nextID, Method: method}
+	if params != nil {
+		b, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		req.Params = b
+	}
+	if err := WriteMessage(c.rw, &req); err != nil {
+		return err
+	}
+	var resp Response
+	if err := ReadMessage(c.rw, &resp); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	// A response with ID 0 reports a failure that happened before the
+	// server could read the request.
+	if resp.ID != req.ID && !(resp.ID == 0 && resp.Error != nil) {
+		return fmt.Errorf("response ID %d does not match request ID %d", resp.ID, req.ID)
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if result != nil && resp.Result != nil {
+		return json.Unmarshal(resp.Result, result)
+	}
+	return nil
+}
+
+// ServerConn is the server end of a connection.
+type ServerConn struct {
+	rw      io.ReadWriter
+	methods []string
+	version int
+}
+
+// NewServerConn returns the server end of a connection over rw, advertising
+// methods to the client.
+func NewServerConn(rw io.ReadWriter, methods []string) *ServerConn {
+	m := append([]string(nil), methods...)
+	sort.Strings(m)
+	return &ServerConn{rw: rw, methods: m}
+}
+
+// ReadRequest returns the next request other than hello, answering hello
+// requests itself. It returns io.EOF when the client closes the connection.
+func (s *ServerConn) ReadRequest() (*Request, error) {
+	for {
+		var req Request
+		if err := ReadMessage(s.rw, &req); err != nil {
+			return nil, err
+		}
+		if req.Method != MethodHello {
+			if s.version == 0 {
+				err := s.Reply(req.ID, nil, Errorf(ErrorInvalidRequest, "%s called before %s", req.Method, MethodHello))
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			return &req, nil
+		}
+		var hello Hello
+		if err := json.Unmarshal(req.Params, &hello); err != nil {
+			if err := s.Reply(req.ID, nil, Errorf(ErrorInvalidParams, "%s", err)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if hello.Version < MinVersion {
+			err := s.Reply(req.ID, nil, Errorf(ErrorUnsupportedVersion, "protocol version %d is not supported", hello.Version))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		s.version = hello.Version
+		if s.version > Version {
+			s.version = Version
+		}
+		if err := s.Reply(req.ID, &Hello{Version: s.version, Methods: s.methods}, nil); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Reply sends the response to request id. If err is not nil it is sent
+// instead of result; errors other than *Error are sent as internal errors.
+func (s *ServerConn) Reply(id uint64, result interface{}, err error) error {
+	return writeResponse(s.rw, id, result, err)
+}
+
+func writeResponse(w io.Writer, id uint64, result interface{}, err error) error {
+	resp := Response{ID: id}
+	if err != nil {
+		rerr, ok := err.(*Error)
+		if !ok {
+			rerr = &Error{Code: ErrorInternal, Message: err.Error()}
+		}
+		resp.Error = rerr
+	} else if result != nil {
+		b, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		resp.Result = b
+	}
+	return WriteMessage(w, &resp)
+}
+
+// Handler handles a request's parameters and returns its result.
+type Handler func(params json.RawMessage) (interface{}, error)
+
+// Serve handles requests on rw with handlers, keyed by method, until the
+// client closes the connection.
+func Serve(rw io.ReadWriter, handlers map[string]Handler) error {
+	var methods []string
+	for m := range handlers {
+		methods = append(methods, m)
+	}
+	s := NewServerConn(rw, methods)
+	for {
+		req, err := s.ReadRequest()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		var result interface{}
+		if h, ok := handlers[req.Method]; ok {
+			result, err = h(req.Params)
+		} else {
+			err = Errorf(ErrorMethodNotFound, "unknown method %s", req.Method)
+		}
+		if err := s.Reply(req.ID, result, err); err != nil {
+			return err
+		}
+	}
+}
+
+// WriteResult writes a successful response with ID 0. This is used to report
+// the result of one-way operations, such as a shim starting, that are not
+// requested by a client.
+func WriteResult(w io.Writer, result interface{}) error {
+	return writeResponse(w, 0, result, nil)
+}
+
+// ReadResult reads a response written by WriteResult or an ErrorWriter into
+// result, which may be nil. It returns io.EOF if no response was written.
+func ReadResult(r io.Reader, result interface{}) error {
+	var resp Response
+	if err := ReadMessage(r, &resp); err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if result != nil && resp.Result != nil {
+		return json.Unmarshal(resp.Result, result)
+	}
+	return nil
+}
+
+// ErrorWriter returns a writer that sends each write to w as an internal
+// error response to request id. It lets text errors, such as those printed
+// when a command fails, be sent over a connection.
+func ErrorWriter(w io.Writer, id uint64) io.Writer {
+	return &errorWriter{w, id}
+}
+
+type errorWriter struct {
+	w  io.Writer
+	id uint64
+}
+
+func (w *errorWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\r\n")
+	if err := writeResponse(w.w, w.id, nil, &Error{Code: ErrorInternal, Message: msg}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
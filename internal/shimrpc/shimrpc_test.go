@@ -0,0 +1,243 @@
+package shimrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+type echoParams struct {
+	Text string
+}
+
+var testHandlers = map[string]Handler{
+	"echo": func(params json.RawMessage) (interface{}, error) {
+		var p echoParams
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, Errorf(ErrorInvalidParams, "%s", err)
+		}
+		return &p, nil
+	},
+	"missing": func(json.RawMessage) (interface{}, error) {
+		return nil, Errorf(ErrorNotFound, "container foo not found")
+	},
+	"fail": func(json.RawMessage) (interface{}, error) {
+		return nil, errors.New("something broke")
+	},
+	"empty": func(json.RawMessage) (interface{}, error) {
+		return nil, nil
+	},
+}
+
+// startServer serves handlers on one end of a pipe and returns the other.
+func startServer(t *testing.T, handlers map[string]Handler) (net.Conn, <-chan error) {
+	client, server := net.Pipe()
+	errCh := make(chan error, 1)
+	go func() {
+		err := Serve(server, handlers)
+		server.Close()
+		errCh <- err
+	}()
+	return client, errCh
+}
+
+func TestCall(t *testing.T) {
+	conn, errCh := startServer(t, testHandlers)
+	c, err := NewClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Version() != Version {
+		t.Fatal("wrong version", c.Version())
+	}
+	for _, m := range []string{"echo", "missing", "fail", "empty"} {
+		if !c.Supports(m) {
+			t.Fatal("method not advertised", m)
+		}
+	}
+	if c.Supports("other") {
+		t.Fatal("unexpected method")
+	}
+
+	var result echoParams
+	if err := c.Call("echo", &echoParams{"hi"}, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Text != "hi" {
+		t.Fatal("wrong result", result)
+	}
+
+	err = c.Call("missing", nil, nil)
+	if !IsCode(err, ErrorNotFound) || err.Error() != "container foo not found" {
+		t.Fatal("expected not found error", err)
+	}
+	err = c.Call("fail", nil, nil)
+	if !IsCode(err, ErrorInternal) || err.Error() != "something broke" {
+		t.Fatal("expected internal error", err)
+	}
+	err = c.Call("echo", "not an object", nil)
+	if !IsCode(err, ErrorInvalidParams) {
+		t.Fatal("expected invalid params error", err)
+	}
+	if err := c.Call("empty", nil, &result); err != nil {
+		t.Fatal(err)
+	}
+
+	// Methods the server did not advertise fail without a round trip.
+	if err := c.Call("other", nil, nil); !IsCode(err, ErrorMethodNotFound) {
+		t.Fatal("expected method not found", err)
+	}
+
+	conn.Close()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	conn, errCh := startServer(t, testHandlers)
+	defer conn.Close()
+
+	call := func(req *Request) *Response {
+		if err := WriteMessage(conn, req); err != nil {
+			t.Fatal(err)
+		}
+		var resp Response
+		if err := ReadMessage(conn, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.ID != req.ID {
+			t.Fatalf("got ID %d, expected %d", resp.ID, req.ID)
+		}
+		return &resp
+	}
+
+	resp := call(&Request{ID: 1, Method: "echo", Params: json.RawMessage(`{}`)})
+	if resp.Error == nil || resp.Error.Code != ErrorInvalidRequest {
+		t.Fatal("expected hello to be required", resp)
+	}
+	resp = call(&Request{ID: 2, Method: MethodHello, Params: json.RawMessage(`{"version":0}`)})
+	if resp.Error == nil || resp.Error.Code != ErrorUnsupportedVersion {
+		t.Fatal("expected unsupported version", resp)
+	}
+	resp = call(&Request{ID: 3, Method: MethodHello, Params: json.RawMessage(`{"version":100}`)})
+	if resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	var hello Hello
+	if err := json.Unmarshal(resp.Result, &hello); err != nil {
+		t.Fatal(err)
+	}
+	expected := Hello{Version: Version, Methods: []string{"echo", "empty", "fail", "missing"}}
+	if !reflect.DeepEqual(hello, expected) {
+		t.Fatalf("got %+v, expected %+v", hello, expected)
+	}
+	resp = call(&Request{ID: 4, Method: "other"})
+	if resp.Error == nil || resp.Error.Code != ErrorMethodNotFound {
+		t.Fatal("expected method not found", resp)
+	}
+
+	conn.Close()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnsupportedServerVersion(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		var req Request
+		if err := ReadMessage(server, &req); err != nil {
+			return
+		}
+		writeResponse(server, req.ID, &Hello{Version: Version + 1}, nil)
+	}()
+	if _, err := NewClient(client); !IsCode(err, ErrorUnsupportedVersion) {
+		t.Fatal("expected unsupported version", err)
+	}
+}
+
+func TestMismatchedResponse(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		var req Request
+		if err := ReadMessage(server, &req); err != nil {
+			return
+		}
+		writeResponse(server, req.ID+1, &Hello{Version: Version}, nil)
+	}()
+	if _, err := NewClient(client); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestServerClosed(t *testing.T) {
+	client, server := net.Pipe()
+	server.Close()
+	if _, err := NewClient(client); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestResult(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteResult(&buf, &echoParams{"ok"}); err != nil {
+		t.Fatal(err)
+	}
+	var result echoParams
+	if err := ReadResult(&buf, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Text != "ok" {
+		t.Fatal("wrong result", result)
+	}
+	if err := ReadResult(&buf, nil); err != io.EOF {
+		t.Fatal("expected EOF", err)
+	}
+
+	fmt.Fprintln(ErrorWriter(&buf, 0), "shim failed")
+	err := ReadResult(&buf, nil)
+	if !IsCode(err, ErrorInternal) || err.Error() != "shim failed" {
+		t.Fatal("expected shim error", err)
+	}
+}
+
+func TestErrorWriterDuringCall(t *testing.T) {
+	// A server that fails before reading the request reports the error with
+	// ID 0.
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		var req Request
+		if err := ReadMessage(server, &req); err != nil {
+			return
+		}
+		fmt.Fprint(ErrorWriter(server, 0), "fatal")
+	}()
+	if _, err := NewClient(client); err == nil || err.Error() != "fatal" {
+		t.Fatal("expected fatal error", err)
+	}
+}
+
+func TestIsLegacyRequest(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteMessage(&buf, &Request{ID: 1, Method: MethodHello}); err != nil {
+		t.Fatal(err)
+	}
+	if IsLegacyRequest(buf.Bytes()[0]) {
+		t.Fatal("message detected as legacy")
+	}
+	if !IsLegacyRequest([]byte(`{"ID":"foo","Op":"create"}`)[0]) {
+		t.Fatal("legacy request not detected")
+	}
+}
@@ -0,0 +1,173 @@
+package uvm
+
+import "sort"
+
+// Allocation describes the devices and shares that are currently allocated
+// in a utility VM. It is intended for diagnostics.
+type Allocation struct {
+	ID              string
+	OperatingSystem string
+	MemorySizeInMB  int32                 // Current memory size of the VM.
+	ProcessorCount  int32                 // Current number of virtual processors of the VM.
+	CPUGroup        string                `json:",omitempty"`
+	SCSIControllers int                   // Number of SCSI controllers in the VM.
+	SCSIFreeLUNs    int                   // Number of LUNs still free across the SCSI controllers.
+	SCSI            []SCSIAllocation      `json:",omitempty"`
+	VPMem           []VPMemAllocation     `json:",omitempty"`
+	VSMB            []VSMBAllocation      `json:",omitempty"`
+	Plan9           []Plan9Allocation     `json:",omitempty"`
+	Pipes           []PipeAllocation      `json:",omitempty"`
+	Namespaces      []NamespaceAllocation `json:",omitempty"`
+}
+
+// SCSIAllocation is a disk attached to a SCSI controller.
+type SCSIAllocation struct {
+	Controller int
+	LUN        int
+	HostPath   string
+	UVMPath    string `json:",omitempty"`
+	ReadOnly   bool   `json:",omitempty"`
+	RefCount   uint32
+}
+
+// VPMemAllocation is a VPMem device. A device holding several layers has
+// no HostPath, and lists the layers in Mappings.
+type VPMemAllocation struct {
+	Device   uint32
+	HostPath string                   `json:",omitempty"`
+	UVMPath  string                   `json:",omitempty"`
+	RefCount uint32                   `json:",omitempty"`
+	Mappings []VPMemMappingAllocation `json:",omitempty"`
+}
+
+// VPMemMappingAllocation is a layer in a VPMem device holding several layers.
+type VPMemMappingAllocation struct {
+	HostPath string
+	UVMPath  string
+	Offset   uint64
+	Size     uint64
+	RefCount uint32
+}
+
+// VSMBAllocation is a VSMB share, or a file in a share restricted to
+// individual files.
+type VSMBAllocation struct {
+	Name     string
+	HostPath string
+	UVMPath  string `json:",omitempty"`
+	RefCount uint32
+}
+
+// Plan9Allocation is a Plan9 share.
+type Plan9Allocation struct {
+	Name     string
+	HostPath string
+	UVMPath  string
+	RefCount uint32
+}
+
+// PipeAllocation is a host named pipe mapped into the utility VM.
+type PipeAllocation struct {
+	HostPath string
+	RefCount uint32
+}
+
+// NamespaceAllocation is a network namespace and the endpoints whose NICs
+// were added for it.
+type NamespaceAllocation struct {
+	ID        string
+	Endpoints []string `json:",omitempty"`
+	RefCount  int
+}
+
+// Allocation returns a snapshot of the resources allocated in the utility VM.
+func (uvm *UtilityVM) Allocation() *Allocation {
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	a := &Allocation{
+		ID:              uvm.id,
+		OperatingSystem: uvm.operatingSystem,
+		MemorySizeInMB:  uvm.memorySizeInMB,
+		ProcessorCount:  uvm.processorCount,
+		CPUGroup:        uvm.cpuGroup,
+		SCSIControllers: uvm.scsiControllerCount,
+	}
+	for controller := 0; controller < uvm.scsiControllerCount; controller++ {
+		for lun, si := range uvm.scsiLocations[controller] {
+			if si.hostPath == "" {
+				a.SCSIFreeLUNs++
+			} else {
+				a.SCSI = append(a.SCSI, SCSIAllocation{
+					Controller: controller,
+					LUN:        lun,
+					HostPath:   si.hostPath,
+					UVMPath:    si.uvmPath,
+					ReadOnly:   si.readOnly,
+					RefCount:   si.refCount,
+				})
+			}
+		}
+	}
+	for device, vi := range uvm.vpmemDevices {
+		if vi.mappings != nil {
+			va := VPMemAllocation{Device: uint32(device)}
+			for _, r := range vi.mappings.alloc.Regions() {
+				va.Mappings = append(va.Mappings, VPMemMappingAllocation{
+					HostPath: r.Key,
+					UVMPath:  vi.mappings.uvmPaths[r.Key],
+					Offset:   r.Offset,
+					Size:     r.Size,
+					RefCount: r.RefCount,
+				})
+			}
+			a.VPMem = append(a.VPMem, va)
+		} else if vi.hostPath != "" {
+			a.VPMem = append(a.VPMem, VPMemAllocation{
+				Device:   uint32(device),
+				HostPath: vi.hostPath,
+				UVMPath:  vi.uvmPath,
+				RefCount: vi.refCount,
+			})
+		}
+	}
+	for hostPath, share := range uvm.vsmbShares {
+		a.VSMB = append(a.VSMB, VSMBAllocation{
+			Name:     share.name,
+			HostPath: hostPath,
+			UVMPath:  share.uvmPath,
+			RefCount: share.refCount,
+		})
+	}
+	for _, share := range uvm.vsmbFileShares {
+		for hostPath, refCount := range share.files {
+			a.VSMB = append(a.VSMB, VSMBAllocation{
+				Name:     share.name,
+				HostPath: hostPath,
+				RefCount: refCount,
+			})
+		}
+	}
+	sort.Slice(a.VSMB, func(i, j int) bool { return a.VSMB[i].HostPath < a.VSMB[j].HostPath })
+	for hostPath, share := range uvm.plan9Shares {
+		a.Plan9 = append(a.Plan9, Plan9Allocation{
+			Name:     share.name,
+			HostPath: hostPath,
+			UVMPath:  share.uvmPath,
+			RefCount: share.refCount,
+		})
+	}
+	sort.Slice(a.Plan9, func(i, j int) bool { return a.Plan9[i].HostPath < a.Plan9[j].HostPath })
+	for hostPath, refCount := range uvm.mappedPipes {
+		a.Pipes = append(a.Pipes, PipeAllocation{HostPath: hostPath, RefCount: refCount})
+	}
+	sort.Slice(a.Pipes, func(i, j int) bool { return a.Pipes[i].HostPath < a.Pipes[j].HostPath })
+	for id, ns := range uvm.namespaces {
+		na := NamespaceAllocation{ID: id, RefCount: ns.refCount}
+		for _, nic := range ns.nics {
+			na.Endpoints = append(na.Endpoints, nic.Endpoint.Id)
+		}
+		a.Namespaces = append(a.Namespaces, na)
+	}
+	sort.Slice(a.Namespaces, func(i, j int) bool { return a.Namespaces[i].ID < a.Namespaces[j].ID })
+	return a
+}
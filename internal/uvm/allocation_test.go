@@ -0,0 +1,54 @@
+package uvm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/internal/hns"
+	"github.com/Microsoft/hcsshim/internal/uvm/vpmemalloc"
+)
+
+func TestAllocation(t *testing.T) {
+	vm := &UtilityVM{
+		id:                  "test",
+		operatingSystem:     "linux",
+		scsiControllerCount: 2,
+		plan9Shares: map[string]*plan9Info{
+			`c:\b`: {refCount: 1, name: "p9-b", uvmPath: "/b"},
+			`c:\a`: {refCount: 2, name: "p9-a", uvmPath: "/a"},
+		},
+		namespaces: map[string]*namespaceInfo{
+			"ns": {refCount: 1, nics: []nicInfo{{Endpoint: &hns.HNSEndpoint{Id: "ep"}}}},
+		},
+	}
+	vm.scsiLocations[0][1] = scsiInfo{hostPath: `c:\scratch.vhdx`, uvmPath: "/tmp/scratch", refCount: 1}
+	vm.vpmemDevices[0] = vpmemInfo{hostPath: `c:\layer.vhd`, uvmPath: "/tmp/layer", refCount: 3}
+	alloc, err := vpmemalloc.New(1<<20, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := alloc.Allocate(`c:\small.vhd`, 5000); err != nil {
+		t.Fatal(err)
+	}
+	vm.vpmemDevices[1] = vpmemInfo{mappings: &vpmemMappings{alloc: alloc, uvmPaths: map[string]string{`c:\small.vhd`: "/tmp/v1-0"}}}
+
+	expected := &Allocation{
+		ID:              "test",
+		OperatingSystem: "linux",
+		SCSIControllers: 2,
+		SCSIFreeLUNs:    127,
+		SCSI:            []SCSIAllocation{{Controller: 0, LUN: 1, HostPath: `c:\scratch.vhdx`, UVMPath: "/tmp/scratch", RefCount: 1}},
+		VPMem: []VPMemAllocation{
+			{Device: 0, HostPath: `c:\layer.vhd`, UVMPath: "/tmp/layer", RefCount: 3},
+			{Device: 1, Mappings: []VPMemMappingAllocation{{HostPath: `c:\small.vhd`, UVMPath: "/tmp/v1-0", Offset: 0, Size: 5000, RefCount: 1}}},
+		},
+		Plan9: []Plan9Allocation{
+			{Name: "p9-a", HostPath: `c:\a`, UVMPath: "/a", RefCount: 2},
+			{Name: "p9-b", HostPath: `c:\b`, UVMPath: "/b", RefCount: 1},
+		},
+		Namespaces: []NamespaceAllocation{{ID: "ns", Endpoints: []string{"ep"}, RefCount: 1}},
+	}
+	if a := vm.Allocation(); !reflect.DeepEqual(a, expected) {
+		t.Fatalf("got %+v, expected %+v", a, expected)
+	}
+}
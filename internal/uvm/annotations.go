@@ -0,0 +1,167 @@
+package uvm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// These OCI annotations on a container that creates a utility VM configure
+// the VM. They are the only way for callers such as Kubernetes runtime
+// classes to influence the VM.
+const (
+	// AnnotationMemorySizeInMB is the VM's memory size in MB. It overrides
+	// the memory limit in the container's resources.
+	AnnotationMemorySizeInMB = "io.microsoft.virtualmachine.computetopology.memory.sizeinmb"
+	// AnnotationMaxMemorySizeInMB is the largest size in MB the VM's memory
+	// may be grown to while it runs. It defaults to the initial size.
+	AnnotationMaxMemorySizeInMB = "io.microsoft.virtualmachine.computetopology.memory.maximumsizeinmb"
+	// AnnotationAllowOvercommit is "true" if the VM's memory is backed by
+	// virtual memory in the host, which may be paged out, or "false" if it is
+	// backed by physical memory. It defaults to true.
+	AnnotationAllowOvercommit = "io.microsoft.virtualmachine.computetopology.memory.allowovercommit"
+	// AnnotationProcessorCount is the number of virtual processors in the
+	// VM. It overrides the CPU count in the container's resources.
+	AnnotationProcessorCount = "io.microsoft.virtualmachine.computetopology.processor.count"
+	// AnnotationMaxProcessorCount is the largest number of virtual processors
+	// the VM may be grown to while it runs. It defaults to the initial count.
+	AnnotationMaxProcessorCount = "io.microsoft.virtualmachine.computetopology.processor.maximumcount"
+	// AnnotationSCSIControllerCount is the number of SCSI controllers in the
+	// VM, up to MaxSCSIControllers. Each controller holds 64 disks.
+	AnnotationSCSIControllerCount = "io.microsoft.virtualmachine.devices.scsi.controllercount"
+	// AnnotationVPMemCount is the maximum number of VPMem devices in a Linux
+	// VM, up to MaxVPMEM.
+	AnnotationVPMemCount = "io.microsoft.virtualmachine.devices.virtualpmem.maximumcount"
+	// AnnotationVPMemMultiMapping is "true" to pack the read-only layers of
+	// containers in a Linux VM into shared VPMem devices.
+	AnnotationVPMemMultiMapping = "io.microsoft.virtualmachine.devices.virtualpmem.multimapping"
+	// AnnotationKernelBootOptions are additional kernel command line options
+	// for a Linux VM.
+	AnnotationKernelBootOptions = "io.microsoft.virtualmachine.lcow.kernelbootoptions"
+	// AnnotationBootFilesPath is the directory holding the kernel and root
+	// file system of a Linux VM.
+	AnnotationBootFilesPath = "io.microsoft.virtualmachine.lcow.bootfilesrootpath"
+	// AnnotationPreferredRootFSType is "initrd" or "vhd", the type of root
+	// file system to boot a Linux VM from.
+	AnnotationPreferredRootFSType = "io.microsoft.virtualmachine.lcow.preferredrootfstype"
+)
+
+// annotationError is a validation error for an annotation.
+type annotationError struct {
+	Annotation string
+	Value      string
+	Reason     string
+}
+
+func (err *annotationError) Error() string {
+	return fmt.Sprintf("invalid value %q for annotation %s: %s", err.Value, err.Annotation, err.Reason)
+}
+
+// ParseAnnotations applies the VM configuration annotations in annotations
+// to opts, whose OperatingSystem must already be set. Annotations that are not
+// VM configuration are ignored.
+func ParseAnnotations(opts *UVMOptions, annotations map[string]string) error {
+	parseInt32 := func(name string, min, max int32) (int32, bool, error) {
+		v, ok := annotations[name]
+		if !ok {
+			return 0, false, nil
+		}
+		i, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			return 0, false, &annotationError{name, v, "not an integer"}
+		}
+		if int32(i) < min || int32(i) > max {
+			return 0, false, &annotationError{name, v, fmt.Sprintf("must be between %d and %d", min, max)}
+		}
+		return int32(i), true, nil
+	}
+	linuxOnly := func(name string) (string, bool, error) {
+		v, ok := annotations[name]
+		if ok && opts.OperatingSystem != "linux" {
+			return "", false, &annotationError{name, v, "only supported for Linux utility VMs"}
+		}
+		return v, ok, nil
+	}
+
+	if i, ok, err := parseInt32(AnnotationMemorySizeInMB, 1, 1<<30); err != nil {
+		return err
+	} else if ok {
+		opts.MemorySizeInMB = i
+	}
+	if i, ok, err := parseInt32(AnnotationProcessorCount, 1, 1<<10); err != nil {
+		return err
+	} else if ok {
+		opts.ProcessorCount = i
+	}
+	if i, ok, err := parseInt32(AnnotationMaxMemorySizeInMB, 1, 1<<30); err != nil {
+		return err
+	} else if ok {
+		opts.MaxMemorySizeInMB = i
+	}
+	if i, ok, err := parseInt32(AnnotationMaxProcessorCount, 1, 1<<10); err != nil {
+		return err
+	} else if ok {
+		opts.MaxProcessorCount = i
+	}
+	if v, ok := annotations[AnnotationAllowOvercommit]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return &annotationError{AnnotationAllowOvercommit, v, "not a boolean"}
+		}
+		opts.AllowOvercommit = &b
+	}
+
+	if i, ok, err := parseInt32(AnnotationSCSIControllerCount, 1, MaxSCSIControllers); err != nil {
+		return err
+	} else if ok {
+		n := int(i)
+		opts.SCSIControllerCount = &n
+	}
+
+	if _, ok, err := linuxOnly(AnnotationVPMemCount); err != nil {
+		return err
+	} else if ok {
+		i, _, err := parseInt32(AnnotationVPMemCount, 1, MaxVPMEM)
+		if err != nil {
+			return err
+		}
+		opts.VPMemDeviceCount = i
+	}
+	if v, ok, err := linuxOnly(AnnotationVPMemMultiMapping); err != nil {
+		return err
+	} else if ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return &annotationError{AnnotationVPMemMultiMapping, v, "not a boolean"}
+		}
+		opts.VPMemMultiMapping = b
+	}
+	if v, ok, err := linuxOnly(AnnotationKernelBootOptions); err != nil {
+		return err
+	} else if ok {
+		opts.KernelBootOptions = v
+	}
+	if v, ok, err := linuxOnly(AnnotationBootFilesPath); err != nil {
+		return err
+	} else if ok {
+		if v == "" {
+			return &annotationError{AnnotationBootFilesPath, v, "must not be empty"}
+		}
+		opts.BootFilesPath = v
+	}
+	if v, ok, err := linuxOnly(AnnotationPreferredRootFSType); err != nil {
+		return err
+	} else if ok {
+		var t PreferredRootFSType
+		switch strings.ToLower(v) {
+		case "initrd":
+			t = PreferredRootFSTypeInitRd
+		case "vhd":
+			t = PreferredRootFSTypeVHD
+		default:
+			return &annotationError{AnnotationPreferredRootFSType, v, `must be "initrd" or "vhd"`}
+		}
+		opts.PreferredRootFSType = &t
+	}
+	return nil
+}
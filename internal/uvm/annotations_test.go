@@ -0,0 +1,116 @@
+package uvm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAnnotations(t *testing.T) {
+	yes, no := true, false
+	four := 4
+	vhd := PreferredRootFSType(PreferredRootFSTypeVHD)
+	tests := []struct {
+		os          string
+		annotations map[string]string
+		expected    UVMOptions
+		err         string
+	}{
+		{
+			os:          "windows",
+			annotations: map[string]string{"other": "x"},
+			expected:    UVMOptions{OperatingSystem: "windows"},
+		},
+		{
+			os: "windows",
+			annotations: map[string]string{
+				AnnotationMemorySizeInMB:      "2048",
+				AnnotationProcessorCount:      "4",
+				AnnotationAllowOvercommit:     "false",
+				AnnotationSCSIControllerCount: "4",
+				AnnotationMaxMemorySizeInMB:   "8192",
+				AnnotationMaxProcessorCount:   "8",
+			},
+			expected: UVMOptions{
+				OperatingSystem:     "windows",
+				MemorySizeInMB:      2048,
+				MaxMemorySizeInMB:   8192,
+				ProcessorCount:      4,
+				MaxProcessorCount:   8,
+				AllowOvercommit:     &no,
+				SCSIControllerCount: &four,
+			},
+		},
+		{
+			os: "linux",
+			annotations: map[string]string{
+				AnnotationAllowOvercommit:     "true",
+				AnnotationVPMemCount:          "16",
+				AnnotationVPMemMultiMapping:   "true",
+				AnnotationKernelBootOptions:   "debug",
+				AnnotationBootFilesPath:       `c:\boot`,
+				AnnotationPreferredRootFSType: "VHD",
+			},
+			expected: UVMOptions{
+				OperatingSystem:     "linux",
+				AllowOvercommit:     &yes,
+				VPMemDeviceCount:    16,
+				VPMemMultiMapping:   true,
+				KernelBootOptions:   "debug",
+				BootFilesPath:       `c:\boot`,
+				PreferredRootFSType: &vhd,
+			},
+		},
+		{
+			os:          "linux",
+			annotations: map[string]string{AnnotationSCSIControllerCount: "5"},
+			err:         `invalid value "5" for annotation ` + AnnotationSCSIControllerCount + `: must be between 1 and 4`,
+		},
+		{
+			os:          "linux",
+			annotations: map[string]string{AnnotationMemorySizeInMB: "lots"},
+			err:         `invalid value "lots" for annotation ` + AnnotationMemorySizeInMB + `: not an integer`,
+		},
+		{
+			os:          "linux",
+			annotations: map[string]string{AnnotationProcessorCount: "0"},
+			err:         `invalid value "0" for annotation ` + AnnotationProcessorCount + `: must be between 1 and 1024`,
+		},
+		{
+			os:          "linux",
+			annotations: map[string]string{AnnotationAllowOvercommit: "maybe"},
+			err:         `invalid value "maybe" for annotation ` + AnnotationAllowOvercommit + `: not a boolean`,
+		},
+		{
+			os:          "linux",
+			annotations: map[string]string{AnnotationVPMemCount: "129"},
+			err:         `invalid value "129" for annotation ` + AnnotationVPMemCount + `: must be between 1 and 128`,
+		},
+		{
+			os:          "windows",
+			annotations: map[string]string{AnnotationKernelBootOptions: "debug"},
+			err:         `invalid value "debug" for annotation ` + AnnotationKernelBootOptions + `: only supported for Linux utility VMs`,
+		},
+		{
+			os:          "linux",
+			annotations: map[string]string{AnnotationPreferredRootFSType: "iso"},
+			err:         `invalid value "iso" for annotation ` + AnnotationPreferredRootFSType + `: must be "initrd" or "vhd"`,
+		},
+	}
+	for i, test := range tests {
+		opts := UVMOptions{OperatingSystem: test.os}
+		err := ParseAnnotations(&opts, test.annotations)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%d: got error %v, expected %s", i, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(opts, test.expected) {
+			t.Errorf("%d: got %+v, expected %+v", i, opts, test.expected)
+		}
+	}
+}
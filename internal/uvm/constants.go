@@ -13,6 +13,25 @@ const (
 
 	MaxVPMEM = 128
 
+	// plan9Port is the vsock port of the Plan9 server that serves every
+	// Plan9 share in a utility VM.
+	plan9Port = 564
+
+	// DefaultVPMemDeviceSizeBytes is the default size of a VPMem device
+	// holding several layers.
+	DefaultVPMemDeviceSizeBytes = 4 * 1024 * 1024 * 1024
+
+	// vpmemMappingAlignment is the alignment of layers within a VPMem device
+	// holding several layers, so that the guest can map each one directly.
+	vpmemMappingAlignment = 4096
+
+	// MaxSCSIControllers is the number of SCSI controllers Hyper-V supports
+	// in a utility VM.
+	MaxSCSIControllers = 4
+
+	// scsiLUNsPerController is the number of LUNs on each SCSI controller.
+	scsiLUNsPerController = 64
+
 	// TODO: These aren't actually used yet
 	// When removing devices from a utility VM.
 	removeTypeVirtualHardware = 1
@@ -20,4 +39,14 @@ const (
 	removeTypeAll             = removeTypeVirtualHardware + removeTypeNotifyGuest
 )
 
+// scsiControllerGUIDs are the channel instance GUIDs of the SCSI controllers.
+// They are fixed so that each controller has the same identity, and so the
+// same guest device path, every time a VM is created.
+var scsiControllerGUIDs = [MaxSCSIControllers]string{
+	"df6d0690-79e5-55b6-a5ec-c1e2f77f580a",
+	"0110f83b-de10-5172-a266-78bca56bf50a",
+	"b5d2d8d4-3a75-51bf-945b-3444dc6b8579",
+	"305891a9-b251-5dfe-91a2-c25d9212275b",
+}
+
 var errNotSupported = fmt.Errorf("not supported")
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 
 	"github.com/Microsoft/hcsshim/internal/guid"
@@ -36,6 +37,13 @@ type UVMOptions struct {
 	OperatingSystem         string                  // "windows" or "linux".
 	Resources               *specs.WindowsResources // Optional resources for the utility VM. Supports Memory.limit and CPU.Count only currently. // TODO consider extending?
 	AdditionHCSDocumentJSON string                  // Optional additional JSON to merge into the HCS document prior
+	MemorySizeInMB          int32                   // Memory for the utility VM in MB. Overrides Resources. Defaults to 1024.
+	ProcessorCount          int32                   // Number of virtual processors. Overrides Resources. Defaults to 2, or 1 on a single processor host.
+	MaxMemorySizeInMB       int32                   // Largest memory size in MB UpdateMemory may resize the running VM to. Defaults to the initial size.
+	MaxProcessorCount       int32                   // Largest number of virtual processors UpdateProcessors may give the running VM. Defaults to the initial count.
+	AllowOvercommit         *bool                   // If false, memory is backed by physical rather than virtual memory in the host. Defaults to true.
+	Memory                  *MemoryTopology         // Optional memory configuration. Defaults depend on the operating system.
+	Processor               *ProcessorTopology      // Optional processor configuration.
 
 	// WCOW specific parameters
 	LayerFolders []string // Set of folders for base layers and scratch. Ordered from top most read-only through base read-only layer, followed by scratch
@@ -49,7 +57,34 @@ type UVMOptions struct {
 	EnableGraphicsConsole bool                 // If true, enable a graphics console for the utility VM
 	ConsolePipe           string               // The named pipe path to use for the serial console.  eg \\.\pipe\vmpipe
 	VPMemDeviceCount      int32                // Number of VPMem devices. Limit at 128. If booting UVM from VHD, device 0 is taken.
-	SCSIControllerCount   *int                 // The number of SCSI controllers. Defaults to 1 if omitted. Currently we only support 0 or 1.
+	VPMemMultiMapping     bool                 // If true, pack read-only layers into shared VPMem devices rather than one device per layer.
+	VPMemDeviceSizeBytes  uint64               // Size of each shared device with VPMemMultiMapping. Defaults to DefaultVPMemDeviceSizeBytes.
+	SCSIControllerCount   *int                 // The number of SCSI controllers, up to MaxSCSIControllers. Defaults to 1 if omitted.
+}
+
+// Size returns the memory size in MB and the number of virtual processors of
+// a utility VM created with opts.
+func (opts *UVMOptions) Size() (int32, int32) {
+	memory := int32(1024)
+	processors := int32(2)
+	if runtime.NumCPU() == 1 {
+		processors = 1
+	}
+	if opts.Resources != nil {
+		if opts.Resources.Memory != nil && opts.Resources.Memory.Limit != nil {
+			memory = int32(*opts.Resources.Memory.Limit / 1024 / 1024) // OCI spec is in bytes. HCS takes MB
+		}
+		if opts.Resources.CPU != nil && opts.Resources.CPU.Count != nil {
+			processors = int32(*opts.Resources.CPU.Count)
+		}
+	}
+	if opts.MemorySizeInMB != 0 {
+		memory = opts.MemorySizeInMB
+	}
+	if opts.ProcessorCount != 0 {
+		processors = opts.ProcessorCount
+	}
+	return memory, processors
 }
 
 // Create creates an HCS compute system representing a utility VM.
@@ -133,8 +168,7 @@ func Create(opts *UVMOptions) (*UtilityVM, error) {
 			Path: filepath.Join(scratchFolder, "sandbox.vhdx"),
 			Type: "VirtualDisk",
 		}
-		scsi["0"] = schema2.VirtualMachinesResourcesStorageScsiV2{Attachments: attachments}
-		uvm.scsiLocations[0][0].hostPath = attachments["0"].Path
+		uvm.scsiLocations[0][0] = scsiInfo{hostPath: attachments["0"].Path, refCount: 1}
 	} else {
 		if opts.VPMemDeviceCount > MaxVPMEM || opts.VPMemDeviceCount < 0 {
 			return nil, fmt.Errorf("vpmem device count must between 0 and %d", MaxVPMEM)
@@ -143,18 +177,17 @@ func Create(opts *UVMOptions) (*UtilityVM, error) {
 			opts.VPMemDeviceCount = MaxVPMEM
 		}
 		uvm.vpmemMax = opts.VPMemDeviceCount
-
-		scsi["0"] = schema2.VirtualMachinesResourcesStorageScsiV2{Attachments: attachments}
-		uvm.scsiControllerCount = 1
-		if opts.SCSIControllerCount != nil {
-			if *opts.SCSIControllerCount < 0 || *opts.SCSIControllerCount > 1 {
-				return nil, fmt.Errorf("SCSI controller count must be 0 or 1") // Future extension here for up to 4
+		if opts.VPMemMultiMapping {
+			uvm.vpmemMultiMapping = true
+			uvm.vpmemDeviceSize = opts.VPMemDeviceSizeBytes
+			if uvm.vpmemDeviceSize == 0 {
+				uvm.vpmemDeviceSize = DefaultVPMemDeviceSizeBytes
 			}
-			uvm.scsiControllerCount = *opts.SCSIControllerCount
-			if uvm.scsiControllerCount == 0 {
-				scsi = nil
+			if uvm.vpmemDeviceSize%vpmemMappingAlignment != 0 {
+				return nil, fmt.Errorf("vpmem device size must be a multiple of %d bytes", vpmemMappingAlignment)
 			}
 		}
+
 		if opts.BootFilesPath == "" {
 			opts.BootFilesPath = filepath.Join(os.Getenv("ProgramFiles"), "Linux Containers")
 		}
@@ -201,18 +234,46 @@ func Create(opts *UVMOptions) (*UtilityVM, error) {
 		}
 	}
 
-	memory := int32(1024)
-	processors := int32(2)
-	if runtime.NumCPU() == 1 {
-		processors = 1
+	// A Windows utility VM needs at least one SCSI controller for its scratch.
+	if opts.SCSIControllerCount != nil {
+		uvm.scsiControllerCount = *opts.SCSIControllerCount
+		if uvm.scsiControllerCount > MaxSCSIControllers || uvm.scsiControllerCount < 0 ||
+			(uvm.scsiControllerCount == 0 && uvm.operatingSystem == "windows") {
+			return nil, fmt.Errorf("SCSI controller count %d is not supported", uvm.scsiControllerCount)
+		}
 	}
-	if opts.Resources != nil {
-		if opts.Resources.Memory != nil && opts.Resources.Memory.Limit != nil {
-			memory = int32(*opts.Resources.Memory.Limit / 1024 / 1024) // OCI spec is in bytes. HCS takes MB
+	for i := 0; i < uvm.scsiControllerCount; i++ {
+		controller := schema2.VirtualMachinesResourcesStorageScsiV2{ChannelInstanceGuid: scsiControllerGUIDs[i]}
+		if i == 0 {
+			controller.Attachments = attachments
 		}
-		if opts.Resources.CPU != nil && opts.Resources.CPU.Count != nil {
-			processors = int32(*opts.Resources.CPU.Count)
+		scsi[strconv.Itoa(i)] = controller
+	}
+	if uvm.scsiControllerCount == 0 {
+		scsi = nil
+	}
+
+	memory, processors := opts.Size()
+	topology, err := computeTopology(opts, memory, processors)
+	if err != nil {
+		return nil, err
+	}
+	uvm.memorySizeInMB, uvm.processorCount = memory, processors
+	uvm.maxMemorySizeInMB, uvm.maxProcessorCount = memory, processors
+	if opts.MaxMemorySizeInMB != 0 {
+		uvm.maxMemorySizeInMB = opts.MaxMemorySizeInMB
+	}
+	if opts.MaxProcessorCount != 0 {
+		// Hyper-V cannot give a VM more virtual processors than the host has
+		// logical processors.
+		_, hostProcessors, err := hostCapacity()
+		if err != nil {
+			return nil, err
 		}
+		if opts.MaxProcessorCount > hostProcessors {
+			return nil, fmt.Errorf("maximum processor count %d exceeds the host's %d processors", opts.MaxProcessorCount, hostProcessors)
+		}
+		uvm.maxProcessorCount = opts.MaxProcessorCount
 	}
 
 	hcsDocument := &schema2.ComputeSystemV2{
@@ -223,15 +284,7 @@ func Create(opts *UVMOptions) (*UtilityVM, error) {
 				UEFI: &schema2.VirtualMachinesResourcesUefiV2{},
 			},
 
-			ComputeTopology: &schema2.VirtualMachinesResourcesComputeTopologyV2{
-				Memory: &schema2.VirtualMachinesResourcesComputeMemoryV2{
-					Backing: "Virtual",
-					Startup: memory,
-				},
-				Processor: &schema2.VirtualMachinesResourcesComputeProcessorV2{
-					Count: processors,
-				},
-			},
+			ComputeTopology: topology,
 
 			Devices: &schema2.VirtualMachinesDevicesV2{
 				SCSI:             scsi,
@@ -243,7 +296,6 @@ func Create(opts *UVMOptions) (*UtilityVM, error) {
 
 	if uvm.operatingSystem == "windows" {
 		hcsDocument.VirtualMachine.Chipset.UEFI.BootThis = &schema2.VirtualMachinesResourcesUefiBootEntryV2{DevicePath: `\EFI\Microsoft\Boot\bootmgfw.efi`}
-		hcsDocument.VirtualMachine.ComputeTopology.Memory.DirectFileMappingMB = 1024 // Sensible default, but could be a tuning parameter somewhere
 		hcsDocument.VirtualMachine.Devices.VirtualSMBShares[0].Path = filepath.Join(uvmFolder, `UtilityVM\Files`)
 		hcsDocument.VirtualMachine.Devices.VirtualSMBShares[0].Flags = schema2.VsmbFlagReadOnly | schema2.VsmbFlagPseudoOplocks | schema2.VsmbFlagTakeBackupPrivilege | schema2.VsmbFlagCacheIO | schema2.VsmbFlagShareRead
 	} else {
@@ -329,3 +381,9 @@ func (uvm *UtilityVM) Close() error {
 	uvm.Terminate()
 	return uvm.hcsSystem.Close()
 }
+
+// Release releases the handle to the utility VM without terminating it, so
+// that another process can take the VM over with Open.
+func (uvm *UtilityVM) Release() error {
+	return uvm.hcsSystem.Close()
+}
@@ -14,12 +14,19 @@ type MappedVirtualDisk struct {
 type MappedDirectory struct {
 	MountPath string
 	Port      int32
-	ShareName string // If empty not using ANames (not currently supported)
+	ShareName string // The aname of the share on the Plan9 server at Port
 	ReadOnly  bool
 }
 
 // Read-only layers over VPMem
 type MappedVPMemDevice struct {
 	DeviceNumber uint32
-	MountPath    string // /tmp/vN
+	MountPath    string            // /tmp/vN
+	MappingInfo  *VPMemMappingInfo `json:",omitempty"` // Set if the layer is one of several in the device
+}
+
+// Location of a layer within a VPMem device holding several layers
+type VPMemMappingInfo struct {
+	DeviceOffsetInBytes uint64
+	DeviceSizeInBytes   uint64
 }
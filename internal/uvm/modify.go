@@ -2,5 +2,8 @@ package uvm
 
 // Modifies the compute system by sending a request to HCS
 func (uvm *UtilityVM) Modify(hcsModificationDocument interface{}) error {
+	if uvm.modifyHook != nil {
+		return uvm.modifyHook(hcsModificationDocument)
+	}
 	return uvm.hcsSystem.Modify(hcsModificationDocument)
 }
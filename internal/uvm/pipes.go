@@ -0,0 +1,99 @@
+package uvm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Microsoft/hcsshim/internal/schema2"
+	"github.com/sirupsen/logrus"
+)
+
+// PipePrefix is the prefix of a named pipe path.
+const PipePrefix = `\\.\pipe\`
+
+// pipeName returns the name of the named pipe hostPath, which must be of the
+// form \\.\pipe\name.
+func pipeName(hostPath string) (string, error) {
+	if len(hostPath) <= len(PipePrefix) || !strings.EqualFold(hostPath[:len(PipePrefix)], PipePrefix) {
+		return "", fmt.Errorf("%s is not a named pipe", hostPath)
+	}
+	return hostPath[len(PipePrefix):], nil
+}
+
+// AddPipe maps the host named pipe hostPath into a Windows utility VM, where
+// it has the same name. Each pipe is ref-counted and only added if it isn't
+// already.
+func (uvm *UtilityVM) AddPipe(hostPath string) error {
+	if uvm.operatingSystem != "windows" {
+		return errNotSupported
+	}
+	name, err := pipeName(hostPath)
+	if err != nil {
+		return err
+	}
+
+	logrus.Debugf("uvm::AddPipe %s id:%s", hostPath, uvm.id)
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	if uvm.mappedPipes == nil {
+		uvm.mappedPipes = make(map[string]uint32)
+	}
+	if uvm.mappedPipes[hostPath] == 0 {
+		modification := &schema2.ModifySettingsRequestV2{
+			ResourceType: schema2.ResourceTypeMappedPipe,
+			RequestType:  schema2.RequestTypeAdd,
+			Settings:     hostPath,
+			ResourceUri:  "virtualmachine/devices/mappedpipes/" + name,
+		}
+		if err := uvm.Modify(modification); err != nil {
+			return fmt.Errorf("failed to map pipe %s into %s: %s", hostPath, uvm.id, err)
+		}
+	}
+	uvm.mappedPipes[hostPath]++
+	logrus.Debugf("hcsshim::AddPipe Success %s: refcount=%d", hostPath, uvm.mappedPipes[hostPath])
+	return nil
+}
+
+// RemovePipe removes a named pipe mapped by AddPipe from a utility VM. It is
+// only actually removed when the ref-count drops to zero.
+func (uvm *UtilityVM) RemovePipe(hostPath string) error {
+	if uvm.operatingSystem != "windows" {
+		return errNotSupported
+	}
+	logrus.Debugf("uvm::RemovePipe %s id:%s", hostPath, uvm.id)
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	if uvm.mappedPipes[hostPath] == 0 {
+		return fmt.Errorf("%s is not mapped into %s, cannot remove", hostPath, uvm.id)
+	}
+	if uvm.mappedPipes[hostPath] > 1 {
+		uvm.mappedPipes[hostPath]--
+		logrus.Debugf("uvm::RemovePipe Success %s id:%s Ref-count now %d. It is still present in the utility VM", hostPath, uvm.id, uvm.mappedPipes[hostPath])
+		return nil
+	}
+
+	name, _ := pipeName(hostPath)
+	modification := &schema2.ModifySettingsRequestV2{
+		ResourceType: schema2.ResourceTypeMappedPipe,
+		RequestType:  schema2.RequestTypeRemove,
+		ResourceUri:  "virtualmachine/devices/mappedpipes/" + name,
+	}
+	if err := uvm.Modify(modification); err != nil {
+		return fmt.Errorf("failed to remove mapped pipe %s from %s: %s", hostPath, uvm.id, err)
+	}
+	delete(uvm.mappedPipes, hostPath)
+	logrus.Debugf("uvm::RemovePipe Success %s id:%s successfully removed from utility VM", hostPath, uvm.id)
+	return nil
+}
+
+// GetPipeGuestPath returns the path in the utility VM of a named pipe mapped
+// by AddPipe.
+func (uvm *UtilityVM) GetPipeGuestPath(hostPath string) (string, error) {
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	if uvm.mappedPipes[hostPath] == 0 {
+		return "", fmt.Errorf("%s is not mapped into %s", hostPath, uvm.id)
+	}
+	name, _ := pipeName(hostPath)
+	return PipePrefix + name, nil
+}
@@ -0,0 +1,65 @@
+package uvm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/internal/schema2"
+)
+
+func TestPipeName(t *testing.T) {
+	for path, expected := range map[string]string{
+		`\\.\pipe\docker_engine`: "docker_engine",
+		`\\.\PIPE\a\b`:           `a\b`,
+		`\\.\pipe\`:              "",
+		`c:\pipe`:                "",
+	} {
+		name, err := pipeName(path)
+		if expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected error", path)
+			}
+			continue
+		}
+		if err != nil || name != expected {
+			t.Errorf("%s: got %q %v, expected %q", path, name, err, expected)
+		}
+	}
+}
+
+func TestPipeReferences(t *testing.T) {
+	vm := &UtilityVM{id: "test", operatingSystem: "windows"}
+	requests := recordModifications(vm)
+	pipe := `\\.\pipe\docker_engine`
+	for i := 0; i < 2; i++ {
+		if err := vm.AddPipe(pipe); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if path, err := vm.GetPipeGuestPath(pipe); err != nil || path != pipe {
+		t.Fatalf("wrong guest path %s: %v", path, err)
+	}
+	if err := vm.RemovePipe(pipe); err != nil {
+		t.Fatal(err)
+	}
+	if vm.mappedPipes[pipe] != 1 {
+		t.Fatalf("wrong ref-count %d", vm.mappedPipes[pipe])
+	}
+	if err := vm.RemovePipe(pipe); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.GetPipeGuestPath(pipe); err == nil {
+		t.Fatal("expected error for a removed pipe")
+	}
+	if err := vm.RemovePipe(pipe); err == nil {
+		t.Fatal("expected error removing a pipe that is not mapped")
+	}
+	if err := vm.AddPipe(`c:\notapipe`); err == nil {
+		t.Fatal("expected error adding a path that is not a pipe")
+	}
+	// The pipe is only mapped by the first reference and removed by the last.
+	expected := []schema2.RequestType{schema2.RequestTypeAdd, schema2.RequestTypeRemove}
+	if !reflect.DeepEqual(*requests, expected) {
+		t.Fatalf("got requests %v, expected %v", *requests, expected)
+	}
+}
@@ -1,6 +1,8 @@
 package uvm
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 
 	"github.com/Microsoft/hcsshim/internal/schema2"
@@ -8,8 +10,18 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// plan9ShareName returns the name of the Plan9 share for hostPath. It depends
+// only on the host path, so that a share's name, and so the aname the guest
+// mounts it by, does not depend on the shares added before it.
+func plan9ShareName(hostPath string) string {
+	h := sha256.Sum256([]byte(hostPath))
+	return "p9-" + hex.EncodeToString(h[:8])
+}
+
 // AddPlan9 adds a Plan9 share to a utility VM. Each Plan9 share is ref-counted and
-// only added if it isn't already.
+// only added if it isn't already, and must be added with the same flags each
+// time. All shares are served on a single port and mounted in the guest by
+// name.
 func (uvm *UtilityVM) AddPlan9(hostPath string, uvmPath string, flags int32) error {
 	if uvm.operatingSystem != "linux" {
 		return errNotSupported
@@ -24,21 +36,22 @@ func (uvm *UtilityVM) AddPlan9(hostPath string, uvmPath string, flags int32) err
 	if uvm.plan9Shares == nil {
 		uvm.plan9Shares = make(map[string]*plan9Info)
 	}
-	if _, ok := uvm.plan9Shares[hostPath]; !ok {
-		uvm.plan9Counter++
-
+	if share, ok := uvm.plan9Shares[hostPath]; !ok {
+		name := plan9ShareName(hostPath)
 		modification := &schema2.ModifySettingsRequestV2{
 			ResourceType: schema2.ResourceTypePlan9Share,
 			RequestType:  schema2.RequestTypeAdd,
 			Settings: schema2.VirtualMachinesResourcesStoragePlan9ShareV2{
-				Name: fmt.Sprintf("%d", uvm.plan9Counter),
-				Path: hostPath,
-				Port: int32(uvm.plan9Counter), // TODO: Temporary. Will all use a single port (9999)
+				Name:  name,
+				Path:  hostPath,
+				Port:  plan9Port,
+				Flags: flags,
 			},
-			ResourceUri: fmt.Sprintf("virtualmachine/devices/plan9shares/%d", uvm.plan9Counter),
+			ResourceUri: fmt.Sprintf("virtualmachine/devices/plan9shares/%s", name),
 			HostedSettings: lcowhostedsettings.MappedDirectory{
 				MountPath: uvmPath,
-				Port:      int32(uvm.plan9Counter), // TODO: Temporary. Will all use a single port (9999)
+				Port:      plan9Port,
+				ShareName: name,
 				ReadOnly:  (flags & schema2.VPlan9FlagReadOnly) == schema2.VPlan9FlagReadOnly,
 			},
 		}
@@ -47,13 +60,15 @@ func (uvm *UtilityVM) AddPlan9(hostPath string, uvmPath string, flags int32) err
 			return err
 		}
 		uvm.plan9Shares[hostPath] = &plan9Info{
-			refCount:  1,
-			uvmPath:   uvmPath,
-			idCounter: uvm.plan9Counter,
-			port:      int32(uvm.plan9Counter), // TODO: Temporary. Will all use a single port (9999)
+			refCount: 1,
+			name:     name,
+			uvmPath:  uvmPath,
+			flags:    flags,
 		}
+	} else if share.flags != flags {
+		return fmt.Errorf("%s cannot be shared with flags %#x as it is already shared with flags %#x", hostPath, flags, share.flags)
 	} else {
-		uvm.plan9Shares[hostPath].refCount++
+		share.refCount++
 	}
 	logrus.Debugf("hcsshim::AddPlan9 Success %s: refcount=%d %+v", hostPath, uvm.plan9Shares[hostPath].refCount, uvm.plan9Shares[hostPath])
 	return nil
@@ -83,23 +98,38 @@ func (uvm *UtilityVM) removePlan9(hostPath, uvmPath string) error {
 		return nil
 	}
 	logrus.Debugf("uvm::RemovePlan9 Zero ref-count, removing. %s id:%s", hostPath, uvm.id)
+	share := uvm.plan9Shares[hostPath]
 	modification := &schema2.ModifySettingsRequestV2{
 		ResourceType: schema2.ResourceTypePlan9Share,
 		RequestType:  schema2.RequestTypeRemove,
 		Settings: schema2.VirtualMachinesResourcesStoragePlan9ShareV2{
-			Name: fmt.Sprintf("%d", uvm.plan9Shares[hostPath].idCounter),
-			Port: uvm.plan9Shares[hostPath].port,
+			Name: share.name,
+			Port: plan9Port,
 		},
-		ResourceUri: fmt.Sprintf("virtualmachine/devices/plan9shares/%d", uvm.plan9Shares[hostPath].idCounter),
+		ResourceUri: fmt.Sprintf("virtualmachine/devices/plan9shares/%s", share.name),
 		HostedSettings: lcowhostedsettings.MappedDirectory{
-			MountPath: uvm.plan9Shares[hostPath].uvmPath,
-			Port:      uvm.plan9Shares[hostPath].port,
+			MountPath: share.uvmPath,
+			Port:      plan9Port,
+			ShareName: share.name,
 		},
 	}
 	if err := uvm.Modify(modification); err != nil {
+		share.refCount++
 		return fmt.Errorf("failed to remove plan9 share %s from %s: %+v: %s", hostPath, uvm.id, modification, err)
 	}
 	delete(uvm.plan9Shares, hostPath)
 	logrus.Debugf("uvm::RemovePlan9 Success %s id:%s successfully removed from utility VM", hostPath, uvm.id)
 	return nil
 }
+
+// GetPlan9GuestPath returns the path in the utility VM at which a Plan9 share
+// is mounted.
+func (uvm *UtilityVM) GetPlan9GuestPath(hostPath string) (string, error) {
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	share := uvm.plan9Shares[hostPath]
+	if share == nil {
+		return "", fmt.Errorf("%s not found as Plan9 share in %s", hostPath, uvm.id)
+	}
+	return share.uvmPath, nil
+}
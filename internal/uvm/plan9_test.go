@@ -0,0 +1,58 @@
+package uvm
+
+import (
+	"testing"
+
+	"github.com/Microsoft/hcsshim/internal/schema2"
+)
+
+func TestPlan9ShareName(t *testing.T) {
+	a, b := plan9ShareName(`c:\data`), plan9ShareName(`c:\data2`)
+	if a == b {
+		t.Fatal("different host paths have the same share name", a)
+	}
+	if a != plan9ShareName(`c:\data`) {
+		t.Fatal("share name is not stable")
+	}
+	if len(a) != len("p9-")+16 {
+		t.Fatal("unexpected share name", a)
+	}
+}
+
+func TestRemovePlan9Reference(t *testing.T) {
+	vm := &UtilityVM{
+		operatingSystem: "linux",
+		plan9Shares: map[string]*plan9Info{
+			`c:\data`: {refCount: 2, name: plan9ShareName(`c:\data`), uvmPath: "/data"},
+		},
+	}
+	// Removing a reference other than the last leaves the share in place.
+	if err := vm.RemovePlan9(`c:\data`); err != nil {
+		t.Fatal(err)
+	}
+	if share := vm.plan9Shares[`c:\data`]; share == nil || share.refCount != 1 {
+		t.Fatalf("wrong share after removal %+v", share)
+	}
+	if err := vm.RemovePlan9(`c:\other`); err == nil {
+		t.Fatal("expected error removing a missing share")
+	}
+}
+
+func TestPlan9ShareFlags(t *testing.T) {
+	vm := &UtilityVM{id: "test", operatingSystem: "linux"}
+	requests := recordModifications(vm)
+	for i := 0; i < 2; i++ {
+		if err := vm.AddPlan9(`c:\data`, "/data", schema2.VPlan9FlagReadOnly); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := vm.AddPlan9(`c:\data`, "/data", 0); err == nil {
+		t.Fatal("expected error sharing a directory with different flags")
+	}
+	if share := vm.plan9Shares[`c:\data`]; share.refCount != 2 || share.flags != schema2.VPlan9FlagReadOnly {
+		t.Fatalf("wrong share %+v", share)
+	}
+	if len(*requests) != 1 {
+		t.Fatalf("expected a single request, got %v", *requests)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 
 	"github.com/Microsoft/hcsshim/internal/copywithtimeout"
 	"github.com/Microsoft/hcsshim/internal/hcs"
@@ -117,28 +118,41 @@ func (uvm *UtilityVM) CreateProcess(opts *ProcessOptions) (*hcs.Process, *ByteCo
 		}
 	}
 
-	// Copy the data back from stdout
+	// Copy the data back from stdout and stderr. They are copied concurrently
+	// so that a process blocked writing to one of them does not stop the
+	// other from being drained.
+	var (
+		wg                   sync.WaitGroup
+		stdoutErr, stderrErr error
+	)
 	if opts.Stdout != nil {
-		// Copy the data over to the writer.
-		if copiedByteCounts.Out, err = copywithtimeout.Copy(opts.Stdout,
-			processStdout,
-			opts.ByteCounts.Out,
-			fmt.Sprintf("CreateProcessEx: from stdout from %q", commandLine),
-			defaultTimeoutSeconds); err != nil {
-			return nil, nil, err
-		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			copiedByteCounts.Out, stdoutErr = copywithtimeout.Copy(opts.Stdout,
+				processStdout,
+				opts.ByteCounts.Out,
+				fmt.Sprintf("CreateProcessEx: from stdout from %q", commandLine),
+				defaultTimeoutSeconds)
+		}()
 	}
-
-	// Copy the data back from stderr
 	if opts.Stderr != nil {
-		// Copy the data over to the writer.
-		if copiedByteCounts.Err, err = copywithtimeout.Copy(opts.Stderr,
-			processStderr,
-			opts.ByteCounts.Err,
-			fmt.Sprintf("CreateProcessEx: from stderr of %s", commandLine),
-			defaultTimeoutSeconds); err != nil {
-			return nil, nil, err
-		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			copiedByteCounts.Err, stderrErr = copywithtimeout.Copy(opts.Stderr,
+				processStderr,
+				opts.ByteCounts.Err,
+				fmt.Sprintf("CreateProcessEx: from stderr of %s", commandLine),
+				defaultTimeoutSeconds)
+		}()
+	}
+	wg.Wait()
+	if stdoutErr != nil {
+		return nil, nil, stdoutErr
+	}
+	if stderrErr != nil {
+		return nil, nil, stderrErr
 	}
 
 	logrus.Debugf("hcsshim: CreateProcessEx success: %q", commandLine)
@@ -0,0 +1,176 @@
+package uvm
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"github.com/Microsoft/hcsshim/internal/schema2"
+	"github.com/sirupsen/logrus"
+)
+
+//go:generate go run $GOROOT/src/syscall/mksyscall_windows.go -output zsyscall_windows.go resize.go
+
+//sys globalMemoryStatusEx(status *memoryStatusEx) (err error) = kernel32.GlobalMemoryStatusEx
+
+// memoryStatusEx is the MEMORYSTATUSEX structure.
+type memoryStatusEx struct {
+	Length               uint32
+	MemoryLoad           uint32
+	TotalPhys            uint64
+	AvailPhys            uint64
+	TotalPageFile        uint64
+	AvailPageFile        uint64
+	TotalVirtual         uint64
+	AvailVirtual         uint64
+	AvailExtendedVirtual uint64
+}
+
+// hostCapacity returns the physical memory of the host in MB and its number
+// of logical processors. It is a variable so that tests can replace it.
+var hostCapacity = func() (int64, int32, error) {
+	status := memoryStatusEx{}
+	status.Length = uint32(unsafe.Sizeof(status))
+	if err := globalMemoryStatusEx(&status); err != nil {
+		return 0, 0, fmt.Errorf("failed to query host memory: %s", err)
+	}
+	return int64(status.TotalPhys / 1024 / 1024), int32(runtime.NumCPU()), nil
+}
+
+// MemorySizeInMB returns the current memory size of the utility VM in MB.
+func (uvm *UtilityVM) MemorySizeInMB() int32 {
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	return uvm.memorySizeInMB
+}
+
+// MaxMemorySizeInMB returns the largest size in MB the memory of the utility
+// VM may be resized to.
+func (uvm *UtilityVM) MaxMemorySizeInMB() int32 {
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	return uvm.maxMemorySizeInMB
+}
+
+// ProcessorCount returns the current number of virtual processors of the
+// utility VM.
+func (uvm *UtilityVM) ProcessorCount() int32 {
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	return uvm.processorCount
+}
+
+// MaxProcessorCount returns the largest number of virtual processors the
+// utility VM may be resized to.
+func (uvm *UtilityVM) MaxProcessorCount() int32 {
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	return uvm.maxProcessorCount
+}
+
+// UpdateMemory resizes the memory of the running utility VM to sizeInMB. The
+// size may not exceed the maximum the VM was created with, nor the physical
+// memory of the host.
+func (uvm *UtilityVM) UpdateMemory(sizeInMB int32) error {
+	logrus.Debugf("uvm::UpdateMemory %d id:%s", sizeInMB, uvm.id)
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	if sizeInMB == uvm.memorySizeInMB {
+		return nil
+	}
+	if sizeInMB <= 0 {
+		return fmt.Errorf("invalid memory size %dMB", sizeInMB)
+	}
+	if sizeInMB > uvm.maxMemorySizeInMB {
+		return fmt.Errorf("memory size %dMB exceeds the maximum of %dMB for %s", sizeInMB, uvm.maxMemorySizeInMB, uvm.id)
+	}
+	hostMemoryMB, _, err := hostCapacity()
+	if err != nil {
+		return err
+	}
+	if int64(sizeInMB) > hostMemoryMB {
+		return fmt.Errorf("memory size %dMB exceeds the host's %dMB of memory", sizeInMB, hostMemoryMB)
+	}
+
+	modification := &schema2.ModifySettingsRequestV2{
+		ResourceType: schema2.ResourceTypeMemory,
+		RequestType:  schema2.RequestTypeUpdate,
+		Settings:     sizeInMB,
+		ResourceUri:  "virtualmachine/computetopology/memory/sizeinmb",
+	}
+	if err := uvm.Modify(modification); err != nil {
+		return fmt.Errorf("failed to resize memory of %s to %dMB: %s", uvm.id, sizeInMB, err)
+	}
+	uvm.memorySizeInMB = sizeInMB
+	logrus.Debugf("uvm::UpdateMemory Success %d id:%s", sizeInMB, uvm.id)
+	return nil
+}
+
+// UpdateProcessors changes the number of virtual processors of the running
+// utility VM to count. The count may not exceed the maximum the VM was created
+// with, nor the number of logical processors of the host.
+func (uvm *UtilityVM) UpdateProcessors(count int32) error {
+	logrus.Debugf("uvm::UpdateProcessors %d id:%s", count, uvm.id)
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	if count == uvm.processorCount {
+		return nil
+	}
+	if count <= 0 {
+		return fmt.Errorf("invalid processor count %d", count)
+	}
+	if count > uvm.maxProcessorCount {
+		return fmt.Errorf("processor count %d exceeds the maximum of %d for %s", count, uvm.maxProcessorCount, uvm.id)
+	}
+	_, hostProcessors, err := hostCapacity()
+	if err != nil {
+		return err
+	}
+	if count > hostProcessors {
+		return fmt.Errorf("processor count %d exceeds the host's %d processors", count, hostProcessors)
+	}
+
+	modification := &schema2.ModifySettingsRequestV2{
+		ResourceType: schema2.ResourceTypeProcessor,
+		RequestType:  schema2.RequestTypeUpdate,
+		Settings:     count,
+		ResourceUri:  "virtualmachine/computetopology/processor/count",
+	}
+	if err := uvm.Modify(modification); err != nil {
+		return fmt.Errorf("failed to change processor count of %s to %d: %s", uvm.id, count, err)
+	}
+	uvm.processorCount = count
+	logrus.Debugf("uvm::UpdateProcessors Success %d id:%s", count, uvm.id)
+	return nil
+}
+
+// SetCPUGroup assigns the virtual processors of the running utility VM to the
+// host CPU group id, which must already exist. An empty id removes the VM from
+// its CPU group.
+func (uvm *UtilityVM) SetCPUGroup(id string) error {
+	logrus.Debugf("uvm::SetCPUGroup %q id:%s", id, uvm.id)
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	if id == uvm.cpuGroup {
+		return nil
+	}
+	modification := &schema2.ModifySettingsRequestV2{
+		ResourceType: schema2.ResourceTypeCpuGroup,
+		RequestType:  schema2.RequestTypeUpdate,
+		Settings:     schema2.VirtualMachinesResourcesComputeCpuGroupV2{Id: id},
+		ResourceUri:  "virtualmachine/computetopology/processor/cpugroup",
+	}
+	if err := uvm.Modify(modification); err != nil {
+		return fmt.Errorf("failed to assign %s to CPU group %q: %s", uvm.id, id, err)
+	}
+	uvm.cpuGroup = id
+	return nil
+}
+
+// CPUGroup returns the host CPU group the utility VM is assigned to, or an
+// empty string if it is not assigned to one.
+func (uvm *UtilityVM) CPUGroup() string {
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	return uvm.cpuGroup
+}
@@ -0,0 +1,47 @@
+package uvm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResizeLimits(t *testing.T) {
+	defer func(f func() (int64, int32, error)) { hostCapacity = f }(hostCapacity)
+	hostCapacity = func() (int64, int32, error) {
+		return 4096, 4, nil
+	}
+	vm := &UtilityVM{
+		id:                "test",
+		memorySizeInMB:    1024,
+		maxMemorySizeInMB: 8192,
+		processorCount:    2,
+		maxProcessorCount: 2,
+	}
+	for _, test := range []struct {
+		name   string
+		update func() error
+		err    string
+	}{
+		{"zero memory", func() error { return vm.UpdateMemory(0) }, "invalid memory size"},
+		{"memory above host", func() error { return vm.UpdateMemory(6144) }, "exceeds the host's 4096MB"},
+		{"memory above maximum", func() error { return vm.UpdateMemory(9000) }, "exceeds the maximum of 8192MB"},
+		{"negative processors", func() error { return vm.UpdateProcessors(-1) }, "invalid processor count"},
+		{"processors above maximum", func() error { return vm.UpdateProcessors(3) }, "exceeds the maximum of 2"},
+	} {
+		err := test.update()
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, expected %q", test.name, err, test.err)
+		}
+	}
+	if vm.MemorySizeInMB() != 1024 || vm.ProcessorCount() != 2 {
+		t.Fatalf("failed updates changed the size to %dMB, %d processors", vm.MemorySizeInMB(), vm.ProcessorCount())
+	}
+
+	// Resizing to the current size is not sent to the VM.
+	if err := vm.UpdateMemory(1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.UpdateProcessors(2); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -8,22 +8,37 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// SCSI caching modes for SCSIOptions.CachingMode.
+const (
+	SCSICachingModeUncached       = "Uncached"
+	SCSICachingModeCached         = "Cached"
+	SCSICachingModeReadOnlyCached = "ReadOnlyCached"
+)
+
+// SCSIOptions are the options for attaching a disk with AddSCSIWithOptions.
+type SCSIOptions struct {
+	ReadOnly         bool   // Attach the disk read-only, in both the host and the guest.
+	CachingMode      string // One of the SCSICachingMode constants. Defaults to the host's choice.
+	IgnoreFlushes    bool   // Ignore flushes from the guest. Unsafe for data that must survive a host crash.
+	NoWriteHardening bool   // Do not harden writes against host crashes.
+}
+
 // allocateSCSI finds the next available slot on the
-// SCSI controllers associated with a utility VM to use.
-func (uvm *UtilityVM) allocateSCSI(hostPath string) (int, int, error) {
-	uvm.m.Lock()
-	defer uvm.m.Unlock()
-	for controller, luns := range uvm.scsiLocations {
-		for lun, si := range luns {
-			if si.hostPath == "" {
-				uvm.scsiLocations[controller][lun].hostPath = hostPath
-				logrus.Debugf("uvm::allocateSCSI %d:%d %q", controller, lun, hostPath)
+// SCSI controllers associated with a utility VM to use, and records si in it
+// with a reference count of one. The lock MUST be held when calling this
+// function.
+func (uvm *UtilityVM) allocateSCSI(si scsiInfo) (int, int, error) {
+	for controller := 0; controller < uvm.scsiControllerCount; controller++ {
+		for lun, existing := range uvm.scsiLocations[controller] {
+			if existing.hostPath == "" {
+				si.refCount = 1
+				uvm.scsiLocations[controller][lun] = si
+				logrus.Debugf("uvm::allocateSCSI %d:%d %q", controller, lun, si.hostPath)
 				return controller, lun, nil
-
 			}
 		}
 	}
-	return -1, -1, fmt.Errorf("no free SCSI locations")
+	return -1, -1, fmt.Errorf("no free SCSI locations on %d controllers", uvm.scsiControllerCount)
 }
 
 func (uvm *UtilityVM) deallocateSCSI(controller int, lun int) error {
@@ -37,8 +52,8 @@ func (uvm *UtilityVM) deallocateSCSI(controller int, lun int) error {
 
 // Lock must be held when calling this function
 func (uvm *UtilityVM) findSCSIAttachment(findThisHostPath string) (int, int, string, error) {
-	for controller, luns := range uvm.scsiLocations {
-		for lun, si := range luns {
+	for controller := 0; controller < uvm.scsiControllerCount; controller++ {
+		for lun, si := range uvm.scsiLocations[controller] {
 			if si.hostPath == findThisHostPath {
 				logrus.Debugf("uvm::findSCSIAttachment %d:%d %+v", controller, lun, si)
 				return controller, lun, si.uvmPath, nil
@@ -48,46 +63,86 @@ func (uvm *UtilityVM) findSCSIAttachment(findThisHostPath string) (int, int, str
 	return -1, -1, "", fmt.Errorf("%s is not attached to SCSI", findThisHostPath)
 }
 
-// AddSCSI adds a SCSI disk to a utility VM at the next available location.
+// addSCSIReference takes another reference on the disk attached at
+// controller:lun, which must be attached at uvmPath with the same read-only
+// option. The lock MUST be held when calling this function.
+func (uvm *UtilityVM) addSCSIReference(controller int, lun int, uvmPath string, readOnly bool) error {
+	si := &uvm.scsiLocations[controller][lun]
+	if si.uvmPath != uvmPath {
+		return fmt.Errorf("%s is already attached to SCSI at %q, not %q", si.hostPath, si.uvmPath, uvmPath)
+	}
+	if si.readOnly != readOnly {
+		return fmt.Errorf("%s is already attached to SCSI with read-only %t", si.hostPath, si.readOnly)
+	}
+	si.refCount++
+	logrus.Debugf("uvm::AddSCSI id:%s hostPath:%s already attached at %d:%d refCount:%d", uvm.id, si.hostPath, controller, lun, si.refCount)
+	return nil
+}
+
+// AddSCSI adds a SCSI disk to a utility VM at the next available location,
+// attached read-write with the default options. See AddSCSIWithOptions.
+func (uvm *UtilityVM) AddSCSI(hostPath string, uvmPath string) (int, int, error) {
+	return uvm.AddSCSIWithOptions(hostPath, uvmPath, nil)
+}
+
+// AddSCSIWithOptions adds a SCSI disk to a utility VM at the next available
+// location.
 //
 // We are in control of everything ourselves. Hence we have ref-
 // counting and so-on tracking what SCSI locations are available or used.
+// Adding a disk that is already attached returns its existing location and
+// takes another reference, which RemoveSCSI releases; the uvmPath and
+// read-only option must match the existing attachment.
 //
 // hostPath is required
 // uvmPath is optional.
 //
 // Returns the controller ID (0..3) and LUN (0..63) where the disk is attached.
-func (uvm *UtilityVM) AddSCSI(hostPath string, uvmPath string) (int, int, error) {
-	controller := -1
-	lun := -1
+// Both are passed to the GCS, which finds the guest device from them.
+func (uvm *UtilityVM) AddSCSIWithOptions(hostPath string, uvmPath string, opts *SCSIOptions) (int, int, error) {
 	if uvm == nil {
 		return -1, -1, fmt.Errorf("no utility VM passed to AddSCSI")
 	}
-	logrus.Debugf("uvm::AddSCSI id:%s hostPath:%s uvmPath:%s", uvm.id, hostPath, uvmPath)
+	logrus.Debugf("uvm::AddSCSI id:%s hostPath:%s uvmPath:%s opts:%+v", uvm.id, hostPath, uvmPath, opts)
 
 	if uvm.scsiControllerCount == 0 {
 		return -1, -1, fmt.Errorf("cannot AddSCSI as the utility VM has no SCSI controller configured")
 	}
+	if opts == nil {
+		opts = &SCSIOptions{}
+	}
+	switch opts.CachingMode {
+	case "", SCSICachingModeUncached, SCSICachingModeCached, SCSICachingModeReadOnlyCached:
+	default:
+		return -1, -1, fmt.Errorf("invalid SCSI caching mode %q", opts.CachingMode)
+	}
 
-	var err error
-	controller, lun, err = uvm.allocateSCSI(hostPath)
+	// The lock is held until the disk is attached, so that no other caller
+	// takes a reference to a slot that is cleared if the attach fails.
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	if controller, lun, _, err := uvm.findSCSIAttachment(hostPath); err == nil {
+		if err := uvm.addSCSIReference(controller, lun, uvmPath, opts.ReadOnly); err != nil {
+			return -1, -1, err
+		}
+		return controller, lun, nil
+	}
+	controller, lun, err := uvm.allocateSCSI(scsiInfo{hostPath: hostPath, uvmPath: uvmPath, readOnly: opts.ReadOnly})
 	if err != nil {
 		return -1, -1, err
 	}
 
-	// TODO: Currently GCS doesn't support more than one SCSI controller. @jhowardmsft/@swernli. This will hopefully be fixed in GCS for RS5.
-	// It will also require the HostedSettings to be extended in the call below to include the controller as well as the LUN.
-	if controller > 0 {
-		return -1, -1, fmt.Errorf("too many SCSI attachments")
-	}
-
 	// TODO: This is wrong. There's no way to hot-add a SCSI attachement currently. This is a HACK
 	SCSIModification := &schema2.ModifySettingsRequestV2{
 		ResourceType: schema2.ResourceTypeMappedVirtualDisk,
 		RequestType:  schema2.RequestTypeAdd,
 		Settings: schema2.VirtualMachinesResourcesStorageAttachmentV2{
-			Path: hostPath,
-			Type: "VirtualDisk",
+			Path:             hostPath,
+			Type:             "VirtualDisk",
+			ReadOnly:         opts.ReadOnly,
+			CachingMode:      opts.CachingMode,
+			IgnoreFlushes:    opts.IgnoreFlushes,
+			NoWriteHardening: opts.NoWriteHardening,
 		},
 		ResourceUri: fmt.Sprintf("VirtualMachine/Devices/SCSI/%d/%d", controller, lun),
 	}
@@ -97,10 +152,11 @@ func (uvm *UtilityVM) AddSCSI(hostPath string, uvmPath string) (int, int, error)
 	if uvm.operatingSystem == "windows" {
 		hostedSettings = schema2.ContainersResourcesMappedDirectoryV2{
 			ContainerPath:     uvmPath,
+			ReadOnly:          opts.ReadOnly,
 			Lun:               uint8(lun),
+			Controller:        uint8(controller),
 			AttachOnly:        (uvmPath == ""),
 			OverwriteIfExists: true,
-			// TODO: Controller: uint8(controller), // TODO NOT IN HCS API CURRENTLY
 		}
 
 	} else {
@@ -108,7 +164,7 @@ func (uvm *UtilityVM) AddSCSI(hostPath string, uvmPath string) (int, int, error)
 			MountPath:  uvmPath,
 			Lun:        uint8(lun),
 			Controller: uint8(controller),
-			ReadOnly:   false,
+			ReadOnly:   opts.ReadOnly,
 		}
 	}
 
@@ -116,7 +172,7 @@ func (uvm *UtilityVM) AddSCSI(hostPath string, uvmPath string) (int, int, error)
 	//}
 
 	if err := uvm.Modify(SCSIModification); err != nil {
-		uvm.deallocateSCSI(controller, lun)
+		uvm.scsiLocations[controller][lun] = scsiInfo{}
 		return -1, -1, fmt.Errorf("uvm::AddSCSI: failed to modify utility VM configuration: %s", err)
 	}
 	logrus.Debugf("uvm::AddSCSI id:%s hostPath:%s added at %d:%d", uvm.id, hostPath, controller, lun)
@@ -124,14 +180,15 @@ func (uvm *UtilityVM) AddSCSI(hostPath string, uvmPath string) (int, int, error)
 
 }
 
-// RemoveSCSI removes a SCSI disk from a utility VM. As an external API, it
-// is "safe". Internal use can call removeSCSI.
+// RemoveSCSI removes a reference to a SCSI disk from a utility VM, detaching
+// it when the last reference is removed. As an external API, it is "safe".
+// Internal use can call removeSCSI.
 func (uvm *UtilityVM) RemoveSCSI(hostPath string) error {
 	uvm.m.Lock()
 	defer uvm.m.Unlock()
 
 	if uvm.scsiControllerCount == 0 {
-		return fmt.Errorf("cannot AddSCSI as the utility VM has no SCSI controller configured")
+		return fmt.Errorf("cannot RemoveSCSI as the utility VM has no SCSI controller configured")
 	}
 
 	// Make sure is actually attached
@@ -148,9 +205,15 @@ func (uvm *UtilityVM) RemoveSCSI(hostPath string) error {
 }
 
 // removeSCSI is the internally callable "unsafe" version of RemoveSCSI. The mutex
-// MUST be held when calling this function.
+// MUST be held when calling this function. The disk is only detached when its
+// last reference is removed.
 func (uvm *UtilityVM) removeSCSI(hostPath string, uvmPath string, controller int, lun int) error {
 	logrus.Debugf("uvm::RemoveSCSI id:%s hostPath:%s", uvm.id, hostPath)
+	if si := &uvm.scsiLocations[controller][lun]; si.refCount > 1 {
+		si.refCount--
+		logrus.Debugf("uvm::RemoveSCSI: Success id:%s hostPath:%s %d:%d refCount:%d", uvm.id, hostPath, controller, lun, si.refCount)
+		return nil
+	}
 	scsiModification := &schema2.ModifySettingsRequestV2{
 		ResourceType: schema2.ResourceTypeMappedVirtualDisk,
 		RequestType:  schema2.RequestTypeRemove,
@@ -158,10 +221,18 @@ func (uvm *UtilityVM) removeSCSI(hostPath string, uvmPath string, controller int
 	}
 	if uvmPath != "" {
 		// Include the HostedSettings so that the GCS ejects the disk cleanly
-		scsiModification.HostedSettings = schema2.ContainersResourcesMappedDirectoryV2{
-			ContainerPath: uvmPath,
-			Lun:           uint8(lun),
-			// TODO: Controller: uint8(controller), // TODO NOT IN HCS API CURRENTLY
+		if uvm.operatingSystem == "windows" {
+			scsiModification.HostedSettings = schema2.ContainersResourcesMappedDirectoryV2{
+				ContainerPath: uvmPath,
+				Lun:           uint8(lun),
+				Controller:    uint8(controller),
+			}
+		} else {
+			scsiModification.HostedSettings = lcowhostedsettings.MappedVirtualDisk{
+				MountPath:  uvmPath,
+				Lun:        uint8(lun),
+				Controller: uint8(controller),
+			}
 		}
 	}
 	if err := uvm.Modify(scsiModification); err != nil {
@@ -0,0 +1,125 @@
+package uvm
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/internal/schema2"
+)
+
+func TestAllocateSCSI(t *testing.T) {
+	vm := &UtilityVM{operatingSystem: "linux", scsiControllerCount: 2}
+	for i := 0; i < 2*scsiLUNsPerController; i++ {
+		controller, lun, err := vm.allocateSCSI(scsiInfo{hostPath: "disk", uvmPath: "/disk"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if controller != i/scsiLUNsPerController || lun != i%scsiLUNsPerController {
+			t.Fatalf("disk %d allocated at %d:%d", i, controller, lun)
+		}
+	}
+	if _, _, err := vm.allocateSCSI(scsiInfo{hostPath: "disk"}); err == nil {
+		t.Fatal("allocated beyond the configured controllers")
+	}
+	if vm.scsiLocations[2][0].hostPath != "" {
+		t.Fatal("allocated on an unconfigured controller")
+	}
+	vm.deallocateSCSI(1, 5)
+	if controller, lun, err := vm.allocateSCSI(scsiInfo{hostPath: "other"}); err != nil || controller != 1 || lun != 5 {
+		t.Fatalf("got %d:%d %v, expected 1:5", controller, lun, err)
+	}
+	if si := vm.scsiLocations[1][5]; si.refCount != 1 || si.hostPath != "other" {
+		t.Fatalf("wrong allocation %+v", si)
+	}
+}
+
+func TestAddSCSIWindowsSecondController(t *testing.T) {
+	vm := &UtilityVM{id: "test", operatingSystem: "windows", scsiControllerCount: 2}
+	var settings []schema2.ContainersResourcesMappedDirectoryV2
+	vm.modifyHook = func(doc interface{}) error {
+		hs := doc.(*schema2.ModifySettingsRequestV2).HostedSettings
+		settings = append(settings, hs.(schema2.ContainersResourcesMappedDirectoryV2))
+		return nil
+	}
+	// The scratch of each container is a disk mapped into the guest. The
+	// 65th no longer fits on the first controller.
+	for i := 0; i <= scsiLUNsPerController; i++ {
+		scratch := fmt.Sprintf(`c:\scratch\%d.vhdx`, i)
+		controller, lun, err := vm.AddSCSI(scratch, fmt.Sprintf(`C:\c\%d`, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if controller != i/scsiLUNsPerController || lun != i%scsiLUNsPerController {
+			t.Fatalf("scratch %d attached at %d:%d", i, controller, lun)
+		}
+	}
+	if hs := settings[scsiLUNsPerController]; hs.Controller != 1 || hs.Lun != 0 || hs.ContainerPath != `C:\c\64` {
+		t.Fatalf("wrong guest mapping %+v", hs)
+	}
+
+	if err := vm.RemoveSCSI(`c:\scratch\64.vhdx`); err != nil {
+		t.Fatal(err)
+	}
+	if hs := settings[len(settings)-1]; hs.Controller != 1 || hs.Lun != 0 {
+		t.Fatalf("wrong guest mapping on removal %+v", hs)
+	}
+	if si := vm.scsiLocations[1][0]; si.hostPath != "" {
+		t.Fatalf("disk still allocated %+v", si)
+	}
+}
+
+func TestSCSIReferences(t *testing.T) {
+	vm := &UtilityVM{operatingSystem: "linux", scsiControllerCount: 1}
+	vm.scsiLocations[0][3] = scsiInfo{hostPath: "data", uvmPath: "/data", readOnly: true, refCount: 1}
+
+	if err := vm.addSCSIReference(0, 3, "/other", true); err == nil {
+		t.Fatal("expected error for a different uvmPath")
+	}
+	if err := vm.addSCSIReference(0, 3, "/data", false); err == nil {
+		t.Fatal("expected error for a different read-only option")
+	}
+	if err := vm.addSCSIReference(0, 3, "/data", true); err != nil {
+		t.Fatal(err)
+	}
+	if n := vm.scsiLocations[0][3].refCount; n != 2 {
+		t.Fatalf("got refCount %d, expected 2", n)
+	}
+	// Removing a reference other than the last leaves the disk attached.
+	if err := vm.RemoveSCSI("data"); err != nil {
+		t.Fatal(err)
+	}
+	if si := vm.scsiLocations[0][3]; si.hostPath != "data" || si.refCount != 1 {
+		t.Fatalf("wrong attachment after removal %+v", si)
+	}
+}
+
+func TestAddSCSIFailedAttach(t *testing.T) {
+	vm := &UtilityVM{operatingSystem: "linux", scsiControllerCount: 1}
+	fail := errors.New("attach failed")
+	attaches := 0
+	vm.modifyHook = func(interface{}) error {
+		attaches++
+		return fail
+	}
+	if _, _, err := vm.AddSCSIWithOptions("data", "/data", &SCSIOptions{ReadOnly: true}); err == nil {
+		t.Fatal("expected the failed attach to be reported")
+	}
+	if si := vm.scsiLocations[0][0]; si.hostPath != "" {
+		t.Fatalf("slot not freed after failed attach %+v", si)
+	}
+
+	// Once attached, further adds only take references.
+	vm.modifyHook = func(interface{}) error {
+		attaches++
+		return nil
+	}
+	for i := 0; i < 2; i++ {
+		if controller, lun, err := vm.AddSCSIWithOptions("data", "/data", &SCSIOptions{ReadOnly: true}); err != nil || controller != 0 || lun != 0 {
+			t.Fatalf("got %d:%d %v, expected 0:0", controller, lun, err)
+		}
+	}
+	if si := vm.scsiLocations[0][0]; si.refCount != 2 || !si.readOnly || attaches != 2 {
+		t.Fatalf("wrong attachment %+v after %d attaches", si, attaches)
+	}
+}
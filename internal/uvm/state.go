@@ -0,0 +1,325 @@
+package uvm
+
+import (
+	"fmt"
+
+	"github.com/Microsoft/hcsshim/internal/guid"
+	"github.com/Microsoft/hcsshim/internal/hcs"
+	"github.com/Microsoft/hcsshim/internal/hns"
+	"github.com/Microsoft/hcsshim/internal/uvm/vpmemalloc"
+)
+
+// stateVersion is the version of the State format. It must be incremented
+// when the meaning of existing fields changes.
+const stateVersion = 1
+
+// State is the bookkeeping of a utility VM: what is attached to it and the
+// counters used to name new attachments. It is saved by the process managing
+// the VM so that, if that process restarts, Open can recreate the UtilityVM.
+type State struct {
+	Version          int
+	ID               string
+	Owner            string
+	OperatingSystem  string
+	ContainerCounter uint64
+
+	MemorySizeInMB    int32  `json:",omitempty"`
+	MaxMemorySizeInMB int32  `json:",omitempty"`
+	ProcessorCount    int32  `json:",omitempty"`
+	MaxProcessorCount int32  `json:",omitempty"`
+	CPUGroup          string `json:",omitempty"`
+
+	VSMBCounter    uint64
+	VSMBShares     []VSMBShareState     `json:",omitempty"`
+	VSMBFileShares []VSMBFileShareState `json:",omitempty"`
+
+	VPMemMax          int32
+	VPMemMultiMapping bool         `json:",omitempty"`
+	VPMemDeviceSize   uint64       `json:",omitempty"`
+	VPMem             []VPMemState `json:",omitempty"`
+
+	SCSIControllerCount int
+	SCSI                []SCSIState `json:",omitempty"`
+
+	Plan9Shares []Plan9ShareState `json:",omitempty"`
+	Pipes       []PipeAllocation  `json:",omitempty"`
+	Namespaces  []NamespaceState  `json:",omitempty"`
+}
+
+// VSMBShareState is a VSMB share of a directory.
+type VSMBShareState struct {
+	HostPath string
+	Name     string
+	UVMPath  string `json:",omitempty"`
+	Flags    int32  `json:",omitempty"`
+	RefCount uint32
+}
+
+// VSMBFileShareState is a VSMB share restricted to some files of a directory.
+type VSMBFileShareState struct {
+	Dir   string
+	Name  string
+	Flags int32
+	Files map[string]uint32
+}
+
+// VPMemState is a VPMem device holding either one layer or, in multi-mapping
+// mode, several.
+type VPMemState struct {
+	Device   uint32
+	HostPath string                   `json:",omitempty"`
+	UVMPath  string                   `json:",omitempty"`
+	RefCount uint32                   `json:",omitempty"`
+	Mappings []VPMemMappingAllocation `json:",omitempty"`
+}
+
+// SCSIState is a disk attached to a SCSI controller.
+type SCSIState struct {
+	Controller int
+	LUN        int
+	HostPath   string
+	UVMPath    string `json:",omitempty"`
+	ReadOnly   bool   `json:",omitempty"`
+	RefCount   uint32
+}
+
+// Plan9ShareState is a Plan9 share.
+type Plan9ShareState struct {
+	HostPath string
+	Name     string
+	UVMPath  string
+	Flags    int32 `json:",omitempty"`
+	RefCount uint32
+}
+
+// NamespaceState is a network namespace added to the utility VM.
+type NamespaceState struct {
+	ID       string
+	NICs     []NICState
+	RefCount int
+}
+
+// NICState is a NIC added to the utility VM for an endpoint.
+type NICState struct {
+	ID       guid.GUID
+	Endpoint *hns.HNSEndpoint
+}
+
+// State returns the state of the utility VM.
+func (uvm *UtilityVM) State() *State {
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	s := &State{
+		Version:             stateVersion,
+		ID:                  uvm.id,
+		Owner:               uvm.owner,
+		OperatingSystem:     uvm.operatingSystem,
+		ContainerCounter:    uvm.containerCounter,
+		MemorySizeInMB:      uvm.memorySizeInMB,
+		MaxMemorySizeInMB:   uvm.maxMemorySizeInMB,
+		ProcessorCount:      uvm.processorCount,
+		MaxProcessorCount:   uvm.maxProcessorCount,
+		CPUGroup:            uvm.cpuGroup,
+		VSMBCounter:         uvm.vsmbCounter,
+		VPMemMax:            uvm.vpmemMax,
+		VPMemMultiMapping:   uvm.vpmemMultiMapping,
+		VPMemDeviceSize:     uvm.vpmemDeviceSize,
+		SCSIControllerCount: uvm.scsiControllerCount,
+	}
+	for hostPath, share := range uvm.vsmbShares {
+		s.VSMBShares = append(s.VSMBShares, VSMBShareState{
+			HostPath: hostPath,
+			Name:     share.name,
+			UVMPath:  share.uvmPath,
+			Flags:    share.flags,
+			RefCount: share.refCount,
+		})
+	}
+	for dir, share := range uvm.vsmbFileShares {
+		fs := VSMBFileShareState{Dir: dir, Name: share.name, Flags: share.flags, Files: make(map[string]uint32)}
+		for f, refCount := range share.files {
+			fs.Files[f] = refCount
+		}
+		s.VSMBFileShares = append(s.VSMBFileShares, fs)
+	}
+	for device, vi := range uvm.vpmemDevices {
+		if vi.mappings != nil {
+			vs := VPMemState{Device: uint32(device)}
+			for _, r := range vi.mappings.alloc.Regions() {
+				vs.Mappings = append(vs.Mappings, VPMemMappingAllocation{
+					HostPath: r.Key,
+					UVMPath:  vi.mappings.uvmPaths[r.Key],
+					Offset:   r.Offset,
+					Size:     r.Size,
+					RefCount: r.RefCount,
+				})
+			}
+			s.VPMem = append(s.VPMem, vs)
+		} else if vi.hostPath != "" {
+			s.VPMem = append(s.VPMem, VPMemState{
+				Device:   uint32(device),
+				HostPath: vi.hostPath,
+				UVMPath:  vi.uvmPath,
+				RefCount: vi.refCount,
+			})
+		}
+	}
+	for controller := 0; controller < uvm.scsiControllerCount; controller++ {
+		for lun, si := range uvm.scsiLocations[controller] {
+			if si.hostPath != "" {
+				s.SCSI = append(s.SCSI, SCSIState{
+					Controller: controller,
+					LUN:        lun,
+					HostPath:   si.hostPath,
+					UVMPath:    si.uvmPath,
+					ReadOnly:   si.readOnly,
+					RefCount:   si.refCount,
+				})
+			}
+		}
+	}
+	for hostPath, share := range uvm.plan9Shares {
+		s.Plan9Shares = append(s.Plan9Shares, Plan9ShareState{
+			HostPath: hostPath,
+			Name:     share.name,
+			UVMPath:  share.uvmPath,
+			Flags:    share.flags,
+			RefCount: share.refCount,
+		})
+	}
+	for hostPath, refCount := range uvm.mappedPipes {
+		s.Pipes = append(s.Pipes, PipeAllocation{HostPath: hostPath, RefCount: refCount})
+	}
+	for id, ns := range uvm.namespaces {
+		nss := NamespaceState{ID: id, RefCount: ns.refCount}
+		for _, nic := range ns.nics {
+			nss.NICs = append(nss.NICs, NICState{ID: nic.ID, Endpoint: nic.Endpoint})
+		}
+		s.Namespaces = append(s.Namespaces, nss)
+	}
+	return s
+}
+
+// Open returns a UtilityVM for the running utility VM id, whose state was
+// saved by State, so that a process can take over managing a VM created by
+// another.
+func Open(id string, state *State) (*UtilityVM, error) {
+	if state.ID != id {
+		return nil, fmt.Errorf("state is for utility VM %s, not %s", state.ID, id)
+	}
+	uvm, err := fromState(state)
+	if err != nil {
+		return nil, err
+	}
+	uvm.hcsSystem, err = hcs.OpenComputeSystem(id)
+	if err != nil {
+		return nil, err
+	}
+	return uvm, nil
+}
+
+// fromState returns a UtilityVM with the bookkeeping in state, but not bound
+// to a compute system.
+func fromState(state *State) (*UtilityVM, error) {
+	if state.Version != stateVersion {
+		return nil, fmt.Errorf("unsupported utility VM state version %d", state.Version)
+	}
+	if state.OperatingSystem != "windows" && state.OperatingSystem != "linux" {
+		return nil, fmt.Errorf("unsupported utility VM operating system %q", state.OperatingSystem)
+	}
+	if state.SCSIControllerCount < 0 || state.SCSIControllerCount > MaxSCSIControllers {
+		return nil, fmt.Errorf("invalid SCSI controller count %d", state.SCSIControllerCount)
+	}
+	if state.VPMemMax < 0 || state.VPMemMax > MaxVPMEM {
+		return nil, fmt.Errorf("invalid VPMem device count %d", state.VPMemMax)
+	}
+	if state.MemorySizeInMB < 0 || state.MaxMemorySizeInMB < state.MemorySizeInMB {
+		return nil, fmt.Errorf("invalid memory size %dMB with maximum %dMB", state.MemorySizeInMB, state.MaxMemorySizeInMB)
+	}
+	if state.ProcessorCount < 0 || state.MaxProcessorCount < state.ProcessorCount {
+		return nil, fmt.Errorf("invalid processor count %d with maximum %d", state.ProcessorCount, state.MaxProcessorCount)
+	}
+	uvm := &UtilityVM{
+		id:                  state.ID,
+		owner:               state.Owner,
+		operatingSystem:     state.OperatingSystem,
+		containerCounter:    state.ContainerCounter,
+		memorySizeInMB:      state.MemorySizeInMB,
+		maxMemorySizeInMB:   state.MaxMemorySizeInMB,
+		processorCount:      state.ProcessorCount,
+		maxProcessorCount:   state.MaxProcessorCount,
+		cpuGroup:            state.CPUGroup,
+		vsmbCounter:         state.VSMBCounter,
+		vpmemMax:            state.VPMemMax,
+		vpmemMultiMapping:   state.VPMemMultiMapping,
+		vpmemDeviceSize:     state.VPMemDeviceSize,
+		scsiControllerCount: state.SCSIControllerCount,
+	}
+	for _, share := range state.VSMBShares {
+		if uvm.vsmbShares == nil {
+			uvm.vsmbShares = make(map[string]*vsmbShare)
+		}
+		uvm.vsmbShares[share.HostPath] = &vsmbShare{refCount: share.RefCount, name: share.Name, uvmPath: share.UVMPath, flags: share.Flags}
+	}
+	for _, share := range state.VSMBFileShares {
+		if uvm.vsmbFileShares == nil {
+			uvm.vsmbFileShares = make(map[string]*vsmbFileShare)
+		}
+		fs := &vsmbFileShare{name: share.Name, flags: share.Flags, files: make(map[string]uint32)}
+		for f, refCount := range share.Files {
+			fs.files[f] = refCount
+		}
+		uvm.vsmbFileShares[share.Dir] = fs
+	}
+	for _, vs := range state.VPMem {
+		if vs.Device >= uint32(state.VPMemMax) {
+			return nil, fmt.Errorf("VPMem device %d is beyond the device count %d", vs.Device, state.VPMemMax)
+		}
+		if vs.Mappings == nil {
+			uvm.vpmemDevices[vs.Device] = vpmemInfo{hostPath: vs.HostPath, uvmPath: vs.UVMPath, refCount: vs.RefCount}
+			continue
+		}
+		alloc, err := vpmemalloc.New(state.VPMemDeviceSize, vpmemMappingAlignment)
+		if err != nil {
+			return nil, err
+		}
+		mappings := &vpmemMappings{alloc: alloc, uvmPaths: make(map[string]string)}
+		for _, m := range vs.Mappings {
+			err := alloc.Restore(vpmemalloc.Region{Key: m.HostPath, Offset: m.Offset, Size: m.Size, RefCount: m.RefCount})
+			if err != nil {
+				return nil, fmt.Errorf("VPMem device %d: %s", vs.Device, err)
+			}
+			mappings.uvmPaths[m.HostPath] = m.UVMPath
+		}
+		uvm.vpmemDevices[vs.Device] = vpmemInfo{mappings: mappings}
+	}
+	for _, ss := range state.SCSI {
+		if ss.Controller < 0 || ss.Controller >= state.SCSIControllerCount || ss.LUN < 0 || ss.LUN >= scsiLUNsPerController {
+			return nil, fmt.Errorf("invalid SCSI location %d:%d", ss.Controller, ss.LUN)
+		}
+		uvm.scsiLocations[ss.Controller][ss.LUN] = scsiInfo{hostPath: ss.HostPath, uvmPath: ss.UVMPath, readOnly: ss.ReadOnly, refCount: ss.RefCount}
+	}
+	for _, share := range state.Plan9Shares {
+		if uvm.plan9Shares == nil {
+			uvm.plan9Shares = make(map[string]*plan9Info)
+		}
+		uvm.plan9Shares[share.HostPath] = &plan9Info{refCount: share.RefCount, name: share.Name, uvmPath: share.UVMPath, flags: share.Flags}
+	}
+	for _, pipe := range state.Pipes {
+		if uvm.mappedPipes == nil {
+			uvm.mappedPipes = make(map[string]uint32)
+		}
+		uvm.mappedPipes[pipe.HostPath] = pipe.RefCount
+	}
+	for _, nss := range state.Namespaces {
+		if uvm.namespaces == nil {
+			uvm.namespaces = make(map[string]*namespaceInfo)
+		}
+		ns := &namespaceInfo{refCount: nss.RefCount}
+		for _, nic := range nss.NICs {
+			ns.nics = append(ns.nics, nicInfo{ID: nic.ID, Endpoint: nic.Endpoint})
+		}
+		uvm.namespaces[nss.ID] = ns
+	}
+	return uvm, nil
+}
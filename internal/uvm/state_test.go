@@ -0,0 +1,108 @@
+package uvm
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/internal/guid"
+	"github.com/Microsoft/hcsshim/internal/hns"
+	"github.com/Microsoft/hcsshim/internal/uvm/vpmemalloc"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	alloc, err := vpmemalloc.New(1<<20, vpmemMappingAlignment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, layer := range []string{`c:\l1.vhd`, `c:\l2.vhd`} {
+		if _, _, err := alloc.Allocate(layer, 5000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vm := &UtilityVM{
+		id:                "test",
+		owner:             "runhcs",
+		operatingSystem:   "linux",
+		containerCounter:  3,
+		memorySizeInMB:    2048,
+		maxMemorySizeInMB: 4096,
+		processorCount:    2,
+		maxProcessorCount: 4,
+		cpuGroup:          "group",
+		vsmbCounter:       2,
+		vsmbShares: map[string]*vsmbShare{
+			`c:\data`: {refCount: 2, name: "s1", flags: 0x4},
+		},
+		vsmbFileShares: map[string]*vsmbFileShare{
+			`c:\files`: {name: "s2", flags: 0x800, files: map[string]uint32{`c:\files\a`: 1, `c:\files\b`: 3}},
+		},
+		vpmemMax:            4,
+		vpmemMultiMapping:   true,
+		vpmemDeviceSize:     1 << 20,
+		scsiControllerCount: 2,
+		plan9Shares: map[string]*plan9Info{
+			`c:\p9`: {refCount: 1, name: plan9ShareName(`c:\p9`), uvmPath: "/p9", flags: 0x1},
+		},
+		mappedPipes: map[string]uint32{`\\.\pipe\p`: 2},
+		namespaces: map[string]*namespaceInfo{
+			"ns": {refCount: 1, nics: []nicInfo{{ID: guid.GUID{1, 2, 3}, Endpoint: &hns.HNSEndpoint{Id: "ep"}}}},
+		},
+	}
+	vm.vpmemDevices[0] = vpmemInfo{hostPath: `c:\rootfs.vhd`, uvmPath: "/", refCount: 1}
+	vm.vpmemDevices[2] = vpmemInfo{mappings: &vpmemMappings{alloc: alloc, uvmPaths: map[string]string{`c:\l1.vhd`: "/tmp/v2-0", `c:\l2.vhd`: "/tmp/v2-2000"}}}
+	vm.scsiLocations[0][0] = scsiInfo{hostPath: `c:\scratch.vhdx`, uvmPath: "/tmp/scratch", refCount: 1}
+	vm.scsiLocations[1][5] = scsiInfo{hostPath: `c:\ro.vhdx`, uvmPath: "/ro", readOnly: true, refCount: 2}
+
+	b, err := json.Marshal(vm.State())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state State
+	if err := json.Unmarshal(b, &state); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := fromState(&state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored, vm) {
+		t.Fatalf("got %+v, expected %+v", restored, vm)
+	}
+
+	// The restored VM goes on counting where the original left off.
+	if n := restored.ContainerCounter(); n != 4 {
+		t.Fatalf("got container counter %d, expected 4", n)
+	}
+}
+
+func TestStateInvalid(t *testing.T) {
+	valid := func() *State {
+		return &State{Version: stateVersion, ID: "test", OperatingSystem: "linux", VPMemMax: 2, SCSIControllerCount: 1}
+	}
+	if _, err := fromState(valid()); err != nil {
+		t.Fatal(err)
+	}
+	for i, modify := range []func(*State){
+		func(s *State) { s.Version = stateVersion + 1 },
+		func(s *State) { s.OperatingSystem = "plan9" },
+		func(s *State) { s.SCSIControllerCount = MaxSCSIControllers + 1 },
+		func(s *State) { s.MemorySizeInMB = 1024 },
+		func(s *State) { s.ProcessorCount, s.MaxProcessorCount = 4, 2 },
+		func(s *State) { s.SCSI = []SCSIState{{Controller: 1, LUN: 0, HostPath: `c:\a`, RefCount: 1}} },
+		func(s *State) { s.VPMem = []VPMemState{{Device: 2, HostPath: `c:\a`, RefCount: 1}} },
+		func(s *State) {
+			s.VPMemDeviceSize = 1 << 20
+			s.VPMem = []VPMemState{{Device: 1, Mappings: []VPMemMappingAllocation{
+				{HostPath: `c:\a`, Offset: 0, Size: 8192, RefCount: 1},
+				{HostPath: `c:\b`, Offset: 4096, Size: 8192, RefCount: 1},
+			}}}
+		},
+	} {
+		s := valid()
+		modify(s)
+		if _, err := fromState(s); err == nil {
+			t.Errorf("%d: expected error for %+v", i, s)
+		}
+	}
+}
@@ -5,3 +5,9 @@ package uvm
 func (uvm *UtilityVM) Terminate() error {
 	return uvm.hcsSystem.Terminate()
 }
+
+// Shutdown requests a utility VM shut down gracefully. If IsPending() on the
+// error returned is true, it may not actually be shut down until Wait() succeeds.
+func (uvm *UtilityVM) Shutdown() error {
+	return uvm.hcsSystem.Shutdown()
+}
@@ -0,0 +1,131 @@
+package uvm
+
+import (
+	"fmt"
+
+	"github.com/Microsoft/hcsshim/internal/schema2"
+)
+
+// MemoryBacking is how the memory of a utility VM is backed in the host.
+type MemoryBacking string
+
+const (
+	// MemoryBackingVirtual backs the VM's memory with virtual memory in the
+	// host, allowing it to be overcommitted and paged out.
+	MemoryBackingVirtual MemoryBacking = "Virtual"
+	// MemoryBackingPhysical backs the VM's memory with physical memory
+	// allocated when the VM starts, for predictable latency.
+	MemoryBackingPhysical MemoryBacking = "Physical"
+)
+
+// defaultDirectFileMappingMB is the default size of the direct file mapping
+// for a Windows utility VM with virtual backing.
+const defaultDirectFileMappingMB = 1024
+
+// MemoryTopology configures the memory of a utility VM other than its size.
+type MemoryTopology struct {
+	Backing                       MemoryBacking // Defaults to virtual, or physical if AllowOvercommit is false.
+	EnableHotHint                 bool          // Virtual backing only.
+	EnableColdHint                bool          // Virtual backing only.
+	EnablePrivateCompressionStore bool          // Virtual backing only.
+	DirectFileMappingMB           int64         // Windows with virtual backing only. Defaults to 1024 there.
+	SharedMemoryMB                int64         // Memory shared with the host.
+	SharedMemoryAccessSids        []string      // SIDs allowed to access the shared memory. Requires SharedMemoryMB.
+}
+
+// ProcessorTopology configures the processors of a utility VM other than
+// their count.
+type ProcessorTopology struct {
+	SynchronizeQPC                 bool // Keep the VM's performance counter in sync with the host's.
+	EnableSchedulerAssist          bool
+	ExposeVirtualizationExtensions bool // Allow nested virtualization.
+}
+
+// computeTopology returns the compute topology for a utility VM of the given
+// memory size and processor count, validating the memory and processor
+// topology in opts and applying the defaults for the VM's operating system.
+// HCS takes no maximum memory size or processor count for a VM: the maximums
+// in opts are only checked against the initial size here, and are enforced by
+// UpdateMemory and UpdateProcessors when the running VM is resized.
+func computeTopology(opts *UVMOptions, memoryMB, processors int32) (*schema2.VirtualMachinesResourcesComputeTopologyV2, error) {
+	var mt MemoryTopology
+	if opts.Memory != nil {
+		mt = *opts.Memory
+	}
+	switch mt.Backing {
+	case "":
+		mt.Backing = MemoryBackingVirtual
+		if opts.AllowOvercommit != nil && !*opts.AllowOvercommit {
+			mt.Backing = MemoryBackingPhysical
+		}
+	case MemoryBackingVirtual:
+		if opts.AllowOvercommit != nil && !*opts.AllowOvercommit {
+			return nil, fmt.Errorf("virtual memory backing requires memory overcommit to be allowed")
+		}
+	case MemoryBackingPhysical:
+		if opts.AllowOvercommit != nil && *opts.AllowOvercommit {
+			return nil, fmt.Errorf("physical memory backing cannot be used with memory overcommit")
+		}
+	default:
+		return nil, fmt.Errorf("invalid memory backing %q", mt.Backing)
+	}
+
+	if mt.Backing == MemoryBackingPhysical {
+		if mt.EnableHotHint || mt.EnableColdHint {
+			return nil, fmt.Errorf("memory hot and cold hints require virtual memory backing")
+		}
+		if mt.EnablePrivateCompressionStore {
+			return nil, fmt.Errorf("the private compression store requires virtual memory backing")
+		}
+		if mt.DirectFileMappingMB != 0 {
+			return nil, fmt.Errorf("direct file mapping requires virtual memory backing")
+		}
+	}
+	if mt.DirectFileMappingMB < 0 || mt.SharedMemoryMB < 0 {
+		return nil, fmt.Errorf("memory sizes must not be negative")
+	}
+	if opts.OperatingSystem == "windows" {
+		if mt.Backing == MemoryBackingVirtual && mt.DirectFileMappingMB == 0 {
+			mt.DirectFileMappingMB = defaultDirectFileMappingMB
+		}
+	} else if mt.DirectFileMappingMB != 0 {
+		return nil, fmt.Errorf("direct file mapping is only supported for Windows utility VMs")
+	}
+	if len(mt.SharedMemoryAccessSids) != 0 && mt.SharedMemoryMB == 0 {
+		return nil, fmt.Errorf("shared memory access SIDs require shared memory")
+	}
+	if mt.SharedMemoryMB != 0 && mt.SharedMemoryMB >= int64(memoryMB) {
+		return nil, fmt.Errorf("shared memory of %dMB does not fit in %dMB of memory", mt.SharedMemoryMB, memoryMB)
+	}
+
+	if opts.MaxMemorySizeInMB != 0 && opts.MaxMemorySizeInMB < memoryMB {
+		return nil, fmt.Errorf("maximum memory size %dMB is less than the memory size %dMB", opts.MaxMemorySizeInMB, memoryMB)
+	}
+
+	var pt ProcessorTopology
+	if opts.Processor != nil {
+		pt = *opts.Processor
+	}
+	if opts.MaxProcessorCount != 0 && opts.MaxProcessorCount < processors {
+		return nil, fmt.Errorf("maximum processor count %d is less than the processor count %d", opts.MaxProcessorCount, processors)
+	}
+
+	return &schema2.VirtualMachinesResourcesComputeTopologyV2{
+		Memory: &schema2.VirtualMachinesResourcesComputeMemoryV2{
+			Startup:                       memoryMB,
+			Backing:                       string(mt.Backing),
+			EnableHotHint:                 mt.EnableHotHint,
+			EnableColdHint:                mt.EnableColdHint,
+			EnablePrivateCompressionStore: mt.EnablePrivateCompressionStore,
+			DirectFileMappingMB:           mt.DirectFileMappingMB,
+			SharedMemoryMB:                mt.SharedMemoryMB,
+			SharedMemoryAccessSids:        mt.SharedMemoryAccessSids,
+		},
+		Processor: &schema2.VirtualMachinesResourcesComputeProcessorV2{
+			Count:                          processors,
+			SynchronizeQPC:                 pt.SynchronizeQPC,
+			EnableSchedulerAssist:          pt.EnableSchedulerAssist,
+			ExposeVirtualizationExtensions: pt.ExposeVirtualizationExtensions,
+		},
+	}, nil
+}
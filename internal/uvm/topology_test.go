@@ -0,0 +1,66 @@
+package uvm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestComputeTopology(t *testing.T) {
+	no, yes := false, true
+	tests := []struct {
+		name string
+		opts UVMOptions
+		err  string
+		// Expected values when err is empty.
+		backing     string
+		directMB    int64
+		nestedVirt  bool
+		schedAssist bool
+	}{
+		{name: "windows defaults", opts: UVMOptions{OperatingSystem: "windows"}, backing: "Virtual", directMB: 1024},
+		{name: "linux defaults", opts: UVMOptions{OperatingSystem: "linux"}, backing: "Virtual"},
+		{name: "no overcommit", opts: UVMOptions{OperatingSystem: "windows", AllowOvercommit: &no}, backing: "Physical"},
+		{name: "explicit physical", opts: UVMOptions{OperatingSystem: "linux", Memory: &MemoryTopology{Backing: MemoryBackingPhysical}}, backing: "Physical"},
+		{name: "direct file mapping", opts: UVMOptions{OperatingSystem: "windows", Memory: &MemoryTopology{DirectFileMappingMB: 256}}, backing: "Virtual", directMB: 256},
+		{name: "processor", opts: UVMOptions{OperatingSystem: "linux", Processor: &ProcessorTopology{ExposeVirtualizationExtensions: true, EnableSchedulerAssist: true}}, backing: "Virtual", nestedVirt: true, schedAssist: true},
+		{name: "physical with overcommit", opts: UVMOptions{OperatingSystem: "linux", AllowOvercommit: &yes, Memory: &MemoryTopology{Backing: MemoryBackingPhysical}}, err: "overcommit"},
+		{name: "virtual without overcommit", opts: UVMOptions{OperatingSystem: "linux", AllowOvercommit: &no, Memory: &MemoryTopology{Backing: MemoryBackingVirtual}}, err: "overcommit"},
+		{name: "bad backing", opts: UVMOptions{OperatingSystem: "linux", Memory: &MemoryTopology{Backing: "Fast"}}, err: "invalid memory backing"},
+		{name: "physical with hints", opts: UVMOptions{OperatingSystem: "linux", Memory: &MemoryTopology{Backing: MemoryBackingPhysical, EnableColdHint: true}}, err: "hints"},
+		{name: "physical with compression", opts: UVMOptions{OperatingSystem: "linux", Memory: &MemoryTopology{Backing: MemoryBackingPhysical, EnablePrivateCompressionStore: true}}, err: "compression"},
+		{name: "physical with direct mapping", opts: UVMOptions{OperatingSystem: "windows", AllowOvercommit: &no, Memory: &MemoryTopology{DirectFileMappingMB: 64}}, err: "direct file mapping"},
+		{name: "linux direct mapping", opts: UVMOptions{OperatingSystem: "linux", Memory: &MemoryTopology{DirectFileMappingMB: 64}}, err: "Windows"},
+		{name: "sids without shared memory", opts: UVMOptions{OperatingSystem: "linux", Memory: &MemoryTopology{SharedMemoryAccessSids: []string{"S-1-5-18"}}}, err: "shared memory"},
+		{name: "shared memory too large", opts: UVMOptions{OperatingSystem: "linux", Memory: &MemoryTopology{SharedMemoryMB: 1024}}, err: "does not fit"},
+		{name: "negative size", opts: UVMOptions{OperatingSystem: "linux", Memory: &MemoryTopology{SharedMemoryMB: -1}}, err: "negative"},
+		{name: "maximums", opts: UVMOptions{OperatingSystem: "linux", MaxMemorySizeInMB: 4096, MaxProcessorCount: 8}, backing: "Virtual"},
+		{name: "maximum memory too small", opts: UVMOptions{OperatingSystem: "linux", MaxMemorySizeInMB: 512}, err: "maximum memory size"},
+		{name: "maximum processors too small", opts: UVMOptions{OperatingSystem: "linux", MaxProcessorCount: 1}, err: "maximum processor count"},
+	}
+	for _, test := range tests {
+		topology, err := computeTopology(&test.opts, 1024, 2)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error containing %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		m, p := topology.Memory, topology.Processor
+		if m.Startup != 1024 || p.Count != 2 {
+			t.Errorf("%s: wrong size %d MB, %d processors", test.name, m.Startup, p.Count)
+		}
+		if m.Backing != test.backing {
+			t.Errorf("%s: got backing %s, expected %s", test.name, m.Backing, test.backing)
+		}
+		if m.DirectFileMappingMB != test.directMB {
+			t.Errorf("%s: got direct file mapping %d, expected %d", test.name, m.DirectFileMappingMB, test.directMB)
+		}
+		if p.ExposeVirtualizationExtensions != test.nestedVirt || p.EnableSchedulerAssist != test.schedAssist {
+			t.Errorf("%s: wrong processor topology %+v", test.name, p)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/Microsoft/hcsshim/internal/guid"
 	"github.com/Microsoft/hcsshim/internal/hcs"
 	"github.com/Microsoft/hcsshim/internal/hns"
+	"github.com/Microsoft/hcsshim/internal/uvm/vpmemalloc"
 )
 
 //                    | WCOW | LCOW
@@ -21,6 +22,15 @@ type vsmbShare struct {
 	refCount uint32
 	name     string
 	uvmPath  string
+	flags    int32
+}
+
+// vsmbFileShare is a VSMB share of a directory that only allows access to
+// some of its files, used to map individual files into a Windows utility VM.
+type vsmbFileShare struct {
+	name  string
+	flags int32
+	files map[string]uint32 // Ref-count of each allowed file, keyed by host path.
 }
 
 // scsiInfo is an internal structure used for determining what is mapped to a utility VM.
@@ -28,6 +38,8 @@ type vsmbShare struct {
 type scsiInfo struct {
 	hostPath string
 	uvmPath  string
+	readOnly bool
+	refCount uint32
 }
 
 // vpmemInfo is an internal structure used for determining VPMem devices mapped to
@@ -36,14 +48,22 @@ type vpmemInfo struct {
 	hostPath string
 	uvmPath  string
 	refCount uint32
+	mappings *vpmemMappings // Set instead of the above for a device holding several layers.
+}
+
+// vpmemMappings tracks the layers packed into a VPMem device in
+// multi-mapping mode.
+type vpmemMappings struct {
+	alloc    *vpmemalloc.Allocator
+	uvmPaths map[string]string // Keyed by host path.
 }
 
 // plan9Info is an internal structure used for ref-counting Plan9 shares mapped to a Linux utility VM.
 type plan9Info struct {
-	refCount  uint32
-	idCounter uint64
-	uvmPath   string
-	port      int32 // Temporary. TODO Remove
+	refCount uint32
+	name     string // The share's name, and the aname the guest mounts it by.
+	uvmPath  string
+	flags    int32
 }
 type nicInfo struct {
 	ID       guid.GUID
@@ -63,22 +83,44 @@ type UtilityVM struct {
 	hcsSystem       *hcs.System // The handle to the compute system
 	m               sync.Mutex  // Lock for adding/removing devices
 
+	// modifyHook, if set, receives modification requests in place of the
+	// compute system, so that tests can run without one.
+	modifyHook func(interface{}) error
+
+	containerCounter uint64 // Counter to generate a unique guest root for each container
+
+	// The current size of the utility VM, and the largest it may be resized to.
+	memorySizeInMB    int32
+	maxMemorySizeInMB int32
+	processorCount    int32
+	maxProcessorCount int32
+	cpuGroup          string // The CPU group the VM's processors run on, if assigned.
+
 	// VSMB shares that are mapped into a Windows UVM. These are used for read-only
 	// layers and mapped directories
-	vsmbShares  map[string]*vsmbShare
-	vsmbCounter uint64 // Counter to generate a unique share name for each VSMB share.
+	vsmbShares     map[string]*vsmbShare
+	vsmbFileShares map[string]*vsmbFileShare // Keyed by the directory containing the files.
+	vsmbCounter    uint64                    // Counter to generate a unique share name for each VSMB share.
 
 	// VPMEM devices that are mapped into a Linux UVM. These are used for read-only layers.
 	vpmemDevices [MaxVPMEM]vpmemInfo // Limited by ACPI size.
 	vpmemMax     int32               // Actual number of VPMem devices
 
+	// In multi-mapping mode, layers share VPMem devices of vpmemDeviceSize bytes.
+	vpmemMultiMapping bool
+	vpmemDeviceSize   uint64
+
 	// SCSI devices that are mapped into a Windows or Linux utility VM
-	scsiLocations       [4][64]scsiInfo // Hyper-V supports 4 controllers, 64 slots per controller. Limited to 1 controller for now though.
-	scsiControllerCount int             // Number of SCSI controllers in the utility VM
+	scsiLocations       [MaxSCSIControllers][scsiLUNsPerController]scsiInfo // Only the first scsiControllerCount controllers are used.
+	scsiControllerCount int                                                 // Number of SCSI controllers in the utility VM
+
+	// Plan9 are directories mapped into a Linux utility VM. They are all
+	// served on plan9Port, and distinguished by name.
+	plan9Shares map[string]*plan9Info
 
-	// Plan9 are directories mapped into a Linux utility VM
-	plan9Shares  map[string]*plan9Info
-	plan9Counter uint64 // Each newly-added plan9 share has a counter used as its ID in the ResourceURI and for the name
+	// Host named pipes mapped into a Windows utility VM, keyed by host path,
+	// with their ref-counts.
+	mappedPipes map[string]uint32
 
 	namespaces map[string]*namespaceInfo
 }
@@ -12,9 +12,8 @@ import (
 // allocateVPMEM finds the next available VPMem slot. The lock MUST be held
 // when calling this function.
 func (uvm *UtilityVM) allocateVPMEM(hostPath string) (uint32, error) {
-	for index, vi := range uvm.vpmemDevices {
-		if vi.hostPath == "" {
-			vi.hostPath = hostPath
+	for index, vi := range uvm.vpmemDevices[:uvm.vpmemMax] {
+		if vi.hostPath == "" && vi.mappings == nil {
 			logrus.Debugf("uvm::allocateVPMEM %d %q", index, hostPath)
 			return uint32(index), nil
 		}
@@ -45,6 +44,9 @@ func (uvm *UtilityVM) findVPMEMDevice(findThisHostPath string) (uint32, string,
 // Returns the location(0..255) where the device is attached, and if exposed,
 // the container path which will be /tmp/v<location>/ if no container path
 // is supplied, or the user supplied one if it is.
+//
+// In multi-mapping mode the disk is instead packed into a device shared with
+// other disks, and is always exposed; see addVPMEMMapping.
 func (uvm *UtilityVM) AddVPMEM(hostPath string, uvmPath string, expose bool) (uint32, string, error) {
 	if uvm.operatingSystem != "linux" {
 		return 0, "", errNotSupported
@@ -55,6 +57,13 @@ func (uvm *UtilityVM) AddVPMEM(hostPath string, uvmPath string, expose bool) (ui
 	uvm.m.Lock()
 	defer uvm.m.Unlock()
 
+	if uvm.vpmemMultiMapping {
+		deviceNumber, mountPath, ok, err := uvm.addVPMEMMapping(hostPath, uvmPath)
+		if ok || err != nil {
+			return deviceNumber, mountPath, err
+		}
+	}
+
 	var deviceNumber uint32
 	var err error
 	currentUVMPath := ""
@@ -125,6 +134,13 @@ func (uvm *UtilityVM) RemoveVPMEM(hostPath string) error {
 	uvm.m.Lock()
 	defer uvm.m.Unlock()
 
+	if deviceNumber, ok := uvm.findVPMEMMapping(hostPath); ok {
+		if err := uvm.removeVPMEMMapping(hostPath, deviceNumber); err != nil {
+			return fmt.Errorf("failed to remove VPMEM %s from utility VM %s: %s", hostPath, uvm.id, err)
+		}
+		return nil
+	}
+
 	// Make sure is actually attached
 	deviceNumber, uvmPath, err := uvm.findVPMEMDevice(hostPath)
 	if err != nil {
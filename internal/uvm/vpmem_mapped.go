@@ -0,0 +1,200 @@
+package uvm
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Microsoft/hcsshim/internal/schema2"
+	"github.com/Microsoft/hcsshim/internal/uvm/lcowhostedsettings"
+	"github.com/Microsoft/hcsshim/internal/uvm/vpmemalloc"
+	"github.com/sirupsen/logrus"
+)
+
+// findVPMEMMapping returns the device holding hostPath as one of several
+// layers. The lock MUST be held when calling this function.
+func (uvm *UtilityVM) findVPMEMMapping(hostPath string) (uint32, bool) {
+	for deviceNumber, vi := range uvm.vpmemDevices {
+		if vi.mappings == nil {
+			continue
+		}
+		if _, ok := vi.mappings.alloc.Find(hostPath); ok {
+			return uint32(deviceNumber), true
+		}
+	}
+	return 0, false
+}
+
+// addVPMEMMapping adds hostPath to the first device shared by several layers
+// that has room for it, adding a new shared device if none does. The layer is
+// mounted at uvmPath, or at /tmp/v<device>-<offset> if uvmPath is empty.
+// Adding a layer that is already mapped takes another reference to it.
+//
+// ok is false if the layer is too large to share a device and should be
+// given one of its own. The lock MUST be held when calling this function.
+func (uvm *UtilityVM) addVPMEMMapping(hostPath string, uvmPath string) (deviceNumber uint32, mountPath string, ok bool, err error) {
+	if deviceNumber, found := uvm.findVPMEMMapping(hostPath); found {
+		mappings := uvm.vpmemDevices[deviceNumber].mappings
+		r, _ := mappings.alloc.Find(hostPath)
+		if _, _, err := mappings.alloc.Allocate(hostPath, r.Size); err != nil {
+			return 0, "", false, err
+		}
+		return deviceNumber, mappings.uvmPaths[hostPath], true, nil
+	}
+
+	fi, err := os.Stat(hostPath)
+	if err != nil {
+		return 0, "", false, err
+	}
+	size := uint64(fi.Size())
+	if size > uvm.vpmemDeviceSize {
+		logrus.Debugf("uvm::addVPMEMMapping %s is too large to share a device (%d bytes)", hostPath, size)
+		return 0, "", false, nil
+	}
+
+	var region vpmemalloc.Region
+	found := false
+	for i, vi := range uvm.vpmemDevices[:uvm.vpmemMax] {
+		if vi.mappings == nil {
+			continue
+		}
+		region, _, err = vi.mappings.alloc.Allocate(hostPath, size)
+		if err == vpmemalloc.ErrNoSpace {
+			continue
+		}
+		if err != nil {
+			return 0, "", false, err
+		}
+		deviceNumber, found = uint32(i), true
+		break
+	}
+	newDevice := false
+	if !found {
+		deviceNumber, err = uvm.addVPMEMSharedDevice()
+		if err != nil {
+			return 0, "", false, err
+		}
+		newDevice = true
+		region, _, err = uvm.vpmemDevices[deviceNumber].mappings.alloc.Allocate(hostPath, size)
+		if err != nil {
+			return 0, "", false, err
+		}
+	}
+	mappings := uvm.vpmemDevices[deviceNumber].mappings
+
+	if uvmPath == "" {
+		uvmPath = fmt.Sprintf("/tmp/v%d-%x", deviceNumber, region.Offset)
+	}
+	modification := &schema2.ModifySettingsRequestV2{
+		ResourceType: schema2.ResourceTypeVPMemDevice,
+		RequestType:  schema2.RequestTypeAdd,
+		Settings: schema2.VirtualMachinesResourcesStorageVpmemMappingV2{
+			HostPath:    hostPath,
+			ImageFormat: "VHD1",
+		},
+		ResourceUri: vpmemMappingURI(deviceNumber, region.Offset),
+		HostedSettings: lcowhostedsettings.MappedVPMemDevice{
+			DeviceNumber: deviceNumber,
+			MountPath:    uvmPath,
+			MappingInfo: &lcowhostedsettings.VPMemMappingInfo{
+				DeviceOffsetInBytes: region.Offset,
+				DeviceSizeInBytes:   region.Size,
+			},
+		},
+	}
+	if err := uvm.Modify(modification); err != nil {
+		mappings.alloc.Release(hostPath)
+		if newDevice {
+			if err := uvm.removeVPMEMSharedDevice(deviceNumber); err != nil {
+				logrus.Warnf("uvm::addVPMEMMapping failed to remove unused VPMem device %d: %s", deviceNumber, err)
+			}
+		}
+		return 0, "", false, fmt.Errorf("uvm::AddVPMEM: failed to modify utility VM configuration: %s", err)
+	}
+	mappings.uvmPaths[hostPath] = uvmPath
+	logrus.Debugf("uvm::addVPMEMMapping id:%s %s mapped at %d:%d (%d bytes) on %s", uvm.id, hostPath, deviceNumber, region.Offset, region.Size, uvmPath)
+	return deviceNumber, uvmPath, true, nil
+}
+
+// removeVPMEMMapping removes a reference to hostPath from the shared device
+// deviceNumber, unmapping it when the last reference is removed and removing
+// the device when it no longer holds any layers. Other layers in the device
+// are not moved. The lock MUST be held when calling this function.
+func (uvm *UtilityVM) removeVPMEMMapping(hostPath string, deviceNumber uint32) error {
+	mappings := uvm.vpmemDevices[deviceNumber].mappings
+	r, _ := mappings.alloc.Find(hostPath)
+	if r.RefCount == 1 {
+		modification := &schema2.ModifySettingsRequestV2{
+			ResourceType: schema2.ResourceTypeVPMemDevice,
+			RequestType:  schema2.RequestTypeRemove,
+			ResourceUri:  vpmemMappingURI(deviceNumber, r.Offset),
+			HostedSettings: lcowhostedsettings.MappedVPMemDevice{
+				DeviceNumber: deviceNumber,
+				MountPath:    mappings.uvmPaths[hostPath],
+				MappingInfo: &lcowhostedsettings.VPMemMappingInfo{
+					DeviceOffsetInBytes: r.Offset,
+					DeviceSizeInBytes:   r.Size,
+				},
+			},
+		}
+		if err := uvm.Modify(modification); err != nil {
+			return err
+		}
+		delete(mappings.uvmPaths, hostPath)
+	}
+	if _, _, err := mappings.alloc.Release(hostPath); err != nil {
+		return err
+	}
+	if mappings.alloc.Empty() {
+		return uvm.removeVPMEMSharedDevice(deviceNumber)
+	}
+	return nil
+}
+
+// addVPMEMSharedDevice adds an empty VPMem device to hold several layers. The
+// lock MUST be held when calling this function.
+func (uvm *UtilityVM) addVPMEMSharedDevice() (uint32, error) {
+	deviceNumber, err := uvm.allocateVPMEM("")
+	if err != nil {
+		return 0, err
+	}
+	alloc, err := vpmemalloc.New(uvm.vpmemDeviceSize, vpmemMappingAlignment)
+	if err != nil {
+		return 0, err
+	}
+	modification := &schema2.ModifySettingsRequestV2{
+		ResourceType: schema2.ResourceTypeVPMemDevice,
+		RequestType:  schema2.RequestTypeAdd,
+		Settings: schema2.VirtualMachinesResourcesStorageVpmemDeviceV2{
+			ReadOnly:  true,
+			SizeBytes: uvm.vpmemDeviceSize,
+		},
+		ResourceUri: fmt.Sprintf("virtualmachine/devices/virtualpmemdevices/%d", deviceNumber),
+	}
+	if err := uvm.Modify(modification); err != nil {
+		return 0, fmt.Errorf("uvm::AddVPMEM: failed to add shared VPMem device: %s", err)
+	}
+	uvm.vpmemDevices[deviceNumber] = vpmemInfo{
+		mappings: &vpmemMappings{alloc: alloc, uvmPaths: make(map[string]string)},
+	}
+	logrus.Debugf("uvm::addVPMEMSharedDevice id:%s device:%d size:%d", uvm.id, deviceNumber, uvm.vpmemDeviceSize)
+	return deviceNumber, nil
+}
+
+// removeVPMEMSharedDevice removes an empty shared VPMem device. The lock MUST
+// be held when calling this function.
+func (uvm *UtilityVM) removeVPMEMSharedDevice(deviceNumber uint32) error {
+	modification := &schema2.ModifySettingsRequestV2{
+		ResourceType: schema2.ResourceTypeVPMemDevice,
+		RequestType:  schema2.RequestTypeRemove,
+		ResourceUri:  fmt.Sprintf("virtualmachine/devices/virtualpmemdevices/%d", deviceNumber),
+	}
+	if err := uvm.Modify(modification); err != nil {
+		return err
+	}
+	uvm.vpmemDevices[deviceNumber] = vpmemInfo{}
+	return nil
+}
+
+func vpmemMappingURI(deviceNumber uint32, offset uint64) string {
+	return fmt.Sprintf("virtualmachine/devices/virtualpmemdevices/%d/mappings/%d", deviceNumber, offset)
+}
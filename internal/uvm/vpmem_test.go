@@ -0,0 +1,197 @@
+package uvm
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/internal/schema2"
+)
+
+// vpmemRequest is a modification sent for a VPMem device or mapping.
+type vpmemRequest struct {
+	Type schema2.RequestType
+	URI  string
+}
+
+// newVPMEMTestVM returns a Linux utility VM packing layers into devices of
+// 16KB, with its modifications recorded. A modification of a URI in fail
+// fails.
+func newVPMEMTestVM(fail map[string]bool) (*UtilityVM, *[]vpmemRequest) {
+	vm := &UtilityVM{
+		id:                "test",
+		operatingSystem:   "linux",
+		vpmemMax:          4,
+		vpmemMultiMapping: true,
+		vpmemDeviceSize:   4 * vpmemMappingAlignment,
+	}
+	var requests []vpmemRequest
+	vm.modifyHook = func(doc interface{}) error {
+		m := doc.(*schema2.ModifySettingsRequestV2)
+		requests = append(requests, vpmemRequest{m.RequestType, m.ResourceUri})
+		if fail[m.ResourceUri] {
+			return errors.New("modify failed")
+		}
+		return nil
+	}
+	return vm, &requests
+}
+
+// writeLayers creates a layer file of each size in a temporary directory.
+func writeLayers(t *testing.T, sizes ...int) ([]string, func()) {
+	dir, err := ioutil.TempDir("", "vpmem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for i, size := range sizes {
+		path := filepath.Join(dir, fmt.Sprintf("layer%d.vhd", i))
+		if err := ioutil.WriteFile(path, make([]byte, size), 0600); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return paths, func() { os.RemoveAll(dir) }
+}
+
+func checkRequests(t *testing.T, requests *[]vpmemRequest, expected ...vpmemRequest) {
+	if !reflect.DeepEqual(*requests, expected) {
+		t.Fatalf("got requests %v, expected %v", *requests, expected)
+	}
+	*requests = nil
+}
+
+func device(n int) string {
+	return fmt.Sprintf("virtualmachine/devices/virtualpmemdevices/%d", n)
+}
+
+func TestVPMEMSharedDevice(t *testing.T) {
+	layers, cleanup := writeLayers(t, 100, 5000)
+	defer cleanup()
+	a, b := layers[0], layers[1]
+	vm, requests := newVPMEMTestVM(nil)
+
+	// The first layer creates a shared device.
+	n, path, err := vm.AddVPMEM(a, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 || path != "/tmp/v0-0" {
+		t.Fatalf("got %d %s", n, path)
+	}
+	checkRequests(t, requests,
+		vpmemRequest{schema2.RequestTypeAdd, device(0)},
+		vpmemRequest{schema2.RequestTypeAdd, vpmemMappingURI(0, 0)})
+	if vm.vpmemDevices[0].mappings == nil || vm.vpmemDevices[0].hostPath != "" {
+		t.Fatalf("device 0 is not shared: %+v", vm.vpmemDevices[0])
+	}
+
+	// The second is packed after it at the next aligned offset, and a second
+	// reference to the first is not sent at all.
+	if n, path, err = vm.AddVPMEM(b, "", true); err != nil || n != 0 || path != "/tmp/v0-1000" {
+		t.Fatalf("got %d %s %v", n, path, err)
+	}
+	if n, path, err = vm.AddVPMEM(a, "", true); err != nil || n != 0 || path != "/tmp/v0-0" {
+		t.Fatalf("got %d %s %v", n, path, err)
+	}
+	checkRequests(t, requests, vpmemRequest{schema2.RequestTypeAdd, vpmemMappingURI(0, vpmemMappingAlignment)})
+
+	// The layer is unmapped with its last reference, and the device removed
+	// with its last layer.
+	for _, layer := range []string{a, a} {
+		if err := vm.RemoveVPMEM(layer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkRequests(t, requests, vpmemRequest{schema2.RequestTypeRemove, vpmemMappingURI(0, 0)})
+	if err := vm.RemoveVPMEM(b); err != nil {
+		t.Fatal(err)
+	}
+	checkRequests(t, requests,
+		vpmemRequest{schema2.RequestTypeRemove, vpmemMappingURI(0, vpmemMappingAlignment)},
+		vpmemRequest{schema2.RequestTypeRemove, device(0)})
+	if vm.vpmemDevices[0] != (vpmemInfo{}) {
+		t.Fatalf("device 0 still in use: %+v", vm.vpmemDevices[0])
+	}
+}
+
+func TestVPMEMOversizedLayer(t *testing.T) {
+	layers, cleanup := writeLayers(t, 100, 5*vpmemMappingAlignment)
+	defer cleanup()
+	small, big := layers[0], layers[1]
+	vm, requests := newVPMEMTestVM(nil)
+
+	if _, _, err := vm.AddVPMEM(small, "", true); err != nil {
+		t.Fatal(err)
+	}
+	*requests = nil
+	// A layer larger than a shared device gets a device of its own.
+	n, path, err := vm.AddVPMEM(big, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || path != "/tmp/v1" {
+		t.Fatalf("got %d %s", n, path)
+	}
+	checkRequests(t, requests, vpmemRequest{schema2.RequestTypeAdd, device(1)})
+	if vi := vm.vpmemDevices[1]; vi.hostPath != big || vi.mappings != nil || vi.refCount != 1 {
+		t.Fatalf("wrong dedicated device %+v", vi)
+	}
+
+	if err := vm.RemoveVPMEM(big); err != nil {
+		t.Fatal(err)
+	}
+	checkRequests(t, requests, vpmemRequest{schema2.RequestTypeRemove, device(1)})
+	if vm.vpmemDevices[1] != (vpmemInfo{}) || vm.vpmemDevices[0].mappings == nil {
+		t.Fatalf("wrong devices after removal %+v", vm.vpmemDevices[:2])
+	}
+}
+
+func TestVPMEMMappingFailure(t *testing.T) {
+	layers, cleanup := writeLayers(t, 100, 100)
+	defer cleanup()
+	a, b := layers[0], layers[1]
+
+	// A failed mapping into a new device removes the device again.
+	vm, requests := newVPMEMTestVM(map[string]bool{vpmemMappingURI(0, 0): true})
+	if _, _, err := vm.AddVPMEM(a, "", true); err == nil {
+		t.Fatal("expected the failed mapping to be reported")
+	}
+	checkRequests(t, requests,
+		vpmemRequest{schema2.RequestTypeAdd, device(0)},
+		vpmemRequest{schema2.RequestTypeAdd, vpmemMappingURI(0, 0)},
+		vpmemRequest{schema2.RequestTypeRemove, device(0)})
+	if vm.vpmemDevices[0] != (vpmemInfo{}) {
+		t.Fatalf("device 0 still in use: %+v", vm.vpmemDevices[0])
+	}
+
+	// A failed mapping into an existing device releases its space but keeps
+	// the device for the layers already in it.
+	vm, requests = newVPMEMTestVM(map[string]bool{vpmemMappingURI(0, vpmemMappingAlignment): true})
+	if _, _, err := vm.AddVPMEM(a, "", true); err != nil {
+		t.Fatal(err)
+	}
+	*requests = nil
+	if _, _, err := vm.AddVPMEM(b, "", true); err == nil {
+		t.Fatal("expected the failed mapping to be reported")
+	}
+	checkRequests(t, requests, vpmemRequest{schema2.RequestTypeAdd, vpmemMappingURI(0, vpmemMappingAlignment)})
+	mappings := vm.vpmemDevices[0].mappings
+	if mappings == nil {
+		t.Fatal("device 0 was removed")
+	}
+	if _, ok := mappings.alloc.Find(b); ok {
+		t.Fatal("failed layer is still allocated")
+	}
+	if _, ok := mappings.uvmPaths[b]; ok {
+		t.Fatal("failed layer still has a path")
+	}
+	if _, ok := mappings.alloc.Find(a); !ok {
+		t.Fatal("existing layer was released")
+	}
+}
@@ -0,0 +1,170 @@
+// Package vpmemalloc lays out regions inside a fixed-size device, such as
+// read-only layer VHDs packed into a single VPMem device.
+//
+// Regions are placed first-fit at aligned offsets and reference counted by
+// key, so adding the same layer twice shares its region. Removing a region
+// frees its space in place; other regions are never moved, since the guest
+// may have them mounted.
+package vpmemalloc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNoSpace is returned when a region does not fit in the free space of a
+// device.
+var ErrNoSpace = errors.New("not enough space in device")
+
+// Region is an allocated region of a device.
+type Region struct {
+	Key      string
+	Offset   uint64
+	Size     uint64
+	RefCount uint32
+}
+
+// Allocator allocates regions of a device. It is not safe for concurrent
+// use.
+type Allocator struct {
+	size      uint64
+	alignment uint64
+	regions   []*Region // Sorted by offset.
+}
+
+// New returns an allocator for a device of size bytes whose regions start at
+// multiples of alignment bytes.
+func New(size, alignment uint64) (*Allocator, error) {
+	if alignment == 0 {
+		return nil, fmt.Errorf("alignment must not be zero")
+	}
+	if size == 0 || size%alignment != 0 {
+		return nil, fmt.Errorf("device size %d must be a non-zero multiple of the alignment %d", size, alignment)
+	}
+	return &Allocator{size: size, alignment: alignment}, nil
+}
+
+// Size returns the size of the device.
+func (a *Allocator) Size() uint64 {
+	return a.size
+}
+
+// Allocate returns the region for key, taking a reference on it. If key does
+// not already have a region, one of size bytes is allocated at the lowest
+// aligned offset where it fits, and created is true.
+func (a *Allocator) Allocate(key string, size uint64) (r Region, created bool, err error) {
+	if existing := a.find(key); existing != nil {
+		if existing.Size != size {
+			return Region{}, false, fmt.Errorf("region %s is %d bytes, not %d", key, existing.Size, size)
+		}
+		existing.RefCount++
+		return *existing, false, nil
+	}
+	if size == 0 {
+		return Region{}, false, fmt.Errorf("region %s must not be empty", key)
+	}
+	var offset uint64
+	i := 0
+	for ; i < len(a.regions); i++ {
+		if offset+size <= a.regions[i].Offset {
+			break
+		}
+		offset = a.align(a.regions[i].Offset + a.regions[i].Size)
+	}
+	if size > a.size || offset > a.size-size {
+		return Region{}, false, ErrNoSpace
+	}
+	nr := &Region{Key: key, Offset: offset, Size: size, RefCount: 1}
+	a.regions = append(a.regions, nil)
+	copy(a.regions[i+1:], a.regions[i:])
+	a.regions[i] = nr
+	return *nr, true, nil
+}
+
+// Restore adds a region allocated earlier, such as by an allocator whose
+// state was saved, at its original offset.
+func (a *Allocator) Restore(r Region) error {
+	if a.find(r.Key) != nil {
+		return fmt.Errorf("region %s is already allocated", r.Key)
+	}
+	if r.Size == 0 || r.RefCount == 0 {
+		return fmt.Errorf("region %s must have a size and a reference", r.Key)
+	}
+	if r.Offset%a.alignment != 0 || r.Size > a.size || r.Offset > a.size-r.Size {
+		return fmt.Errorf("region %s at %d of %d bytes does not fit the device", r.Key, r.Offset, r.Size)
+	}
+	i := 0
+	for ; i < len(a.regions) && a.regions[i].Offset < r.Offset; i++ {
+	}
+	if (i > 0 && a.regions[i-1].Offset+a.regions[i-1].Size > r.Offset) ||
+		(i < len(a.regions) && r.Offset+r.Size > a.regions[i].Offset) {
+		return fmt.Errorf("region %s overlaps another region", r.Key)
+	}
+	nr := r
+	a.regions = append(a.regions, nil)
+	copy(a.regions[i+1:], a.regions[i:])
+	a.regions[i] = &nr
+	return nil
+}
+
+// Release drops a reference to the region for key. When the last reference
+// is dropped the region's space is freed and freed is true.
+func (a *Allocator) Release(key string) (r Region, freed bool, err error) {
+	for i, existing := range a.regions {
+		if existing.Key != key {
+			continue
+		}
+		existing.RefCount--
+		if existing.RefCount > 0 {
+			return *existing, false, nil
+		}
+		a.regions = append(a.regions[:i], a.regions[i+1:]...)
+		return *existing, true, nil
+	}
+	return Region{}, false, fmt.Errorf("region %s is not allocated", key)
+}
+
+// Find returns the region for key.
+func (a *Allocator) Find(key string) (Region, bool) {
+	if r := a.find(key); r != nil {
+		return *r, true
+	}
+	return Region{}, false
+}
+
+// Regions returns the allocated regions in offset order.
+func (a *Allocator) Regions() []Region {
+	regions := make([]Region, len(a.regions))
+	for i, r := range a.regions {
+		regions[i] = *r
+	}
+	return regions
+}
+
+// Empty returns whether no regions are allocated.
+func (a *Allocator) Empty() bool {
+	return len(a.regions) == 0
+}
+
+// Free returns the number of bytes not allocated to regions, including any
+// lost to alignment.
+func (a *Allocator) Free() uint64 {
+	free := a.size
+	for _, r := range a.regions {
+		free -= r.Size
+	}
+	return free
+}
+
+func (a *Allocator) find(key string) *Region {
+	for _, r := range a.regions {
+		if r.Key == key {
+			return r
+		}
+	}
+	return nil
+}
+
+func (a *Allocator) align(offset uint64) uint64 {
+	return (offset + a.alignment - 1) / a.alignment * a.alignment
+}
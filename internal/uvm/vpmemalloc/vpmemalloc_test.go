@@ -0,0 +1,163 @@
+package vpmemalloc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func newAllocator(t *testing.T, size, alignment uint64) *Allocator {
+	a, err := New(size, alignment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func allocate(t *testing.T, a *Allocator, key string, size uint64) Region {
+	r, _, err := a.Allocate(key, size)
+	if err != nil {
+		t.Fatalf("allocating %s: %s", key, err)
+	}
+	return r
+}
+
+func checkRegions(t *testing.T, a *Allocator, expected []Region) {
+	regions := a.Regions()
+	if !reflect.DeepEqual(regions, expected) {
+		t.Fatalf("got regions %+v, expected %+v", regions, expected)
+	}
+	for i := 1; i < len(regions); i++ {
+		if regions[i-1].Offset+regions[i-1].Size > regions[i].Offset {
+			t.Fatalf("regions %+v and %+v overlap", regions[i-1], regions[i])
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, test := range []struct{ size, alignment uint64 }{
+		{0, 4096},
+		{4096, 0},
+		{6000, 4096},
+	} {
+		if _, err := New(test.size, test.alignment); err == nil {
+			t.Errorf("New(%d, %d): expected error", test.size, test.alignment)
+		}
+	}
+}
+
+func TestAllocateAligned(t *testing.T) {
+	a := newAllocator(t, 64, 16)
+	allocate(t, a, "a", 10)
+	allocate(t, a, "b", 16)
+	allocate(t, a, "c", 1)
+	checkRegions(t, a, []Region{
+		{Key: "a", Offset: 0, Size: 10, RefCount: 1},
+		{Key: "b", Offset: 16, Size: 16, RefCount: 1},
+		{Key: "c", Offset: 32, Size: 1, RefCount: 1},
+	})
+	if _, _, err := a.Allocate("d", 17); err != ErrNoSpace {
+		t.Fatalf("expected ErrNoSpace, got %v", err)
+	}
+	allocate(t, a, "d", 16)
+	if free := a.Free(); free != 64-10-16-1-16 {
+		t.Fatalf("wrong free space %d", free)
+	}
+}
+
+func TestAllocateFirstFit(t *testing.T) {
+	a := newAllocator(t, 64, 16)
+	allocate(t, a, "a", 16)
+	allocate(t, a, "b", 32)
+	allocate(t, a, "c", 16)
+	if _, freed, err := a.Release("a"); err != nil || !freed {
+		t.Fatalf("release: freed %t, %v", freed, err)
+	}
+	if _, freed, err := a.Release("c"); err != nil || !freed {
+		t.Fatalf("release: freed %t, %v", freed, err)
+	}
+	// The hole at the start is too small, so the region goes after b, which
+	// has not moved.
+	if _, _, err := a.Allocate("big", 32); err != ErrNoSpace {
+		t.Fatalf("expected ErrNoSpace, got %v", err)
+	}
+	allocate(t, a, "d", 8)
+	allocate(t, a, "e", 16)
+	checkRegions(t, a, []Region{
+		{Key: "d", Offset: 0, Size: 8, RefCount: 1},
+		{Key: "b", Offset: 16, Size: 32, RefCount: 1},
+		{Key: "e", Offset: 48, Size: 16, RefCount: 1},
+	})
+}
+
+func TestRefCount(t *testing.T) {
+	a := newAllocator(t, 64, 16)
+	r1, created, err := a.Allocate("a", 10)
+	if err != nil || !created {
+		t.Fatalf("first allocation: created %t, %v", created, err)
+	}
+	r2, created, err := a.Allocate("a", 10)
+	if err != nil || created {
+		t.Fatalf("second allocation: created %t, %v", created, err)
+	}
+	if r1.Offset != r2.Offset || r2.RefCount != 2 {
+		t.Fatalf("got %+v, expected a second reference to %+v", r2, r1)
+	}
+	if _, _, err := a.Allocate("a", 11); err == nil {
+		t.Fatal("expected error for a different size")
+	}
+	if r, freed, err := a.Release("a"); err != nil || freed || r.RefCount != 1 {
+		t.Fatalf("release: %+v freed %t, %v", r, freed, err)
+	}
+	if _, ok := a.Find("a"); !ok {
+		t.Fatal("region released too early")
+	}
+	if _, freed, err := a.Release("a"); err != nil || !freed {
+		t.Fatalf("release: freed %t, %v", freed, err)
+	}
+	if !a.Empty() {
+		t.Fatal("allocator not empty")
+	}
+	if _, _, err := a.Release("a"); err == nil {
+		t.Fatal("expected error releasing a free region")
+	}
+}
+
+func TestAllocateErrors(t *testing.T) {
+	a := newAllocator(t, 64, 16)
+	if _, _, err := a.Allocate("empty", 0); err == nil {
+		t.Fatal("expected error for an empty region")
+	}
+	if _, _, err := a.Allocate("huge", 1<<63); err != ErrNoSpace {
+		t.Fatalf("expected ErrNoSpace, got %v", err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	a := newAllocator(t, 16384, 4096)
+	regions := []Region{
+		{Key: "b", Offset: 8192, Size: 100, RefCount: 2},
+		{Key: "a", Offset: 0, Size: 5000, RefCount: 1},
+	}
+	for _, r := range regions {
+		if err := a.Restore(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkRegions(t, a, []Region{regions[1], regions[0]})
+	for _, r := range []Region{
+		{Key: "a", Offset: 12288, Size: 1, RefCount: 1},   // duplicate key
+		{Key: "c", Offset: 4096, Size: 4097, RefCount: 1}, // overlaps b
+		{Key: "c", Offset: 4096, Size: 1, RefCount: 1},    // overlaps a
+		{Key: "c", Offset: 12289, Size: 1, RefCount: 1},   // unaligned
+		{Key: "c", Offset: 12288, Size: 4097, RefCount: 1},
+		{Key: "c", Offset: 12288, Size: 1, RefCount: 0},
+	} {
+		if err := a.Restore(r); err == nil {
+			t.Errorf("expected error restoring %+v", r)
+		}
+	}
+	// Allocation continues around the restored regions.
+	if r := allocate(t, a, "c", 3000); r.Offset != 12288 {
+		t.Fatalf("allocated %+v", r)
+	}
+}
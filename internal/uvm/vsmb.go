@@ -2,6 +2,8 @@ package uvm
 
 import (
 	"fmt"
+	"path/filepath"
+	"sort"
 	"strconv"
 
 	"github.com/Microsoft/hcsshim/internal/schema2"
@@ -9,11 +11,16 @@ import (
 )
 
 func (share *vsmbShare) GuestPath() string {
-	return `\\?\VMSMB\VSMB-{dcc079ae-60ba-4d07-847c-3493609c0870}\` + share.name
+	return vsmbGuestPath(share.name)
+}
+
+func vsmbGuestPath(name string) string {
+	return `\\?\VMSMB\VSMB-{dcc079ae-60ba-4d07-847c-3493609c0870}\` + name
 }
 
 // AddVSMB adds a VSMB share to a utility VM. Each VSMB share is ref-counted and
-// only added if it isn't already.
+// only added if it isn't already. A share must be added with the same flags
+// each time.
 func (uvm *UtilityVM) AddVSMB(hostPath string, uvmPath string, flags int32) error {
 	if uvm.operatingSystem != "windows" {
 		return errNotSupported
@@ -52,8 +59,11 @@ func (uvm *UtilityVM) AddVSMB(hostPath string, uvmPath string, flags int32) erro
 		share = &vsmbShare{
 			name:    shareName,
 			uvmPath: uvmPath,
+			flags:   flags,
 		}
 		uvm.vsmbShares[hostPath] = share
+	} else if share.flags != flags {
+		return fmt.Errorf("%s cannot be shared with flags %#x as it is already shared with flags %#x", hostPath, flags, share.flags)
 	}
 	share.refCount++
 	logrus.Debugf("hcsshim::AddVSMB Success %s: refcount=%d %+v", hostPath, share.refCount, share)
@@ -94,18 +104,142 @@ func (uvm *UtilityVM) RemoveVSMB(hostPath string) error {
 	return nil
 }
 
-// GetVSMBGuestPath returns the guest path of a VSMB mount.
+// GetVSMBGuestPath returns the guest path of a VSMB mount, either a directory
+// added by AddVSMB or a file added by AddVSMBFile.
 func (uvm *UtilityVM) GetVSMBGuestPath(hostPath string) (string, error) {
 	if hostPath == "" {
 		return "", fmt.Errorf("no hostPath passed to GetVSMBShareCounter")
 	}
 	uvm.m.Lock()
 	defer uvm.m.Unlock()
-	share := uvm.vsmbShares[hostPath]
-	if share == nil {
+	var path string
+	if share := uvm.vsmbShares[hostPath]; share != nil {
+		path = share.GuestPath()
+	} else if share := uvm.vsmbFileShares[filepath.Dir(hostPath)]; share != nil && share.files[hostPath] != 0 {
+		path = vsmbGuestPath(share.name) + `\` + filepath.Base(hostPath)
+	} else {
 		return "", fmt.Errorf("%s not found as VSMB share in %s", hostPath, uvm.id)
 	}
-	path := share.GuestPath()
 	logrus.Debugf("uvm::GetVSMBGuestPath Success %s id:%s path:%s", hostPath, uvm.id, path)
 	return path, nil
 }
+
+// AddVSMBFile makes the file hostPath available in a Windows utility VM. The
+// file's directory is shared with access restricted to the files added this
+// way, so that the rest of the directory is not exposed. Files in the same
+// directory share a VSMB share, and must be added with the same flags. Each
+// file is ref-counted.
+func (uvm *UtilityVM) AddVSMBFile(hostPath string, flags int32) error {
+	if uvm.operatingSystem != "windows" {
+		return errNotSupported
+	}
+
+	logrus.Debugf("uvm::AddVSMBFile %s %d id:%s", hostPath, flags, uvm.id)
+	flags |= schema2.VsmbFlagRestrictFileAccess
+	dir := filepath.Dir(hostPath)
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	if uvm.vsmbFileShares == nil {
+		uvm.vsmbFileShares = make(map[string]*vsmbFileShare)
+	}
+	share := uvm.vsmbFileShares[dir]
+	if share == nil {
+		uvm.vsmbCounter++
+		share = &vsmbFileShare{
+			name:  "s" + strconv.FormatUint(uvm.vsmbCounter, 16),
+			flags: flags,
+			files: make(map[string]uint32),
+		}
+		if err := uvm.modifyVSMBFileShare(dir, share, schema2.RequestTypeAdd, hostPath); err != nil {
+			return err
+		}
+		uvm.vsmbFileShares[dir] = share
+	} else if share.flags != flags {
+		return fmt.Errorf("%s cannot be shared with flags %#x as files in %s are already shared with flags %#x", hostPath, flags, dir, share.flags)
+	} else if share.files[hostPath] == 0 {
+		if err := uvm.modifyVSMBFileShare(dir, share, schema2.RequestTypeUpdate, hostPath); err != nil {
+			return err
+		}
+	}
+	share.files[hostPath]++
+	logrus.Debugf("hcsshim::AddVSMBFile Success %s: refcount=%d share=%s", hostPath, share.files[hostPath], share.name)
+	return nil
+}
+
+// RemoveVSMBFile removes a reference to a file added by AddVSMBFile. When the
+// last reference is removed the file is no longer accessible in the utility
+// VM, and when no files remain the share is removed.
+func (uvm *UtilityVM) RemoveVSMBFile(hostPath string) error {
+	if uvm.operatingSystem != "windows" {
+		return errNotSupported
+	}
+	logrus.Debugf("uvm::RemoveVSMBFile %s id:%s", hostPath, uvm.id)
+	dir := filepath.Dir(hostPath)
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	share := uvm.vsmbFileShares[dir]
+	if share == nil || share.files[hostPath] == 0 {
+		return fmt.Errorf("%s is not present as a VSMB file share in %s, cannot remove", hostPath, uvm.id)
+	}
+	if share.files[hostPath] > 1 {
+		share.files[hostPath]--
+		logrus.Debugf("uvm::RemoveVSMBFile Success %s id:%s Ref-count now %d. It is still present in the utility VM", hostPath, uvm.id, share.files[hostPath])
+		return nil
+	}
+
+	if len(share.files) == 1 {
+		modification := &schema2.ModifySettingsRequestV2{
+			ResourceType: schema2.ResourceTypeVSmbShare,
+			RequestType:  schema2.RequestTypeRemove,
+			Settings:     schema2.VirtualMachinesResourcesStorageVSmbShareV2{Name: share.name},
+			ResourceUri:  "virtualmachine/devices/virtualsmbshares/" + share.name,
+		}
+		if err := uvm.Modify(modification); err != nil {
+			return fmt.Errorf("failed to remove vsmb share %s from %s: %s", dir, uvm.id, err)
+		}
+		delete(uvm.vsmbFileShares, dir)
+		logrus.Debugf("uvm::RemoveVSMBFile Success %s id:%s share %s removed from utility VM", hostPath, uvm.id, share.name)
+		return nil
+	}
+
+	delete(share.files, hostPath)
+	if err := uvm.modifyVSMBFileShare(dir, share, schema2.RequestTypeUpdate, ""); err != nil {
+		share.files[hostPath] = 1
+		return fmt.Errorf("failed to remove %s from vsmb share %s in %s: %s", hostPath, share.name, uvm.id, err)
+	}
+	logrus.Debugf("uvm::RemoveVSMBFile Success %s id:%s no longer allowed in share %s", hostPath, uvm.id, share.name)
+	return nil
+}
+
+// modifyVSMBFileShare adds or updates the restricted share of dir, allowing
+// access to the share's files and to newFile if it is not empty. The lock
+// MUST be held when calling this function.
+func (uvm *UtilityVM) modifyVSMBFileShare(dir string, share *vsmbFileShare, requestType schema2.RequestType, newFile string) error {
+	allowed := vsmbAllowedFiles(share, newFile)
+	modification := &schema2.ModifySettingsRequestV2{
+		ResourceType: schema2.ResourceTypeVSmbShare,
+		RequestType:  requestType,
+		Settings: schema2.VirtualMachinesResourcesStorageVSmbShareV2{
+			Name:         share.name,
+			Flags:        share.flags,
+			Path:         dir,
+			AllowedFiles: allowed,
+		},
+		ResourceUri: "virtualmachine/devices/virtualsmbshares/" + share.name,
+	}
+	return uvm.Modify(modification)
+}
+
+// vsmbAllowedFiles returns the sorted list of files a restricted share
+// allows, including newFile if it is not empty.
+func vsmbAllowedFiles(share *vsmbFileShare, newFile string) []string {
+	var allowed []string
+	for f := range share.files {
+		allowed = append(allowed, f)
+	}
+	if newFile != "" && share.files[newFile] == 0 {
+		allowed = append(allowed, newFile)
+	}
+	sort.Strings(allowed)
+	return allowed
+}
@@ -0,0 +1,118 @@
+package uvm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/internal/schema2"
+)
+
+// recordModifications makes vm record the request types of its modification
+// requests instead of sending them to a compute system.
+func recordModifications(vm *UtilityVM) *[]schema2.RequestType {
+	var requests []schema2.RequestType
+	vm.modifyHook = func(doc interface{}) error {
+		requests = append(requests, doc.(*schema2.ModifySettingsRequestV2).RequestType)
+		return nil
+	}
+	return &requests
+}
+
+func TestVSMBFileShares(t *testing.T) {
+	vm := &UtilityVM{id: "test", operatingSystem: "windows"}
+	requests := recordModifications(vm)
+	a, b, other := `c:\data\a.txt`, `c:\data\b.txt`, `c:\other\c.txt`
+	for _, f := range []string{a, b, a, other} {
+		if err := vm.AddVSMBFile(f, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(vm.vsmbFileShares) != 2 {
+		t.Fatalf("expected one share per directory, got %d", len(vm.vsmbFileShares))
+	}
+	// A second file in a shared directory updates the share, and a second
+	// reference to a file is not sent at all.
+	expected := []schema2.RequestType{schema2.RequestTypeAdd, schema2.RequestTypeUpdate, schema2.RequestTypeAdd}
+	if !reflect.DeepEqual(*requests, expected) {
+		t.Fatalf("got requests %v, expected %v", *requests, expected)
+	}
+	share := vm.vsmbFileShares[`c:\data`]
+	if allowed := vsmbAllowedFiles(share, ""); !reflect.DeepEqual(allowed, []string{a, b}) {
+		t.Fatalf("wrong allowed files %v", allowed)
+	}
+	if err := vm.AddVSMBFile(`c:\data\d.txt`, 1); err == nil {
+		t.Fatal("expected error adding a file with different flags")
+	}
+	if path, err := vm.GetVSMBGuestPath(b); err != nil || path != vsmbGuestPath(share.name)+`\b.txt` {
+		t.Fatalf("wrong guest path %s: %v", path, err)
+	}
+	if _, err := vm.GetVSMBGuestPath(`c:\data\d.txt`); err == nil {
+		t.Fatal("expected error for a file that is not shared")
+	}
+
+	// The share stays until its last file is removed.
+	for _, f := range []string{a, b} {
+		if err := vm.RemoveVSMBFile(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if vm.vsmbFileShares[`c:\data`] == nil || share.files[a] != 1 || share.files[b] != 0 {
+		t.Fatalf("wrong share after removal %+v", share)
+	}
+	if err := vm.RemoveVSMBFile(a); err != nil {
+		t.Fatal(err)
+	}
+	if vm.vsmbFileShares[`c:\data`] != nil {
+		t.Fatal("share not removed with its last file")
+	}
+	if err := vm.RemoveVSMBFile(a); err == nil {
+		t.Fatal("expected error removing a file that is not shared")
+	}
+	expected = append(expected, schema2.RequestTypeUpdate, schema2.RequestTypeRemove)
+	if !reflect.DeepEqual(*requests, expected) {
+		t.Fatalf("got requests %v, expected %v", *requests, expected)
+	}
+}
+
+func TestVSMBShareFlags(t *testing.T) {
+	vm := &UtilityVM{id: "test", operatingSystem: "windows"}
+	requests := recordModifications(vm)
+	for i := 0; i < 2; i++ {
+		if err := vm.AddVSMB(`c:\data`, "", schema2.VsmbFlagReadOnly); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := vm.AddVSMB(`c:\data`, "", 0); err == nil {
+		t.Fatal("expected error sharing a directory with different flags")
+	}
+	if share := vm.vsmbShares[`c:\data`]; share.refCount != 2 || share.flags != schema2.VsmbFlagReadOnly {
+		t.Fatalf("wrong share %+v", share)
+	}
+	if len(*requests) != 1 {
+		t.Fatalf("expected a single request, got %v", *requests)
+	}
+}
+
+func TestVSMBFileShareFlags(t *testing.T) {
+	vm := &UtilityVM{id: "test", operatingSystem: "windows"}
+	requests := recordModifications(vm)
+	a, b := `c:\data\a.txt`, `c:\data\b.txt`
+	if err := vm.AddVSMBFile(a, schema2.VsmbFlagReadOnly); err != nil {
+		t.Fatal(err)
+	}
+	// Neither a file already shared nor a new file in the same directory can
+	// be added with different flags.
+	if err := vm.AddVSMBFile(a, 0); err == nil {
+		t.Fatal("expected error sharing a file again with different flags")
+	}
+	if err := vm.AddVSMBFile(b, 0); err == nil {
+		t.Fatal("expected error sharing a file in the directory with different flags")
+	}
+	share := vm.vsmbFileShares[`c:\data`]
+	if share.files[a] != 1 || share.files[b] != 0 {
+		t.Fatalf("wrong file references %v", share.files)
+	}
+	if len(*requests) != 1 {
+		t.Fatalf("expected a single request, got %v", *requests)
+	}
+}
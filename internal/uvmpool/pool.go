@@ -0,0 +1,287 @@
+// Package uvmpool keeps started utility VMs ready to be handed out, so that
+// creating a container in a new utility VM does not wait for the VM to boot.
+package uvmpool
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Microsoft/hcsshim/internal/guid"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrEmpty is returned by Get when no VM of the requested profile is
+	// ready.
+	ErrEmpty = errors.New("no utility VM of the profile is ready")
+	// ErrClosed is returned by Get once the pool is closed.
+	ErrClosed = errors.New("the utility VM pool is closed")
+)
+
+// Profile is a configuration of utility VMs. VMs of the same profile are
+// interchangeable.
+type Profile struct {
+	OperatingSystem  string   // "windows" or "linux".
+	BootFilesPath    string   `json:",omitempty"` // Linux only. Defaults as for uvm.Create.
+	LayerFolders     []string `json:",omitempty"` // Windows only. The read-only layers of the utility VM image.
+	MemorySizeInMB   int32
+	ProcessorCount   int32
+	VPMemDeviceCount int32 `json:",omitempty"` // Linux only.
+}
+
+// Key returns a string identifying the profile.
+func (p Profile) Key() string {
+	b, _ := json.Marshal(p)
+	return string(b)
+}
+
+// VM is a started utility VM held by the pool.
+type VM interface {
+	ID() string
+	// Release gives up the pool's handle to the VM, which keeps running for
+	// the owner it was handed out to.
+	Release() error
+	// Terminate stops the VM and releases its resources.
+	Terminate() error
+}
+
+// Backend starts the utility VMs of a pool.
+type Backend interface {
+	Start(id string, profile Profile) (VM, error)
+}
+
+// Config is the configuration of a pool.
+type Config struct {
+	Profiles []Profile     // The profiles of which VMs are kept ready.
+	Size     int           // Number of VMs kept ready for each profile.
+	MaxAge   time.Duration // Idle VMs older than this are retired. Zero keeps them indefinitely.
+}
+
+// idleVM is a VM that is ready to be handed out.
+type idleVM struct {
+	vm      VM
+	created time.Time
+}
+
+// ProfileStatus is the number of VMs of a profile in the pool.
+type ProfileStatus struct {
+	Profile  Profile
+	Ready    int
+	Starting int
+	Failed   bool `json:",omitempty"` // The last VM of the profile failed to start.
+}
+
+// Pool keeps Config.Size started VMs ready for each configured profile. VMs
+// handed out by Get are replaced asynchronously. VMs that outlive the maximum
+// age, or whose profile is no longer configured, are retired.
+//
+// A profile whose VM fails to start is not refilled again until the next
+// call to Tick, so that a broken profile does not start VMs in a loop.
+type Pool struct {
+	backend Backend
+	newID   func() string
+	now     func() time.Time
+
+	m        sync.Mutex
+	config   Config
+	profiles map[string]Profile  // The configured profiles, by key.
+	idle     map[string][]idleVM // Oldest first, by profile key.
+	starting map[string]int
+	failed   map[string]bool
+	closed   bool
+	wg       sync.WaitGroup // Outstanding starts.
+}
+
+// New returns a pool of VMs started by backend, and starts filling it.
+func New(backend Backend, config Config) *Pool {
+	p := &Pool{
+		backend: backend,
+		newID: func() string {
+			return guid.New().String() + "@pool"
+		},
+		now:      time.Now,
+		idle:     make(map[string][]idleVM),
+		starting: make(map[string]int),
+	}
+	p.Reconfigure(config)
+	return p
+}
+
+// Get hands out a ready VM of profile, oldest first, and starts a
+// replacement. The pool no longer tracks the VM: the caller binds it to its
+// new owner and must release or terminate it. Get returns ErrEmpty rather
+// than waiting for a VM to start.
+func (p *Pool) Get(profile Profile) (VM, error) {
+	key := profile.Key()
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.closed {
+		return nil, ErrClosed
+	}
+	idle := p.idle[key]
+	if len(idle) == 0 {
+		return nil, ErrEmpty
+	}
+	vm := idle[0].vm
+	if len(idle) == 1 {
+		delete(p.idle, key)
+	} else {
+		p.idle[key] = idle[1:]
+	}
+	p.refill(key)
+	logrus.Debugf("uvmpool: handing out utility VM %s", vm.ID())
+	return vm, nil
+}
+
+// Reconfigure changes the configuration of the pool. VMs of profiles that are
+// no longer configured, and VMs beyond the new size, are retired.
+func (p *Pool) Reconfigure(config Config) {
+	p.m.Lock()
+	p.config = config
+	p.profiles = make(map[string]Profile)
+	for _, profile := range config.Profiles {
+		p.profiles[profile.Key()] = profile
+	}
+	var retired []VM
+	for key, idle := range p.idle {
+		keep := 0
+		if _, ok := p.profiles[key]; ok && config.Size > 0 {
+			keep = config.Size
+		}
+		if len(idle) <= keep {
+			continue
+		}
+		for _, v := range idle[:len(idle)-keep] {
+			retired = append(retired, v.vm)
+		}
+		if keep == 0 {
+			delete(p.idle, key)
+		} else {
+			p.idle[key] = idle[len(idle)-keep:]
+		}
+	}
+	p.failed = make(map[string]bool)
+	for key := range p.profiles {
+		p.refill(key)
+	}
+	p.m.Unlock()
+	terminate(retired)
+}
+
+// Tick retires the idle VMs older than the maximum age and refills the pool,
+// including the profiles whose VMs failed to start. The pool's owner calls it
+// periodically.
+func (p *Pool) Tick() {
+	p.m.Lock()
+	var retired []VM
+	if p.config.MaxAge > 0 {
+		now := p.now()
+		for key, idle := range p.idle {
+			i := 0
+			for i < len(idle) && now.Sub(idle[i].created) >= p.config.MaxAge {
+				retired = append(retired, idle[i].vm)
+				i++
+			}
+			if i == len(idle) {
+				delete(p.idle, key)
+			} else {
+				p.idle[key] = idle[i:]
+			}
+		}
+	}
+	p.failed = make(map[string]bool)
+	for key := range p.profiles {
+		p.refill(key)
+	}
+	p.m.Unlock()
+	terminate(retired)
+}
+
+// Status returns the number of VMs of each configured profile, in the order
+// of the configuration.
+func (p *Pool) Status() []ProfileStatus {
+	p.m.Lock()
+	defer p.m.Unlock()
+	var status []ProfileStatus
+	for _, profile := range p.config.Profiles {
+		key := profile.Key()
+		status = append(status, ProfileStatus{
+			Profile:  profile,
+			Ready:    len(p.idle[key]),
+			Starting: p.starting[key],
+			Failed:   p.failed[key],
+		})
+	}
+	return status
+}
+
+// Close terminates the idle VMs, and waits for the VMs being started to start
+// and be terminated.
+func (p *Pool) Close() {
+	p.m.Lock()
+	p.closed = true
+	var retired []VM
+	for _, idle := range p.idle {
+		for _, v := range idle {
+			retired = append(retired, v.vm)
+		}
+	}
+	p.idle = make(map[string][]idleVM)
+	p.m.Unlock()
+	terminate(retired)
+	p.wg.Wait()
+}
+
+// refill starts VMs of the profile key until enough are ready or starting.
+// The lock MUST be held when calling this function.
+func (p *Pool) refill(key string) {
+	profile, ok := p.profiles[key]
+	if !ok || p.closed || p.failed[key] {
+		return
+	}
+	for n := len(p.idle[key]) + p.starting[key]; n < p.config.Size; n++ {
+		p.starting[key]++
+		p.wg.Add(1)
+		go p.start(p.newID(), key, profile)
+	}
+}
+
+// start starts the VM id of profile and adds it to the pool, unless the pool
+// no longer needs it.
+func (p *Pool) start(id string, key string, profile Profile) {
+	defer p.wg.Done()
+	vm, err := p.backend.Start(id, profile)
+
+	p.m.Lock()
+	p.starting[key]--
+	if p.starting[key] == 0 {
+		delete(p.starting, key)
+	}
+	if err != nil {
+		p.failed[key] = true
+		p.m.Unlock()
+		logrus.Warnf("uvmpool: failed to start utility VM %s: %s", id, err)
+		return
+	}
+	_, ok := p.profiles[key]
+	if p.closed || !ok || len(p.idle[key]) >= p.config.Size {
+		p.m.Unlock()
+		terminate([]VM{vm})
+		return
+	}
+	p.idle[key] = append(p.idle[key], idleVM{vm: vm, created: p.now()})
+	p.m.Unlock()
+	logrus.Debugf("uvmpool: utility VM %s is ready", id)
+}
+
+// terminate terminates VMs retired from the pool.
+func terminate(vms []VM) {
+	for _, vm := range vms {
+		logrus.Debugf("uvmpool: retiring utility VM %s", vm.ID())
+		if err := vm.Terminate(); err != nil {
+			logrus.Warnf("uvmpool: failed to terminate utility VM %s: %s", vm.ID(), err)
+		}
+	}
+}
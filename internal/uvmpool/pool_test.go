@@ -0,0 +1,200 @@
+package uvmpool
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBackend starts fake VMs, recording what it starts and what is
+// terminated.
+type fakeBackend struct {
+	m          sync.Mutex
+	started    []string
+	terminated []string
+	fail       bool
+	gate       chan struct{} // If not nil, starts wait for it to be closed.
+}
+
+type fakeVM struct {
+	id      string
+	backend *fakeBackend
+}
+
+func (b *fakeBackend) Start(id string, profile Profile) (VM, error) {
+	if b.gate != nil {
+		<-b.gate
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.fail {
+		return nil, errors.New("start failed")
+	}
+	b.started = append(b.started, id)
+	return &fakeVM{id: id, backend: b}, nil
+}
+
+func (b *fakeBackend) counts() (int, int) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return len(b.started), len(b.terminated)
+}
+
+func (vm *fakeVM) ID() string {
+	return vm.id
+}
+
+func (vm *fakeVM) Release() error {
+	return nil
+}
+
+func (vm *fakeVM) Terminate() error {
+	vm.backend.m.Lock()
+	defer vm.backend.m.Unlock()
+	vm.backend.terminated = append(vm.backend.terminated, vm.id)
+	return nil
+}
+
+var (
+	linux   = Profile{OperatingSystem: "linux", MemorySizeInMB: 1024, ProcessorCount: 2}
+	windows = Profile{OperatingSystem: "windows", LayerFolders: []string{`c:\uvm`}, MemorySizeInMB: 2048, ProcessorCount: 2}
+)
+
+// newTestPool returns a pool with a fake clock, filled according to config.
+func newTestPool(b *fakeBackend, config Config) (*Pool, *time.Time) {
+	p := New(b, Config{})
+	now := time.Unix(0, 0)
+	n := 0
+	p.now = func() time.Time {
+		return now
+	}
+	p.newID = func() string {
+		n++
+		return fmt.Sprintf("vm%d", n)
+	}
+	p.Reconfigure(config)
+	p.wg.Wait()
+	return p, &now
+}
+
+func checkStatus(t *testing.T, p *Pool, expected ...ProfileStatus) {
+	t.Helper()
+	p.wg.Wait()
+	if status := p.Status(); !reflect.DeepEqual(status, expected) {
+		t.Fatalf("got status %+v, expected %+v", status, expected)
+	}
+}
+
+func TestPoolGet(t *testing.T) {
+	b := &fakeBackend{}
+	p, _ := newTestPool(b, Config{Profiles: []Profile{linux, windows}, Size: 2})
+	defer p.Close()
+	checkStatus(t, p, ProfileStatus{Profile: linux, Ready: 2}, ProfileStatus{Profile: windows, Ready: 2})
+
+	vm, err := p.Get(linux)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The VM handed out is no longer the pool's, and is replaced.
+	checkStatus(t, p, ProfileStatus{Profile: linux, Ready: 2}, ProfileStatus{Profile: windows, Ready: 2})
+	if started, terminated := b.counts(); started != 5 || terminated != 0 {
+		t.Fatalf("started %d terminated %d VMs", started, terminated)
+	}
+	vm2, err := p.Get(linux)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm.ID() == vm2.ID() {
+		t.Fatalf("VM %s handed out twice", vm.ID())
+	}
+
+	other := linux
+	other.MemorySizeInMB = 512
+	if _, err := p.Get(other); err != ErrEmpty {
+		t.Fatalf("got %v for an unconfigured profile", err)
+	}
+}
+
+func TestPoolEmpty(t *testing.T) {
+	b := &fakeBackend{gate: make(chan struct{})}
+	p := New(b, Config{Profiles: []Profile{linux}, Size: 1})
+	if _, err := p.Get(linux); err != ErrEmpty {
+		t.Fatalf("got %v while the VM is starting", err)
+	}
+	close(b.gate)
+	p.Close()
+	if _, err := p.Get(linux); err != ErrClosed {
+		t.Fatalf("got %v from a closed pool", err)
+	}
+	// The VM that finished starting after the pool closed is terminated.
+	if started, terminated := b.counts(); started != 1 || terminated != 1 {
+		t.Fatalf("started %d terminated %d VMs", started, terminated)
+	}
+}
+
+func TestPoolMaxAge(t *testing.T) {
+	b := &fakeBackend{}
+	p, now := newTestPool(b, Config{Profiles: []Profile{linux}, Size: 1, MaxAge: time.Hour})
+	defer p.Close()
+
+	*now = now.Add(time.Minute)
+	p.Tick()
+	checkStatus(t, p, ProfileStatus{Profile: linux, Ready: 1})
+	if started, terminated := b.counts(); started != 1 || terminated != 0 {
+		t.Fatalf("started %d terminated %d VMs before the maximum age", started, terminated)
+	}
+
+	*now = now.Add(time.Hour)
+	p.Tick()
+	checkStatus(t, p, ProfileStatus{Profile: linux, Ready: 1})
+	if !reflect.DeepEqual(b.terminated, []string{"vm1"}) || !reflect.DeepEqual(b.started, []string{"vm1", "vm2"}) {
+		t.Fatalf("started %v terminated %v, expected vm1 replaced by vm2", b.started, b.terminated)
+	}
+}
+
+func TestPoolReconfigure(t *testing.T) {
+	b := &fakeBackend{}
+	p, _ := newTestPool(b, Config{Profiles: []Profile{linux, windows}, Size: 2})
+	defer p.Close()
+
+	// Shrinking retires the oldest VMs.
+	p.Reconfigure(Config{Profiles: []Profile{linux, windows}, Size: 1})
+	checkStatus(t, p, ProfileStatus{Profile: linux, Ready: 1}, ProfileStatus{Profile: windows, Ready: 1})
+	if _, terminated := b.counts(); terminated != 2 {
+		t.Fatalf("terminated %d VMs, expected 2", terminated)
+	}
+
+	// A changed profile replaces the VMs of the old one.
+	bigger := linux
+	bigger.MemorySizeInMB = 4096
+	p.Reconfigure(Config{Profiles: []Profile{bigger}, Size: 1})
+	checkStatus(t, p, ProfileStatus{Profile: bigger, Ready: 1})
+	if started, terminated := b.counts(); started != 5 || terminated != 4 {
+		t.Fatalf("started %d terminated %d VMs", started, terminated)
+	}
+	if _, err := p.Get(linux); err != ErrEmpty {
+		t.Fatalf("got %v for a profile that is no longer configured", err)
+	}
+	if _, err := p.Get(bigger); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolStartFailure(t *testing.T) {
+	b := &fakeBackend{fail: true}
+	p, _ := newTestPool(b, Config{Profiles: []Profile{linux}, Size: 2})
+	defer p.Close()
+
+	// Failed starts are not retried until the next tick.
+	checkStatus(t, p, ProfileStatus{Profile: linux, Failed: true})
+	b.fail = false
+	if _, err := p.Get(linux); err != ErrEmpty {
+		t.Fatalf("got %v from a failed profile", err)
+	}
+	checkStatus(t, p, ProfileStatus{Profile: linux, Failed: true})
+	p.Tick()
+	checkStatus(t, p, ProfileStatus{Profile: linux, Ready: 2})
+}
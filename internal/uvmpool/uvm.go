@@ -0,0 +1,130 @@
+// +build windows
+
+package uvmpool
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Microsoft/hcsshim/internal/hcs"
+	"github.com/Microsoft/hcsshim/internal/uvm"
+)
+
+// ProfileOf returns the profile of VMs created with opts, and whether such
+// VMs can be taken from a pool. VMs configured beyond what a profile records
+// cannot. For a Windows VM, the last layer folder, the scratch, is not part
+// of the profile.
+func ProfileOf(opts *uvm.UVMOptions) (Profile, bool) {
+	o := *opts
+	memory, processors := o.Size()
+	p := Profile{
+		OperatingSystem:  o.OperatingSystem,
+		BootFilesPath:    o.BootFilesPath,
+		MemorySizeInMB:   memory,
+		ProcessorCount:   processors,
+		VPMemDeviceCount: o.VPMemDeviceCount,
+	}
+	if o.OperatingSystem == "windows" {
+		if len(o.LayerFolders) < 2 {
+			return Profile{}, false
+		}
+		p.LayerFolders = o.LayerFolders[:len(o.LayerFolders)-1]
+	}
+
+	// Clear what the profile records; anything left is not supported.
+	o.ID, o.Owner, o.OperatingSystem, o.Resources = "", "", "", nil
+	o.MemorySizeInMB, o.ProcessorCount = 0, 0
+	o.BootFilesPath, o.LayerFolders, o.VPMemDeviceCount = "", nil, 0
+	if o.AdditionHCSDocumentJSON != "" || o.MaxMemorySizeInMB != 0 || o.MaxProcessorCount != 0 ||
+		o.AllowOvercommit != nil || o.Memory != nil || o.Processor != nil ||
+		o.KernelFile != "" || o.RootFSFile != "" || o.PreferredRootFSType != nil ||
+		o.KernelBootOptions != "" || o.EnableGraphicsConsole || o.ConsolePipe != "" ||
+		o.VPMemMultiMapping || o.VPMemDeviceSizeBytes != 0 || o.SCSIControllerCount != nil {
+		return Profile{}, false
+	}
+	return p, true
+}
+
+// UVMBackend starts the utility VMs of a pool with package uvm.
+type UVMBackend struct {
+	Owner       string // The owner of the compute systems.
+	ScratchRoot string // The directory holding the scratch folders of Windows VMs.
+}
+
+// UVM is a utility VM started by UVMBackend.
+type UVM struct {
+	vm      *uvm.UtilityVM
+	scratch string
+}
+
+// Start creates and starts a utility VM of profile.
+func (b *UVMBackend) Start(id string, profile Profile) (VM, error) {
+	opts := &uvm.UVMOptions{
+		ID:               id,
+		Owner:            b.Owner,
+		OperatingSystem:  profile.OperatingSystem,
+		MemorySizeInMB:   profile.MemorySizeInMB,
+		ProcessorCount:   profile.ProcessorCount,
+		BootFilesPath:    profile.BootFilesPath,
+		VPMemDeviceCount: profile.VPMemDeviceCount,
+	}
+	scratch := ""
+	if profile.OperatingSystem == "windows" {
+		scratch = filepath.Join(b.ScratchRoot, id)
+		if err := os.MkdirAll(scratch, 0); err != nil {
+			return nil, err
+		}
+		opts.LayerFolders = append(append([]string(nil), profile.LayerFolders...), scratch)
+	}
+	vm, err := uvm.Create(opts)
+	if err == nil {
+		err = vm.Start()
+		if err != nil {
+			vm.Close()
+		}
+	}
+	if err != nil {
+		if scratch != "" {
+			os.RemoveAll(scratch)
+		}
+		return nil, fmt.Errorf("failed to start utility VM %s: %s", id, err)
+	}
+	return &UVM{vm: vm, scratch: scratch}, nil
+}
+
+// ID returns the ID of the VM's compute system.
+func (v *UVM) ID() string {
+	return v.vm.ID()
+}
+
+// State returns the state with which the VM's new owner opens it.
+func (v *UVM) State() *uvm.State {
+	return v.vm.State()
+}
+
+// ScratchPath returns the scratch folder of a Windows VM, which its new owner
+// removes once the VM is terminated.
+func (v *UVM) ScratchPath() string {
+	return v.scratch
+}
+
+// Release releases the pool's handle to the VM.
+func (v *UVM) Release() error {
+	return v.vm.Release()
+}
+
+// Terminate terminates the VM and removes its scratch folder.
+func (v *UVM) Terminate() error {
+	err := v.vm.Terminate()
+	if hcs.IsPending(err) {
+		err = v.vm.Wait()
+	}
+	v.vm.Release()
+	if v.scratch != "" {
+		if rerr := os.RemoveAll(v.scratch); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}